@@ -1,3 +1,10 @@
 module gedis
 
 go 1.19
+
+require github.com/yuin/gopher-lua v1.1.1
+
+require (
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/term v0.10.0
+)
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestSelectSuites(t *testing.T) {
+	if selected, err := selectSuites(""); err != nil || len(selected) != len(suites) {
+		t.Error("TestSelectSuites failed")
+	}
+	selected, err := selectSuites("get, LRANGE_100")
+	if err != nil || len(selected) != 2 || selected[0].name != "GET" || selected[1].name != "LRANGE_100" {
+		t.Error("TestSelectSuites failed")
+	}
+	if _, err := selectSuites("get,nocmd"); err == nil {
+		t.Error("TestSelectSuites failed")
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	keyspace = 0
+	if args := selected[0].args(rnd, "x"); len(args) != 2 || args[1] != "key:__rand_int__" {
+		t.Error("TestSelectSuites failed")
+	}
+	keyspace = 10
+	defer func() { keyspace = 0 }()
+	if args := selected[1].args(rnd, "x"); len(args) != 4 || len(args[1]) != len("mylist:")+12 {
+		t.Error("TestSelectSuites failed")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	latencies := make([]time.Duration, 0)
+	for i := 1; i <= 100; i++ {
+		latencies = append(latencies, time.Duration(i))
+	}
+	if percentile(latencies, 0) != 1 || percentile(latencies, 50) != 50 || percentile(latencies, 99) != 99 || percentile(latencies, 100) != 100 {
+		t.Error("TestPercentile failed")
+	}
+	if percentile(nil, 50) != 0 {
+		t.Error("TestPercentile failed")
+	}
+}
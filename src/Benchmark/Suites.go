@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// a test sends the same cmd with random keys or members
+type suite struct {
+	name string
+	// the args of a request, value is the payload of -d
+	args func(rnd *rand.Rand, value string) []string
+}
+
+var suites = []suite{
+	{"SET", func(rnd *rand.Rand, value string) []string {
+		return []string{"SET", randKey(rnd, "key:"), value}
+	}},
+	{"GET", func(rnd *rand.Rand, value string) []string {
+		return []string{"GET", randKey(rnd, "key:")}
+	}},
+	{"MSET", func(rnd *rand.Rand, value string) []string {
+		args := []string{"MSET"}
+		for i := 0; i < 10; i++ {
+			args = append(args, randKey(rnd, "key:"), value)
+		}
+		return args
+	}},
+	{"LPUSH", func(rnd *rand.Rand, value string) []string {
+		return []string{"LPUSH", randKey(rnd, "mylist:"), value}
+	}},
+	{"RPUSH", func(rnd *rand.Rand, value string) []string {
+		return []string{"RPUSH", randKey(rnd, "mylist:"), value}
+	}},
+	{"LPOP", func(rnd *rand.Rand, value string) []string {
+		return []string{"LPOP", randKey(rnd, "mylist:")}
+	}},
+	{"RPOP", func(rnd *rand.Rand, value string) []string {
+		return []string{"RPOP", randKey(rnd, "mylist:")}
+	}},
+	{"LRANGE_100", func(rnd *rand.Rand, value string) []string {
+		return []string{"LRANGE", randKey(rnd, "mylist:"), "0", "99"}
+	}},
+	{"ZADD", func(rnd *rand.Rand, value string) []string {
+		return []string{"ZADD", randKey(rnd, "myzset:"), fmt.Sprint(rnd.Intn(1000000)), randKey(rnd, "member:")}
+	}},
+	{"ZRANGE_100", func(rnd *rand.Rand, value string) []string {
+		return []string{"ZRANGE", randKey(rnd, "myzset:"), "0", "99"}
+	}},
+	{"SETBIT", func(rnd *rand.Rand, value string) []string {
+		return []string{"SETBIT", randKey(rnd, "mybits:"), fmt.Sprint(rnd.Intn(1 << 16)), "1"}
+	}},
+	{"PFADD", func(rnd *rand.Rand, value string) []string {
+		return []string{"PFADD", randKey(rnd, "myhll:"), randKey(rnd, "element:")}
+	}},
+	{"XADD", func(rnd *rand.Rand, value string) []string {
+		return []string{"XADD", randKey(rnd, "mystream:"), "*", "field", value}
+	}},
+}
+
+// size of the keyspace of the random keys, 0 for a single key
+var keyspace = 0
+
+// the key is fixed unless the keyspace is given, like redis-benchmark -r
+func randKey(rnd *rand.Rand, prefix string) string {
+	if keyspace <= 0 {
+		return prefix + "__rand_int__"
+	}
+	return fmt.Sprintf("%s%012d", prefix, rnd.Intn(keyspace))
+}
+
+// the suites of a comma separated list of names, all if it's empty
+func selectSuites(names string) ([]suite, error) {
+	if names == "" {
+		return suites, nil
+	}
+	selected := make([]suite, 0)
+	for _, name := range strings.Split(names, ",") {
+		found := false
+		for _, s := range suites {
+			if strings.EqualFold(s.name, strings.TrimSpace(name)) {
+				selected = append(selected, s)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown test '%s'", name)
+		}
+	}
+	return selected, nil
+}
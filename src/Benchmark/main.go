@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gedis/src/Server/server"
+	"gedis/src/zinx/znet"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var host = flag.String("h", "127.0.0.1", "server hostname")
+var port = flag.Int("p", 8999, "server port")
+var unix_socket = flag.String("s", "", "connect to the unix socket at the path instead of tcp")
+var clients = flag.Int("c", 50, "number of parallel connections")
+var requests = flag.Int("n", 100000, "total number of requests of each test")
+var pipeline = flag.Int("P", 1, "number of requests sent at once by a connection before reading their replies")
+var keyspace_size = flag.Int("r", 0, "use random keys of a keyspace of the size, a single key for each test if 0")
+var data_size = flag.Int("d", 3, "size in bytes of the values of SET, LPUSH...")
+var tests = flag.String("t", "", "comma separated list of the tests to run, all of them if empty")
+var quiet = flag.Bool("q", false, "only print the requests per second and p50 latency of each test")
+
+// the latencies and errors of a test
+type result struct {
+	elapsed   time.Duration
+	latencies []time.Duration
+	errors    int
+}
+
+func dial() (net.Conn, error) {
+	if *unix_socket != "" {
+		return net.Dial("unix", *unix_socket)
+	}
+	return net.Dial("tcp", net.JoinHostPort(*host, strconv.Itoa(*port)))
+}
+
+// run a suite with all the connections, which take the requests left in batches of pipeline
+func runSuite(s suite, value string) (*result, error) {
+	conns := make([]net.Conn, 0, *clients)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < *clients; i++ {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+
+	left := int64(*requests)
+	// take at most n requests, 0 if all of them are taken
+	take := func(n int64) int64 {
+		for {
+			l := atomic.LoadInt64(&left)
+			if l <= 0 {
+				return 0
+			}
+			if l < n {
+				n = l
+			}
+			if atomic.CompareAndSwapInt64(&left, l, l-n) {
+				return n
+			}
+		}
+	}
+
+	res := &result{latencies: make([]time.Duration, 0, *requests)}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(chan error, len(conns))
+	start := time.Now()
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn, rnd *rand.Rand) {
+			defer wg.Done()
+			latencies, errors, err := runConn(conn, rnd, s, value, take)
+			if err != nil {
+				errs <- err
+				// the other connections stop as soon as possible
+				atomic.StoreInt64(&left, 0)
+			}
+			lock.Lock()
+			res.latencies = append(res.latencies, latencies...)
+			res.errors += errors
+			lock.Unlock()
+		}(conn, rand.New(rand.NewSource(time.Now().UnixNano()+int64(i))))
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+	return res, nil
+}
+
+// send the requests taken by a connection and wait for their replies,
+// the latency of a request is from sending its batch to receiving its reply
+func runConn(conn net.Conn, rnd *rand.Rand, s suite, value string, take func(int64) int64) ([]time.Duration, int, error) {
+	msg_packer := znet.NewDataPack()
+	cmd_packer := server.NewCmdPack()
+	latencies := make([]time.Duration, 0)
+	errors := 0
+	for {
+		n := take(int64(*pipeline))
+		if n == 0 {
+			return latencies, errors, nil
+		}
+		buf := make([]byte, 0)
+		for i := int64(0); i < n; i++ {
+			args := s.args(rnd, value)
+			cmd := make([][]byte, len(args))
+			for j, arg := range args {
+				cmd[j] = []byte(arg)
+			}
+			msg, err := msg_packer.Pack(znet.NewMessage(server.GetCmdMsgID(args[0]), cmd_packer.PackCmd(cmd)))
+			if err != nil {
+				return latencies, errors, err
+			}
+			buf = append(buf, msg...)
+		}
+		start := time.Now()
+		if _, err := conn.Write(buf); err != nil {
+			return latencies, errors, err
+		}
+		for i := int64(0); i < n; i++ {
+			msg, err := msg_packer.ReadMsg(conn)
+			if err != nil {
+				return latencies, errors, err
+			}
+			latencies = append(latencies, time.Since(start))
+			if reply := cmd_packer.UnpackCmd(msg.GetMsgData()); len(reply) > 0 && strings.HasPrefix(string(reply[0]), "(error) ") {
+				errors++
+			}
+		}
+	}
+}
+
+// the latency at percentile p of the sorted latencies
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p/100*float64(len(latencies)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return latencies[idx]
+}
+
+func msec(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
+
+func report(name string, res *result) {
+	rps := float64(len(res.latencies)) / res.elapsed.Seconds()
+	if *quiet {
+		fmt.Printf("%s: %.2f requests per second, p50=%s msec\n", name, rps, msec(percentile(res.latencies, 50)))
+		return
+	}
+	var total time.Duration
+	for _, latency := range res.latencies {
+		total += latency
+	}
+	avg := time.Duration(0)
+	if len(res.latencies) > 0 {
+		avg = total / time.Duration(len(res.latencies))
+	}
+
+	fmt.Printf("====== %s ======\n", name)
+	fmt.Printf("  %d requests completed in %.2f seconds\n", len(res.latencies), res.elapsed.Seconds())
+	fmt.Printf("  %d parallel clients\n", *clients)
+	fmt.Printf("  %d bytes payload\n", *data_size)
+	fmt.Printf("  %d requests pipelined\n", *pipeline)
+	fmt.Printf("\nSummary:\n")
+	fmt.Printf("  throughput summary: %.2f requests per second\n", rps)
+	fmt.Printf("  latency summary (msec):\n")
+	fmt.Printf("  %9s %9s %9s %9s %9s %9s\n", "avg", "min", "p50", "p95", "p99", "max")
+	fmt.Printf("  %9s %9s %9s %9s %9s %9s\n", msec(avg), msec(percentile(res.latencies, 0)), msec(percentile(res.latencies, 50)),
+		msec(percentile(res.latencies, 95)), msec(percentile(res.latencies, 99)), msec(percentile(res.latencies, 100)))
+	if res.errors > 0 {
+		fmt.Printf("  errors: %d\n", res.errors)
+	}
+	fmt.Println()
+}
+
+func main() {
+	flag.Parse()
+	keyspace = *keyspace_size
+	if *clients <= 0 || *requests <= 0 || *pipeline <= 0 || *data_size < 0 {
+		fmt.Fprintln(os.Stderr, "-c, -n and -P must be positive, -d can't be negative")
+		os.Exit(1)
+	}
+
+	selected, err := selectSuites(*tests)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	value := strings.Repeat("x", *data_size)
+	for _, s := range selected {
+		res, err := runSuite(s, value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", s.name, err.Error())
+			os.Exit(1)
+		}
+		report(s.name, res)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errUnbalancedQuotes = errors.New("Invalid argument(s)")
+
+// split a line into args like a shell does.
+// Args are separated by any number of spaces or tabs, quoted parts are joined with the text around them.
+// In double quotes \n \r \t \b \a \" \\ and \xHH are escaped, single quotes only escape \' and take the rest literally.
+// Out of quotes a backslash escapes the next char, so `a\ b` is one arg
+func splitLine(line string) ([]string, error) {
+	args := make([]string, 0)
+	var arg strings.Builder
+	in_arg := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if in_arg {
+				args = append(args, arg.String())
+				arg.Reset()
+				in_arg = false
+			}
+		case c == '"':
+			in_arg = true
+			j, err := readDoubleQuoted(line, i+1, &arg)
+			if err != nil {
+				return nil, err
+			}
+			i = j
+		case c == '\'':
+			in_arg = true
+			j, err := readSingleQuoted(line, i+1, &arg)
+			if err != nil {
+				return nil, err
+			}
+			i = j
+		case c == '\\' && i+1 < len(line):
+			in_arg = true
+			i++
+			arg.WriteByte(line[i])
+		default:
+			in_arg = true
+			arg.WriteByte(c)
+		}
+	}
+	if in_arg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// read from start to the closing double quote, returns its index
+func readDoubleQuoted(line string, start int, arg *strings.Builder) (int, error) {
+	for i := start; i < len(line); i++ {
+		c := line[i]
+		if c == '"' {
+			return i, nil
+		}
+		if c != '\\' || i+1 >= len(line) {
+			arg.WriteByte(c)
+			continue
+		}
+		i++
+		switch line[i] {
+		case 'n':
+			arg.WriteByte('\n')
+		case 'r':
+			arg.WriteByte('\r')
+		case 't':
+			arg.WriteByte('\t')
+		case 'b':
+			arg.WriteByte('\b')
+		case 'a':
+			arg.WriteByte('\a')
+		case 'x':
+			if i+2 < len(line) {
+				if b, err := strconv.ParseUint(line[i+1:i+3], 16, 8); err == nil {
+					arg.WriteByte(byte(b))
+					i += 2
+					break
+				}
+			}
+			arg.WriteByte('x')
+		default:
+			arg.WriteByte(line[i])
+		}
+	}
+	return 0, errUnbalancedQuotes
+}
+
+// read from start to the closing single quote, returns its index
+func readSingleQuoted(line string, start int, arg *strings.Builder) (int, error) {
+	for i := start; i < len(line); i++ {
+		c := line[i]
+		if c == '\'' {
+			return i, nil
+		}
+		if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+			i++
+		}
+		arg.WriteByte(line[i])
+	}
+	return 0, errUnbalancedQuotes
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected []string
+	}{
+		{"", []string{}},
+		{"  SET  k   v ", []string{"SET", "k", "v"}},
+		{`SET k "a b"`, []string{"SET", "k", "a b"}},
+		{`SET k 'a b'`, []string{"SET", "k", "a b"}},
+		{`SET k ""`, []string{"SET", "k", ""}},
+		{`SET k "\x00\xff\n\"\\"`, []string{"SET", "k", "\x00\xff\n\"\\"}},
+		{`SET k 'it\'s \n'`, []string{"SET", "k", `it's \n`}},
+		{`SET k a\ b`, []string{"SET", "k", "a b"}},
+		{`SET k pre"mid"'post'`, []string{"SET", "k", "premidpost"}},
+		{"SET\tk\tv", []string{"SET", "k", "v"}},
+	}
+	for _, c := range cases {
+		if args, err := splitLine(c.line); err != nil || !reflect.DeepEqual(args, c.expected) {
+			t.Error("TestSplitLine failed")
+		}
+	}
+	for _, line := range []string{`SET k "a`, `SET k 'a`, `SET k "a\"`} {
+		if _, err := splitLine(line); err == nil {
+			t.Error("TestSplitLine failed")
+		}
+	}
+}
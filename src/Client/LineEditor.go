@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+const max_history = 1000
+
+// ctrl-c on the line being edited
+var errInterrupted = errors.New("interrupted")
+
+// line editing of the REPL, the terminal is in raw mode only while a line is being read.
+// If stdin isn't a terminal, lines are read as they are without prompts
+type LineEditor struct {
+	in       *bufio.Reader
+	fd       int
+	terminal bool
+	complete func(prefix string) []string
+
+	history      []string
+	history_file string
+
+	// the line being edited, guarded by lock since messages may be printed above it
+	lock      sync.Mutex
+	editing   bool
+	old_state *term.State
+	prompt    string
+	line      []rune
+	pos       int
+}
+
+// history is loaded from and appended to history_file, nothing is saved if it's empty
+func NewLineEditor(history_file string, complete func(prefix string) []string) *LineEditor {
+	editor := &LineEditor{
+		in:           bufio.NewReader(os.Stdin),
+		fd:           int(os.Stdin.Fd()),
+		complete:     complete,
+		history:      make([]string, 0),
+		history_file: history_file,
+	}
+	editor.terminal = term.IsTerminal(editor.fd) && term.IsTerminal(int(os.Stdout.Fd()))
+	editor.loadHistory()
+	return editor
+}
+
+func (this *LineEditor) IsTerminal() bool {
+	return this.terminal
+}
+
+// read a line, io.EOF is returned on ctrl-d of an empty line or the end of stdin
+func (this *LineEditor) ReadLine(prompt string) (string, error) {
+	if !this.terminal {
+		line, err := this.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	old_state, err := term.MakeRaw(this.fd)
+	if err != nil {
+		return "", err
+	}
+	this.lock.Lock()
+	this.editing, this.old_state = true, old_state
+	this.prompt, this.line, this.pos = prompt, make([]rune, 0), 0
+	this.refresh()
+	this.lock.Unlock()
+	defer this.Restore()
+
+	// index in history while browsing it, len(history) is the line being edited
+	hist_idx := len(this.history)
+	editing_line := ""
+	tabs := 0
+	for {
+		r, _, err := this.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		if r == '\t' {
+			tabs++
+		} else {
+			tabs = 0
+		}
+
+		this.lock.Lock()
+		switch r {
+		case '\r', '\n':
+			line := string(this.line)
+			this.pos = len(this.line)
+			this.refresh()
+			fmt.Print("\r\n")
+			this.lock.Unlock()
+			return line, nil
+		case 3: // ctrl-c
+			fmt.Print("^C\r\n")
+			this.lock.Unlock()
+			return "", errInterrupted
+		case 4: // ctrl-d, delete or exit on an empty line
+			if len(this.line) == 0 {
+				fmt.Print("\r\n")
+				this.lock.Unlock()
+				return "", io.EOF
+			}
+			this.deleteAt(this.pos)
+		case 1: // ctrl-a
+			this.pos = 0
+		case 5: // ctrl-e
+			this.pos = len(this.line)
+		case 2: // ctrl-b
+			this.moveBy(-1)
+		case 6: // ctrl-f
+			this.moveBy(1)
+		case 11: // ctrl-k
+			this.line = this.line[:this.pos]
+		case 21: // ctrl-u
+			this.line, this.pos = append([]rune{}, this.line[this.pos:]...), 0
+		case 23: // ctrl-w, delete the word before the cursor
+			start := this.pos
+			for start > 0 && this.line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && this.line[start-1] != ' ' {
+				start--
+			}
+			this.line = append(this.line[:start], this.line[this.pos:]...)
+			this.pos = start
+		case 12: // ctrl-l
+			fmt.Print("\x1b[H\x1b[2J")
+		case 127, 8: // backspace
+			if this.pos > 0 {
+				this.pos--
+				this.deleteAt(this.pos)
+			}
+		case 16, 14: // ctrl-p and ctrl-n
+			hist_idx, editing_line = this.browse(hist_idx, editing_line, r == 16)
+		case '\t':
+			this.completeLine(tabs > 1)
+		case 27:
+			this.lock.Unlock()
+			key := this.readEscape()
+			this.lock.Lock()
+			switch key {
+			case 'A', 'B':
+				hist_idx, editing_line = this.browse(hist_idx, editing_line, key == 'A')
+			case 'C':
+				this.moveBy(1)
+			case 'D':
+				this.moveBy(-1)
+			case 'H':
+				this.pos = 0
+			case 'F':
+				this.pos = len(this.line)
+			case '3':
+				this.deleteAt(this.pos)
+			}
+		default:
+			if r >= ' ' {
+				this.line = append(this.line[:this.pos], append([]rune{r}, this.line[this.pos:]...)...)
+				this.pos++
+			}
+		}
+		this.refresh()
+		this.lock.Unlock()
+	}
+}
+
+// restore the terminal if a line is being read, e.g. before exiting
+func (this *LineEditor) Restore() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.editing {
+		term.Restore(this.fd, this.old_state)
+		this.editing = false
+	}
+}
+
+// print lines above the line being edited, which is redrawn after them
+func (this *LineEditor) Print(lines ...string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if !this.editing {
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		return
+	}
+	fmt.Print("\r\x1b[K")
+	for _, line := range lines {
+		fmt.Print(line + "\r\n")
+	}
+	this.refresh()
+}
+
+// the escape sequences of the arrows, home, end and delete,
+// returns A B C D for the arrows, H F for home and end, 3 for delete, 0 for the unknown ones
+func (this *LineEditor) readEscape() byte {
+	b, err := this.in.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return 0
+	}
+	b, err = this.in.ReadByte()
+	if err != nil {
+		return 0
+	}
+	if b < '0' || b > '9' {
+		return b
+	}
+	// ESC [ n ~
+	key := b
+	for {
+		b, err = this.in.ReadByte()
+		if err != nil || b == '~' {
+			break
+		}
+	}
+	switch key {
+	case '1', '7':
+		return 'H'
+	case '4', '8':
+		return 'F'
+	case '3':
+		return '3'
+	}
+	return 0
+}
+
+// called with the lock
+func (this *LineEditor) refresh() {
+	fmt.Print("\r" + this.prompt + string(this.line) + "\x1b[K")
+	if back := len(this.line) - this.pos; back > 0 {
+		fmt.Printf("\x1b[%dD", back)
+	}
+}
+
+// called with the lock
+func (this *LineEditor) moveBy(n int) {
+	if pos := this.pos + n; pos >= 0 && pos <= len(this.line) {
+		this.pos = pos
+	}
+}
+
+// called with the lock
+func (this *LineEditor) deleteAt(pos int) {
+	if pos < len(this.line) {
+		this.line = append(this.line[:pos], this.line[pos+1:]...)
+	}
+}
+
+// move to the previous or next line of history, the line being edited is kept to come back to.
+// called with the lock
+func (this *LineEditor) browse(idx int, editing_line string, prev bool) (int, string) {
+	if idx == len(this.history) {
+		editing_line = string(this.line)
+	}
+	if prev && idx > 0 {
+		idx--
+	} else if !prev && idx < len(this.history) {
+		idx++
+	} else {
+		return idx, editing_line
+	}
+	line := editing_line
+	if idx < len(this.history) {
+		line = this.history[idx]
+	}
+	this.line, this.pos = []rune(line), len([]rune(line))
+	return idx, editing_line
+}
+
+// complete the cmd name before the cursor to the common prefix of the candidates,
+// they are listed if there is nothing more to complete on a repeated tab.
+// called with the lock
+func (this *LineEditor) completeLine(list bool) {
+	prefix := string(this.line[:this.pos])
+	if this.complete == nil || strings.ContainsAny(prefix, " \t") {
+		return
+	}
+	candidates := this.complete(prefix)
+	if len(candidates) == 0 {
+		return
+	}
+	common := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(strings.ToUpper(candidate), strings.ToUpper(common)) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(candidates) == 1 {
+		common += " "
+	}
+	if len(common) > len(prefix) {
+		this.line = append([]rune(common), this.line[this.pos:]...)
+		this.pos = len([]rune(common))
+		return
+	}
+	if list {
+		fmt.Print("\r\n" + strings.Join(candidates, "  ") + "\r\n")
+	}
+}
+
+func (this *LineEditor) loadHistory() {
+	if this.history_file == "" {
+		return
+	}
+	file, err := os.Open(this.history_file)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		this.addHistory(scanner.Text())
+	}
+}
+
+// lines typed in the terminal are saved as they are, the file is rewritten when it grows too long
+func (this *LineEditor) AddHistory(line string) {
+	if !this.terminal || line == "" || (len(this.history) > 0 && this.history[len(this.history)-1] == line) {
+		return
+	}
+	this.addHistory(line)
+	if this.history_file == "" {
+		return
+	}
+	if len(this.history) == max_history {
+		os.WriteFile(this.history_file, []byte(strings.Join(this.history, "\n")+"\n"), 0600)
+		return
+	}
+	file, err := os.OpenFile(this.history_file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	file.WriteString(line + "\n")
+}
+
+func (this *LineEditor) addHistory(line string) {
+	this.history = append(this.history, line)
+	if len(this.history) > max_history {
+		this.history = this.history[len(this.history)-max_history:]
+	}
+}
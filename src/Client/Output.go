@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"gedis/src/Server/server"
+	"strconv"
+	"strings"
+)
+
+// how the replies are printed
+const (
+	output_quoted = iota // each line of the reply quoted, the default in a terminal
+	output_raw           // the lines as they are, the default if stdout isn't a terminal
+	output_json          // the reply as a json value on one line
+	output_csv           // the values of the reply separated by commas on one line
+)
+
+var output = output_quoted
+
+func formatReply(values []string) []string {
+	switch output {
+	case output_raw:
+		return values
+	case output_json:
+		buf, _ := json.Marshal(replyValue(values))
+		return []string{string(buf)}
+	case output_csv:
+		fields := make([]string, 0)
+		for _, value := range flattenValue(replyValue(values)) {
+			fields = append(fields, csvField(value))
+		}
+		return []string{strings.Join(fields, ",")}
+	}
+	// bytes not printable are escaped
+	lines := make([]string, 0, len(values))
+	for _, v := range values {
+		lines = append(lines, strconv.Quote(v))
+	}
+	return lines
+}
+
+// the reply as nil, string, int64, replyError or []interface{} of them
+func replyValue(values []string) interface{} {
+	if len(values) == 1 {
+		return leafValue(values[0])
+	}
+	if len(values) > 0 && strings.HasPrefix(values[0], "1) ") {
+		return nestedValue(server.ParseNested(values))
+	}
+	items := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		items = append(items, leafValue(v))
+	}
+	return items
+}
+
+func nestedValue(items []interface{}) []interface{} {
+	values := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		if item, ok := item.([]interface{}); ok {
+			values = append(values, nestedValue(item))
+			continue
+		}
+		values = append(values, leafValue(item.(string)))
+	}
+	return values
+}
+
+type replyError struct {
+	Error string `json:"error"`
+}
+
+func leafValue(value string) interface{} {
+	switch {
+	case value == "(nil)":
+		return nil
+	case value == "(empty array)":
+		return []interface{}{}
+	case strings.HasPrefix(value, "(error) "):
+		return replyError{strings.TrimPrefix(value, "(error) ")}
+	case strings.HasPrefix(value, "(integer) "):
+		if n, err := strconv.ParseInt(strings.TrimPrefix(value, "(integer) "), 10, 64); err == nil {
+			return n
+		}
+	}
+	return value
+}
+
+func flattenValue(value interface{}) []interface{} {
+	items, ok := value.([]interface{})
+	if !ok {
+		return []interface{}{value}
+	}
+	values := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		values = append(values, flattenValue(item)...)
+	}
+	return values
+}
+
+// strings are always quoted, with the quotes in them doubled
+func csvField(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case replyError:
+		return "ERROR," + csvField(value.Error)
+	case string:
+		return `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+	}
+	return ""
+}
+
+func isErrorReply(values []string) bool {
+	return len(values) == 1 && strings.HasPrefix(values[0], "(error) ")
+}
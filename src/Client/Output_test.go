@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFormatReply(t *testing.T) {
+	defer func() { output = output_quoted }()
+	nested := []string{"1) 1) 1-0", "   2) 1) f", "      2) v\"q", "2) (nil)"}
+	cases := []struct {
+		format   int
+		values   []string
+		expected []string
+	}{
+		{output_quoted, []string{"a b", "\x00"}, []string{`"a b"`, `"\x00"`}},
+		{output_raw, []string{"a b", "(integer) 1"}, []string{"a b", "(integer) 1"}},
+		{output_json, []string{"(integer) 3"}, []string{"3"}},
+		{output_json, []string{"(nil)"}, []string{"null"}},
+		{output_json, []string{"(empty array)"}, []string{"[]"}},
+		{output_json, []string{"(error) ERR syntax error"}, []string{`{"error":"ERR syntax error"}`}},
+		{output_json, []string{"a", "(nil)"}, []string{`["a",null]`}},
+		{output_json, nested, []string{`[["1-0",["f","v\"q"]],null]`}},
+		{output_csv, nested, []string{`"1-0","f","v""q",NULL`}},
+		{output_csv, []string{"(integer) -1"}, []string{"-1"}},
+		{output_csv, []string{"(error) ERR x"}, []string{`ERROR,"ERR x"`}},
+	}
+	for _, c := range cases {
+		output = c.format
+		if res := formatReply(c.values); !reflect.DeepEqual(res, c.expected) {
+			t.Error("TestFormatReply failed")
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned when the client is used after Close
+var ErrClosed = errors.New("gedis: client is closed")
+
+type Options struct {
+	Network string // tcp or unix, tcp if empty
+	Addr    string // host:port or the path of the unix socket, 127.0.0.1:8999 if empty
+
+	TLSConfig *tls.Config // tls is used if it's not nil
+
+	// the connections are authenticated if Password isn't empty, as the default user if Username is empty
+	Username string
+	Password string
+
+	DB int // the db selected by the client, each connection selects it before the cmds
+
+	PoolSize    int           // max number of connections, 10 if 0
+	DialTimeout time.Duration // 5 seconds if 0
+	// times a cmd is retried on a new connection, if a connection in the pool is found broken
+	// e.g. by a restart of the server. 1 if 0, -1 to never retry
+	MaxRetries int
+}
+
+func (this *Options) init() {
+	if this.Network == "" {
+		this.Network = "tcp"
+	}
+	if this.Addr == "" {
+		this.Addr = "127.0.0.1:8999"
+	}
+	if this.PoolSize <= 0 {
+		this.PoolSize = 10
+	}
+	if this.DialTimeout == 0 {
+		this.DialTimeout = 5 * time.Second
+	}
+	if this.MaxRetries == 0 {
+		this.MaxRetries = 1
+	} else if this.MaxRetries < 0 {
+		this.MaxRetries = 0
+	}
+}
+
+// at most PoolSize connections are in use, each of them holds a token of sem
+type pool struct {
+	opt  *Options
+	sem  chan struct{}
+	lock sync.Mutex
+	idle []*conn
+
+	closed bool
+}
+
+func (this *pool) get(ctx context.Context) (*conn, error) {
+	// select picks randomly when both are ready
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case this.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		<-this.sem
+		return nil, ErrClosed
+	}
+	if n := len(this.idle); n > 0 {
+		cn := this.idle[n-1]
+		this.idle = this.idle[:n-1]
+		this.lock.Unlock()
+		cn.reused = true
+		return cn, nil
+	}
+	this.lock.Unlock()
+
+	cn, err := dialConn(ctx, this.opt)
+	if err != nil {
+		<-this.sem
+		return nil, err
+	}
+	return cn, nil
+}
+
+// broken connections are closed, the others are kept for later cmds
+func (this *pool) put(cn *conn) {
+	this.lock.Lock()
+	if cn.broken || this.closed {
+		cn.close()
+	} else {
+		this.idle = append(this.idle, cn)
+	}
+	this.lock.Unlock()
+	<-this.sem
+}
+
+func (this *pool) closeIdle() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for _, cn := range this.idle {
+		cn.close()
+	}
+	this.idle = nil
+}
+
+func (this *pool) close() error {
+	this.lock.Lock()
+	this.closed = true
+	this.lock.Unlock()
+	this.closeIdle()
+	return nil
+}
+
+// a client of the server with a pool of connections, safe for concurrent use
+type Client struct {
+	opt  *Options
+	pool *pool
+	db   int
+}
+
+func NewClient(opt *Options) *Client {
+	o := *opt
+	o.init()
+	return &Client{
+		opt:  &o,
+		pool: &pool{opt: &o, sem: make(chan struct{}, o.PoolSize)},
+		db:   o.DB,
+	}
+}
+
+// a client of db sharing the pool, the connections select the db of the client using them
+func (this *Client) DB(db int) *Client {
+	return &Client{opt: this.opt, pool: this.pool, db: db}
+}
+
+// close the connections, the ones in use are closed when they are put back
+func (this *Client) Close() error {
+	return this.pool.close()
+}
+
+// run f with a connection in the db of the client, it's retried on a new connection
+// if the one of the pool is broken
+func (this *Client) withConn(ctx context.Context, f func(cn *conn) error) error {
+	for attempt := 0; ; attempt++ {
+		cn, err := this.pool.get(ctx)
+		if err != nil {
+			return err
+		}
+		err = cn.selectDb(ctx, this.db)
+		if err == nil {
+			err = f(cn)
+		}
+		this.pool.put(cn)
+
+		if !cn.broken {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// the deadline of the connection may pass before ctx is done
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		if !cn.reused || attempt >= this.opt.MaxRetries {
+			return err
+		}
+		// the other idle connections are likely broken as well, e.g. by a restart of the server
+		this.pool.closeIdle()
+	}
+}
+
+// send a cmd like Do(ctx, "SET", "k", "v"), the error of an error reply is returned as well
+func (this *Client) Do(ctx context.Context, args ...string) (Reply, error) {
+	if len(args) > 0 && strings.ToUpper(args[0]) == "SELECT" {
+		return nil, errors.New("gedis: use Client.DB to select a db")
+	}
+	var reply Reply
+	err := this.withConn(ctx, func(cn *conn) error {
+		var err error
+		reply, err = cn.do(ctx, args)
+		return err
+	})
+	return reply, err
+}
@@ -0,0 +1,291 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gedis/src/Client/client"
+	"gedis/src/Server/server"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// a server with the routers of main in dir, stopped by the returned func
+func startServer(t *testing.T, dir string, port int) (stop func()) {
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	// only the fields set are restored, the handlers of blocked cmds may still read the others
+	old_port, old_acl_file := utils.Global_obj.Port, utils.Global_obj.AclFile
+	utils.Global_obj.Port = uint32(port)
+	utils.Global_obj.AclFile = filepath.Join(dir, "users.acl")
+
+	acl := server.NewAcl()
+	pubsub := server.NewPubSub()
+	db_mgr := server.NewDbManager()
+	db_mgr.SetOnNotify(pubsub.Notify)
+	db_mgr.Start()
+	cluster := server.NewCluster(db_mgr)
+
+	s := znet.NewServer()
+	s.AddRounter(0, server.NewDbRouter(acl, cluster))
+	s.AddRounter(1, server.NewDbSelectRouter(acl, db_mgr))
+	s.AddRounter(server.SERVER_MSG_ID, server.NewServerRouter(acl, s, db_mgr))
+	s.AddRounter(server.PUBSUB_MSG_ID, server.NewPubSubRouter(acl, pubsub, db_mgr))
+	s.SetOnConnStart(func(conn ziface.IConnection) {
+		conn.SetProperty("db", db_mgr.GetDb(0))
+		acl.OnConnStart(conn)
+	})
+	s.SetOnConnStop(func(conn ziface.IConnection) {
+		pubsub.RemoveConn(conn)
+	})
+	go s.Start()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return func() {
+		s.Stop()
+		db_mgr.Stop()
+		utils.Global_obj.Port, utils.Global_obj.AclFile = old_port, old_acl_file
+		os.Chdir(wd)
+	}
+}
+
+func freePort() int {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func newTestClient(t *testing.T) (*client.Client, string) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	port := freePort()
+	t.Cleanup(startServer(t, dir, port))
+	c := client.NewClient(&client.Options{Addr: fmt.Sprintf("127.0.0.1:%d", port), PoolSize: 4})
+	t.Cleanup(func() { c.Close() })
+	return c, dir
+}
+
+// typed helpers
+func TestClient1(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "k", "a b"); err != nil {
+		t.Error("TestClient1 failed")
+	}
+	if v, err := c.Get(ctx, "k"); err != nil || v != "a b" {
+		t.Error("TestClient1 failed")
+	}
+	if _, err := c.Get(ctx, "nokey"); err != client.ErrNil {
+		t.Error("TestClient1 failed")
+	}
+	if n, err := c.Del(ctx, "k", "nokey"); err != nil || n != 1 {
+		t.Error("TestClient1 failed")
+	}
+
+	if n, err := c.LPush(ctx, "l", "a", "b"); err != nil || n != 2 {
+		t.Error("TestClient1 failed")
+	}
+	if n, err := c.RPush(ctx, "l", "c"); err != nil || n != 3 {
+		t.Error("TestClient1 failed")
+	}
+	if l, err := c.LRange(ctx, "l", 0, -1); err != nil || !reflect.DeepEqual(l, []string{"b", "a", "c"}) {
+		t.Error("TestClient1 failed")
+	}
+	if v, err := c.LPop(ctx, "l"); err != nil || v != "b" {
+		t.Error("TestClient1 failed")
+	}
+	if l, err := c.LRange(ctx, "nolist", 0, -1); err != nil || len(l) != 0 {
+		t.Error("TestClient1 failed")
+	}
+
+	if n, err := c.ZAdd(ctx, "z", client.Z{Score: 1, Member: "a"}, client.Z{Score: 2.5, Member: "b"}, client.Z{Score: 3, Member: "c"}); err != nil || n != 3 {
+		t.Error("TestClient1 failed")
+	}
+	if m, err := c.ZRangeByScore(ctx, "z", 2, 3); err != nil || !reflect.DeepEqual(m, []string{"b", "c"}) {
+		t.Error("TestClient1 failed")
+	}
+	if m, err := c.ZRange(ctx, "z", 0, 0); err != nil || !reflect.DeepEqual(m, []string{"a"}) {
+		t.Error("TestClient1 failed")
+	}
+	if s, err := c.ZScore(ctx, "z", "b"); err != nil || s != 2.5 {
+		t.Error("TestClient1 failed")
+	}
+	if _, err := c.ZScore(ctx, "z", "nomember"); err != client.ErrNil {
+		t.Error("TestClient1 failed")
+	}
+
+	// error replies
+	var reply_err client.Error
+	if _, err := c.Do(ctx, "GET"); !errors.As(err, &reply_err) || reply_err.Error() != "ERR wrong number of arguments for 'get' command" {
+		t.Error("TestClient1 failed")
+	}
+	if _, err := c.Do(ctx, "SUBSCRIBE", "ch"); err == nil {
+		t.Error("TestClient1 failed")
+	}
+}
+
+// the connections select the db of the client using them
+func TestClient2(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c3 := c.DB(3)
+
+	for i := 0; i < 10; i++ {
+		if err := c.Set(ctx, "k", "db0"); err != nil {
+			t.Error("TestClient2 failed")
+		}
+		if err := c3.Set(ctx, "k", "db3"); err != nil {
+			t.Error("TestClient2 failed")
+		}
+	}
+	if v, _ := c.Get(ctx, "k"); v != "db0" {
+		t.Error("TestClient2 failed")
+	}
+	if v, _ := c3.Get(ctx, "k"); v != "db3" {
+		t.Error("TestClient2 failed")
+	}
+	if _, err := c.Do(ctx, "SELECT", "1"); err == nil {
+		t.Error("TestClient2 failed")
+	}
+	if err := c.DB(99).Set(ctx, "k", "v"); err == nil || err.Error() != "ERR DB index is out of range" {
+		t.Error("TestClient2 failed")
+	}
+}
+
+// pipelining and context timeouts
+func TestClient3(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+
+	p := c.Pipeline()
+	for i := 0; i < 1000; i++ {
+		p.Do("SET", fmt.Sprintf("k%d", i), fmt.Sprint(i)).Do("GET", fmt.Sprintf("k%d", i))
+	}
+	p.Do("GET")
+	replies, err := p.Exec(ctx)
+	if err != nil || len(replies) != 2001 || p.Len() != 0 {
+		t.Fatal("TestClient3 failed")
+	}
+	for i := 0; i < 1000; i++ {
+		if v, err := replies[2*i+1].Text(); err != nil || v != fmt.Sprint(i) {
+			t.Error("TestClient3 failed")
+		}
+	}
+	if replies[2000].Err() == nil {
+		t.Error("TestClient3 failed")
+	}
+
+	// XREAD blocks until the timeout of the context
+	ctx_timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.Do(ctx_timeout, "XREAD", "BLOCK", "0", "STREAMS", "s", "$"); err != context.DeadlineExceeded {
+		t.Error("TestClient3 failed")
+	}
+	ctx_cancel, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.Do(ctx_cancel, "GET", "k1"); err != context.Canceled {
+		t.Error("TestClient3 failed")
+	}
+	// the connection timed out isn't reused
+	if v, err := c.Get(ctx, "k1"); err != nil || v != "1" {
+		t.Error("TestClient3 failed")
+	}
+}
+
+// the connections are reconnected after the server restarts
+func TestClient4(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	port := freePort()
+	stop := startServer(t, dir, port)
+	c := client.NewClient(&client.Options{Addr: fmt.Sprintf("127.0.0.1:%d", port)})
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "k", "v"); err != nil {
+		t.Error("TestClient4 failed")
+	}
+	sub, err := c.Subscribe(ctx, "ch")
+	if err != nil {
+		t.Fatal("TestClient4 failed")
+	}
+	defer sub.Close()
+	if msg := <-sub.Channel(); msg.Kind != "subscribe" || msg.Channel != "ch" || msg.Count != 1 {
+		t.Error("TestClient4 failed")
+	}
+
+	stop()
+	defer startServer(t, dir, port)()
+
+	if v, err := c.Get(ctx, "k"); err != nil || v != "v" {
+		t.Error("TestClient4 failed", err)
+	}
+	// subscribed again after reconnecting
+	select {
+	case msg := <-sub.Channel():
+		if msg.Kind != "subscribe" || msg.Channel != "ch" {
+			t.Error("TestClient4 failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestClient4 failed")
+	}
+	if n, err := c.Publish(ctx, "ch", "hello"); err != nil || n != 1 {
+		t.Error("TestClient4 failed")
+	}
+	if msg := <-sub.Channel(); msg.Kind != "message" || msg.Channel != "ch" || msg.Payload != "hello" {
+		t.Error("TestClient4 failed")
+	}
+}
+
+// pub/sub with patterns
+func TestClient5(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+
+	sub, err := c.PSubscribe(ctx, "news.*")
+	if err != nil {
+		t.Fatal("TestClient5 failed")
+	}
+	if msg := <-sub.Channel(); msg.Kind != "psubscribe" || msg.Channel != "news.*" || msg.Count != 1 {
+		t.Error("TestClient5 failed")
+	}
+	sub.Subscribe(ctx, "weather")
+	if msg := <-sub.Channel(); msg.Kind != "subscribe" || msg.Count != 2 {
+		t.Error("TestClient5 failed")
+	}
+
+	c.Publish(ctx, "news.sport", "goal")
+	if msg := <-sub.Channel(); msg.Kind != "pmessage" || msg.Pattern != "news.*" || msg.Channel != "news.sport" || msg.Payload != "goal" {
+		t.Error("TestClient5 failed")
+	}
+	sub.Unsubscribe(ctx)
+	if msg := <-sub.Channel(); msg.Kind != "unsubscribe" || msg.Channel != "weather" || msg.Count != 1 {
+		t.Error("TestClient5 failed")
+	}
+	if n, _ := c.Publish(ctx, "weather", "sunny"); n != 0 {
+		t.Error("TestClient5 failed")
+	}
+
+	sub.Close()
+	if _, ok := <-sub.Channel(); ok {
+		t.Error("TestClient5 failed")
+	}
+	if err := sub.Subscribe(ctx, "ch"); err != client.ErrClosed {
+		t.Error("TestClient5 failed")
+	}
+}
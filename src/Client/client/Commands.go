@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// a member of a sorted set with its score
+type Z struct {
+	Score  float64
+	Member string
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (this *Client) textCmd(ctx context.Context, args ...string) (string, error) {
+	reply, err := this.Do(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	return reply.Text()
+}
+
+func (this *Client) intCmd(ctx context.Context, args ...string) (int64, error) {
+	reply, err := this.Do(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Int()
+}
+
+func (this *Client) stringsCmd(ctx context.Context, args ...string) ([]string, error) {
+	reply, err := this.Do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Strings()
+}
+
+func (this *Client) okCmd(ctx context.Context, args ...string) error {
+	_, err := this.Do(ctx, args...)
+	return err
+}
+
+// keys
+
+// ErrNil if key doesn't exist
+func (this *Client) Get(ctx context.Context, key string) (string, error) {
+	return this.textCmd(ctx, "GET", key)
+}
+
+func (this *Client) Set(ctx context.Context, key string, value string) error {
+	return this.okCmd(ctx, "SET", key, value)
+}
+
+// pairs of keys and values
+func (this *Client) MSet(ctx context.Context, pairs ...string) error {
+	return this.okCmd(ctx, append([]string{"MSET"}, pairs...)...)
+}
+
+// returns the number of the keys deleted
+func (this *Client) Del(ctx context.Context, keys ...string) (int64, error) {
+	return this.intCmd(ctx, append([]string{"DEL"}, keys...)...)
+}
+
+// the ttl is in seconds
+func (this *Client) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return this.okCmd(ctx, "EXPIRE", key, strconv.FormatInt(int64(ttl/time.Second), 10))
+}
+
+// the ttl in seconds, -1 if key has no ttl and -2 if it doesn't exist
+func (this *Client) TTL(ctx context.Context, key string) (int64, error) {
+	return this.intCmd(ctx, "TTL", key)
+}
+
+func (this *Client) Persist(ctx context.Context, key string) error {
+	return this.okCmd(ctx, "PERSIST", key)
+}
+
+func (this *Client) Keys(ctx context.Context, pattern string) ([]string, error) {
+	return this.stringsCmd(ctx, "KEYS", pattern)
+}
+
+func (this *Client) FlushDB(ctx context.Context) error {
+	return this.okCmd(ctx, "FLUSHDB")
+}
+
+// lists
+
+// returns the length of the list
+func (this *Client) LPush(ctx context.Context, key string, values ...string) (int64, error) {
+	return this.intCmd(ctx, append([]string{"LPUSH", key}, values...)...)
+}
+
+func (this *Client) RPush(ctx context.Context, key string, values ...string) (int64, error) {
+	return this.intCmd(ctx, append([]string{"RPUSH", key}, values...)...)
+}
+
+// ErrNil if the list is empty
+func (this *Client) LPop(ctx context.Context, key string) (string, error) {
+	return this.textCmd(ctx, "LPOP", key)
+}
+
+func (this *Client) RPop(ctx context.Context, key string) (string, error) {
+	return this.textCmd(ctx, "RPOP", key)
+}
+
+func (this *Client) LLen(ctx context.Context, key string) (int64, error) {
+	return this.intCmd(ctx, "LLEN", key)
+}
+
+// ErrNil if index is out of range
+func (this *Client) LIndex(ctx context.Context, key string, index int64) (string, error) {
+	return this.textCmd(ctx, "LINDEX", key, strconv.FormatInt(index, 10))
+}
+
+func (this *Client) LRange(ctx context.Context, key string, start int64, stop int64) ([]string, error) {
+	return this.stringsCmd(ctx, "LRANGE", key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10))
+}
+
+// sorted sets
+
+// returns the number of the members added
+func (this *Client) ZAdd(ctx context.Context, key string, members ...Z) (int64, error) {
+	args := []string{"ZADD", key}
+	for _, z := range members {
+		args = append(args, formatFloat(z.Score), z.Member)
+	}
+	return this.intCmd(ctx, args...)
+}
+
+// returns the number of the members removed
+func (this *Client) ZRem(ctx context.Context, key string, members ...string) (int64, error) {
+	return this.intCmd(ctx, append([]string{"ZREM", key}, members...)...)
+}
+
+func (this *Client) ZCard(ctx context.Context, key string) (int64, error) {
+	return this.intCmd(ctx, "ZCARD", key)
+}
+
+// members by rank from start to stop
+func (this *Client) ZRange(ctx context.Context, key string, start int64, stop int64) ([]string, error) {
+	return this.stringsCmd(ctx, "ZRANGE", key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10))
+}
+
+// members with scores from min to max
+func (this *Client) ZRangeByScore(ctx context.Context, key string, min float64, max float64) ([]string, error) {
+	return this.stringsCmd(ctx, "ZRANGEBYSCORE", key, formatFloat(min), formatFloat(max))
+}
+
+// ErrNil if member doesn't exist
+func (this *Client) ZScore(ctx context.Context, key string, member string) (float64, error) {
+	reply, err := this.Do(ctx, "ZSCORE", key, member)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Float()
+}
+
+// ErrNil if member doesn't exist
+func (this *Client) ZRank(ctx context.Context, key string, member string) (int64, error) {
+	return this.intCmd(ctx, "ZRANK", key, member)
+}
+
+// pub/sub
+
+// returns the number of the receivers
+func (this *Client) Publish(ctx context.Context, channel string, message string) (int64, error) {
+	return this.intCmd(ctx, "PUBLISH", channel, message)
+}
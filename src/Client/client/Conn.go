@@ -0,0 +1,164 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"gedis/src/Server/server"
+	"gedis/src/zinx/znet"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the replies of (un)subscribing are pushed like the messages, they are only sent by PubSub
+var push_reply_cmds = map[string]bool{"SUBSCRIBE": true, "UNSUBSCRIBE": true, "PSUBSCRIBE": true, "PUNSUBSCRIBE": true}
+
+// a connection to the server, not safe for concurrent use
+type conn struct {
+	net_conn   net.Conn
+	msg_packer *znet.DataPack
+	cmd_packer *server.CmdPack
+
+	db int
+	// the connection can't be used anymore after network errors and timeouts,
+	// the replies of the requests may still come
+	broken bool
+	// taken from the idle connections of the pool rather than dialed for the request
+	reused bool
+}
+
+// dial and authenticate, the db is selected later when the connection is used
+func dialConn(ctx context.Context, opt *Options) (*conn, error) {
+	dialer := &net.Dialer{Timeout: opt.DialTimeout}
+	var net_conn net.Conn
+	var err error
+	if opt.TLSConfig != nil {
+		net_conn, err = (&tls.Dialer{NetDialer: dialer, Config: opt.TLSConfig}).DialContext(ctx, opt.Network, opt.Addr)
+	} else {
+		net_conn, err = dialer.DialContext(ctx, opt.Network, opt.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &conn{net_conn: net_conn, msg_packer: znet.NewDataPack(), cmd_packer: server.NewCmdPack()}
+	if opt.Password != "" {
+		args := []string{"AUTH", opt.Password}
+		if opt.Username != "" {
+			args = []string{"AUTH", opt.Username, opt.Password}
+		}
+		if _, err := cn.do(ctx, args); err != nil {
+			cn.close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+func (this *conn) close() error {
+	return this.net_conn.Close()
+}
+
+// the deadline of the connection follows ctx until the returned func is called
+func (this *conn) withContext(ctx context.Context) (stop func()) {
+	deadline, _ := ctx.Deadline()
+	this.net_conn.SetDeadline(deadline)
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			// wake up the blocked read or write
+			this.net_conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// the msg of a cmd, sent with the id of the router handling it
+func (this *conn) pack(args []string) ([]byte, error) {
+	name := strings.ToUpper(args[0])
+	cmd := make([][]byte, len(args))
+	for i, arg := range args {
+		cmd[i] = []byte(arg)
+	}
+	cmd[0] = []byte(name)
+	return this.msg_packer.Pack(znet.NewMessage(server.GetCmdMsgID(name), this.cmd_packer.PackCmd(cmd)))
+}
+
+func (this *conn) write(args []string) error {
+	buf, err := this.pack(args)
+	if err != nil {
+		return err
+	}
+	if _, err := this.net_conn.Write(buf); err != nil {
+		this.broken = true
+		return err
+	}
+	return nil
+}
+
+func (this *conn) read() (uint32, Reply, error) {
+	msg, err := this.msg_packer.ReadMsg(this.net_conn)
+	if err != nil {
+		this.broken = true
+		return 0, nil, err
+	}
+	return msg.GetMsgID(), newReply(this.cmd_packer.UnpackCmd(msg.GetMsgData())), nil
+}
+
+// the reply of a cmd, SELECT is replied with the id of the db by the server
+func (this *conn) readReply() (Reply, error) {
+	for {
+		id, reply, err := this.read()
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case server.PUBSUB_MSG_ID:
+			// pushed messages aren't replies
+			continue
+		case 1:
+			db, _ := strconv.Atoi(reply[0])
+			this.db = db
+			reply = Reply{"OK"}
+		}
+		return reply, reply.Err()
+	}
+}
+
+// send a cmd and wait for its reply, the error of an error reply is returned as well
+func (this *conn) do(ctx context.Context, args []string) (Reply, error) {
+	if len(args) == 0 {
+		return nil, errors.New("gedis: empty command")
+	}
+	if push_reply_cmds[strings.ToUpper(args[0])] {
+		return nil, errors.New("gedis: use Client.Subscribe and PSubscribe to subscribe")
+	}
+	stop := this.withContext(ctx)
+	defer stop()
+
+	if err := this.write(args); err != nil {
+		return nil, err
+	}
+	return this.readReply()
+}
+
+// select db if the connection is in another one
+func (this *conn) selectDb(ctx context.Context, db int) error {
+	if this.db == db {
+		return nil
+	}
+	_, err := this.do(ctx, []string{"SELECT", strconv.Itoa(db)})
+	return err
+}
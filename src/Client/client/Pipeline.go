@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// cmds sent at once by a connection, their replies are read after all of them are sent
+type Pipeline struct {
+	client *Client
+	cmds   [][]string
+}
+
+func (this *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: this, cmds: make([][]string, 0)}
+}
+
+// queue a cmd, it's sent by Exec
+func (this *Pipeline) Do(args ...string) *Pipeline {
+	this.cmds = append(this.cmds, args)
+	return this
+}
+
+func (this *Pipeline) Len() int {
+	return len(this.cmds)
+}
+
+// send the queued cmds and return their replies in order, the pipeline is empty after it.
+// The error is only for the failures of the connection, error replies are checked by Reply.Err
+func (this *Pipeline) Exec(ctx context.Context) ([]Reply, error) {
+	cmds := this.cmds
+	this.cmds = make([][]string, 0)
+	for _, cmd := range cmds {
+		if len(cmd) == 0 {
+			return nil, errors.New("gedis: empty command")
+		}
+		if name := strings.ToUpper(cmd[0]); name == "SELECT" || push_reply_cmds[name] {
+			return nil, errors.New("gedis: " + name + " can't be pipelined")
+		}
+	}
+
+	var replies []Reply
+	err := this.client.withConn(ctx, func(cn *conn) error {
+		buf := make([]byte, 0)
+		for _, cmd := range cmds {
+			msg, err := cn.pack(cmd)
+			if err != nil {
+				return err
+			}
+			buf = append(buf, msg...)
+		}
+		stop := cn.withContext(ctx)
+		defer stop()
+
+		// replies are read while sending, the server stops reading once too many requests are pending
+		write_err := make(chan error, 1)
+		go func() {
+			_, err := cn.net_conn.Write(buf)
+			write_err <- err
+		}()
+		replies = make([]Reply, 0, len(cmds))
+		for range cmds {
+			reply, err := cn.readReply()
+			if err != nil && cn.broken {
+				// wake up the writer if it's blocked
+				cn.net_conn.Close()
+				<-write_err
+				return err
+			}
+			replies = append(replies, reply)
+		}
+		if err := <-write_err; err != nil {
+			cn.broken = true
+			return err
+		}
+		return nil
+	})
+	return replies, err
+}
@@ -0,0 +1,267 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"gedis/src/Server/server"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a pushed message or the confirmation of (un)subscribing
+type Message struct {
+	Kind    string // message, pmessage, subscribe, unsubscribe, psubscribe or punsubscribe
+	Pattern string // the pattern matched by pmessage
+	Channel string // the channel of the message, or the one (un)subscribed
+	Payload string
+	Count   int // the number of the channels and patterns subscribed after (un)subscribing
+}
+
+func parseMessage(reply Reply) (*Message, bool) {
+	if len(reply) < 3 {
+		return nil, false
+	}
+	msg := &Message{Kind: reply[0]}
+	switch reply[0] {
+	case "message":
+		msg.Channel, msg.Payload = reply[1], reply[2]
+	case "pmessage":
+		if len(reply) < 4 {
+			return nil, false
+		}
+		msg.Pattern, msg.Channel, msg.Payload = reply[1], reply[2], reply[3]
+	case "subscribe", "unsubscribe", "psubscribe", "punsubscribe":
+		msg.Channel = reply[1]
+		count, err := strconv.Atoi(strings.TrimPrefix(reply[2], "(integer) "))
+		if err != nil {
+			return nil, false
+		}
+		msg.Count = count
+	default:
+		return nil, false
+	}
+	return msg, true
+}
+
+// the min and max delays between the attempts to reconnect
+const (
+	reconnect_min = 100 * time.Millisecond
+	reconnect_max = 2 * time.Second
+)
+
+// subscriptions on a connection of their own, messages are received by Channel.
+// The connection is reconnected if it's broken, and the channels and patterns are subscribed again
+type PubSub struct {
+	opt *Options
+
+	lock     sync.Mutex
+	cn       *conn
+	channels map[string]bool
+	patterns map[string]bool
+	closed   bool
+
+	msgs      chan *Message
+	exit_chan chan struct{}
+	exit_wg   sync.WaitGroup
+}
+
+func (this *Client) newPubSub(ctx context.Context) (*PubSub, error) {
+	cn, err := dialConn(ctx, this.opt)
+	if err != nil {
+		return nil, err
+	}
+	p := &PubSub{
+		opt:       this.opt,
+		cn:        cn,
+		channels:  make(map[string]bool),
+		patterns:  make(map[string]bool),
+		msgs:      make(chan *Message, 100),
+		exit_chan: make(chan struct{}),
+	}
+	p.exit_wg.Add(1)
+	go p.receive(cn)
+	return p, nil
+}
+
+func (this *Client) Subscribe(ctx context.Context, channels ...string) (*PubSub, error) {
+	p, err := this.newPubSub(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Subscribe(ctx, channels...); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (this *Client) PSubscribe(ctx context.Context, patterns ...string) (*PubSub, error) {
+	p, err := this.newPubSub(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.PSubscribe(ctx, patterns...); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// the confirmations are received by Channel like the messages
+func (this *PubSub) Subscribe(ctx context.Context, channels ...string) error {
+	return this.send(ctx, "SUBSCRIBE", this.channels, channels, true)
+}
+
+func (this *PubSub) PSubscribe(ctx context.Context, patterns ...string) error {
+	return this.send(ctx, "PSUBSCRIBE", this.patterns, patterns, true)
+}
+
+// all the channels are unsubscribed if none is given
+func (this *PubSub) Unsubscribe(ctx context.Context, channels ...string) error {
+	return this.send(ctx, "UNSUBSCRIBE", this.channels, channels, false)
+}
+
+func (this *PubSub) PUnsubscribe(ctx context.Context, patterns ...string) error {
+	return this.send(ctx, "PUNSUBSCRIBE", this.patterns, patterns, false)
+}
+
+// the subscriptions are recorded even if sending fails, they are sent again after reconnecting
+func (this *PubSub) send(ctx context.Context, cmd string, subs map[string]bool, names []string, add bool) error {
+	if add && len(names) == 0 {
+		return errors.New("gedis: no channel or pattern to " + strings.ToLower(cmd))
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed {
+		return ErrClosed
+	}
+	if add {
+		for _, name := range names {
+			subs[name] = true
+		}
+	} else if len(names) == 0 {
+		for name := range subs {
+			delete(subs, name)
+		}
+	} else {
+		for _, name := range names {
+			delete(subs, name)
+		}
+	}
+
+	// only the deadline of ctx is used, the connection is read by receive
+	deadline, _ := ctx.Deadline()
+	this.cn.net_conn.SetWriteDeadline(deadline)
+	return writeRaw(this.cn, append([]string{cmd}, names...))
+}
+
+// write without marking the connection broken, which is only touched by receive
+func writeRaw(cn *conn, args []string) error {
+	buf, err := cn.pack(args)
+	if err != nil {
+		return err
+	}
+	_, err = cn.net_conn.Write(buf)
+	return err
+}
+
+// the messages and confirmations, it's closed after Close
+func (this *PubSub) Channel() <-chan *Message {
+	return this.msgs
+}
+
+func (this *PubSub) Close() error {
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		return nil
+	}
+	this.closed = true
+	close(this.exit_chan)
+	this.cn.close()
+	this.lock.Unlock()
+
+	this.exit_wg.Wait()
+	close(this.msgs)
+	return nil
+}
+
+// read the pushed messages of cn until it's broken, then reconnect
+func (this *PubSub) receive(cn *conn) {
+	defer this.exit_wg.Done()
+	for {
+		id, reply, err := cn.read()
+		if err != nil {
+			if cn = this.reconnect(); cn == nil {
+				return
+			}
+			continue
+		}
+		// errors like NOAUTH are replied with the msg id 0
+		if id != server.PUBSUB_MSG_ID {
+			continue
+		}
+		if msg, ok := parseMessage(reply); ok {
+			select {
+			case this.msgs <- msg:
+			case <-this.exit_chan:
+				return
+			}
+		}
+	}
+}
+
+// dial until it succeeds and subscribe again, nil if the PubSub is closed
+func (this *PubSub) reconnect() *conn {
+	delay := reconnect_min
+	for {
+		select {
+		case <-this.exit_chan:
+			return nil
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > reconnect_max {
+			delay = reconnect_max
+		}
+
+		cn, err := dialConn(context.Background(), this.opt)
+		if err != nil {
+			continue
+		}
+		this.lock.Lock()
+		if this.closed {
+			this.lock.Unlock()
+			cn.close()
+			return nil
+		}
+		err = this.resubscribe(cn)
+		if err != nil {
+			this.lock.Unlock()
+			cn.close()
+			continue
+		}
+		this.cn.close()
+		this.cn = cn
+		this.lock.Unlock()
+		return cn
+	}
+}
+
+// called with the lock
+func (this *PubSub) resubscribe(cn *conn) error {
+	for cmd, subs := range map[string]map[string]bool{"SUBSCRIBE": this.channels, "PSUBSCRIBE": this.patterns} {
+		if len(subs) == 0 {
+			continue
+		}
+		args := []string{cmd}
+		for name := range subs {
+			args = append(args, name)
+		}
+		if err := writeRaw(cn, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
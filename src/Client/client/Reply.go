@@ -0,0 +1,93 @@
+package client
+
+import (
+	"errors"
+	"gedis/src/Server/server"
+	"strconv"
+	"strings"
+)
+
+// ErrNil is returned when the reply is (nil), e.g. GET of a key not existing
+var ErrNil = errors.New("gedis: nil")
+
+// an error replied by the server, like "ERR syntax error"
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// the lines of a reply, formatted by the server as redis-cli shows them:
+// (integer) n, (nil), (empty array), (error) msg or nested arrays like "1) 1) a"
+type Reply []string
+
+func newReply(values [][]byte) Reply {
+	reply := make(Reply, 0, len(values))
+	for _, v := range values {
+		reply = append(reply, string(v))
+	}
+	return reply
+}
+
+// the error of an error reply, nil otherwise
+func (r Reply) Err() error {
+	if len(r) == 1 && strings.HasPrefix(r[0], "(error) ") {
+		return Error(strings.TrimPrefix(r[0], "(error) "))
+	}
+	return nil
+}
+
+// the single value of the reply, ErrNil if it's (nil)
+func (r Reply) Text() (string, error) {
+	if err := r.Err(); err != nil {
+		return "", err
+	}
+	if len(r) != 1 {
+		return "", errors.New("gedis: the reply isn't a single value")
+	}
+	if r[0] == "(nil)" {
+		return "", ErrNil
+	}
+	return r[0], nil
+}
+
+// the value of an (integer) reply
+func (r Reply) Int() (int64, error) {
+	text, err := r.Text()
+	if err != nil {
+		return 0, err
+	}
+	if !strings.HasPrefix(text, "(integer) ") {
+		return 0, errors.New("gedis: the reply isn't an integer: " + text)
+	}
+	return strconv.ParseInt(strings.TrimPrefix(text, "(integer) "), 10, 64)
+}
+
+// the value of a (float) reply, or of a bulk string holding a float like HGET
+func (r Reply) Float() (float64, error) {
+	text, err := r.Text()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimPrefix(text, "(float) "), 64)
+}
+
+// the values of a flat array reply like LRANGE, a single value is an array of one element.
+// Empty arrays are replied as (nil) by some cmds
+func (r Reply) Strings() ([]string, error) {
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	if len(r) == 1 && (r[0] == "(empty array)" || r[0] == "(nil)") {
+		return []string{}, nil
+	}
+	return []string(r), nil
+}
+
+// the items of a nested array reply, strings or []interface{} of them
+func (r Reply) Nested() ([]interface{}, error) {
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	return server.ParseNested(r), nil
+}
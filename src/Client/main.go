@@ -2,125 +2,400 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
 	"fmt"
 	"gedis/src/Server/server"
 	"gedis/src/zinx/znet"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+
+	"golang.org/x/term"
 )
 
-var setCmds = []string{"SET", "GET", "DEL", "MSET", "EXPIRE", "TTL", "KEYS", "PERSIST",
-	"LPUSH", "RPUSH", "LPOP", "RPOP", "LINDEX", "LLEN", "LRANGE",
-	"ZADD", "ZCARD", "ZREM", "ZRANGE", "ZRANGEBYSCORE", "ZCOUNT", "ZRANK", "ZSCORE"}
-var selectCmds = []string{"SELECT"}
+// the replies of (un)subscribing are pushed like the messages instead of being replied
+var push_reply_cmds = map[string]bool{"SUBSCRIBE": true, "UNSUBSCRIBE": true, "PSUBSCRIBE": true, "PUNSUBSCRIBE": true}
 
 var db_id int = 0
 var prompt = "Gedis"
 
-func reader(conn net.Conn) {
+// cmd name -> id of the msg to send it with, from COMMAND DOCS of the server
+var cmd_msg_ids map[string]uint32
+
+var host = flag.String("h", "127.0.0.1", "server hostname")
+var port = flag.Int("p", 8999, "server port")
+var db_num = flag.Int("n", 0, "database number")
+var pipe_mode = flag.Bool("pipe", false, "send the cmds read from stdin pipelined, and report the errors in the replies")
+var raw_output = flag.Bool("raw", false, "print the replies as they are, the default if stdout isn't a terminal")
+var no_raw_output = flag.Bool("no-raw", false, "quote the replies even if stdout isn't a terminal")
+var json_output = flag.Bool("json", false, "print each reply as a json value")
+var csv_output = flag.Bool("csv", false, "print each reply as a line of csv")
+var unix_socket = flag.String("s", "", "connect to the unix socket at the path instead of tcp")
+var use_tls = flag.Bool("tls", false, "connect with tls")
+var tls_cacert = flag.String("cacert", "", "CA cert file to verify the server, system CAs if empty")
+var tls_cert = flag.String("cert", "", "client cert file, if the server verifies clients")
+var tls_key = flag.String("key", "", "client key file, if the server verifies clients")
+var tls_insecure = flag.Bool("insecure", false, "don't verify the cert of the server")
+
+type reply struct {
+	msg_id uint32
+	values []string
+}
+
+// read the msgs from the server, pushed messages are printed at once and the replies are sent to replies
+func reader(conn net.Conn, replies chan<- reply, editor *LineEditor) {
 	msg_packer := znet.NewDataPack()
 	cmd_packer := server.NewCmdPack()
 	for {
-		fmt.Printf("%s[%d]> ", prompt, db_id)
-		buf := make([]byte, msg_packer.GetHeadLen())
-		_, err := conn.Read(buf)
-		if err != nil {
+		msg, err := msg_packer.ReadMsg(conn)
+		if err == io.EOF {
+			editor.Restore()
+			fmt.Println("\nconnection is closed by server")
+			os.Exit(0)
+		} else if err != nil {
+			editor.Restore()
 			panic(err.Error())
 		}
-		msg, err := msg_packer.UnpackHead(buf)
-		if err != nil {
-			panic(err.Error())
+		values := make([]string, 0)
+		for _, v := range cmd_packer.UnpackCmd(msg.GetMsgData()) {
+			values = append(values, string(v))
 		}
-		_, err = conn.Read(msg.GetMsgData())
-		if err != nil {
-			panic(err.Error())
+		if msg.GetMsgID() == server.PUBSUB_MSG_ID {
+			if !*pipe_mode {
+				editor.Print(formatReply(values)...)
+			}
+			continue
 		}
-		cmd_packed := msg.GetMsgData()
-		cmds := cmd_packer.UnpackCmd(cmd_packed)
-		if msg.GetMsgID() == 1 {
-			db_id, err = strconv.Atoi(string(cmds[0]))
-			fmt.Printf("\"OK\"\n")
-		} else {
-			for _, v := range cmds {
-				fmt.Printf("\"%s\"\n", v)
+		// the lines of MONITOR are quoted already
+		if msg.GetMsgID() == server.MONITOR_MSG_ID {
+			if !*pipe_mode {
+				editor.Print(values...)
 			}
+			continue
 		}
+		replies <- reply{msg.GetMsgID(), values}
 	}
 }
 
-func writer(conn net.Conn) {
-	msg_packer := znet.NewDataPack()
-	cmd_packer := server.NewCmdPack()
+func send(conn net.Conn, msg_id uint32, cmd [][]byte) error {
+	msg_packed, err := znet.NewDataPack().Pack(znet.NewMessage(msg_id, server.NewCmdPack().PackCmd(cmd)))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(msg_packed)
+	return err
+}
 
-	for {
-		cmd := parseCmd()
-		// convert cmd[0] to upper case
-		cmd[0] = []byte(strings.ToUpper(string(cmd[0])))
-		// 退出
-		if string(cmd[0]) == "EXIT" {
-			break
-		}
-		// 检查命令是否合法, 在validCmds中
-		msg_id := 0
-		valid := false
-		for _, v := range setCmds {
-			if string(cmd[0]) == v {
-				valid = true
-				break
-			}
+// the docs of the cmds are requested in batches, the reply of all of them exceeds the max length of a msg
+const docs_batch = 16
+
+// load the cmds of the server for routing and completion,
+// the cmds known at build time are used if it fails, e.g. before AUTH
+func loadCmds(conn net.Conn, replies <-chan reply) {
+	names, ok := request(conn, replies, server.SERVER_MSG_ID, "COMMAND", "LIST")
+	if !ok {
+		return
+	}
+	ids := make(map[string]uint32)
+	for start := 0; start < len(names); start += docs_batch {
+		end := start + docs_batch
+		if end > len(names) {
+			end = len(names)
 		}
-		if !valid {
-			for _, v := range selectCmds {
-				if string(cmd[0]) == v {
-					valid = true
-					msg_id = 1
-					break
+		res, ok := request(conn, replies, server.SERVER_MSG_ID, append([]string{"COMMAND", "DOCS"}, names[start:end]...)...)
+		if !ok {
+			return
+		}
+		docs := server.ParseNested(res)
+		for i := 0; i+1 < len(docs); i += 2 {
+			name, _ := docs[i].(string)
+			doc, _ := docs[i+1].([]interface{})
+			ids[strings.ToUpper(name)] = 0
+			for j := 0; j+1 < len(doc); j += 2 {
+				if value, _ := doc[j+1].(string); doc[j] == "msg_id" {
+					id, _ := strconv.Atoi(strings.TrimPrefix(value, "(integer) "))
+					ids[strings.ToUpper(name)] = uint32(id)
 				}
 			}
 		}
-		if !valid {
-			fmt.Printf("invalid command: %s\n", cmd[0])
-			fmt.Printf("%s[%d]> ", prompt, db_id)
+	}
+	cmd_msg_ids = ids
+}
+
+// send a cmd and wait for its reply, false if it fails or the reply is an error
+func request(conn net.Conn, replies <-chan reply, msg_id uint32, args ...string) ([]string, bool) {
+	cmd := make([][]byte, len(args))
+	for i, arg := range args {
+		cmd[i] = []byte(arg)
+	}
+	if send(conn, msg_id, cmd) != nil {
+		return nil, false
+	}
+	res := <-replies
+	if len(res.values) == 0 || strings.HasPrefix(res.values[0], "(error) ") {
+		return nil, false
+	}
+	return res.values, true
+}
+
+func getCmdMsgID(name string) uint32 {
+	if cmd_msg_ids == nil {
+		return server.GetCmdMsgID(name)
+	}
+	return cmd_msg_ids[name]
+}
+
+// cmd names starting with prefix, in lower case unless prefix has upper case letters
+func completeCmd(prefix string) []string {
+	names := server.GetCmdNames()
+	if cmd_msg_ids != nil {
+		names = make([]string, 0, len(cmd_msg_ids))
+		for name := range cmd_msg_ids {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	upper := prefix != strings.ToLower(prefix)
+	candidates := make([]string, 0)
+	for _, name := range names {
+		if !strings.HasPrefix(name, strings.ToUpper(prefix)) {
 			continue
 		}
-		cmd_packed := cmd_packer.PackCmd(cmd)
-		msg := znet.NewMessage(uint32(msg_id), cmd_packed)
-		msg_packed, err := msg_packer.Pack(msg)
-		if err != nil {
-			panic(err.Error())
+		if !upper {
+			name = strings.ToLower(name)
 		}
-		conn.Write(msg_packed)
+		candidates = append(candidates, name)
 	}
+	return candidates
+}
+
+func historyFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".gedis_history")
+}
 
+// send a cmd and wait for its reply, the reply is nil for the cmds replied by pushes
+func execute(conn net.Conn, replies <-chan reply, args []string) ([]string, error) {
+	name := strings.ToUpper(args[0])
+	cmd := make([][]byte, len(args))
+	for i, arg := range args {
+		cmd[i] = []byte(arg)
+	}
+	cmd[0] = []byte(name)
+	if err := send(conn, getCmdMsgID(name), cmd); err != nil {
+		return nil, err
+	}
+	if push_reply_cmds[name] {
+		return nil, nil
+	}
+	res := <-replies
+	if res.msg_id == 1 {
+		db_id, _ = strconv.Atoi(res.values[0])
+		return []string{"OK"}, nil
+	}
+	// the cmds of the server may be read after authenticating
+	if name == "AUTH" && cmd_msg_ids == nil && len(res.values) == 1 && res.values[0] == "OK" {
+		loadCmds(conn, replies)
+	}
+	return res.values, nil
 }
 
-func parseCmd() [][]byte {
-	// 将命令行参数解析为[][]byte，例如：
-	// SET genshin impact
-	// -> [][]byte{[]byte("SET"), []byte("genshin"), []byte("impact")}
-	reader := bufio.NewReader(os.Stdin)
-	line, err := reader.ReadString('\n')
-	line = strings.TrimRight(line, "\n")
+// read cmds, send each of them and wait for its reply.
+// Cmds are read from stdin without prompts if it isn't a terminal
+func repl(conn net.Conn, replies <-chan reply, editor *LineEditor) {
+	for {
+		line, err := editor.ReadLine(fmt.Sprintf("%s[%d]> ", prompt, db_id))
+		if err == errInterrupted {
+			continue
+		} else if err == io.EOF {
+			return
+		} else if err != nil {
+			panic(err.Error())
+		}
+		args, err := splitLine(line)
+		if err != nil {
+			editor.Print(err.Error())
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		editor.AddHistory(line)
+		if name := strings.ToUpper(args[0]); name == "EXIT" || name == "QUIT" {
+			return
+		}
+
+		res, err := execute(conn, replies, args)
+		if err != nil {
+			editor.Print(fmt.Sprintf("(error) %s", err.Error()))
+		} else if res != nil {
+			editor.Print(formatReply(res)...)
+		}
+	}
+}
+
+// run the cmd of the command line, exits with 1 if the reply is an error
+func runCmd(conn net.Conn, replies <-chan reply, args []string) int {
+	res, err := execute(conn, replies, args)
 	if err != nil {
-		panic(err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	for _, line := range formatReply(res) {
+		fmt.Println(line)
+	}
+	if isErrorReply(res) {
+		return 1
+	}
+	// the lines of MONITOR are printed by the reader until the connection is closed
+	if strings.ToUpper(args[0]) == "MONITOR" {
+		select {}
+	}
+	return 0
+}
+
+// send the cmds of stdin without waiting for the replies, they are counted by the errors in them.
+// Exits with 1 if any cmd fails
+func pipeCmds(conn net.Conn, replies <-chan reply) int {
+	// numbers of the cmds sent and the invalid ones, once all of them are sent
+	type result struct{ sent, invalid int }
+	done := make(chan result, 1)
+	go func() {
+		sent, invalid := 0, 0
+		in := bufio.NewReader(os.Stdin)
+		for line_num := 1; ; line_num++ {
+			line, err := in.ReadString('\n')
+			if line == "" && err != nil {
+				break
+			}
+			args, err := splitLine(line)
+			if err == nil && len(args) == 0 {
+				continue
+			}
+			if err == nil {
+				name := strings.ToUpper(args[0])
+				cmd := make([][]byte, len(args))
+				for i, arg := range args {
+					cmd[i] = []byte(arg)
+				}
+				cmd[0] = []byte(name)
+				if err = send(conn, getCmdMsgID(name), cmd); err == nil {
+					if !push_reply_cmds[name] {
+						sent++
+					}
+					continue
+				}
+			}
+			fmt.Fprintf(os.Stderr, "line %d: %s\n", line_num, err.Error())
+			invalid++
+		}
+		fmt.Println("All data transferred. Waiting for the last reply...")
+		done <- result{sent, invalid}
+	}()
+
+	fails, received, sent := 0, 0, -1
+	for sent < 0 || received < sent {
+		select {
+		case res := <-replies:
+			received++
+			if isErrorReply(res.values) {
+				fails++
+			}
+		case r := <-done:
+			sent = r.sent
+			fails += r.invalid
+		}
 	}
-	strs := strings.Split(line, " ")
-	cmd := make([][]byte, len(strs))
-	for i, str := range strs {
-		cmd[i] = []byte(str)
+	fmt.Println("Last reply received from server.")
+	fmt.Printf("errors: %d, replies: %d\n", fails, received)
+	if fails > 0 {
+		return 1
 	}
-	return cmd
+	return 0
+}
+
+func dial(addr string) (net.Conn, error) {
+	if *unix_socket != "" {
+		return net.Dial("unix", *unix_socket)
+	}
+	if !*use_tls {
+		return net.Dial("tcp", addr)
+	}
+
+	config := &tls.Config{InsecureSkipVerify: *tls_insecure}
+	if *tls_cacert != "" {
+		buf, err := ioutil.ReadFile(*tls_cacert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no cert found in %s", *tls_cacert)
+		}
+	}
+	if *tls_cert != "" || *tls_key != "" {
+		cert, err := tls.LoadX509KeyPair(*tls_cert, *tls_key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return tls.Dial("tcp", addr, config)
 }
 
 func main() {
+	flag.Parse()
+	switch {
+	case *json_output:
+		output = output_json
+	case *csv_output:
+		output = output_csv
+	case *raw_output:
+		output = output_raw
+	case !*no_raw_output && !term.IsTerminal(int(os.Stdout.Fd())):
+		output = output_raw
+	}
+
 	// 连接服务器
-	conn, err := net.Dial("tcp", "127.0.0.1:8999")
+	addr := net.JoinHostPort(*host, strconv.Itoa(*port))
+	conn, err := dial(addr)
 	if err != nil {
-		panic(err.Error())
+		fmt.Fprintf(os.Stderr, "Could not connect to Gedis at %s: %s\n", addr, err.Error())
+		os.Exit(1)
 	}
 
-	go reader(conn)
-	writer(conn)
+	editor := NewLineEditor(historyFile(), completeCmd)
+	replies := make(chan reply, 16)
+	go reader(conn, replies, editor)
+	loadCmds(conn, replies)
+	if *db_num != 0 {
+		res, err := execute(conn, replies, []string{"SELECT", strconv.Itoa(*db_num)})
+		if err == nil && isErrorReply(res) {
+			err = errors.New(strings.TrimPrefix(res[0], "(error) "))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not select db %d: %s\n", *db_num, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	switch {
+	case *pipe_mode:
+		os.Exit(pipeCmds(conn, replies))
+	case flag.NArg() > 0:
+		os.Exit(runCmd(conn, replies, flag.Args()))
+	default:
+		repl(conn, replies, editor)
+	}
 }
@@ -1,22 +1,90 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"gedis/src/Server/server"
+	"gedis/src/zinx/utils"
 	"gedis/src/zinx/ziface"
 	"gedis/src/zinx/znet"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
 )
 
+var config_file = flag.String("config", "", "path of the json config file, config/config.json if it exists by default")
+
 func main() {
+	flag.Parse()
+	// a missing default config means the defaults, the other errors stop the server
+	path := *config_file
+	if path == "" {
+		path = utils.ConfigFile
+	}
+	if err := utils.LoadConfig(path); err != nil && (*config_file != "" || !errors.Is(err, fs.ErrNotExist)) {
+		fmt.Fprintf(os.Stderr, "Could not load config: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	acl := server.NewAcl()
+	if err := acl.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load acl file: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	pubsub := server.NewPubSub()
+	if err := pubsub.SetNotifyFlags(utils.Global_obj.NotifyKeyspaceEvents); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid NotifyKeyspaceEvents: %s\n", err.Error())
+		os.Exit(1)
+	}
+	server.GetConfig().OnSet("notify-keyspace-events", func(value string) { pubsub.SetNotifyFlags(value) })
+
 	db_mgr := server.NewDbManager()
+	repl := server.NewReplication(db_mgr)
+	db_mgr.SetOnWrite(repl.Feed)
+	db_mgr.SetOnNotify(pubsub.Notify)
 	db_mgr.Start()
 	defer db_mgr.Stop()
+	defer repl.Stop()
+
+	cluster := server.NewCluster(db_mgr)
+	if err := cluster.Start(); err != nil {
+		panic(err.Error())
+	}
+	defer cluster.Stop()
 
 	gedis_server := znet.NewServer()
-	gedis_server.AddRounter(0, server.NewDbRouter())
-	gedis_server.AddRounter(1, server.NewDbSelectRouter(db_mgr))
+	gedis_server.AddRounter(0, server.NewDbRouter(acl, cluster))
+	gedis_server.AddRounter(1, server.NewDbSelectRouter(acl, db_mgr))
+	gedis_server.AddRounter(server.REPL_MSG_ID, server.NewReplRouter(acl, repl))
+	gedis_server.AddRounter(server.CLUSTER_MSG_ID, server.NewClusterRouter(acl, cluster))
+	gedis_server.AddRounter(server.ACL_MSG_ID, server.NewAclRouter(acl))
+	gedis_server.AddRounter(server.SERVER_MSG_ID, server.NewServerRouter(acl, gedis_server, db_mgr))
+	gedis_server.AddRounter(server.PUBSUB_MSG_ID, server.NewPubSubRouter(acl, pubsub, db_mgr))
 	gedis_server.SetOnConnStart(func(conn ziface.IConnection) {
 		conn.SetProperty("db", db_mgr.GetDb(0))
+		acl.OnConnStart(conn)
+	})
+	gedis_server.SetOnConnStop(func(conn ziface.IConnection) {
+		repl.RemoveReplica(conn)
+		pubsub.RemoveConn(conn)
+		server.GetMonitor().Remove(conn)
 	})
 
+	if utils.Global_obj.MetricsAddr != "" {
+		listener, err := net.Listen("tcp", utils.Global_obj.MetricsAddr)
+		if err != nil {
+			panic(err.Error())
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", server.GetMetrics().Handler(gedis_server))
+		metrics_server := &http.Server{Handler: mux}
+		go metrics_server.Serve(listener)
+		defer metrics_server.Close()
+	}
+
+	// returns after all the requests are handled and connections are closed, then the dbs are closed by defer
 	gedis_server.Serve()
 }
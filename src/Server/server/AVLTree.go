@@ -15,6 +15,14 @@ func max(a int, b int) int {
 	}
 }
 
+func min(a int, b int) int {
+	if a <= b {
+		return a
+	} else {
+		return b
+	}
+}
+
 type avlNode struct {
 	Score  float64
 	Key    string
@@ -59,10 +67,12 @@ func (this *avlNode) diffChildsHeight() int {
 type AVLTree struct {
 	root *avlNode
 	size uint32
+	// score of each key, the tree is ordered by score and can't be searched by key
+	dict map[string]float64
 }
 
 func NewAvlTree() (avl_tree *AVLTree) {
-	return &AVLTree{root: nil, size: 0}
+	return &AVLTree{root: nil, size: 0, dict: make(map[string]float64)}
 }
 
 func (this *AVLTree) l_rotate(node *avlNode) *avlNode {
@@ -96,8 +106,9 @@ func (this *AVLTree) r_rotate(node *avlNode) *avlNode {
 }
 
 func (this *AVLTree) Add(score float64, key string) {
+	defer func() { this.dict[key] = score }()
 	if this.root == nil {
-		this.root = &avlNode{Score: score, Key: key}
+		this.root = NewAvlNode(score, key)
 		return
 	}
 
@@ -178,7 +189,14 @@ func (this *AVLTree) Remove(key string) (err error) {
 	if this.root == nil {
 		return fmt.Errorf("tree is empty")
 	}
-	this.root, err = this.remove(key, this.root)
+	score, ok := this.dict[key]
+	if !ok {
+		return fmt.Errorf("key %s is not found", key)
+	}
+	this.root, err = this.remove(key, score, this.root)
+	if err == nil {
+		delete(this.dict, key)
+	}
 
 	// assert remove successfully
 	// if score, err := this.getScore(key, this.root); err == nil {
@@ -198,7 +216,9 @@ func (this *AVLTree) getAndDelMin(curroot *avlNode) (newroot *avlNode, minroot *
 	return this.balance(curroot), minroot
 }
 
-func (this *AVLTree) remove(key string, curroot *avlNode) (newroot *avlNode, err error) {
+// the scores of the left subtree are <= the score of curroot, and the right ones are >=,
+// so only the subtrees that may have the score are searched
+func (this *AVLTree) remove(key string, score float64, curroot *avlNode) (newroot *avlNode, err error) {
 	if curroot == nil {
 		return nil, fmt.Errorf("key %s is not found", key)
 	}
@@ -219,12 +239,16 @@ func (this *AVLTree) remove(key string, curroot *avlNode) (newroot *avlNode, err
 		}
 	}
 
-	if curroot.Left, err = this.remove(key, curroot.Left); err == nil {
-		return this.balance(curroot), nil
+	if score <= curroot.Score {
+		if curroot.Left, err = this.remove(key, score, curroot.Left); err == nil {
+			return this.balance(curroot), nil
+		}
 	}
 
-	if curroot.Right, err = this.remove(key, curroot.Right); err == nil {
-		return this.balance(curroot), nil
+	if score >= curroot.Score {
+		if curroot.Right, err = this.remove(key, score, curroot.Right); err == nil {
+			return this.balance(curroot), nil
+		}
 	}
 
 	return curroot, fmt.Errorf("key %s is not found", key)
@@ -239,36 +263,25 @@ func (this *AVLTree) GetSize() uint32 {
 }
 
 func (this *AVLTree) GetScore(key string) (score float64, err error) {
-	return this.getScore(key, this.root)
-}
-
-func (this *AVLTree) getScore(key string, curroot *avlNode) (score float64, err error) {
-	if curroot == nil {
+	score, ok := this.dict[key]
+	if !ok {
 		return -1, fmt.Errorf("%s is not found", key)
 	}
-
-	if strings.Compare(key, curroot.Key) == 0 {
-		return curroot.Score, nil
-	}
-
-	if score, err = this.getScore(key, curroot.Left); err == nil {
-		return score, err
-	}
-	if score, err = this.getScore(key, curroot.Right); err == nil {
-		return score, err
-	}
-
-	return -1, fmt.Errorf("%s is not found", key)
+	return score, nil
 }
 
 func (this *AVLTree) GetRank(key string) (rank uint32, err error) {
 	if this.root == nil {
 		return 0, fmt.Errorf("tree is empty")
 	}
-	return this.getRank(key, this.root)
+	score, ok := this.dict[key]
+	if !ok {
+		return math.MaxUint32, fmt.Errorf("%s is not found", key)
+	}
+	return this.getRank(key, score, this.root)
 }
 
-func (this *AVLTree) getRank(key string, curroot *avlNode) (rank uint32, err error) {
+func (this *AVLTree) getRank(key string, score float64, curroot *avlNode) (rank uint32, err error) {
 	if curroot == nil {
 		return math.MaxUint32, fmt.Errorf("%s is not found", key)
 	}
@@ -282,11 +295,15 @@ func (this *AVLTree) getRank(key string, curroot *avlNode) (rank uint32, err err
 		return currank, nil
 	}
 
-	if rank, err = this.getRank(key, curroot.Left); err == nil {
-		return rank, err
+	if score <= curroot.Score {
+		if rank, err = this.getRank(key, score, curroot.Left); err == nil {
+			return rank, err
+		}
 	}
-	if rank, err = this.getRank(key, curroot.Right); err == nil {
-		return rank + (currank + 1), err
+	if score >= curroot.Score {
+		if rank, err = this.getRank(key, score, curroot.Right); err == nil {
+			return rank + (currank + 1), err
+		}
 	}
 
 	return math.MaxUint32, fmt.Errorf("%s is not found", key)
@@ -322,33 +339,58 @@ func (this *AVLTree) getRangeByRank(start, end int, curroot *avlNode) (entries [
 }
 
 func (this *AVLTree) GetRangeByScore(start, end float64) (entries []siface.SetEntry) {
-	return this.getRangeByScore(start, end, this.root)
-}
-
-func (this *AVLTree) getRangeByScore(start, end float64, curroot *avlNode) (entries []siface.SetEntry) {
-	if curroot == nil {
-		return []siface.SetEntry{}
-	}
+	entries = make([]siface.SetEntry, 0)
 	if start > end {
-		return []siface.SetEntry{}
+		return
 	}
+	this.getRangeByScore(start, end, this.root, &entries)
+	return
+}
 
+// in-order traversal of the nodes in [start, end], O(logn + k)
+func (this *AVLTree) getRangeByScore(start, end float64, curroot *avlNode, entries *[]siface.SetEntry) {
 	// important bug fix:
 	// rank is relative to the left most node. When searching the right subtree, left subtree and curnode is ignored,
 	// so the rank of the right subtree is relative to the left most node (currank + 1 before, now it is 0 rank) of the right subtree, not the whole tree,
 	// thus we need to subtract the rank of current node when searching the right subtree, pass [start- (currank + 1), end - (currank + 1)]
 	// BUT
 	// while score is fixed in each node, don't need to subtract any value when searching subtrees, just pass [start, end]
+	if curroot == nil {
+		return
+	}
 
 	curscore := curroot.Score
+	if start <= curscore {
+		this.getRangeByScore(start, end, curroot.Left, entries)
+	}
 	if start <= curscore && end >= curscore {
-		entries = this.getRangeByScore(start, curscore, curroot.Left)
-		entries = append(entries, siface.SetEntry{Key: curroot.Key, Score: curroot.Score})
-		entries = append(entries, this.getRangeByScore(curscore, end, curroot.Right)...)
-	} else if end < curscore {
-		entries = this.getRangeByScore(start, end, curroot.Left)
-	} else if start > curscore {
-		entries = this.getRangeByScore(start, end, curroot.Right)
+		*entries = append(*entries, siface.SetEntry{Key: curroot.Key, Score: curroot.Score})
+	}
+	if end >= curscore {
+		this.getRangeByScore(start, end, curroot.Right, entries)
+	}
+}
+
+// number of the entries in [start, end], O(logn)
+func (this *AVLTree) GetCountByScore(start, end float64) uint32 {
+	if start > end {
+		return 0
+	}
+	return this.countLess(end, true) - this.countLess(start, false)
+}
+
+// number of the entries with score < score, or <= score if inclusive
+func (this *AVLTree) countLess(score float64, inclusive bool) (count uint32) {
+	for curroot := this.root; curroot != nil; {
+		if curroot.Score < score || (inclusive && curroot.Score == score) {
+			count++
+			if curroot.Left != nil {
+				count += curroot.Left.Size
+			}
+			curroot = curroot.Right
+		} else {
+			curroot = curroot.Left
+		}
 	}
 	return
 }
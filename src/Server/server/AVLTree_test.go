@@ -437,3 +437,53 @@ func TestAvl9(t *testing.T) {
 		}
 	}
 }
+
+// test rank, count and remove with duplicated scores
+func TestAvl10(t *testing.T) {
+	tree := server.NewAvlTree()
+
+	num := 1000
+	perm := rand.Perm(num)
+	for i := 0; i < num; i++ {
+		// 10 keys per score
+		tree.Add(float64(perm[i]/10), "key"+fmt.Sprint(perm[i]))
+	}
+	// count by score
+	if tree.GetCountByScore(10, 19) != 100 {
+		t.Error("TestAvl10 failed")
+	}
+	if tree.GetCountByScore(10.5, 11) != 10 {
+		t.Error("TestAvl10 failed")
+	}
+	if tree.GetCountByScore(-1, 1000) != uint32(num) || tree.GetCountByScore(2, 1) != 0 {
+		t.Error("TestAvl10 failed")
+	}
+	// rank is consistent with the range by rank
+	entries := tree.GetRangeByRank(0, uint32(num-1))
+	for i, entry := range entries {
+		rank, err := tree.GetRank(entry.Key)
+		if err != nil || rank != uint32(i) {
+			t.Error("TestAvl10 failed")
+		}
+	}
+	// remove the keys of the same score one by one
+	for i := 0; i < num; i += 2 {
+		if err := tree.Remove("key" + fmt.Sprint(i)); err != nil {
+			t.Error("TestAvl10 failed")
+		}
+	}
+	if err := tree.Remove("key0"); err == nil {
+		t.Error("TestAvl10 failed")
+	}
+	if tree.GetSize() != uint32(num/2) || tree.GetCountByScore(0, 9) != 50 {
+		t.Error("TestAvl10 failed")
+	}
+	// re-adding with a new score moves the key
+	tree.Add(-1, "key1")
+	if rank, _ := tree.GetRank("key1"); rank != 0 {
+		t.Error("TestAvl10 failed")
+	}
+	if tree.GetCountByScore(-1, -1) != 1 || tree.GetSize() != uint32(num/2) {
+		t.Error("TestAvl10 failed")
+	}
+}
@@ -0,0 +1,446 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/ziface"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// auth, acl cmds are sent with this msg id
+const ACL_MSG_ID = 4
+
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords map[string]bool // sha256 of passwords in hex
+	cmds      map[string]bool // cmds allowed to run
+	cmd_rules []string        // +@category, -cmd... in order, the cmds are built from them
+	patterns  []string        // keys allowed to access
+}
+
+// a new user is off, has no password, no cmds and no keys
+func newAclUser(name string) *aclUser {
+	return &aclUser{
+		name:      name,
+		enabled:   false,
+		nopass:    false,
+		passwords: make(map[string]bool),
+		cmds:      make(map[string]bool),
+		cmd_rules: make([]string, 0),
+		patterns:  make([]string, 0),
+	}
+}
+
+func (this *aclUser) copy() *aclUser {
+	user := newAclUser(this.name)
+	user.enabled = this.enabled
+	user.nopass = this.nopass
+	for k := range this.passwords {
+		user.passwords[k] = true
+	}
+	for k := range this.cmds {
+		user.cmds[k] = true
+	}
+	user.cmd_rules = append(user.cmd_rules, this.cmd_rules...)
+	user.patterns = append(user.patterns, this.patterns...)
+	return user
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// apply a rule of ACL SETUSER, the rules are the same as redis
+func (this *aclUser) applyRule(rule string) error {
+	switch lower := strings.ToLower(rule); {
+	case lower == "on":
+		this.enabled = true
+	case lower == "off":
+		this.enabled = false
+	case lower == "nopass":
+		this.nopass = true
+		this.passwords = make(map[string]bool)
+	case lower == "resetpass":
+		this.nopass = false
+		this.passwords = make(map[string]bool)
+	case lower == "allkeys":
+		this.patterns = []string{"*"}
+	case lower == "resetkeys":
+		this.patterns = make([]string, 0)
+	case lower == "allcommands":
+		return this.applyRule("+@all")
+	case lower == "nocommands":
+		return this.applyRule("-@all")
+	case lower == "reset":
+		for _, r := range []string{"off", "resetpass", "resetkeys", "nocommands"} {
+			this.applyRule(r)
+		}
+	case strings.HasPrefix(rule, ">"):
+		this.passwords[hashPassword(rule[1:])] = true
+		this.nopass = false
+	case strings.HasPrefix(rule, "<"):
+		delete(this.passwords, hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "#"):
+		hash := strings.ToLower(rule[1:])
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		this.passwords[hash] = true
+		this.nopass = false
+	case strings.HasPrefix(rule, "!"):
+		delete(this.passwords, strings.ToLower(rule[1:]))
+	case strings.HasPrefix(rule, "~"):
+		if _, err := filepath.Match(rule[1:], ""); err != nil {
+			return errors.New("Syntax error")
+		}
+		this.patterns = append(this.patterns, rule[1:])
+	case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+		return this.applyCmdRule(rule)
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+func (this *aclUser) applyCmdRule(rule string) error {
+	allow := rule[0] == '+'
+	cmds := make([]string, 0)
+	if strings.HasPrefix(rule[1:], "@") {
+		category := strings.ToLower(rule[2:])
+		cmds = GetCategoryCmds(category)
+		if category != "all" && len(cmds) == 0 {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		// +@all or -@all overrides all the rules before
+		if category == "all" {
+			this.cmd_rules = make([]string, 0)
+			this.cmds = make(map[string]bool)
+		}
+		rule = rule[:1] + "@" + category
+	} else {
+		name := strings.ToUpper(rule[1:])
+		if !IsCmdExist(name) {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		cmds = append(cmds, name)
+		rule = rule[:1] + strings.ToLower(name)
+	}
+
+	for _, cmd := range cmds {
+		if allow {
+			this.cmds[cmd] = true
+		} else {
+			delete(this.cmds, cmd)
+		}
+	}
+	// -@all of a new user is the same as no rules
+	if rule != "-@all" || len(this.cmd_rules) != 0 {
+		this.cmd_rules = append(this.cmd_rules, rule)
+	}
+	return nil
+}
+
+// rules to rebuild the user, as ACL LIST and the acl file show it
+func (this *aclUser) describe() string {
+	rules := []string{"user", this.name}
+	if this.enabled {
+		rules = append(rules, "on")
+	} else {
+		rules = append(rules, "off")
+	}
+	if this.nopass {
+		rules = append(rules, "nopass")
+	}
+	hashes := make([]string, 0, len(this.passwords))
+	for hash := range this.passwords {
+		hashes = append(hashes, "#"+hash)
+	}
+	sort.Strings(hashes)
+	rules = append(rules, hashes...)
+	if len(this.patterns) == 0 {
+		rules = append(rules, "resetkeys")
+	}
+	for _, pattern := range this.patterns {
+		rules = append(rules, "~"+pattern)
+	}
+	if len(this.cmd_rules) == 0 {
+		rules = append(rules, "-@all")
+	}
+	rules = append(rules, this.cmd_rules...)
+	return strings.Join(rules, " ")
+}
+
+func (this *aclUser) canAccessKey(key string) bool {
+	for _, pattern := range this.patterns {
+		if ismatch, _ := filepath.Match(pattern, key); ismatch {
+			return true
+		}
+	}
+	return false
+}
+
+// Acl keeps the users, the user a connection authenticated as is the property "user" of the connection
+type Acl struct {
+	users map[string]*aclUser
+	file  string
+	lock  sync.RWMutex
+}
+
+// the default user is on with all the permissions, it needs requirepass as its password if set
+func NewAcl() *Acl {
+	acl := &Acl{
+		users: make(map[string]*aclUser),
+		file:  utils.Global_obj.AclFile,
+		lock:  sync.RWMutex{},
+	}
+	acl.users["default"] = acl.defaultUser()
+	return acl
+}
+
+func (this *Acl) defaultUser() *aclUser {
+	user := newAclUser("default")
+	rules := []string{"on", "nopass", "allkeys", "allcommands"}
+	if utils.Global_obj.RequirePass != "" {
+		rules[1] = ">" + utils.Global_obj.RequirePass
+	}
+	for _, rule := range rules {
+		user.applyRule(rule)
+	}
+	return user
+}
+
+// called when a connection starts, it is authenticated as default if the default user needs no password
+func (this *Acl) OnConnStart(conn ziface.IConnection) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if user := this.users["default"]; user.enabled && user.nopass {
+		conn.SetProperty("user", "default")
+	}
+}
+
+func (this *Acl) Auth(conn ziface.IConnection, name string, password string) error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	user, ok := this.users[name]
+	if !ok || !user.enabled || !(user.nopass || user.passwords[hashPassword(password)]) {
+		return errors.New("(error) WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	conn.SetProperty("user", name)
+	return nil
+}
+
+func (this *Acl) WhoAmI(conn ziface.IConnection) string {
+	name, err := conn.GetProperty("user")
+	if err != nil {
+		return ""
+	}
+	return name.(string)
+}
+
+// check whether the user of conn can run cmd, the error to reply if not
+func (this *Acl) Check(conn ziface.IConnection, cmd []string) string {
+	if len(cmd) == 0 || cmd[0] == "AUTH" {
+		return ""
+	}
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	name, err := conn.GetProperty("user")
+	if err != nil {
+		return "(error) NOAUTH Authentication required."
+	}
+	user, ok := this.users[name.(string)]
+	if !ok || !user.enabled {
+		return "(error) NOAUTH Authentication required."
+	}
+	// unknown cmds are left to the handlers to reply
+	if !IsCmdExist(cmd[0]) {
+		return ""
+	}
+	if !user.cmds[cmd[0]] {
+		return fmt.Sprintf("(error) NOPERM User %s has no permissions to run the '%s' command", user.name, strings.ToLower(cmd[0]))
+	}
+	for _, key := range GetCmdKeys(cmd) {
+		if !user.canAccessKey(key) {
+			return "(error) NOPERM No permissions to access a key"
+		}
+	}
+	return ""
+}
+
+// create the user if not exists and apply the rules, the user is not changed if any rule is invalid
+func (this *Acl) SetUser(name string, rules []string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	user, ok := this.users[name]
+	if ok {
+		user = user.copy()
+	} else {
+		user = newAclUser(name)
+	}
+	for _, rule := range rules {
+		if err := user.applyRule(rule); err != nil {
+			return fmt.Errorf("(error) ERR Error in ACL SETUSER modifier '%s': %s", rule, err.Error())
+		}
+	}
+	this.users[name] = user
+	return this.save()
+}
+
+func (this *Acl) GetUser(name string) (res []string, err error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	user, ok := this.users[name]
+	if !ok {
+		return nil, errors.New("(nil)")
+	}
+	flags := []string{"off"}
+	if user.enabled {
+		flags[0] = "on"
+	}
+	if user.nopass {
+		flags = append(flags, "nopass")
+	}
+	hashes := make([]string, 0, len(user.passwords))
+	for hash := range user.passwords {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	cmds := "-@all"
+	if len(user.cmd_rules) > 0 {
+		cmds = strings.Join(user.cmd_rules, " ")
+	}
+	keys := make([]string, 0, len(user.patterns))
+	for _, pattern := range user.patterns {
+		keys = append(keys, "~"+pattern)
+	}
+
+	res = []string{
+		"flags: " + strings.Join(flags, " "),
+		"passwords: " + strings.Join(hashes, " "),
+		"commands: " + cmds,
+		"keys: " + strings.Join(keys, " "),
+	}
+	return
+}
+
+// delete users except the default one, return how many users are deleted
+func (this *Acl) DelUser(names []string) (num int, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, name := range names {
+		if name == "default" {
+			return 0, errors.New("(error) ERR The 'default' user cannot be removed")
+		}
+	}
+	for _, name := range names {
+		if _, ok := this.users[name]; ok {
+			delete(this.users, name)
+			num++
+		}
+	}
+	if num > 0 {
+		err = this.save()
+	}
+	return
+}
+
+func (this *Acl) List() (res []string) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	res = make([]string, 0, len(this.users))
+	for _, user := range this.users {
+		res = append(res, user.describe())
+	}
+	sort.Strings(res)
+	return
+}
+
+func (this *Acl) Save() error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.save()
+}
+
+// lock should be held. write into a temp file and rename, the acl file is never half written
+func (this *Acl) save() error {
+	tmp_fd, err := ioutil.TempFile(filepath.Dir(this.file), "tmpacl")
+	if err != nil {
+		return fmt.Errorf("(error) ERR fail to save acl file, %s", err.Error())
+	}
+	writer := bufio.NewWriter(tmp_fd)
+	names := make([]string, 0, len(this.users))
+	for name := range this.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writer.WriteString(this.users[name].describe() + "\n")
+	}
+	writer.Flush()
+	tmp_fd.Close()
+
+	if err = os.Rename(tmp_fd.Name(), this.file); err != nil {
+		os.Remove(tmp_fd.Name())
+		return fmt.Errorf("(error) ERR fail to save acl file, %s", err.Error())
+	}
+	return nil
+}
+
+// replace all the users by the acl file, nothing changes if the file has any error. a missing file is not an error
+func (this *Acl) Load() error {
+	fd, err := os.Open(this.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("(error) ERR fail to load acl file, %s", err.Error())
+	}
+	defer fd.Close()
+
+	users := make(map[string]*aclUser)
+	scanner := bufio.NewScanner(fd)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || fields[0] != "user" {
+			return fmt.Errorf("(error) ERR %s:%d should start with user keyword", this.file, lineno)
+		}
+		user := newAclUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := user.applyRule(rule); err != nil {
+				return fmt.Errorf("(error) ERR %s:%d: %s", this.file, lineno, err.Error())
+			}
+		}
+		users[user.name] = user
+	}
+	if _, ok := users["default"]; !ok {
+		users["default"] = this.defaultUser()
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.users = users
+	return nil
+}
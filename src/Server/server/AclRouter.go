@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"gedis/src/Server/siface"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"sort"
+	"strings"
+	"time"
+)
+
+type AclRouter struct {
+	znet.BaseRounter
+	acl        *Acl
+	cmd_packer siface.ICmdPack
+}
+
+func NewAclRouter(acl *Acl) *AclRouter {
+	return &AclRouter{
+		acl:        acl,
+		cmd_packer: NewCmdPack(),
+	}
+}
+
+func (this *AclRouter) Handle(req ziface.IRequest) {
+	start := time.Now()
+	conn := req.GetConn()
+	buf := req.GetData()
+
+	cmd_arg := this.cmd_packer.UnpackCmd(buf)
+	args := make([]string, 0, len(cmd_arg))
+	for _, v := range cmd_arg {
+		args = append(args, string(v))
+	}
+
+	onCmd(conn, args)
+	if len(args) == 0 {
+		this.reply(conn, "", start, []string{"(error) ERR empty command"})
+		return
+	}
+	if err := this.acl.Check(conn, args); err != "" {
+		this.reply(conn, args[0], start, []string{err})
+		return
+	}
+
+	var res []string
+	switch args[0] {
+	case "AUTH":
+		res = this.auth(conn, args[1:])
+	case "ACL":
+		if len(args) < 2 {
+			res = []string{"(error) ERR wrong number of arguments for 'acl' command"}
+			break
+		}
+		res = this.acl_cmd(conn, strings.ToUpper(args[1]), args[2:])
+	default:
+		res = []string{"Unspported command"}
+	}
+	this.reply(conn, args[0], start, res)
+}
+
+func (this *AclRouter) reply(conn ziface.IConnection, cmd string, start time.Time, res []string) {
+	resp := make([][]byte, 0, len(res))
+	for _, r := range res {
+		resp = append(resp, []byte(r))
+	}
+	if cmd != "" {
+		metrics.ObserveCmd(cmd, time.Since(start), resp)
+	}
+	conn.SendMsg(0, this.cmd_packer.PackCmd(resp))
+}
+
+// AUTH [username] password
+func (this *AclRouter) auth(conn ziface.IConnection, args []string) []string {
+	var err error
+	switch len(args) {
+	case 1:
+		err = this.acl.Auth(conn, "default", args[0])
+	case 2:
+		err = this.acl.Auth(conn, args[0], args[1])
+	default:
+		return []string{"(error) ERR wrong number of arguments for 'auth' command"}
+	}
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return []string{"OK"}
+}
+
+func (this *AclRouter) acl_cmd(conn ziface.IConnection, subcmd string, args []string) []string {
+	switch subcmd {
+	case "SETUSER":
+		if len(args) < 1 {
+			return []string{"(error) ERR wrong number of arguments for 'acl|setuser' command"}
+		}
+		if err := this.acl.SetUser(args[0], args[1:]); err != nil {
+			return []string{err.Error()}
+		}
+		return []string{"OK"}
+	case "GETUSER":
+		if len(args) != 1 {
+			return []string{"(error) ERR wrong number of arguments for 'acl|getuser' command"}
+		}
+		res, err := this.acl.GetUser(args[0])
+		if err != nil {
+			return []string{err.Error()}
+		}
+		return res
+	case "DELUSER":
+		if len(args) < 1 {
+			return []string{"(error) ERR wrong number of arguments for 'acl|deluser' command"}
+		}
+		num, err := this.acl.DelUser(args)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		return []string{fmt.Sprintf("(integer) %d", num)}
+	case "LIST":
+		return this.acl.List()
+	case "WHOAMI":
+		return []string{this.acl.WhoAmI(conn)}
+	case "CAT":
+		var res []string
+		if len(args) == 0 {
+			res = GetCategories()
+		} else {
+			res = GetCategoryCmds(strings.ToLower(args[0]))
+			for i := range res {
+				res[i] = strings.ToLower(res[i])
+			}
+		}
+		if len(res) == 0 {
+			return []string{"(empty array)"}
+		}
+		sort.Strings(res)
+		return res
+	case "SAVE":
+		if err := this.acl.Save(); err != nil {
+			return []string{err.Error()}
+		}
+		return []string{"OK"}
+	case "LOAD":
+		if err := this.acl.Load(); err != nil {
+			return []string{err.Error()}
+		}
+		return []string{"OK"}
+	default:
+		return []string{fmt.Sprintf("(error) ERR unknown subcommand '%s'", subcmd)}
+	}
+}
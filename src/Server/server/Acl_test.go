@@ -0,0 +1,193 @@
+package server_test
+
+import (
+	"errors"
+	"gedis/src/Server/server"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/ziface"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connection only keeps properties, enough for acl
+type fakeConn struct {
+	properties map[string]interface{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{properties: make(map[string]interface{})}
+}
+
+func (this *fakeConn) Start()                                   {}
+func (this *fakeConn) Stop()                                    {}
+func (this *fakeConn) StopPassive()                             {}
+func (this *fakeConn) GetConnID() uint32                        { return 0 }
+func (this *fakeConn) RemoteAddr() net.Addr                     { return nil }
+func (this *fakeConn) SendMsg(id uint32, data []byte) error     { return nil }
+func (this *fakeConn) TrySendMsg(id uint32, data []byte) error  { return nil }
+func (this *fakeConn) SendMsgWait(id uint32, data []byte) error { return nil }
+func (this *fakeConn) GetRouterManager() ziface.IRouterManager  { return nil }
+func (this *fakeConn) GetStartTime() time.Time                  { return time.Time{} }
+func (this *fakeConn) GetLastActive() time.Time                 { return time.Time{} }
+func (this *fakeConn) GetPending() int                          { return 0 }
+func (this *fakeConn) SetProperty(key string, value interface{}) {
+	this.properties[key] = value
+}
+func (this *fakeConn) GetProperty(key string) (interface{}, error) {
+	value, ok := this.properties[key]
+	if !ok {
+		return nil, errors.New("property not found")
+	}
+	return value, nil
+}
+func (this *fakeConn) RemoveProperty(key string) {
+	delete(this.properties, key)
+}
+
+func newTestAcl(t *testing.T, requirepass string) *server.Acl {
+	utils.Global_obj.AclFile = filepath.Join(t.TempDir(), "users.acl")
+	utils.Global_obj.RequirePass = requirepass
+	t.Cleanup(func() { utils.Global_obj.RequirePass = "" })
+	return server.NewAcl()
+}
+
+// without requirepass, connections are authenticated as default with all permissions
+func TestAclDefault(t *testing.T) {
+	acl := newTestAcl(t, "")
+	conn := newFakeConn()
+	acl.OnConnStart(conn)
+
+	if acl.WhoAmI(conn) != "default" {
+		t.Error("TestAclDefault failed")
+	}
+	if err := acl.Check(conn, []string{"FLUSHDB"}); err != "" {
+		t.Error("TestAclDefault failed", err)
+	}
+}
+
+// requirepass needs AUTH before any other cmd
+func TestAclRequirePass(t *testing.T) {
+	acl := newTestAcl(t, "secret")
+	conn := newFakeConn()
+	acl.OnConnStart(conn)
+
+	if err := acl.Check(conn, []string{"GET", "key"}); !strings.Contains(err, "NOAUTH") {
+		t.Error("TestAclRequirePass failed", err)
+	}
+	if err := acl.Check(conn, []string{"AUTH", "secret"}); err != "" {
+		t.Error("TestAclRequirePass failed", err)
+	}
+	if err := acl.Auth(conn, "default", "wrong"); err == nil {
+		t.Error("TestAclRequirePass failed")
+	}
+	if err := acl.Auth(conn, "default", "secret"); err != nil {
+		t.Error("TestAclRequirePass failed", err)
+	}
+	if err := acl.Check(conn, []string{"GET", "key"}); err != "" {
+		t.Error("TestAclRequirePass failed", err)
+	}
+}
+
+// cmds are allowed by categories and cmd rules, keys by patterns
+func TestAclPermissions(t *testing.T) {
+	acl := newTestAcl(t, "")
+	err := acl.SetUser("alice", []string{"on", ">pass", "~cache:*", "+@read", "+@string", "-mset"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newFakeConn()
+	if err := acl.Auth(conn, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		cmd     []string
+		allowed bool
+	}{
+		{[]string{"GET", "cache:1"}, true},
+		{[]string{"SET", "cache:1", "v"}, true},
+		{[]string{"LRANGE", "cache:list", "0", "-1"}, true},
+		{[]string{"GET", "user:1"}, false},
+		{[]string{"MSET", "cache:1", "v"}, false},
+		{[]string{"LPUSH", "cache:list", "v"}, false},
+		{[]string{"FLUSHDB"}, false},
+		{[]string{"ACL", "LIST"}, false},
+	}
+	for _, c := range cases {
+		err := acl.Check(conn, c.cmd)
+		if (err == "") != c.allowed {
+			t.Errorf("TestAclPermissions failed, cmd %v, err %s", c.cmd, err)
+		}
+	}
+
+	// the change of the user works at once
+	acl.SetUser("alice", []string{"off"})
+	if err := acl.Check(conn, []string{"GET", "cache:1"}); err == "" {
+		t.Error("TestAclPermissions failed")
+	}
+	if err := acl.Auth(newFakeConn(), "alice", "pass"); err == nil {
+		t.Error("TestAclPermissions failed")
+	}
+}
+
+// invalid rules don't change the user
+func TestAclInvalidRule(t *testing.T) {
+	acl := newTestAcl(t, "")
+	if err := acl.SetUser("bob", []string{"on", "nopass", "+@nosuchcategory"}); err == nil {
+		t.Error("TestAclInvalidRule failed")
+	}
+	if _, err := acl.GetUser("bob"); err == nil {
+		t.Error("TestAclInvalidRule failed")
+	}
+	if err := acl.SetUser("bob", []string{"on", "+nosuchcmd"}); err == nil {
+		t.Error("TestAclInvalidRule failed")
+	}
+	if _, err := acl.DelUser([]string{"default"}); err == nil {
+		t.Error("TestAclInvalidRule failed")
+	}
+}
+
+// users are saved into the acl file and loaded back
+func TestAclSaveLoad(t *testing.T) {
+	acl := newTestAcl(t, "")
+	acl.SetUser("alice", []string{"on", ">pass", "~a*", "~b*", "+@all", "-flushdb"})
+	acl.SetUser("bob", []string{"on", "nopass", "+get"})
+	acl.SetUser("carol", []string{"on", "nopass"})
+	acl.DelUser([]string{"carol"})
+	list := acl.List()
+
+	loaded := server.NewAcl()
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	loaded_list := loaded.List()
+	if strings.Join(list, "\n") != strings.Join(loaded_list, "\n") || len(list) != 3 {
+		t.Errorf("TestAclSaveLoad failed\n%v\n%v", list, loaded_list)
+	}
+
+	conn := newFakeConn()
+	if err := loaded.Auth(conn, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Check(conn, []string{"FLUSHDB"}); err == "" {
+		t.Error("TestAclSaveLoad failed")
+	}
+	if err := loaded.Check(conn, []string{"SET", "bkey", "v"}); err != "" {
+		t.Error("TestAclSaveLoad failed", err)
+	}
+}
+
+// an empty cmd frame gets an error instead of panicking the worker
+func TestAclEmptyCmd(t *testing.T) {
+	acl := newTestAcl(t, "")
+	router := server.NewAclRouter(acl)
+	conn := newMsgConn(1)
+	acl.OnConnStart(conn)
+	router.Handle(newEmptyRequest(conn))
+	if res := conn.next(); len(res) != 1 || res[0] != "(error) ERR empty command" {
+		t.Error("TestAclEmptyCmd failed", res)
+	}
+}
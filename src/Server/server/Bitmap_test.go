@@ -0,0 +1,232 @@
+package server_test
+
+import (
+	"gedis/src/Server/server"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// SETBIT/GETBIT with growth
+func TestBitmap1(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	if res := handle(engine, "SETBIT b 7 1"); res[0] != "(integer) 0" {
+		t.Error("TestBitmap1 failed")
+	}
+	if res := handle(engine, "SETBIT b 7 0"); res[0] != "(integer) 1" {
+		t.Error("TestBitmap1 failed")
+	}
+	handle(engine, "SETBIT b 100 1")
+	if res := handle(engine, "GET b"); len(res[0]) != 13 || res[0][12] != 0x08 {
+		t.Error("TestBitmap1 failed")
+	}
+	if res := handle(engine, "GETBIT b 100"); res[0] != "(integer) 1" {
+		t.Error("TestBitmap1 failed")
+	}
+	if res := handle(engine, "GETBIT b 100000"); res[0] != "(integer) 0" {
+		t.Error("TestBitmap1 failed")
+	}
+	if res := handle(engine, "SETBIT b 4294967296 1"); !strings.HasPrefix(res[0], "(error)") {
+		t.Error("TestBitmap1 failed")
+	}
+	if res := handle(engine, "SETBIT b 1 2"); !strings.HasPrefix(res[0], "(error)") {
+		t.Error("TestBitmap1 failed")
+	}
+	handle(engine, "LPUSH l a")
+	if res := handle(engine, "SETBIT l 1 1"); !strings.HasPrefix(res[0], "(error) WRONGTYPE") {
+		t.Error("TestBitmap1 failed")
+	}
+}
+
+// BITCOUNT and BITPOS with ranges
+func TestBitmap2(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	// "\xff\xf0\x00"
+	engine.Handle([]string{"SET", "b", "\xff\xf0\x00"})
+	cases := map[string]string{
+		"BITCOUNT b":          "(integer) 12",
+		"BITCOUNT b 1 1":      "(integer) 4",
+		"BITCOUNT b -2 -1":    "(integer) 4",
+		"BITCOUNT b 5 30 BIT": "(integer) 7",
+		"BITCOUNT b 2 1":      "(integer) 0",
+		"BITCOUNT nokey":      "(integer) 0",
+		"BITPOS b 0":          "(integer) 12",
+		"BITPOS b 1 1":        "(integer) 8",
+		"BITPOS b 1 2":        "(integer) -1",
+		"BITPOS b 0 3 6 BIT":  "(integer) -1",
+		"BITPOS b 0 3 13 BIT": "(integer) 12",
+		"BITPOS nokey 0":      "(integer) 0",
+		"BITPOS nokey 1":      "(integer) -1",
+		"BITCOUNT b 1":        "(error) ERR syntax error",
+		"BITCOUNT b 0 1 WORD": "(error) ERR syntax error",
+		"BITPOS b 2":          "(error) ERR The bit argument must be 1 or 0.",
+	}
+	for cmdline, expected := range cases {
+		if res := handle(engine, cmdline); res[0] != expected {
+			t.Error("TestBitmap2 failed")
+		}
+	}
+
+	// all bits set without an end: the first clear bit is after the string
+	engine.Handle([]string{"SET", "ones", "\xff"})
+	if res := handle(engine, "BITPOS ones 0"); res[0] != "(integer) 8" {
+		t.Error("TestBitmap2 failed")
+	}
+	if res := handle(engine, "BITPOS ones 0 0 0"); res[0] != "(integer) -1" {
+		t.Error("TestBitmap2 failed")
+	}
+}
+
+// BITOP
+func TestBitmap3(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	engine.Handle([]string{"SET", "a", "\x0f\xff"})
+	engine.Handle([]string{"SET", "b", "\xf0"})
+	cases := [][]string{
+		{"AND", "\x00\x00"},
+		{"OR", "\xff\xff"},
+		{"XOR", "\xff\xff"},
+	}
+	for _, c := range cases {
+		if res := handle(engine, "BITOP "+c[0]+" dest a b nokey"); res[0] != "(integer) 2" {
+			t.Error("TestBitmap3 failed")
+		}
+		if c[0] == "AND" {
+			// nokey is all zero bytes
+			c[1] = "\x00\x00"
+		}
+		if res := handle(engine, "GET dest"); res[0] != c[1] {
+			t.Error("TestBitmap3 failed")
+		}
+	}
+	handle(engine, "BITOP NOT dest b")
+	if res := handle(engine, "GET dest"); res[0] != "\x0f" {
+		t.Error("TestBitmap3 failed")
+	}
+	if res := handle(engine, "BITOP NOT dest a b"); !strings.HasPrefix(res[0], "(error)") {
+		t.Error("TestBitmap3 failed")
+	}
+	// empty result deletes the destination
+	if res := handle(engine, "BITOP OR dest nokey"); res[0] != "(integer) 0" {
+		t.Error("TestBitmap3 failed")
+	}
+	if res := handle(engine, "GET dest"); res[0] != "(nil)" {
+		t.Error("TestBitmap3 failed")
+	}
+}
+
+// BITFIELD with overflows
+func TestBitmap4(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	cases := []struct {
+		cmdline  string
+		expected []string
+	}{
+		{"BITFIELD f SET u8 0 255 GET u8 0 GET i8 0", []string{"(integer) 0", "(integer) 255", "(integer) -1"}},
+		{"BITFIELD f INCRBY u8 0 1", []string{"(integer) 0"}},
+		{"BITFIELD f OVERFLOW SAT INCRBY u8 0 -1", []string{"(integer) 0"}},
+		{"BITFIELD f OVERFLOW FAIL INCRBY u8 0 -1 GET u8 0", []string{"(nil)", "(integer) 0"}},
+		{"BITFIELD f SET i8 #1 127 OVERFLOW SAT INCRBY i8 #1 10", []string{"(integer) 0", "(integer) 127"}},
+		{"BITFIELD f OVERFLOW WRAP INCRBY i8 8 1", []string{"(integer) -128"}},
+		{"BITFIELD f SET u4 100 17", []string{"(integer) 0"}},
+		{"BITFIELD f GET u4 100", []string{"(integer) 1"}},
+		{"BITFIELD g SET i64 0 -1 INCRBY i64 0 1", []string{"(integer) 0", "(integer) 0"}},
+		{"BITFIELD g OVERFLOW SAT INCRBY i64 0 9223372036854775807 INCRBY i64 0 1", []string{"(integer) 9223372036854775807", "(integer) 9223372036854775807"}},
+		{"BITFIELD f", []string{"(empty array)"}},
+		{"BITFIELD f GET u64 0", []string{"(error) ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."}},
+		{"BITFIELD f GET u8 4294967290", []string{"(error) ERR bit offset is not an integer or out of range"}},
+		{"BITFIELD f OVERFLOW NONE GET u8 0", []string{"(error) ERR Invalid OVERFLOW type specified"}},
+		{"BITFIELD_RO f GET i8 8", []string{"(integer) -128"}},
+		{"BITFIELD_RO f SET u8 0 1", []string{"(error) ERR BITFIELD_RO only supports the GET subcommand"}},
+	}
+	for _, c := range cases {
+		if res := handle(engine, c.cmdline); !reflect.DeepEqual(res, c.expected) {
+			t.Error("TestBitmap4 failed")
+		}
+	}
+
+	// only the writes are propagated
+	if _, props := engine.HandleProp(strings.Fields("BITFIELD f GET u8 0")); len(props) != 0 {
+		t.Error("TestBitmap4 failed")
+	}
+	if _, props := engine.HandleProp(strings.Fields("BITFIELD f OVERFLOW FAIL INCRBY u8 0 1000")); len(props) != 0 {
+		t.Error("TestBitmap4 failed")
+	}
+	if _, props := engine.HandleProp(strings.Fields("BITFIELD f INCRBY u8 0 1")); len(props) != 1 {
+		t.Error("TestBitmap4 failed")
+	}
+}
+
+// binary-safe values survive the aof, its rewrite and the recovery
+func TestBitmap5(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	values := []string{"", "a b", "line\nbreak", "\x00\xff\r\n", "\"quoted", "中文"}
+	exec := func(db *server.Db, cmd ...string) string {
+		bcmd := make([][]byte, 0, len(cmd))
+		for _, arg := range cmd {
+			bcmd = append(bcmd, []byte(arg))
+		}
+		return string(db.Exec(bcmd)[0])
+	}
+
+	db := server.NewDb("test_binary")
+	db.Open()
+	for i, value := range values {
+		exec(db, "SET", "key"+value, value)
+		exec(db, "RPUSH", "list", value)
+		exec(db, "SETBIT", "bits", string(rune('0'+i)), "1")
+	}
+	db.Close()
+
+	// recover from the aof, it's rewritten once after more than 5 writes
+	db = server.NewDb("test_binary")
+	db.Open()
+	defer db.Close()
+	for _, value := range values {
+		if exec(db, "GET", "key"+value) != value {
+			t.Error("TestBitmap5 failed")
+		}
+	}
+	if exec(db, "LLEN", "list") != "(integer) 6" {
+		t.Error("TestBitmap5 failed")
+	}
+	if exec(db, "LINDEX", "list", "3") != values[3] {
+		t.Error("TestBitmap5 failed")
+	}
+	if exec(db, "BITCOUNT", "bits") != "(integer) 6" {
+		t.Error("TestBitmap5 failed")
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	cmd := []string{"SET", "", "a b", "\x00\xff", "\"", "x\"y", "\\n"}
+	line := server.NewCmdFilePack().SerializeCmd(cmd)
+	if strings.Count(line, "\n") != 1 {
+		t.Error("TestSplitArgs failed")
+	}
+	if res := server.NewCmdFilePack().UnserializeCmd(line); !reflect.DeepEqual(res, cmd) {
+		t.Error("TestSplitArgs failed")
+	}
+	// plain args are kept as they are
+	if line := server.NewCmdFilePack().SerializeCmd([]string{"SET", "k", "v"}); line != "SET k v\n" {
+		t.Error("TestSplitArgs failed")
+	}
+	if _, err := server.SplitArgs(`SET "unterminated`); err == nil {
+		t.Error("TestSplitArgs failed")
+	}
+}
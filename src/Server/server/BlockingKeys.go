@@ -0,0 +1,101 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// clients blocked on keys, waked up when the keys are written
+type BlockingKeys struct {
+	waiters map[string]map[chan bool]bool
+	stopped bool
+	lock    sync.Mutex
+}
+
+func NewBlockingKeys() *BlockingKeys {
+	return &BlockingKeys{
+		waiters: make(map[string]map[chan bool]bool),
+	}
+}
+
+// register a waiter on keys, the chan gets a value when any of them is signaled.
+// register before checking the keys, so a write between the check and the wait is not missed
+func (this *BlockingKeys) Register(keys []string) chan bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ch := make(chan bool, 1)
+	if this.stopped {
+		ch <- true
+		return ch
+	}
+	for _, key := range keys {
+		if this.waiters[key] == nil {
+			this.waiters[key] = make(map[chan bool]bool)
+		}
+		this.waiters[key][ch] = true
+	}
+	return ch
+}
+
+func (this *BlockingKeys) Unregister(keys []string, ch chan bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, key := range keys {
+		delete(this.waiters[key], ch)
+		if len(this.waiters[key]) == 0 {
+			delete(this.waiters, key)
+		}
+	}
+}
+
+// wait for a signal until deadline, zero deadline waits forever. returns false if timeout
+func (this *BlockingKeys) Wait(ch chan bool, deadline time.Time) bool {
+	if deadline.IsZero() {
+		<-ch
+		return true
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (this *BlockingKeys) Signal(key string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for ch := range this.waiters[key] {
+		select {
+		case ch <- true:
+		default:
+		}
+	}
+}
+
+// wake up all the waiters and stop blocking, used when the db is closing
+func (this *BlockingKeys) Stop() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.stopped = true
+	for _, chs := range this.waiters {
+		for ch := range chs {
+			select {
+			case ch <- true:
+			default:
+			}
+		}
+	}
+}
+
+func (this *BlockingKeys) IsStopped() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.stopped
+}
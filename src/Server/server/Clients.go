@@ -0,0 +1,228 @@
+package server
+
+import (
+	"fmt"
+	"gedis/src/Server/siface"
+	"gedis/src/zinx/ziface"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// called by the routers once a cmd of conn is received, before it's checked and handled
+// the name of the last cmd is shown by CLIENT LIST, NULL if it's unknown like redis
+func onCmd(conn ziface.IConnection, args []string) {
+	name := "NULL"
+	if len(args) > 0 && IsCmdExist(args[0]) {
+		name = strings.ToLower(args[0])
+	}
+	conn.SetProperty("cmd", name)
+}
+
+// a string property of conn, "" if not set
+func getStringProperty(conn ziface.IConnection, key string) string {
+	value, err := conn.GetProperty(key)
+	if err != nil {
+		return ""
+	}
+	return value.(string)
+}
+
+// CLIENT LIST | INFO | KILL | SETNAME | GETNAME | ID | PAUSE | UNPAUSE | NO-EVICT
+// stop is true if conn itself is killed, it's stopped after the reply
+func (this *ServerRouter) client(conn ziface.IConnection, args []string) (res []string, stop bool) {
+	if len(args) == 0 {
+		return []string{"(error) ERR wrong number of arguments for 'client' command"}, false
+	}
+	sub, name := strings.ToUpper(args[0]), args[0]
+	args = args[1:]
+	switch {
+	case sub == "LIST":
+		return this.clientList(args), false
+	case sub == "INFO" && len(args) == 0:
+		return []string{this.clientInfo(conn)}, false
+	case sub == "KILL" && len(args) > 0:
+		return this.clientKill(conn, args)
+	case sub == "SETNAME" && len(args) == 1:
+		return clientSetName(conn, args[0]), false
+	case sub == "GETNAME" && len(args) == 0:
+		if conn_name := getStringProperty(conn, "name"); conn_name != "" {
+			return []string{conn_name}, false
+		}
+		return []string{"(nil)"}, false
+	case sub == "ID" && len(args) == 0:
+		return []string{integerReply(conn.GetConnID())}, false
+	case sub == "PAUSE" && (len(args) == 1 || len(args) == 2):
+		return this.clientPause(args), false
+	case sub == "UNPAUSE" && len(args) == 0:
+		this.db_mgr.Unpause()
+		return []string{"OK"}, false
+	case sub == "NO-EVICT" && len(args) == 1:
+		switch strings.ToUpper(args[0]) {
+		case "ON":
+			conn.SetProperty("no-evict", true)
+		case "OFF":
+			conn.RemoveProperty("no-evict")
+		default:
+			return []string{"(error) ERR syntax error"}, false
+		}
+		return []string{"OK"}, false
+	case sub == "INFO" || sub == "KILL" || sub == "SETNAME" || sub == "GETNAME" || sub == "ID" ||
+		sub == "PAUSE" || sub == "UNPAUSE" || sub == "NO-EVICT":
+		return []string{fmt.Sprintf("(error) ERR wrong number of arguments for 'client|%s' command", strings.ToLower(sub))}, false
+	}
+	return []string{fmt.Sprintf("(error) ERR unknown subcommand '%s'. Try CLIENT HELP.", name)}, false
+}
+
+// CLIENT LIST [ID client-id [client-id ...]]
+// a line for each connection
+func (this *ServerRouter) clientList(args []string) []string {
+	var ids map[uint32]bool
+	if len(args) > 0 {
+		if strings.ToUpper(args[0]) != "ID" || len(args) == 1 {
+			return []string{"(error) ERR syntax error"}
+		}
+		ids = make(map[uint32]bool)
+		for _, arg := range args[1:] {
+			id, err := strconv.ParseUint(arg, 10, 32)
+			if err != nil {
+				return []string{"(error) ERR Invalid client ID"}
+			}
+			ids[uint32(id)] = true
+		}
+	}
+
+	lines := make([]string, 0)
+	for _, conn := range this.server.GetConnectionManager().GetConns() {
+		if ids == nil || ids[conn.GetConnID()] {
+			lines = append(lines, this.clientInfo(conn))
+		}
+	}
+	if len(lines) == 0 {
+		return []string{""}
+	}
+	return lines
+}
+
+// id=1 addr=127.0.0.1:50000 name= age=3 idle=0 flags=N db=0 qlen=0 cmd=client user=default
+// qlen is the requests read but not handled yet including the one being handled, flags is N or e if NO-EVICT is on
+func (this *ServerRouter) clientInfo(conn ziface.IConnection) string {
+	now := time.Now()
+	db := -1
+	if idb, err := conn.GetProperty("db"); err == nil {
+		db = this.db_mgr.GetDbID(idb.(siface.IDb))
+	}
+	flags := "N"
+	if _, err := conn.GetProperty("no-evict"); err == nil {
+		flags = "e"
+	}
+	return fmt.Sprintf("id=%d addr=%s name=%s age=%d idle=%d flags=%s db=%d qlen=%d cmd=%s user=%s",
+		conn.GetConnID(), conn.RemoteAddr().String(), getStringProperty(conn, "name"),
+		int64(now.Sub(conn.GetStartTime()).Seconds()), int64(now.Sub(conn.GetLastActive()).Seconds()),
+		flags, db, conn.GetPending(), getStringProperty(conn, "cmd"), getStringProperty(conn, "user"))
+}
+
+// CLIENT KILL ip:port | CLIENT KILL [ID client-id] [ADDR ip:port] [USER username] [SKIPME yes|no]
+// the old form replies OK, the new one the number of the connections killed, which doesn't include conn by default
+func (this *ServerRouter) clientKill(conn ziface.IConnection, args []string) (res []string, stop bool) {
+	old_form := len(args) == 1
+	id := int64(-1)
+	addr, user, skipme := "", "", !old_form
+	if old_form {
+		addr = args[0]
+	} else {
+		if len(args)%2 != 0 {
+			return []string{"(error) ERR syntax error"}, false
+		}
+		for i := 0; i < len(args); i += 2 {
+			value := args[i+1]
+			switch strings.ToUpper(args[i]) {
+			case "ID":
+				n, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return []string{"(error) ERR Invalid client ID"}, false
+				}
+				id = int64(n)
+			case "ADDR":
+				addr = value
+			case "USER":
+				user = value
+			case "SKIPME":
+				switch strings.ToUpper(value) {
+				case "YES":
+					skipme = true
+				case "NO":
+					skipme = false
+				default:
+					return []string{"(error) ERR syntax error"}, false
+				}
+			default:
+				return []string{"(error) ERR syntax error"}, false
+			}
+		}
+	}
+
+	killed := 0
+	for _, c := range this.server.GetConnectionManager().GetConns() {
+		if (id >= 0 && int64(c.GetConnID()) != id) || (addr != "" && c.RemoteAddr().String() != addr) ||
+			(user != "" && getStringProperty(c, "user") != user) {
+			continue
+		}
+		if c.GetConnID() == conn.GetConnID() {
+			if skipme {
+				continue
+			}
+			stop = true
+		} else {
+			// stopping may wait the writer of c to flush, which mustn't block this worker
+			go c.Stop()
+		}
+		killed++
+	}
+
+	if !old_form {
+		return []string{integerReply(killed)}, stop
+	}
+	if killed == 0 {
+		return []string{"(error) ERR No such client"}, false
+	}
+	return []string{"OK"}, stop
+}
+
+// CLIENT SETNAME name, an empty name removes the name
+func clientSetName(conn ziface.IConnection, name string) []string {
+	for _, c := range name {
+		if c < '!' || c > '~' {
+			return []string{"(error) ERR Client names cannot contain spaces, newlines or special characters."}
+		}
+	}
+	if name == "" {
+		conn.RemoveProperty("name")
+	} else {
+		conn.SetProperty("name", name)
+	}
+	return []string{"OK"}
+}
+
+// CLIENT PAUSE timeout [WRITE|ALL]
+// the write cmds of the dbs and PUBLISH, or all the cmds of the dbs and pubsub, wait until timeout ms
+// passes or CLIENT UNPAUSE, for failovers.
+// Unlike redis, the keys expiring meanwhile are still deleted by the ttl monitor and notified
+func (this *ServerRouter) clientPause(args []string) []string {
+	timeout, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || timeout < 0 {
+		return []string{"(error) ERR timeout is not an integer or out of range"}
+	}
+	all := true
+	if len(args) == 2 {
+		switch strings.ToUpper(args[1]) {
+		case "WRITE":
+			all = false
+		case "ALL":
+		default:
+			return []string{"(error) ERR syntax error"}
+		}
+	}
+	this.db_mgr.Pause(time.Duration(timeout)*time.Millisecond, all)
+	return []string{"OK"}
+}
@@ -0,0 +1,216 @@
+package server_test
+
+import (
+	"gedis/src/Server/server"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connection of a client in the connection manager, removed from it once stopped
+type clientConn struct {
+	*msgConn
+	addr     *net.TCPAddr
+	start    time.Time
+	conn_mgr ziface.IConnectionManager
+	stopped  chan bool
+	once     sync.Once
+}
+
+func newClientConn(id uint32, conn_mgr ziface.IConnectionManager) *clientConn {
+	conn := &clientConn{
+		msgConn:  newMsgConn(id),
+		addr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000 + int(id)},
+		start:    time.Now(),
+		conn_mgr: conn_mgr,
+		stopped:  make(chan bool),
+	}
+	conn_mgr.Add(conn)
+	return conn
+}
+
+func (this *clientConn) RemoteAddr() net.Addr     { return this.addr }
+func (this *clientConn) GetStartTime() time.Time  { return this.start }
+func (this *clientConn) GetLastActive() time.Time { return this.start }
+func (this *clientConn) Stop() {
+	this.once.Do(func() {
+		this.conn_mgr.Remove(this)
+		close(this.stopped)
+	})
+}
+
+// whether it's stopped in d, connections may be stopped by another goroutine
+func (this *clientConn) waitStopped(d time.Duration) bool {
+	select {
+	case <-this.stopped:
+		return true
+	default:
+	}
+	select {
+	case <-this.stopped:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// CLIENT LIST/INFO/SETNAME/GETNAME/ID/KILL
+func TestClients1(t *testing.T) {
+	acl := newTestAcl(t, "")
+	db_mgr := server.NewDbManager()
+	s := znet.NewServer()
+	router := server.NewServerRouter(acl, s, db_mgr)
+	c1, c2 := newClientConn(1, s.GetConnectionManager()), newClientConn(2, s.GetConnectionManager())
+	c1.SetProperty("db", db_mgr.GetDb(0))
+	c2.SetProperty("db", db_mgr.GetDb(3))
+	acl.OnConnStart(c1)
+	acl.OnConnStart(c2)
+	client := func(conn *clientConn, cmdline string) []string {
+		router.Handle(newFakeRequest(conn, cmdline))
+		return conn.next()
+	}
+
+	if res := client(c1, "CLIENT ID"); res[0] != "(integer) 1" {
+		t.Error("TestClients1 failed")
+	}
+	if res := client(c1, "CLIENT GETNAME"); res[0] != "(nil)" {
+		t.Error("TestClients1 failed")
+	}
+	if res := client(c1, "CLIENT SETNAME worker"); res[0] != "OK" || client(c1, "CLIENT GETNAME")[0] != "worker" {
+		t.Error("TestClients1 failed")
+	}
+	if res := client(c1, "CLIENT SETNAME a\nb"); res[0] != "(error) ERR Client names cannot contain spaces, newlines or special characters." {
+		t.Error("TestClients1 failed")
+	}
+	res := client(c1, "CLIENT LIST")
+	if len(res) != 2 || res[0] != "id=1 addr=127.0.0.1:1001 name=worker age=0 idle=0 flags=N db=0 qlen=0 cmd=client user=default" ||
+		!strings.HasPrefix(res[1], "id=2 addr=127.0.0.1:1002 name= ") || !strings.Contains(res[1], " db=3 ") || !strings.Contains(res[1], " cmd= ") {
+		t.Error("TestClients1 failed", res)
+	}
+	client(c2, "CLIENT NO-EVICT on")
+	if res := client(c1, "CLIENT LIST ID 2"); len(res) != 1 || !strings.Contains(res[0], " flags=e ") || !strings.Contains(res[0], " cmd=client ") {
+		t.Error("TestClients1 failed")
+	}
+	if res := client(c1, "CLIENT LIST ID 3"); len(res) != 1 || res[0] != "" {
+		t.Error("TestClients1 failed")
+	}
+	if res := client(c2, "CLIENT INFO"); len(res) != 1 || !strings.HasPrefix(res[0], "id=2 ") {
+		t.Error("TestClients1 failed")
+	}
+
+	// kill
+	if res := client(c1, "CLIENT KILL 127.0.0.1:9"); res[0] != "(error) ERR No such client" {
+		t.Error("TestClients1 failed")
+	}
+	// ids start from 0
+	if res := client(c1, "CLIENT KILL ID 0"); res[0] != "(integer) 0" {
+		t.Error("TestClients1 failed")
+	}
+	if res := client(c1, "CLIENT KILL ID 2"); res[0] != "(integer) 1" || !c2.waitStopped(time.Second) || s.GetConnectionManager().Size() != 1 {
+		t.Error("TestClients1 failed")
+	}
+	// itself is skipped by default
+	if res := client(c1, "CLIENT KILL USER default"); res[0] != "(integer) 0" || c1.waitStopped(0) {
+		t.Error("TestClients1 failed")
+	}
+	if res := client(c1, "CLIENT KILL ID x"); res[0] != "(error) ERR Invalid client ID" {
+		t.Error("TestClients1 failed")
+	}
+	if res := client(c1, "CLIENT KILL ID 1 SKIPME"); res[0] != "(error) ERR syntax error" {
+		t.Error("TestClients1 failed")
+	}
+	// replied before stopped
+	if res := client(c1, "CLIENT KILL ADDR 127.0.0.1:1001 SKIPME no"); res[0] != "(integer) 1" || !c1.waitStopped(time.Second) {
+		t.Error("TestClients1 failed")
+	}
+
+	if res := client(c1, "CLIENT GETNAME x"); res[0] != "(error) ERR wrong number of arguments for 'client|getname' command" {
+		t.Error("TestClients1 failed")
+	}
+	if res := client(c1, "CLIENT foo"); res[0] != "(error) ERR unknown subcommand 'foo'. Try CLIENT HELP." {
+		t.Error("TestClients1 failed")
+	}
+}
+
+// CLIENT PAUSE/UNPAUSE
+func TestClients2(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	acl := newTestAcl(t, "")
+	db_mgr := server.NewDbManager()
+	db_mgr.Start()
+	defer db_mgr.Stop()
+	s := znet.NewServer()
+	router := server.NewServerRouter(acl, s, db_mgr)
+	db_router := server.NewDbRouter(acl, server.NewCluster(db_mgr))
+	pubsub_router := server.NewPubSubRouter(acl, server.NewPubSub(), db_mgr)
+	admin, c1, c2 := newClientConn(1, s.GetConnectionManager()), newClientConn(2, s.GetConnectionManager()), newClientConn(3, s.GetConnectionManager())
+	for _, conn := range []*clientConn{admin, c1, c2} {
+		conn.SetProperty("db", db_mgr.GetDb(0))
+		acl.OnConnStart(conn)
+	}
+	client := func(cmdline string) []string {
+		router.Handle(newFakeRequest(admin, cmdline))
+		return admin.next()
+	}
+	exec := func(conn *clientConn, cmdline string) {
+		db_router.Handle(newFakeRequest(conn, cmdline))
+	}
+
+	// writes and PUBLISH wait, reads go on
+	if res := client("CLIENT PAUSE 10000 WRITE"); res[0] != "OK" {
+		t.Fatal("TestClients2 failed")
+	}
+	exec(c1, "SET k v")
+	if !c1.empty() {
+		t.Error("TestClients2 failed")
+	}
+	if exec(c2, "GET k"); c2.next()[0] != "(nil)" {
+		t.Error("TestClients2 failed")
+	}
+	if pubsub_router.Handle(newFakeRequest(c2, "PUBLISH news hello")); !c2.empty() {
+		t.Error("TestClients2 failed")
+	}
+	client("CLIENT UNPAUSE")
+	if res := c1.next(); res == nil || res[0] != "OK" {
+		t.Error("TestClients2 failed")
+	}
+	if res := c2.next(); res == nil || res[0] != "(integer) 0" {
+		t.Error("TestClients2 failed")
+	}
+	if exec(c2, "GET k"); c2.next()[0] != "v" {
+		t.Error("TestClients2 failed")
+	}
+
+	// all the cmds wait until the timeout
+	start := time.Now()
+	client("CLIENT PAUSE 100 ALL")
+	if exec(c2, "GET k"); c2.next()[0] != "v" || time.Since(start) < 100*time.Millisecond {
+		t.Error("TestClients2 failed")
+	}
+	// a longer pause isn't ended by the timer of the shorter one
+	client("CLIENT PAUSE 50 WRITE")
+	client("CLIENT PAUSE 300 WRITE")
+	exec(c1, "DEL k")
+	time.Sleep(100 * time.Millisecond)
+	if !c1.empty() || c1.next()[0] != "(integer) 1" {
+		t.Error("TestClients2 failed")
+	}
+
+	if res := client("CLIENT PAUSE x"); res[0] != "(error) ERR timeout is not an integer or out of range" {
+		t.Error("TestClients2 failed")
+	}
+	if res := client("CLIENT PAUSE 10 READ"); res[0] != "(error) ERR syntax error" {
+		t.Error("TestClients2 failed")
+	}
+}
@@ -0,0 +1,681 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"gedis/src/Server/siface"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cluster cmds (CLUSTER, ASKING, MIGRATE) are sent with this msg id
+const CLUSTER_MSG_ID = 3
+
+// the cluster bus of a node listens on its client port + CLUSTER_BUS_PORT_INCR
+const CLUSTER_BUS_PORT_INCR = 10000
+
+type clusterNode struct {
+	id      string
+	addr    string // ip:port for clients
+	epoch   uint64 // the slots claimed by the node with the greater epoch win
+	link_ok bool
+}
+
+func (this *clusterNode) busAddr() string {
+	host, port, err := net.SplitHostPort(this.addr)
+	if err != nil {
+		return this.addr
+	}
+	p, _ := strconv.Atoi(port)
+	return net.JoinHostPort(host, fmt.Sprint(p+CLUSTER_BUS_PORT_INCR))
+}
+
+// Cluster shards the keys of db 0 into 16384 hash slots over the nodes.
+// nodes know each other by CLUSTER MEET and gossip their slots through the cluster bus every second:
+// each message is [PING|PONG|MEET, id, addr, epoch, slots, id@addr of known nodes...].
+// a cmd with keys in a slot of another node gets MOVED, a slot migrating to another node gets ASK for keys already moved.
+type Cluster struct {
+	enabled bool
+	myself  *clusterNode
+	nodes   map[string]*clusterNode
+	slots   [CLUSTER_SLOTS]*clusterNode
+	// slots of myself migrating to other nodes, and slots importing from other nodes
+	migrating [CLUSTER_SLOTS]*clusterNode
+	importing [CLUSTER_SLOTS]*clusterNode
+	lock      sync.RWMutex
+
+	db_mgr     *DbManager
+	cmd_packer siface.ICmdPack
+	data_pack  ziface.IDataPack
+
+	listener  net.Listener
+	exit_chan chan bool
+}
+
+func NewCluster(db_mgr *DbManager) *Cluster {
+	myself := &clusterNode{
+		id:      newRandomId(),
+		addr:    fmt.Sprintf("%s:%d", utils.Global_obj.Ip, utils.Global_obj.Port),
+		epoch:   0,
+		link_ok: true,
+	}
+	cluster := &Cluster{
+		enabled: utils.Global_obj.ClusterEnabled,
+		myself:  myself,
+		nodes:   make(map[string]*clusterNode),
+		lock:    sync.RWMutex{},
+
+		db_mgr:     db_mgr,
+		cmd_packer: NewCmdPack(),
+		data_pack:  znet.NewDataPack(),
+
+		exit_chan: make(chan bool),
+	}
+	cluster.nodes[myself.id] = myself
+	return cluster
+}
+
+func (this *Cluster) IsEnabled() bool {
+	return this.enabled
+}
+
+// start the cluster bus and the gossip, nothing to do if cluster is disabled
+func (this *Cluster) Start() error {
+	if !this.enabled {
+		return nil
+	}
+	// the bus is between servers, it uses tls like replication
+	listener, err := znet.ListenPeer(this.myself.busAddr())
+	if err != nil {
+		return err
+	}
+	this.listener = listener
+
+	go this.serveBus()
+	go this.gossip()
+	return nil
+}
+
+func (this *Cluster) Stop() {
+	if !this.enabled || this.listener == nil {
+		return
+	}
+	close(this.exit_chan)
+	this.listener.Close()
+}
+
+// check whether cmd can be executed by this node, or return the error to redirect the client
+func (this *Cluster) CheckRedirect(conn ziface.IConnection, cmd []string) string {
+	// ASKING only works for the next cmd
+	_, err := conn.GetProperty("asking")
+	asking := err == nil
+	conn.RemoveProperty("asking")
+
+	if !this.enabled {
+		return ""
+	}
+	keys := GetCmdKeys(cmd)
+	if len(keys) == 0 {
+		return ""
+	}
+	slot := KeyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if KeyHashSlot(key) != slot {
+			return "(error) CROSSSLOT Keys in request don't hash to the same slot"
+		}
+	}
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	owner := this.slots[slot]
+	if owner == nil {
+		return "(error) CLUSTERDOWN Hash slot not served"
+	}
+	if owner == this.myself {
+		target := this.migrating[slot]
+		if target == nil {
+			return ""
+		}
+		// keys already migrated are asked to the target
+		db := this.db_mgr.GetDb(0)
+		missing := 0
+		for _, key := range keys {
+			if len(db.DumpKey(key)) == 0 {
+				missing++
+			}
+		}
+		if missing == 0 {
+			return ""
+		} else if missing == len(keys) {
+			return fmt.Sprintf("(error) ASK %d %s", slot, target.addr)
+		}
+		return "(error) TRYAGAIN Multiple keys request during rehashing of slot"
+	}
+	if this.importing[slot] != nil && asking {
+		return ""
+	}
+	return fmt.Sprintf("(error) MOVED %d %s", slot, owner.addr)
+}
+
+// the error reply of a cmd called by a script if its keys aren't served by this node, as the script
+// can't be redirected once it runs
+func (this *Cluster) CheckScriptKeys(cmd []string) string {
+	if !this.enabled {
+		return ""
+	}
+	keys := GetCmdKeys(cmd)
+	if len(keys) == 0 {
+		return ""
+	}
+	slot := KeyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if KeyHashSlot(key) != slot {
+			return "(error) CROSSSLOT Keys in request don't hash to the same slot"
+		}
+	}
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	// the script of an importing slot is run after ASKING
+	if this.slots[slot] != this.myself && this.importing[slot] == nil {
+		return "(error) ERR Script attempted to access a non local key in a cluster node"
+	}
+	return ""
+}
+
+func (this *Cluster) GetMyId() string {
+	return this.myself.id
+}
+
+// join the node at addr (its client port) into the cluster
+func (this *Cluster) Meet(addr string) error {
+	node := &clusterNode{addr: addr}
+	return this.ping(node, "MEET")
+}
+
+func (this *Cluster) AddSlots(slots []uint32) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, slot := range slots {
+		if this.slots[slot] != nil {
+			return fmt.Errorf("(error) ERR Slot %d is already busy", slot)
+		}
+	}
+	for _, slot := range slots {
+		this.slots[slot] = this.myself
+		this.importing[slot] = nil
+	}
+	return nil
+}
+
+func (this *Cluster) DelSlots(slots []uint32) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, slot := range slots {
+		if this.slots[slot] == nil {
+			return fmt.Errorf("(error) ERR Slot %d is already unassigned", slot)
+		}
+	}
+	for _, slot := range slots {
+		this.slots[slot] = nil
+		this.migrating[slot] = nil
+		this.importing[slot] = nil
+	}
+	return nil
+}
+
+// CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE id, or CLUSTER SETSLOT slot STABLE
+func (this *Cluster) SetSlot(slot uint32, state string, id string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	node := this.nodes[id]
+	if state != "STABLE" && node == nil {
+		return fmt.Errorf("(error) ERR I don't know about node %s", id)
+	}
+
+	switch state {
+	case "MIGRATING":
+		if this.slots[slot] != this.myself {
+			return fmt.Errorf("(error) ERR I'm not the owner of hash slot %d", slot)
+		}
+		this.migrating[slot] = node
+	case "IMPORTING":
+		if this.slots[slot] == this.myself {
+			return fmt.Errorf("(error) ERR I'm already the owner of hash slot %d", slot)
+		}
+		this.importing[slot] = node
+	case "STABLE":
+		this.migrating[slot] = nil
+		this.importing[slot] = nil
+	case "NODE":
+		this.migrating[slot] = nil
+		this.importing[slot] = nil
+		this.slots[slot] = node
+		// the new owner bumps its epoch, so its claim of the slot wins in the gossip
+		if node == this.myself {
+			this.myself.epoch = this.maxEpoch() + 1
+		}
+	default:
+		return errors.New("(error) ERR Invalid CLUSTER SETSLOT action or number of arguments")
+	}
+	return nil
+}
+
+// lock should be held
+func (this *Cluster) maxEpoch() (epoch uint64) {
+	for _, node := range this.nodes {
+		if node.epoch > epoch {
+			epoch = node.epoch
+		}
+	}
+	return
+}
+
+func (this *Cluster) CountKeysInSlot(slot uint32) (num int) {
+	this.db_mgr.GetDb(0).Foreach(func(key string, val interface{}, TTL int64) {
+		if KeyHashSlot(key) == slot {
+			num++
+		}
+	})
+	return
+}
+
+func (this *Cluster) GetKeysInSlot(slot uint32, count int) (keys []string) {
+	keys = make([]string, 0)
+	this.db_mgr.GetDb(0).Foreach(func(key string, val interface{}, TTL int64) {
+		if len(keys) < count && KeyHashSlot(key) == slot {
+			keys = append(keys, key)
+		}
+	})
+	return
+}
+
+// one line for each node: id addr flags epoch link slots
+func (this *Cluster) Nodes() (lines []string) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	ids := make([]string, 0, len(this.nodes))
+	for id := range this.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	lines = make([]string, 0, len(ids))
+	for _, id := range ids {
+		node := this.nodes[id]
+		flags := "master"
+		if node == this.myself {
+			flags = "myself,master"
+		}
+		link := "connected"
+		if !node.link_ok {
+			link = "disconnected"
+		}
+		line := fmt.Sprintf("%s %s %s %d %s %s", node.id, node.addr, flags, node.epoch, link, this.slotsOf(node))
+		for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+			if node == this.myself && this.migrating[slot] != nil {
+				line += fmt.Sprintf(" [%d->-%s]", slot, this.migrating[slot].id)
+			}
+			if node == this.myself && this.importing[slot] != nil {
+				line += fmt.Sprintf(" [%d-<-%s]", slot, this.importing[slot].id)
+			}
+		}
+		lines = append(lines, line)
+	}
+	return
+}
+
+// one line for each range of continuous slots: start end addr id
+func (this *Cluster) Slots() (lines []string) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	lines = make([]string, 0)
+	for start := 0; start < CLUSTER_SLOTS; {
+		owner := this.slots[start]
+		end := start
+		for end+1 < CLUSTER_SLOTS && this.slots[end+1] == owner {
+			end++
+		}
+		if owner != nil {
+			lines = append(lines, fmt.Sprintf("%d %d %s %s", start, end, owner.addr, owner.id))
+		}
+		start = end + 1
+	}
+	return
+}
+
+func (this *Cluster) Info() []string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	assigned := 0
+	for _, node := range this.slots {
+		if node != nil {
+			assigned++
+		}
+	}
+	state := "ok"
+	if assigned < CLUSTER_SLOTS {
+		state = "fail"
+	}
+	return []string{
+		fmt.Sprintf("cluster_state:%s", state),
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_known_nodes:%d", len(this.nodes)),
+		fmt.Sprintf("cluster_current_epoch:%d", this.maxEpoch()),
+		fmt.Sprintf("cluster_my_epoch:%d", this.myself.epoch),
+	}
+}
+
+// move key of db to the node at addr, the key is deleted from db after the target has it.
+// auth is the AUTH cmd to send first, empty if the target needs no password.
+// db runs no other cmd until it's done, so no write to the key between the dump and the DEL is lost
+func (this *Cluster) Migrate(db siface.IDb, addr string, key string, dst_db string, timeout time.Duration, auth []string) (err error) {
+	atomic_err := db.Atomic(func(exec func(cmd []string) []string) {
+		err = this.migrate(db, exec, addr, key, dst_db, timeout, auth)
+	})
+	if atomic_err != nil {
+		return atomic_err
+	}
+	return
+}
+
+func (this *Cluster) migrate(db siface.IDb, exec func(cmd []string) []string, addr string, key string, dst_db string, timeout time.Duration, auth []string) error {
+	cmds := db.DumpKey(key)
+	if len(cmds) == 0 {
+		return errors.New("NOKEY")
+	}
+
+	conn, err := znet.DialPeer(addr, timeout)
+	if err != nil {
+		return fmt.Errorf("(error) IOERR error or timeout connecting to the client")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if len(auth) > 0 {
+		if _, err = this.call(conn, ACL_MSG_ID, auth); err != nil {
+			return err
+		}
+	}
+	if dst_db != "0" {
+		if _, err = this.call(conn, 1, []string{"SELECT", dst_db}); err != nil {
+			return err
+		}
+	}
+	// the slot is importing in the target, every cmd needs ASKING before it
+	cmds = append([][]string{{"DEL", key}}, cmds...)
+	for _, cmd := range cmds {
+		if _, err = this.call(conn, CLUSTER_MSG_ID, []string{"ASKING"}); err != nil {
+			return err
+		}
+		if _, err = this.call(conn, 0, cmd); err != nil {
+			return err
+		}
+	}
+
+	exec([]string{"DEL", key})
+	return nil
+}
+
+// send a cmd to a node as a client and wait for the reply
+func (this *Cluster) call(conn net.Conn, msg_id uint32, cmd []string) ([]string, error) {
+	if err := this.send(conn, msg_id, cmd); err != nil {
+		return nil, err
+	}
+	res, err := this.recv(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) > 0 && strings.HasPrefix(res[0], "(error)") {
+		return nil, errors.New(res[0])
+	}
+	return res, nil
+}
+
+func (this *Cluster) send(conn net.Conn, msg_id uint32, cmd []string) error {
+	bcmd := make([][]byte, 0, len(cmd))
+	for _, v := range cmd {
+		bcmd = append(bcmd, []byte(v))
+	}
+	buf, err := this.data_pack.Pack(znet.NewMessage(msg_id, this.cmd_packer.PackCmd(bcmd)))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf)
+	return err
+}
+
+func (this *Cluster) recv(conn net.Conn) ([]string, error) {
+	msg, err := this.data_pack.ReadMsg(conn)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	for _, v := range this.cmd_packer.UnpackCmd(msg.GetMsgData()) {
+		res = append(res, string(v))
+	}
+	return res, nil
+}
+
+// [type, id, addr, epoch, slots, id@addr of known nodes...]
+func (this *Cluster) header(typ string) []string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	header := []string{typ, this.myself.id, this.myself.addr, fmt.Sprint(this.myself.epoch), this.slotsOf(this.myself)}
+	for _, node := range this.nodes {
+		if node != this.myself {
+			header = append(header, fmt.Sprintf("%s@%s", node.id, node.addr))
+		}
+	}
+	return header
+}
+
+// merge what sender tells about itself and the nodes it knows
+func (this *Cluster) processHeader(header []string) error {
+	if len(header) < 5 {
+		return errors.New("invalid cluster bus msg")
+	}
+	id, addr := header[1], header[2]
+	epoch, err := strconv.ParseUint(header[3], 10, 64)
+	if err != nil {
+		return err
+	}
+	claimed, err := parseSlots(header[4])
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if id == this.myself.id {
+		return nil
+	}
+	sender, ok := this.nodes[id]
+	if !ok {
+		sender = &clusterNode{id: id}
+		this.nodes[id] = sender
+	}
+	sender.addr = addr
+	sender.epoch = epoch
+	sender.link_ok = true
+
+	for slot := uint32(0); slot < CLUSTER_SLOTS; slot++ {
+		owner := this.slots[slot]
+		if claimed[slot] {
+			if owner == nil || (owner != sender && owner.epoch < sender.epoch) {
+				this.slots[slot] = sender
+				if this.migrating[slot] == sender {
+					this.migrating[slot] = nil
+				}
+			}
+		} else if owner == sender {
+			this.slots[slot] = nil
+		}
+	}
+
+	for _, gossip := range header[5:] {
+		node_id, node_addr, found := strings.Cut(gossip, "@")
+		if !found || node_id == this.myself.id {
+			continue
+		}
+		if _, ok := this.nodes[node_id]; !ok {
+			this.nodes[node_id] = &clusterNode{id: node_id, addr: node_addr}
+		}
+	}
+	return nil
+}
+
+func (this *Cluster) serveBus() {
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			select {
+			case <-this.exit_chan:
+				return
+			default:
+				fmt.Println(err.Error())
+				continue
+			}
+		}
+		go this.handleBusConn(conn)
+	}
+}
+
+func (this *Cluster) handleBusConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header, err := this.recv(conn)
+		if err != nil {
+			return
+		}
+		if err = this.processHeader(header); err != nil {
+			fmt.Printf("[CLUSTER]: %s\n", err.Error())
+			return
+		}
+		if err = this.send(conn, 0, this.header("PONG")); err != nil {
+			return
+		}
+	}
+}
+
+// ping a node through the bus and process its pong
+func (this *Cluster) ping(node *clusterNode, typ string) error {
+	conn, err := znet.DialPeer(node.busAddr(), time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	if err = this.send(conn, 0, this.header(typ)); err != nil {
+		return err
+	}
+	header, err := this.recv(conn)
+	if err != nil {
+		return err
+	}
+	return this.processHeader(header)
+}
+
+func (this *Cluster) gossip() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			this.lock.RLock()
+			nodes := make([]*clusterNode, 0, len(this.nodes))
+			for _, node := range this.nodes {
+				if node != this.myself {
+					nodes = append(nodes, node)
+				}
+			}
+			this.lock.RUnlock()
+
+			for _, node := range nodes {
+				err := this.ping(node, "PING")
+				if err != nil {
+					this.lock.Lock()
+					node.link_ok = false
+					this.lock.Unlock()
+				}
+			}
+		case <-this.exit_chan:
+			return
+		}
+	}
+}
+
+// lock should be held. slots as ranges like 0-5460,5462, "-" if no slots
+func (this *Cluster) slotsOf(node *clusterNode) string {
+	ranges := make([]string, 0)
+	for start := 0; start < CLUSTER_SLOTS; {
+		if this.slots[start] != node {
+			start++
+			continue
+		}
+		end := start
+		for end+1 < CLUSTER_SLOTS && this.slots[end+1] == node {
+			end++
+		}
+		if start == end {
+			ranges = append(ranges, fmt.Sprint(start))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, end))
+		}
+		start = end + 1
+	}
+	if len(ranges) == 0 {
+		return "-"
+	}
+	return strings.Join(ranges, ",")
+}
+
+func parseSlots(str string) (slots []bool, err error) {
+	slots = make([]bool, CLUSTER_SLOTS)
+	if str == "-" {
+		return
+	}
+	for _, r := range strings.Split(str, ",") {
+		start_str, end_str, found := strings.Cut(r, "-")
+		if !found {
+			end_str = start_str
+		}
+		start, err := ParseSlot(start_str)
+		if err != nil {
+			return nil, err
+		}
+		end, err := ParseSlot(end_str)
+		if err != nil {
+			return nil, err
+		}
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = true
+		}
+	}
+	return
+}
+
+func ParseSlot(str string) (uint32, error) {
+	slot, err := strconv.Atoi(str)
+	if err != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+		return 0, errors.New("(error) ERR Invalid or out of range slot")
+	}
+	return uint32(slot), nil
+}
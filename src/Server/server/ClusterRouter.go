@@ -0,0 +1,225 @@
+package server
+
+import (
+	"fmt"
+	"gedis/src/Server/siface"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ClusterRouter struct {
+	znet.BaseRounter
+	acl        *Acl
+	cluster    *Cluster
+	cmd_packer siface.ICmdPack
+}
+
+func NewClusterRouter(acl *Acl, cluster *Cluster) *ClusterRouter {
+	return &ClusterRouter{
+		acl:        acl,
+		cluster:    cluster,
+		cmd_packer: NewCmdPack(),
+	}
+}
+
+func (this *ClusterRouter) Handle(req ziface.IRequest) {
+	start := time.Now()
+	conn := req.GetConn()
+	buf := req.GetData()
+
+	cmd_arg := this.cmd_packer.UnpackCmd(buf)
+	args := make([]string, 0, len(cmd_arg))
+	for _, v := range cmd_arg {
+		args = append(args, string(v))
+	}
+
+	onCmd(conn, args)
+	if err := this.acl.Check(conn, args); err != "" {
+		this.reply(conn, args[0], start, []string{err})
+		return
+	}
+
+	var res []string
+	switch args[0] {
+	case "ASKING":
+		if !this.cluster.IsEnabled() {
+			res = []string{"(error) ERR This instance has cluster support disabled"}
+			break
+		}
+		conn.SetProperty("asking", true)
+		res = []string{"OK"}
+	case "MIGRATE":
+		res = this.migrate(conn, args[1:])
+	case "CLUSTER":
+		if !this.cluster.IsEnabled() {
+			res = []string{"(error) ERR This instance has cluster support disabled"}
+			break
+		}
+		if len(args) < 2 {
+			res = []string{"(error) ERR wrong number of arguments for 'cluster' command"}
+			break
+		}
+		res = this.cluster_cmd(strings.ToUpper(args[1]), args[2:])
+	default:
+		res = []string{"Unspported command"}
+	}
+	this.reply(conn, args[0], start, res)
+}
+
+func (this *ClusterRouter) reply(conn ziface.IConnection, cmd string, start time.Time, res []string) {
+	resp := make([][]byte, 0, len(res))
+	for _, r := range res {
+		resp = append(resp, []byte(r))
+	}
+	metrics.ObserveCmd(cmd, time.Since(start), resp)
+	conn.SendMsg(0, this.cmd_packer.PackCmd(resp))
+}
+
+func (this *ClusterRouter) cluster_cmd(subcmd string, args []string) []string {
+	switch subcmd {
+	case "MEET":
+		if len(args) != 2 {
+			return []string{"(error) ERR wrong number of arguments for 'cluster|meet' command"}
+		}
+		if err := this.cluster.Meet(net.JoinHostPort(args[0], args[1])); err != nil {
+			return []string{fmt.Sprintf("(error) ERR fail to meet %s:%s, %s", args[0], args[1], err.Error())}
+		}
+		return []string{"OK"}
+	case "ADDSLOTS", "DELSLOTS":
+		if len(args) < 1 {
+			return []string{fmt.Sprintf("(error) ERR wrong number of arguments for 'cluster|%s' command", strings.ToLower(subcmd))}
+		}
+		slots := make([]uint32, 0, len(args))
+		for _, arg := range args {
+			slot, err := ParseSlot(arg)
+			if err != nil {
+				return []string{err.Error()}
+			}
+			slots = append(slots, slot)
+		}
+		return this.addOrDelSlots(subcmd == "ADDSLOTS", slots)
+	case "ADDSLOTSRANGE", "DELSLOTSRANGE":
+		if len(args) < 2 || len(args)%2 != 0 {
+			return []string{fmt.Sprintf("(error) ERR wrong number of arguments for 'cluster|%s' command", strings.ToLower(subcmd))}
+		}
+		slots := make([]uint32, 0)
+		for i := 0; i < len(args); i += 2 {
+			start, err := ParseSlot(args[i])
+			if err != nil {
+				return []string{err.Error()}
+			}
+			end, err := ParseSlot(args[i+1])
+			if err != nil {
+				return []string{err.Error()}
+			}
+			for slot := start; slot <= end; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+		return this.addOrDelSlots(subcmd == "ADDSLOTSRANGE", slots)
+	case "SETSLOT":
+		if len(args) < 2 {
+			return []string{"(error) ERR wrong number of arguments for 'cluster|setslot' command"}
+		}
+		slot, err := ParseSlot(args[0])
+		if err != nil {
+			return []string{err.Error()}
+		}
+		state := strings.ToUpper(args[1])
+		id := ""
+		if state != "STABLE" {
+			if len(args) != 3 {
+				return []string{"(error) ERR wrong number of arguments for 'cluster|setslot' command"}
+			}
+			id = args[2]
+		}
+		if err = this.cluster.SetSlot(slot, state, id); err != nil {
+			return []string{err.Error()}
+		}
+		return []string{"OK"}
+	case "NODES":
+		return this.cluster.Nodes()
+	case "SLOTS":
+		return this.cluster.Slots()
+	case "INFO":
+		return this.cluster.Info()
+	case "MYID":
+		return []string{this.cluster.GetMyId()}
+	case "KEYSLOT":
+		if len(args) != 1 {
+			return []string{"(error) ERR wrong number of arguments for 'cluster|keyslot' command"}
+		}
+		return []string{fmt.Sprintf("(integer) %d", KeyHashSlot(args[0]))}
+	case "COUNTKEYSINSLOT":
+		if len(args) != 1 {
+			return []string{"(error) ERR wrong number of arguments for 'cluster|countkeysinslot' command"}
+		}
+		slot, err := ParseSlot(args[0])
+		if err != nil {
+			return []string{err.Error()}
+		}
+		return []string{fmt.Sprintf("(integer) %d", this.cluster.CountKeysInSlot(slot))}
+	case "GETKEYSINSLOT":
+		if len(args) != 2 {
+			return []string{"(error) ERR wrong number of arguments for 'cluster|getkeysinslot' command"}
+		}
+		slot, err := ParseSlot(args[0])
+		if err != nil {
+			return []string{err.Error()}
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count < 0 {
+			return []string{"(error) ERR Invalid number of keys"}
+		}
+		keys := this.cluster.GetKeysInSlot(slot, count)
+		if len(keys) == 0 {
+			return []string{"(empty array)"}
+		}
+		return keys
+	default:
+		return []string{fmt.Sprintf("(error) ERR unknown subcommand '%s'", subcmd)}
+	}
+}
+
+func (this *ClusterRouter) addOrDelSlots(add bool, slots []uint32) []string {
+	var err error
+	if add {
+		err = this.cluster.AddSlots(slots)
+	} else {
+		err = this.cluster.DelSlots(slots)
+	}
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return []string{"OK"}
+}
+
+// MIGRATE host port key destination-db timeout(ms) [AUTH password | AUTH2 username password]
+func (this *ClusterRouter) migrate(conn ziface.IConnection, args []string) []string {
+	auth := []string{}
+	if len(args) == 7 && strings.ToUpper(args[5]) == "AUTH" {
+		auth = []string{"AUTH", args[6]}
+	} else if len(args) == 8 && strings.ToUpper(args[5]) == "AUTH2" {
+		auth = []string{"AUTH", args[6], args[7]}
+	} else if len(args) != 5 {
+		return []string{"(error) ERR wrong number of arguments for 'migrate' command"}
+	}
+	timeout, err := strconv.Atoi(args[4])
+	if err != nil || timeout <= 0 {
+		return []string{"(error) ERR value is not an integer or out of range"}
+	}
+	idb, err := conn.GetProperty("db")
+	if err != nil {
+		panic("db is not found")
+	}
+
+	err = this.cluster.Migrate(idb.(siface.IDb), net.JoinHostPort(args[0], args[1]), args[2], args[3], time.Duration(timeout)*time.Millisecond, auth)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return []string{"OK"}
+}
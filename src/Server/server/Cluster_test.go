@@ -0,0 +1,315 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"gedis/src/Server/server"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a cluster node serving clients on a real port, its bus listens on port + CLUSTER_BUS_PORT_INCR
+type testClusterNode struct {
+	addr      string
+	acl       *server.Acl
+	cluster   *server.Cluster
+	db_mgr    *server.DbManager
+	db_router *server.DbRouter
+	router    *server.ClusterRouter
+	s         ziface.IServer
+}
+
+func startClusterNode(t *testing.T, dir string) *testClusterNode {
+	port := 0
+	for port == 0 {
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		port = listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		if port+server.CLUSTER_BUS_PORT_INCR > 65535 {
+			port = 0
+		}
+	}
+	old_ip, old_port := utils.Global_obj.Ip, utils.Global_obj.Port
+	old_enabled, old_acl := utils.Global_obj.ClusterEnabled, utils.Global_obj.AclFile
+	utils.Global_obj.Ip = "127.0.0.1"
+	utils.Global_obj.Port = uint32(port)
+	utils.Global_obj.ClusterEnabled = true
+	utils.Global_obj.AclFile = filepath.Join(dir, "users.acl")
+
+	acl := server.NewAcl()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	node := &testClusterNode{addr: fmt.Sprintf("127.0.0.1:%d", port), acl: acl}
+	node.db_mgr = server.NewDbManagerIn(filepath.Join(dir, "database"))
+	node.db_mgr.Start()
+	node.cluster = server.NewCluster(node.db_mgr)
+	if err := node.cluster.Start(); err != nil {
+		t.Fatal(err)
+	}
+	node.db_router = server.NewDbRouter(acl, node.cluster)
+	node.router = server.NewClusterRouter(acl, node.cluster)
+
+	s := znet.NewServer()
+	node.s = s
+	s.AddRounter(0, node.db_router)
+	s.AddRounter(server.CLUSTER_MSG_ID, node.router)
+	s.SetOnConnStart(func(conn ziface.IConnection) {
+		conn.SetProperty("db", node.db_mgr.GetDb(0))
+		acl.OnConnStart(conn)
+	})
+	go s.Start()
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", node.addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// the server and the cluster have read the config
+	utils.Global_obj.Ip, utils.Global_obj.Port = old_ip, old_port
+	utils.Global_obj.ClusterEnabled, utils.Global_obj.AclFile = old_enabled, old_acl
+	t.Cleanup(func() {
+		s.Stop()
+		node.cluster.Stop()
+		node.db_mgr.Stop()
+	})
+	return node
+}
+
+// a client of node, cmds are handled by the routers of node
+func (this *testClusterNode) client(id uint32) *clientConn {
+	conn := newClientConn(id, this.s.GetConnectionManager())
+	conn.SetProperty("db", this.db_mgr.GetDb(0))
+	this.acl.OnConnStart(conn)
+	return conn
+}
+
+// slots are the same as redis cluster
+func TestKeyHashSlot(t *testing.T) {
+	cases := map[string]uint32{
+		"123456789":            12739,
+		"foo":                  12182,
+		"bar":                  5061,
+		"hello":                866,
+		"{user1000}.following": 3443,
+		"{user1000}.followers": 3443,
+		"foo{}{bar}":           8363,
+		"foo{{bar}}zap":        4015,
+		"foo{bar}{zap}":        5061,
+		"":                     0,
+	}
+	for key, slot := range cases {
+		if server.KeyHashSlot(key) != slot {
+			t.Errorf("TestKeyHashSlot failed, key %s, slot %d, expect %d", key, server.KeyHashSlot(key), slot)
+		}
+	}
+}
+
+func TestGetCmdKeys(t *testing.T) {
+	cases := []struct {
+		cmd  []string
+		keys []string
+	}{
+		{[]string{"SET", "k", "v"}, []string{"k"}},
+		{[]string{"MSET", "k1", "v1", "k2", "v2"}, []string{"k1", "k2"}},
+		{[]string{"DEL", "k1", "k2", "k3"}, []string{"k1", "k2", "k3"}},
+		{[]string{"KEYS", "*"}, []string{}},
+		{[]string{"ZADD", "z", "1", "a"}, []string{"z"}},
+		{[]string{"GET"}, []string{}},
+		{[]string{"UNKNOWN", "k"}, []string{}},
+	}
+	for _, c := range cases {
+		keys := server.GetCmdKeys(c.cmd)
+		if len(keys) != len(c.keys) {
+			t.Errorf("TestGetCmdKeys failed, cmd %v", c.cmd)
+			continue
+		}
+		for i := range keys {
+			if keys[i] != c.keys[i] {
+				t.Errorf("TestGetCmdKeys failed, cmd %v", c.cmd)
+			}
+		}
+	}
+}
+
+// MOVED, ASK and MIGRATE between two nodes
+func TestCluster1(t *testing.T) {
+	a, b := startClusterNode(t, t.TempDir()), startClusterNode(t, t.TempDir())
+	slots := make([]uint32, 0, server.CLUSTER_SLOTS)
+	for slot := uint32(0); slot < server.CLUSTER_SLOTS; slot++ {
+		if slot != 12182 {
+			slots = append(slots, slot)
+		}
+	}
+	a.cluster.AddSlots(slots)
+	b.cluster.AddSlots([]uint32{12182})
+	if err := a.cluster.Meet(b.addr); err != nil {
+		t.Fatal(err)
+	}
+	ca, cb := a.client(1), b.client(2)
+
+	// foo is in the slot of b
+	if a.db_router.Handle(newFakeRequest(ca, "SET foo 1")); ca.next()[0] != "(error) MOVED 12182 "+b.addr {
+		t.Error("TestCluster1 failed")
+	}
+	if b.db_router.Handle(newFakeRequest(cb, "SET foo 1")); cb.next()[0] != "OK" {
+		t.Error("TestCluster1 failed")
+	}
+	if a.db_router.Handle(newFakeRequest(ca, "RPUSH {bar}l x y")); ca.next()[0] != "(integer) 2" {
+		t.Error("TestCluster1 failed")
+	}
+	a.db_router.Handle(newFakeRequest(ca, "SET bar v"))
+	ca.next()
+
+	// move slot 5061 of {bar}l and bar from a to b
+	if err := b.cluster.SetSlot(5061, "IMPORTING", a.cluster.GetMyId()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.cluster.SetSlot(5061, "MIGRATING", b.cluster.GetMyId()); err != nil {
+		t.Fatal(err)
+	}
+	if a.router.Handle(newFakeRequest(ca, fmt.Sprintf("MIGRATE 127.0.0.1 %s {bar}l 0 1000", b.addr[len("127.0.0.1:"):]))); ca.next()[0] != "OK" {
+		t.Fatal("TestCluster1 failed")
+	}
+	// the keys moved are asked to b, the keys left are still served by a
+	if a.db_router.Handle(newFakeRequest(ca, "LRANGE {bar}l 0 -1")); ca.next()[0] != "(error) ASK 5061 "+b.addr {
+		t.Error("TestCluster1 failed")
+	}
+	if a.db_router.Handle(newFakeRequest(ca, "GET bar")); ca.next()[0] != "v" {
+		t.Error("TestCluster1 failed")
+	}
+	if a.db_router.Handle(newFakeRequest(ca, "DEL bar {bar}l")); ca.next()[0] != "(error) TRYAGAIN Multiple keys request during rehashing of slot" {
+		t.Error("TestCluster1 failed")
+	}
+	// b serves the slot importing only after ASKING
+	if b.db_router.Handle(newFakeRequest(cb, "LRANGE {bar}l 0 -1")); cb.next()[0] != "(error) MOVED 5061 "+a.addr {
+		t.Error("TestCluster1 failed")
+	}
+	b.router.Handle(newFakeRequest(cb, "ASKING"))
+	cb.next()
+	if b.db_router.Handle(newFakeRequest(cb, "LRANGE {bar}l 0 -1")); !reflect.DeepEqual(cb.next(), []string{"x", "y"}) {
+		t.Error("TestCluster1 failed")
+	}
+
+	// migrating a key missing
+	if a.router.Handle(newFakeRequest(ca, fmt.Sprintf("MIGRATE 127.0.0.1 %s {bar}l 0 1000", b.addr[len("127.0.0.1:"):]))); ca.next()[0] != "NOKEY" {
+		t.Error("TestCluster1 failed")
+	}
+}
+
+// a script can't access the keys of the slots of other nodes
+func TestCluster3(t *testing.T) {
+	a, b := startClusterNode(t, t.TempDir()), startClusterNode(t, t.TempDir())
+	slots := make([]uint32, 0, server.CLUSTER_SLOTS)
+	for slot := uint32(0); slot < server.CLUSTER_SLOTS; slot++ {
+		if slot != 12182 {
+			slots = append(slots, slot)
+		}
+	}
+	a.cluster.AddSlots(slots)
+	b.cluster.AddSlots([]uint32{12182})
+	if err := a.cluster.Meet(b.addr); err != nil {
+		t.Fatal(err)
+	}
+	ca := a.client(1)
+
+	if a.db_router.Handle(newFakeRequest(ca, "EVAL redis.call('SET','bar','1') 0")); ca.next()[0] != "(nil)" {
+		t.Error("TestCluster3 failed")
+	}
+	// foo is in the slot of b
+	a.db_router.Handle(newFakeRequest(ca, "EVAL redis.call('SET','foo','1') 0"))
+	if res := ca.next()[0]; !strings.Contains(res, "Script attempted to access a non local key in a cluster node") {
+		t.Error("TestCluster3 failed", res)
+	}
+	a.db_router.Handle(newFakeRequest(ca, "EVAL redis.call('MSET','bar','1','baz','2') 0"))
+	if res := ca.next()[0]; !strings.Contains(res, "CROSSSLOT") {
+		t.Error("TestCluster3 failed", res)
+	}
+}
+
+// a self-signed cert of 127.0.0.1, it's also the CA to verify itself
+func newTestCert(t *testing.T, dir string) (cert_file string, key_file string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gedis"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, _ := x509.MarshalECPrivateKey(key)
+	cert_file, key_file = filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key")
+	os.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600)
+	return
+}
+
+// with TLSReplication the nodes talk through the bus with tls, and the bus refuses plain tcp
+func TestCluster2(t *testing.T) {
+	dir := t.TempDir()
+	cert_file, key_file := newTestCert(t, dir)
+	old_cert, old_key, old_ca := utils.Global_obj.TLSCertFile, utils.Global_obj.TLSKeyFile, utils.Global_obj.TLSCAFile
+	old_auth, old_repl := utils.Global_obj.TLSAuthClients, utils.Global_obj.TLSReplication
+	utils.Global_obj.TLSCertFile, utils.Global_obj.TLSKeyFile, utils.Global_obj.TLSCAFile = cert_file, key_file, cert_file
+	utils.Global_obj.TLSAuthClients, utils.Global_obj.TLSReplication = true, true
+	t.Cleanup(func() {
+		utils.Global_obj.TLSCertFile, utils.Global_obj.TLSKeyFile, utils.Global_obj.TLSCAFile = old_cert, old_key, old_ca
+		utils.Global_obj.TLSAuthClients, utils.Global_obj.TLSReplication = old_auth, old_repl
+	})
+
+	a, b := startClusterNode(t, t.TempDir()), startClusterNode(t, t.TempDir())
+	b.cluster.AddSlots([]uint32{12182})
+	if err := a.cluster.Meet(b.addr); err != nil {
+		t.Fatal(err)
+	}
+	ca := a.client(1)
+	if a.db_router.Handle(newFakeRequest(ca, "GET foo")); ca.next()[0] != "(error) MOVED 12182 "+b.addr {
+		t.Error("TestCluster2 failed")
+	}
+
+	// a PING in plain tcp gets no PONG
+	host, port, _ := net.SplitHostPort(b.addr)
+	p, _ := strconv.Atoi(port)
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(p+server.CLUSTER_BUS_PORT_INCR)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cmd_packer, data_pack := server.NewCmdPack(), znet.NewDataPack()
+	ping := [][]byte{[]byte("PING"), []byte("id"), []byte("127.0.0.1:1"), []byte("0"), []byte("-")}
+	buf, _ := data_pack.Pack(znet.NewMessage(0, cmd_packer.PackCmd(ping)))
+	conn.Write(buf)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = data_pack.ReadMsg(conn); err == nil {
+		t.Error("TestCluster2 failed, plain tcp is accepted")
+	}
+	if len(b.cluster.Nodes()) != 2 {
+		t.Error("TestCluster2 failed")
+	}
+}
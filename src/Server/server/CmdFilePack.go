@@ -1,6 +1,11 @@
 package server
 
-import "strings"
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
 type CmdFilePack struct {
 	// read commands, don't need to persist into file
@@ -11,7 +16,11 @@ func NewCmdFilePack() *CmdFilePack {
 	return &CmdFilePack{
 		rcmds: []string{"GET", "TTL", "KEYS",
 			"LLEN", "LINDEX", "LRANGE",
-			"ZCARD", "ZRANGE", "ZCOUNT", "ZRANK", "ZSCORE"},
+			"ZCARD", "ZRANGE", "ZCOUNT", "ZRANK", "ZSCORE",
+			"GETBIT", "BITCOUNT", "BITPOS", "BITFIELD_RO",
+			"PFCOUNT", "PFDEBUG",
+			"GEOPOS", "GEODIST", "GEOHASH", "GEOSEARCH",
+			"XLEN", "XRANGE", "XREVRANGE", "XREAD", "XPENDING", "XINFO"},
 	}
 }
 
@@ -22,22 +31,59 @@ func (this *CmdFilePack) SerializeCmd(cmd []string) string {
 		}
 	}
 
-	return strings.Join(cmd, " ") + "\n"
+	args := make([]string, 0, len(cmd))
+	for _, arg := range cmd {
+		args = append(args, QuoteArg(arg))
+	}
+	return strings.Join(args, " ") + "\n"
 }
 
 func (this *CmdFilePack) UnserializeCmd(buf string) []string {
-	cmd := make([]string, 0)
-	word := ""
-	for _, v := range buf {
-		if v == ' ' || v == '\n' {
-			if word != "" {
-				cmd = append(cmd, word)
-				word = ""
+	cmd, err := SplitArgs(buf)
+	if err != nil {
+		return []string{}
+	}
+	return cmd
+}
+
+// args are binary-safe in a cmdline: an arg is quoted like a go string if it's empty,
+// starts with a quote, or has spaces or bytes not printable. the others are kept as they are,
+// so old cmdlines split by space are still valid
+func QuoteArg(arg string) string {
+	if arg == "" || arg[0] == '"' {
+		return strconv.Quote(arg)
+	}
+	for _, r := range arg {
+		if r == utf8.RuneError || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return strconv.Quote(arg)
+		}
+	}
+	return arg
+}
+
+// split a cmdline into args separated by spaces, args in double quotes are unquoted like go strings
+func SplitArgs(line string) ([]string, error) {
+	args := make([]string, 0)
+	for {
+		line = strings.TrimLeft(line, " \t\r\n")
+		if line == "" {
+			return args, nil
+		}
+		if line[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, err
 			}
+			arg, _ := strconv.Unquote(quoted)
+			args = append(args, arg)
+			line = line[len(quoted):]
 			continue
-		} else {
-			word += string(v)
 		}
+		end := strings.IndexAny(line, " \t\r\n")
+		if end < 0 {
+			end = len(line)
+		}
+		args = append(args, line[:end])
+		line = line[end:]
 	}
-	return cmd
 }
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"strconv"
 )
 
@@ -56,6 +57,22 @@ func (this *CmdPack) UnpackCmd(buf []byte) [][]byte {
 	}
 }
 
+// unpack a stream of cmds packed one after another, i.e. the replication backlog
+func (this *CmdPack) UnpackCmds(buf []byte) [][][]byte {
+	reader := bufio.NewReader(bytes.NewReader(buf))
+	cmds := make([][][]byte, 0)
+	for {
+		sign, err := reader.ReadByte()
+		if err == io.EOF {
+			return cmds
+		}
+		if err != nil || sign != byte('*') {
+			panic("invalid msg to unpack")
+		}
+		cmds = append(cmds, this.unpackArray(reader))
+	}
+}
+
 func (this *CmdPack) unpackArray(reader *bufio.Reader) [][]byte {
 	bnum, err := reader.ReadBytes('\n')
 	bnum = bytes.TrimRight(bnum, this.eof)
@@ -86,7 +103,8 @@ func (this *CmdPack) unpackBinary(reader *bufio.Reader) []byte {
 		panic(err.Error())
 	}
 	data := make([]byte, num)
-	if _, err = reader.Read(data); err != nil {
+	// bufio.Reader.Read may return less than len(data) when its buffer runs out, use ReadFull
+	if _, err = io.ReadFull(reader, data); err != nil {
 		panic(err.Error())
 	}
 	// 读取\r\n
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// categories of a cmd and where the keys are in its args, index 0 is the cmd name itself
+type cmdSpec struct {
+	categories string // separated by space, used by ACL as @category
+
+	// 0 means the cmd has no key, -1 means the keys are the first half of the args after STREAMS,
+	// -2 means the keys follow numkeys, which is the 2nd arg
+	first_key int
+	last_key  int // negative index counts from the end, -1 is the last arg
+	step      int
+}
+
+var cmd_specs = map[string]cmdSpec{
+	// string
+	"SET":     {"write string", 1, 1, 1},
+	"GET":     {"read string", 1, 1, 1},
+	"DEL":     {"write keyspace", 1, -1, 1},
+	"MSET":    {"write string", 1, -1, 2},
+	"EXPIRE":  {"write keyspace", 1, 1, 1},
+	"PERSIST": {"write keyspace", 1, 1, 1},
+	"TTL":     {"read keyspace", 1, 1, 1},
+	"KEYS":    {"read keyspace dangerous", 0, 0, 0},
+	"FLUSHDB": {"write keyspace dangerous", 0, 0, 0},
+	// list
+	"LPUSH":  {"write list", 1, 1, 1},
+	"RPUSH":  {"write list", 1, 1, 1},
+	"LPOP":   {"write list", 1, 1, 1},
+	"RPOP":   {"write list", 1, 1, 1},
+	"LLEN":   {"read list", 1, 1, 1},
+	"LINDEX": {"read list", 1, 1, 1},
+	"LRANGE": {"read list", 1, 1, 1},
+	// zset
+	"ZADD":          {"write sortedset", 1, 1, 1},
+	"ZREM":          {"write sortedset", 1, 1, 1},
+	"ZCARD":         {"read sortedset", 1, 1, 1},
+	"ZRANGE":        {"read sortedset", 1, 1, 1},
+	"ZRANGEBYSCORE": {"read sortedset", 1, 1, 1},
+	"ZCOUNT":        {"read sortedset", 1, 1, 1},
+	"ZRANK":         {"read sortedset", 1, 1, 1},
+	"ZSCORE":        {"read sortedset", 1, 1, 1},
+	// bitmap
+	"SETBIT":      {"write bitmap", 1, 1, 1},
+	"GETBIT":      {"read bitmap", 1, 1, 1},
+	"BITCOUNT":    {"read bitmap", 1, 1, 1},
+	"BITPOS":      {"read bitmap", 1, 1, 1},
+	"BITOP":       {"write bitmap", 2, -1, 1},
+	"BITFIELD":    {"write bitmap", 1, 1, 1},
+	"BITFIELD_RO": {"read bitmap", 1, 1, 1},
+	// geo
+	"GEOADD":         {"write geo", 1, 1, 1},
+	"GEOPOS":         {"read geo", 1, 1, 1},
+	"GEODIST":        {"read geo", 1, 1, 1},
+	"GEOHASH":        {"read geo", 1, 1, 1},
+	"GEOSEARCH":      {"read geo", 1, 1, 1},
+	"GEOSEARCHSTORE": {"write geo", 1, 2, 1},
+	// scripting
+	"EVAL":     {"scripting", -2, 0, 0},
+	"EVALSHA":  {"scripting", -2, 0, 0},
+	"SCRIPT":   {"scripting", 0, 0, 0},
+	"FCALL":    {"scripting", -2, 0, 0},
+	"FCALL_RO": {"scripting", -2, 0, 0},
+	"FUNCTION": {"scripting", 0, 0, 0},
+	// hyperloglog
+	"PFADD":   {"write hyperloglog", 1, 1, 1},
+	"PFCOUNT": {"read hyperloglog", 1, -1, 1},
+	"PFMERGE": {"write hyperloglog", 1, -1, 1},
+	"PFDEBUG": {"read hyperloglog admin", 2, 2, 1},
+	// stream
+	"XADD":       {"write stream", 1, 1, 1},
+	"XLEN":       {"read stream", 1, 1, 1},
+	"XRANGE":     {"read stream", 1, 1, 1},
+	"XREVRANGE":  {"read stream", 1, 1, 1},
+	"XDEL":       {"write stream", 1, 1, 1},
+	"XTRIM":      {"write stream", 1, 1, 1},
+	"XSETID":     {"write stream", 1, 1, 1},
+	"XREAD":      {"read stream blocking", -1, 0, 0},
+	"XGROUP":     {"write stream", 2, 2, 1},
+	"XREADGROUP": {"write stream blocking", -1, 0, 0},
+	"XACK":       {"write stream", 1, 1, 1},
+	"XPENDING":   {"read stream", 1, 1, 1},
+	"XCLAIM":     {"write stream", 1, 1, 1},
+	"XAUTOCLAIM": {"write stream", 1, 1, 1},
+	"XINFO":      {"read stream", 2, 2, 1},
+	// db select
+	"SELECT": {"connection", 0, 0, 0},
+	// replication
+	"PSYNC":     {"admin dangerous", 0, 0, 0},
+	"REPLICAOF": {"admin dangerous", 0, 0, 0},
+	"ROLE":      {"admin", 0, 0, 0},
+	// cluster
+	"CLUSTER": {"admin", 0, 0, 0},
+	"ASKING":  {"connection", 0, 0, 0},
+	"MIGRATE": {"write keyspace dangerous", 3, 3, 1},
+	// auth and acl
+	"AUTH": {"connection", 0, 0, 0},
+	"ACL":  {"admin dangerous", 0, 0, 0},
+	// server
+	"SHUTDOWN": {"admin dangerous", 0, 0, 0},
+	"COMMAND":  {"connection", 0, 0, 0},
+	"INFO":     {"dangerous", 0, 0, 0},
+	"SLOWLOG":  {"admin dangerous", 0, 0, 0},
+	"CLIENT":   {"admin connection", 0, 0, 0},
+	"MONITOR":  {"admin dangerous", 0, 0, 0},
+	"CONFIG":   {"admin dangerous", 0, 0, 0},
+	// pubsub
+	"SUBSCRIBE":    {"pubsub", 0, 0, 0},
+	"UNSUBSCRIBE":  {"pubsub", 0, 0, 0},
+	"PSUBSCRIBE":   {"pubsub", 0, 0, 0},
+	"PUNSUBSCRIBE": {"pubsub", 0, 0, 0},
+	"PUBLISH":      {"pubsub", 0, 0, 0},
+	"PUBSUB":       {"pubsub", 0, 0, 0},
+}
+
+// ids of the msgs carrying the cmds not handled by the DbRouter
+var cmd_msg_ids = map[string]uint32{
+	"SELECT":       1,
+	"PSYNC":        REPL_MSG_ID,
+	"REPLICAOF":    REPL_MSG_ID,
+	"ROLE":         REPL_MSG_ID,
+	"CLUSTER":      CLUSTER_MSG_ID,
+	"ASKING":       CLUSTER_MSG_ID,
+	"MIGRATE":      CLUSTER_MSG_ID,
+	"AUTH":         ACL_MSG_ID,
+	"ACL":          ACL_MSG_ID,
+	"SHUTDOWN":     SERVER_MSG_ID,
+	"COMMAND":      SERVER_MSG_ID,
+	"INFO":         SERVER_MSG_ID,
+	"SLOWLOG":      SERVER_MSG_ID,
+	"CLIENT":       SERVER_MSG_ID,
+	"MONITOR":      SERVER_MSG_ID,
+	"CONFIG":       SERVER_MSG_ID,
+	"SUBSCRIBE":    PUBSUB_MSG_ID,
+	"UNSUBSCRIBE":  PUBSUB_MSG_ID,
+	"PSUBSCRIBE":   PUBSUB_MSG_ID,
+	"PUNSUBSCRIBE": PUBSUB_MSG_ID,
+	"PUBLISH":      PUBSUB_MSG_ID,
+	"PUBSUB":       PUBSUB_MSG_ID,
+}
+
+// the id of the msg a client sends cmd with, 0 for the DbRouter
+func GetCmdMsgID(name string) uint32 {
+	return cmd_msg_ids[name]
+}
+
+// the group of a cmd shown by COMMAND DOCS, its first category other than the flags
+func getCmdGroup(name string) string {
+	for _, category := range strings.Fields(cmd_specs[name].categories) {
+		switch category {
+		case "read", "write", "dangerous", "blocking", "admin":
+		default:
+			return category
+		}
+	}
+	return "server"
+}
+
+func GetCmdNames() (names []string) {
+	names = make([]string, 0, len(cmd_specs))
+	for name := range cmd_specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// keys accessed by cmd, unknown cmds and cmds with wrong number of args have no keys
+func GetCmdKeys(cmd []string) (keys []string) {
+	keys = make([]string, 0)
+	if len(cmd) == 0 {
+		return
+	}
+	spec, ok := cmd_specs[cmd[0]]
+	if !ok || spec.first_key == 0 {
+		return
+	}
+	if spec.first_key == -1 {
+		for i, arg := range cmd {
+			if strings.ToUpper(arg) == "STREAMS" {
+				rest := cmd[i+1:]
+				return append(keys, rest[:len(rest)/2]...)
+			}
+		}
+		return
+	}
+	if spec.first_key == -2 {
+		if len(cmd) < 3 {
+			return
+		}
+		numkeys, err := strconv.Atoi(cmd[2])
+		if err != nil || numkeys < 0 || numkeys > len(cmd)-3 {
+			return
+		}
+		return append(keys, cmd[3:3+numkeys]...)
+	}
+
+	last := spec.last_key
+	if last < 0 {
+		last = len(cmd) + last
+	}
+	for i := spec.first_key; i <= last && i < len(cmd); i += spec.step {
+		keys = append(keys, cmd[i])
+	}
+	return
+}
+
+func isWriteCmd(name string) bool {
+	spec, ok := cmd_specs[name]
+	return ok && spec.hasCategory("write")
+}
+
+// all the cmds in category, "all" for every cmd
+func GetCategoryCmds(category string) (cmds []string) {
+	cmds = make([]string, 0)
+	for name, spec := range cmd_specs {
+		if category == "all" || spec.hasCategory(category) {
+			cmds = append(cmds, name)
+		}
+	}
+	return
+}
+
+func GetCategories() (categories []string) {
+	categories = make([]string, 0)
+	set := make(map[string]bool)
+	for _, spec := range cmd_specs {
+		for _, category := range strings.Fields(spec.categories) {
+			if !set[category] {
+				set[category] = true
+				categories = append(categories, category)
+			}
+		}
+	}
+	return
+}
+
+func IsCmdExist(name string) bool {
+	_, ok := cmd_specs[name]
+	return ok
+}
+
+func (this *cmdSpec) hasCategory(category string) bool {
+	for _, v := range strings.Fields(this.categories) {
+		if v == category {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"fmt"
+	"gedis/src/zinx/utils"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// a parameter of CONFIG, a field of utils.Global_obj
+type configParam struct {
+	// pointer to the field, Global_obj is copied over by LoadConfig and tests so it's taken each time
+	field func() interface{}
+	// nil if the parameter can't be changed at runtime
+	parse func(value string) (interface{}, error)
+}
+
+// the parameters like redis.conf, the mutable ones are read by the accessors of utils each time they are used,
+// so they take effect at once
+var config_params = map[string]configParam{
+	"bind":              {func() interface{} { return &utils.Global_obj.Ip }, nil},
+	"port":              {func() interface{} { return &utils.Global_obj.Port }, nil},
+	"unixsocket":        {func() interface{} { return &utils.Global_obj.UnixSocket }, nil},
+	"unixsocketperm":    {func() interface{} { return &utils.Global_obj.UnixSocketPerm }, nil},
+	"maxclients":        {func() interface{} { return &utils.Global_obj.MaxConnSize }, parseUint32},
+	"max-data-len":      {func() interface{} { return &utils.Global_obj.MaxDataLen }, nil},
+	"pool-size":         {func() interface{} { return &utils.Global_obj.PoolSize }, nil},
+	"task-queue-size":   {func() interface{} { return &utils.Global_obj.TaskQueueSize }, nil},
+	"max-conn-pending":  {func() interface{} { return &utils.Global_obj.MaxConnPending }, nil},
+	"shutdown-timeout":  {func() interface{} { return &utils.Global_obj.ShutdownTimeout }, parseUint32},
+	"tls-cert-file":     {func() interface{} { return &utils.Global_obj.TLSCertFile }, nil},
+	"tls-key-file":      {func() interface{} { return &utils.Global_obj.TLSKeyFile }, nil},
+	"tls-ca-cert-file":  {func() interface{} { return &utils.Global_obj.TLSCAFile }, nil},
+	"tls-auth-clients":  {func() interface{} { return &utils.Global_obj.TLSAuthClients }, nil},
+	"tls-replication":   {func() interface{} { return &utils.Global_obj.TLSReplication }, nil},
+	"repl-backlog-size": {func() interface{} { return &utils.Global_obj.ReplBacklogSize }, nil},
+	"masteruser":        {func() interface{} { return &utils.Global_obj.MasterUser }, parseString},
+	"masterauth":        {func() interface{} { return &utils.Global_obj.MasterAuth }, parseString},
+	"cluster-enabled":   {func() interface{} { return &utils.Global_obj.ClusterEnabled }, nil},
+	"requirepass":       {func() interface{} { return &utils.Global_obj.RequirePass }, nil},
+	"aclfile":           {func() interface{} { return &utils.Global_obj.AclFile }, nil},
+	"metrics-addr":      {func() interface{} { return &utils.Global_obj.MetricsAddr }, nil},
+
+	"notify-keyspace-events":  {func() interface{} { return &utils.Global_obj.NotifyKeyspaceEvents }, parseNotifyFlags},
+	"slowlog-log-slower-than": {func() interface{} { return &utils.Global_obj.SlowlogLogSlowerThan }, parseInt64},
+	"slowlog-max-len":         {func() interface{} { return &utils.Global_obj.SlowlogMaxLen }, parseUint32},
+	"maxmemory":               {func() interface{} { return &utils.Global_obj.MaxMemory }, parseMemory},
+	"aof-rewrite-cmds":        {func() interface{} { return &utils.Global_obj.AofRewriteCmds }, parseUint32},
+	"lua-time-limit":          {func() interface{} { return &utils.Global_obj.LuaTimeLimit }, parseUint32},
+}
+
+// CONFIG cmds, shared by the process like utils.Global_obj
+var config = NewConfig()
+
+type Config struct {
+	// CONFIG SET changes several parameters at once
+	lock   sync.Mutex
+	on_set map[string]func(value string)
+}
+
+func NewConfig() *Config {
+	return &Config{on_set: make(map[string]func(value string))}
+}
+
+// the config shared by the process
+func GetConfig() *Config {
+	return config
+}
+
+// fun is called with the new value once the parameter is set, for the ones kept out of Global_obj
+// like notify-keyspace-events in PubSub
+func (this *Config) OnSet(name string, fun func(value string)) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.on_set[name] = fun
+}
+
+func parseString(value string) (interface{}, error) {
+	return value, nil
+}
+
+func parseUint32(value string) (interface{}, error) {
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("argument couldn't be parsed into an integer")
+	}
+	return uint32(n), nil
+}
+
+func parseInt64(value string) (interface{}, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("argument couldn't be parsed into an integer")
+	}
+	return n, nil
+}
+
+// the flags are kept in the order of notify_chars like PubSub
+func parseNotifyFlags(value string) (interface{}, error) {
+	flags, err := ParseNotifyFlags(value)
+	if err != nil {
+		return nil, err
+	}
+	return NotifyFlagsString(flags), nil
+}
+
+// bytes with the units of redis, like 100mb or 1gb
+func parseMemory(value string) (interface{}, error) {
+	units := []struct {
+		suffix string
+		bytes  uint64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1},
+	}
+	lower := strings.ToLower(value)
+	unit := uint64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, unit = strings.TrimSuffix(lower, u.suffix), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseUint(lower, 10, 64)
+	if err != nil || n > ^uint64(0)/unit {
+		return nil, fmt.Errorf("argument must be a memory value")
+	}
+	return n * unit, nil
+}
+
+func configValue(param configParam) string {
+	switch field := param.field().(type) {
+	case *string:
+		return *field
+	case *uint32:
+		return fmt.Sprint(*field)
+	case *uint64:
+		return fmt.Sprint(*field)
+	case *int64:
+		return fmt.Sprint(*field)
+	case *bool:
+		if *field {
+			return "yes"
+		}
+		return "no"
+	}
+	return ""
+}
+
+// CONFIG GET parameter [parameter ...] | SET parameter value [parameter value ...] | REWRITE
+func (this *Config) configCmd(args []string) []string {
+	if len(args) == 0 {
+		return []string{"(error) ERR wrong number of arguments for 'config' command"}
+	}
+	sub := strings.ToUpper(args[0])
+	switch {
+	case sub == "GET" && len(args) > 1:
+		return this.get(args[1:])
+	case sub == "SET" && len(args) > 1 && len(args)%2 == 1:
+		return this.set(args[1:])
+	case sub == "REWRITE" && len(args) == 1:
+		this.lock.Lock()
+		defer this.lock.Unlock()
+		if err := utils.SaveConfig(); err != nil {
+			return []string{fmt.Sprintf("(error) ERR Rewriting config file: %s", err.Error())}
+		}
+		return []string{"OK"}
+	case sub == "GET" || sub == "SET" || sub == "REWRITE":
+		return []string{fmt.Sprintf("(error) ERR wrong number of arguments for 'config|%s' command", strings.ToLower(sub))}
+	}
+	return []string{fmt.Sprintf("(error) ERR unknown subcommand '%s'. Try CONFIG HELP.", args[0])}
+}
+
+// the names and values of the parameters matching any of the patterns, sorted by name
+func (this *Config) get(patterns []string) []string {
+	names := make([]string, 0)
+	for name := range config_params {
+		for _, pattern := range patterns {
+			if ismatch, _ := filepath.Match(strings.ToLower(pattern), name); ismatch {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	res := make([]string, 0, 2*len(names))
+	utils.ReadGlobalObj(func() {
+		for _, name := range names {
+			res = append(res, name, configValue(config_params[name]))
+		}
+	})
+	if len(res) == 0 {
+		return []string{"(empty array)"}
+	}
+	return res
+}
+
+// all the values are parsed before any of them is set, so none is set if any is invalid
+func (this *Config) set(args []string) []string {
+	values := make(map[string]interface{})
+	for i := 0; i < len(args); i += 2 {
+		name := strings.ToLower(args[i])
+		param, ok := config_params[name]
+		if !ok {
+			return []string{fmt.Sprintf("(error) ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i])}
+		}
+		if param.parse == nil {
+			return []string{fmt.Sprintf("(error) ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name)}
+		}
+		if _, ok := values[name]; ok {
+			return []string{fmt.Sprintf("(error) ERR CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", name)}
+		}
+		value, err := param.parse(args[i+1])
+		if err != nil {
+			return []string{fmt.Sprintf("(error) ERR CONFIG SET failed (possibly related to argument '%s') - %s", name, err.Error())}
+		}
+		values[name] = value
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	// the fields are read by the cmds running meanwhile through the accessors of utils
+	utils.SetGlobalObj(func() {
+		for name, value := range values {
+			switch field := config_params[name].field().(type) {
+			case *string:
+				*field = value.(string)
+			case *uint32:
+				*field = value.(uint32)
+			case *uint64:
+				*field = value.(uint64)
+			case *int64:
+				*field = value.(int64)
+			}
+		}
+	})
+	for name := range values {
+		if fun, ok := this.on_set[name]; ok {
+			fun(configValue(config_params[name]))
+		}
+	}
+	return []string{"OK"}
+}
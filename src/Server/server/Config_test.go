@@ -0,0 +1,188 @@
+package server_test
+
+import (
+	"fmt"
+	"gedis/src/Server/server"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/znet"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// CONFIG GET and SET change utils.Global_obj
+func TestConfig1(t *testing.T) {
+	old_max_len, old_max_memory := utils.Global_obj.SlowlogMaxLen, utils.Global_obj.MaxMemory
+	old_events := utils.Global_obj.NotifyKeyspaceEvents
+	defer func() {
+		utils.Global_obj.SlowlogMaxLen, utils.Global_obj.MaxMemory = old_max_len, old_max_memory
+		utils.Global_obj.NotifyKeyspaceEvents = old_events
+	}()
+
+	acl := newTestAcl(t, "")
+	s := znet.NewServer()
+	router := server.NewServerRouter(acl, s, server.NewDbManager())
+	c := newClientConn(1, s.GetConnectionManager())
+	acl.OnConnStart(c)
+	config := func(cmd string) []string {
+		router.Handle(newFakeRequest(c, cmd))
+		return c.next()
+	}
+
+	if res := config("CONFIG GET slowlog-*"); !reflect.DeepEqual(res, []string{"slowlog-log-slower-than", "10000", "slowlog-max-len", "128"}) {
+		t.Error("TestConfig1 failed", res)
+	}
+	if res := config("CONFIG GET port TLS-auth-clients nothing"); !reflect.DeepEqual(res, []string{"port", "8999", "tls-auth-clients", "no"}) {
+		t.Error("TestConfig1 failed", res)
+	}
+	if res := config("CONFIG GET nothing"); res[0] != "(empty array)" {
+		t.Error("TestConfig1 failed")
+	}
+
+	if res := config("CONFIG SET slowlog-max-len 10 maxmemory 2mb"); res[0] != "OK" ||
+		utils.Global_obj.SlowlogMaxLen != 10 || utils.Global_obj.MaxMemory != 2*1024*1024 {
+		t.Error("TestConfig1 failed")
+	}
+	if res := config("CONFIG SET maxmemory 3k"); res[0] != "OK" || utils.Global_obj.MaxMemory != 3000 {
+		t.Error("TestConfig1 failed")
+	}
+	// nothing is set if a value is invalid
+	if res := config("CONFIG SET slowlog-max-len 20 maxmemory 1xb"); !strings.HasPrefix(res[0], "(error) ERR CONFIG SET failed (possibly related to argument 'maxmemory')") ||
+		utils.Global_obj.SlowlogMaxLen != 10 {
+		t.Error("TestConfig1 failed", res)
+	}
+	if res := config("CONFIG SET port 1"); res[0] != "(error) ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config" {
+		t.Error("TestConfig1 failed", res)
+	}
+	if res := config("CONFIG SET nothing 1"); res[0] != "(error) ERR Unknown option or number of arguments for CONFIG SET - 'nothing'" {
+		t.Error("TestConfig1 failed", res)
+	}
+	if res := config("CONFIG SET maxclients"); res[0] != "(error) ERR wrong number of arguments for 'config|set' command" {
+		t.Error("TestConfig1 failed", res)
+	}
+
+	// the flags are normalized and passed to the hook
+	set := ""
+	server.GetConfig().OnSet("notify-keyspace-events", func(value string) { set = value })
+	defer server.GetConfig().OnSet("notify-keyspace-events", func(value string) {})
+	if res := config("CONFIG SET notify-keyspace-events KEA"); res[0] != "OK" || set != "AKE" || utils.Global_obj.NotifyKeyspaceEvents != "AKE" {
+		t.Error("TestConfig1 failed", set)
+	}
+	if res := config("CONFIG SET notify-keyspace-events Kq"); !strings.HasPrefix(res[0], "(error) ERR CONFIG SET failed") || set != "AKE" {
+		t.Error("TestConfig1 failed", res)
+	}
+}
+
+// CONFIG REWRITE writes the file loaded by LoadConfig
+func TestConfig2(t *testing.T) {
+	old_rewrite, old_max_conns, old_file := utils.Global_obj.AofRewriteCmds, utils.Global_obj.MaxConnSize, utils.ConfigFile
+	defer func() {
+		utils.Global_obj.AofRewriteCmds, utils.Global_obj.MaxConnSize, utils.ConfigFile = old_rewrite, old_max_conns, old_file
+	}()
+	dir := t.TempDir()
+	utils.ConfigFile = filepath.Join(dir, "config", "config.json")
+
+	acl := newTestAcl(t, "")
+	s := znet.NewServer()
+	router := server.NewServerRouter(acl, s, server.NewDbManager())
+	c := newClientConn(1, s.GetConnectionManager())
+	acl.OnConnStart(c)
+	router.Handle(newFakeRequest(c, "CONFIG SET aof-rewrite-cmds 100 maxclients 5"))
+	c.next()
+	if router.Handle(newFakeRequest(c, "CONFIG REWRITE")); c.next()[0] != "OK" {
+		t.Fatal("TestConfig2 failed")
+	}
+
+	// the saved fields are loaded, the others are the same
+	port := utils.Global_obj.Port
+	utils.Global_obj.AofRewriteCmds, utils.Global_obj.MaxConnSize = old_rewrite, old_max_conns
+	if err := utils.LoadConfig(utils.ConfigFile); err != nil || utils.Global_obj.AofRewriteCmds != 100 ||
+		utils.Global_obj.MaxConnSize != 5 || utils.Global_obj.Port != port {
+		t.Error("TestConfig2 failed", err)
+	}
+
+	// a malformed file is an error and Global_obj is kept
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(bad, []byte(`{"Port": "x"`), 0644)
+	if err := utils.LoadConfig(bad); err == nil || utils.Global_obj.MaxConnSize != 5 || utils.ConfigFile == bad {
+		t.Error("TestConfig2 failed")
+	}
+	if err := utils.LoadConfig(filepath.Join(dir, "nothing.json")); !os.IsNotExist(err) {
+		t.Error("TestConfig2 failed")
+	}
+}
+
+// write cmds growing the dbs are denied over maxmemory
+func TestConfig3(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+	old_max_memory := utils.Global_obj.MaxMemory
+	defer func() { utils.Global_obj.MaxMemory = old_max_memory }()
+
+	acl := newTestAcl(t, "")
+	db_mgr := server.NewDbManager()
+	db_mgr.Start()
+	defer db_mgr.Stop()
+	router := server.NewDbRouter(acl, server.NewCluster(db_mgr))
+	c := newClientConn(1, znet.NewServer().GetConnectionManager())
+	c.SetProperty("db", db_mgr.GetDb(0))
+	acl.OnConnStart(c)
+	db := func(cmd string) string {
+		router.Handle(newFakeRequest(c, cmd))
+		return c.next()[0]
+	}
+
+	db("SET k v")
+	utils.Global_obj.MaxMemory = 1
+	if res := db("SET k2 v"); res != "(error) OOM command not allowed when used memory > 'maxmemory'." {
+		t.Error("TestConfig3 failed", res)
+	}
+	if res := db("GET k"); res != "v" {
+		t.Error("TestConfig3 failed", res)
+	}
+	if res := db("DEL k"); res != "(integer) 1" {
+		t.Error("TestConfig3 failed", res)
+	}
+	utils.Global_obj.MaxMemory = 0
+	if res := db("SET k2 v"); res != "OK" {
+		t.Error("TestConfig3 failed", res)
+	}
+}
+
+// CONFIG SET while the cmds read the parameters, checked by the race detector
+func TestConfig4(t *testing.T) {
+	old_slower_than, old_max_memory := utils.Global_obj.SlowlogLogSlowerThan, utils.Global_obj.MaxMemory
+	defer func() {
+		utils.Global_obj.SlowlogLogSlowerThan, utils.Global_obj.MaxMemory = old_slower_than, old_max_memory
+	}()
+
+	acl := newTestAcl(t, "")
+	s := znet.NewServer()
+	router := server.NewServerRouter(acl, s, server.NewDbManager())
+	c := newClientConn(1, s.GetConnectionManager())
+	acl.OnConnStart(c)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			router.Handle(newFakeRequest(c, fmt.Sprintf("CONFIG SET slowlog-log-slower-than %d maxmemory %d", i, i)))
+			c.next()
+		}
+		close(done)
+	}()
+	slowlog := server.NewSlowlog()
+	for i := 0; i < 100; i++ {
+		slowlog.Observe([]string{"GET", "k"}, time.Millisecond, "127.0.0.1:1", 1)
+		utils.GetMaxMemory()
+	}
+	<-done
+	if res := utils.GetMaxMemory(); res != 99 {
+		t.Error("TestConfig4 failed", res)
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import "strings"
+
+const CLUSTER_SLOTS = 16384
+
+// crc16 of CCITT (XMODEM), poly 0x1021, the same as redis cluster
+func crc16(buf []byte) uint16 {
+	var crc uint16 = 0
+	for _, b := range buf {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ 0x1021
+			} else {
+				crc = crc << 1
+			}
+		}
+	}
+	return crc
+}
+
+// only the part in the first {...} is hashed if it is not empty,
+// so keys like {user1000}.following and {user1000}.followers are in the same slot
+func KeyHashSlot(key string) uint32 {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return uint32(crc16([]byte(key))) % CLUSTER_SLOTS
+}
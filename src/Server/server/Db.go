@@ -2,14 +2,17 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"gedis/src/Server/siface"
+	"gedis/src/zinx/utils"
 	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 const (
@@ -19,11 +22,20 @@ const (
 
 type Db struct {
 	name string
+	dir  string // the aof is dir/db_name
 
 	engine siface.IEngine
 
 	cmd_file_packer *CmdFilePack
 	cmd_chan        chan []string
+	save_chan       chan chan error
+	drain_chan      chan chan bool
+	on_write        func(name string, cmd []string)
+	on_notify       func(name string, class int, event string, key string)
+
+	// Exec holds it for reading, Close waits the running cmds with it
+	exec_lock sync.RWMutex
+	closed    bool
 
 	f_lock     sync.RWMutex
 	fd         *os.File
@@ -31,21 +43,57 @@ type Db struct {
 	rewrite_wg sync.WaitGroup
 	exit_chan  chan bool
 	exit_wg    sync.WaitGroup
+
+	// aof rewrites shown by INFO
+	stats_lock        sync.Mutex
+	rewrites          uint64
+	rewriting         bool
+	last_rewrite_err  error
+	last_rewrite_at   int64
+	last_rewrite_time int64
 }
 
 func NewDb(name string) *Db {
-	return &Db{
+	return NewDbIn("database", name)
+}
+
+func NewDbIn(dir string, name string) *Db {
+	db := &Db{
 		name: name,
+		dir:  dir,
 
 		engine: NewEngine(),
 
 		cmd_file_packer: NewCmdFilePack(),
 		cmd_chan:        make(chan []string, 256),
+		save_chan:       make(chan chan error),
+		drain_chan:      make(chan chan bool),
+		on_write:        func(name string, cmd []string) {},
+		on_notify:       func(name string, class int, event string, key string) {},
 		f_lock:          sync.RWMutex{},
 		rewrite_wg:      sync.WaitGroup{},
 		exit_chan:       make(chan bool),
 		exit_wg:         sync.WaitGroup{},
+
+		last_rewrite_time: -1,
 	}
+	db.engine.SetOnNotify(func(class int, event string, key string) {
+		if event == "expired" {
+			metrics.AddExpiredKey()
+		}
+		db.on_notify(db.name, class, event, key)
+	})
+	// write cmds go to persistDb in the order they are executed
+	db.engine.SetOnProps(func(props [][]string) {
+		for _, prop := range props {
+			db.cmd_chan <- prop
+		}
+	})
+	return db
+}
+
+func (this *Db) path() string {
+	return filepath.Join(this.dir, fmt.Sprintf("db_%s", this.name))
 }
 
 func (this *Db) Open() error {
@@ -53,6 +101,8 @@ func (this *Db) Open() error {
 	this.engine.Start()
 	// open database
 	this.recoverDb()
+	// the lookups replaying the aof aren't counted
+	this.engine.ResetKeyspaceStats()
 	// start persist
 	this.persistReset()
 	this.exit_wg.Add(1) // used for wait persistDb exits compeletly
@@ -62,6 +112,12 @@ func (this *Db) Open() error {
 }
 
 func (this *Db) Close() error {
+	// blocked cmds return first, otherwise they hold exec_lock forever
+	this.engine.Unblock()
+	this.exec_lock.Lock()
+	this.closed = true
+	this.exec_lock.Unlock()
+
 	this.exit_chan <- true
 	// wait persist2File exits compeletly:
 	// 1. handle all cmds in channel
@@ -69,14 +125,22 @@ func (this *Db) Close() error {
 	this.exit_wg.Wait()
 
 	this.engine.Stop()
+	functions.Close()
 
 	close(this.cmd_chan)
+	close(this.save_chan)
+	close(this.drain_chan)
 	close(this.exit_chan)
 
 	return nil
 }
 
 func (this *Db) Exec(bcmd [][]byte) [][]byte {
+	return this.ExecCheck(bcmd, nil)
+}
+
+// like Exec, the cmds called by scripts are run only if check returns no error reply, nil checks nothing
+func (this *Db) ExecCheck(bcmd [][]byte, check func(cmd []string) string) [][]byte {
 	if len(bcmd) == 0 {
 		ret := make([][]byte, 0, 1)
 		ret = append(ret, []byte("(error) ERR wrong number of arguments for 'exec' command"))
@@ -89,10 +153,14 @@ func (this *Db) Exec(bcmd [][]byte) [][]byte {
 		cmd = append(cmd, string(v))
 	}
 
-	// execute cmd
-	res := this.engine.Handle(cmd)
-	// write into cmd channel for persistance
-	this.cmd_chan <- cmd
+	this.exec_lock.RLock()
+	defer this.exec_lock.RUnlock()
+	if this.closed {
+		return [][]byte{[]byte("(error) ERR server is shutting down")}
+	}
+
+	// execute cmd, the cmds to persist are sent to cmd channel by the engine
+	res, _ := this.engine.HandleCheck(cmd, check)
 
 	// []string -> [][]byte
 	ret := make([][]byte, 0, len(res))
@@ -102,23 +170,134 @@ func (this *Db) Exec(bcmd [][]byte) [][]byte {
 	return ret
 }
 
+// rewrite the aof file now and wait it finishes
+func (this *Db) Save() error {
+	res := make(chan error)
+	this.save_chan <- res
+	return <-res
+}
+
+// run fun while no cmd is running and every cmd executed is passed to the OnWrite callback,
+// so the data seen by fun is the one at the current point of the write stream
+func (this *Db) Freeze(fun func()) {
+	this.exec_lock.RLock()
+	defer this.exec_lock.RUnlock()
+	if this.closed {
+		fun()
+		return
+	}
+	this.engine.Exclusive(func(handle func(cmd []string) []string) {
+		done := make(chan bool)
+		this.drain_chan <- done
+		<-done
+		fun()
+	})
+}
+
+// run fun while no other cmd is running, the cmds fun runs by exec are persisted like the ones of Exec
+func (this *Db) Atomic(fun func(exec func(cmd []string) []string)) error {
+	this.exec_lock.RLock()
+	defer this.exec_lock.RUnlock()
+	if this.closed {
+		return errors.New("(error) ERR server is shutting down")
+	}
+	this.engine.Exclusive(fun)
+	return nil
+}
+
+// set the callback called with every write cmd, before it is persisted
+func (this *Db) SetOnWrite(fun func(name string, cmd []string)) {
+	this.on_write = fun
+}
+
+// fun is called with the keyspace notifications of this db, set it before Open
+func (this *Db) SetOnNotify(fun func(name string, class int, event string, key string)) {
+	this.on_notify = fun
+}
+
+func (this *Db) GetStats() siface.DbStats {
+	stats := siface.DbStats{}
+	stats.Keys, stats.Expires = this.engine.Count()
+	stats.KeyspaceHits, stats.KeyspaceMisses = this.engine.GetKeyspaceStats()
+
+	// the cmds buffered are counted as well
+	this.f_lock.RLock()
+	if finfo, err := os.Stat(this.path()); err == nil {
+		stats.AofSize = finfo.Size()
+	}
+	if this.writer != nil {
+		stats.AofSize += int64(this.writer.Buffered())
+	}
+	this.f_lock.RUnlock()
+
+	this.stats_lock.Lock()
+	stats.AofRewrites = this.rewrites
+	stats.AofRewriteInProgress = this.rewriting
+	stats.AofLastRewriteOk = this.last_rewrite_err == nil
+	stats.AofLastRewriteAt = this.last_rewrite_at
+	stats.AofLastRewriteTime = this.last_rewrite_time
+	this.stats_lock.Unlock()
+	return stats
+}
+
+// cmds to rebuild the current data of this db, used by the full resync of replication
+func (this *Db) Snapshot() (cmds [][]string) {
+	cmds = make([][]string, 0)
+	this.engine.Foreach(func(key string, val interface{}, TTL int64) {
+		cmds = append(cmds, this.key2cmds(key, val, TTL)...)
+	})
+	return
+}
+
+func (this *Db) Foreach(f func(key string, val interface{}, TTL int64)) {
+	this.engine.Foreach(f)
+}
+
+// cmds to rebuild a single key, empty if the key doesn't exist. used by MIGRATE of cluster
+func (this *Db) DumpKey(key string) [][]string {
+	val, TTL, err := this.engine.Dump(key)
+	if err != nil {
+		return [][]string{}
+	}
+	return this.key2cmds(key, val, TTL)
+}
+
+func (this *Db) key2cmds(key string, val interface{}, TTL int64) (cmds [][]string) {
+	cmds = this.entry2cmds(key, val, TTL)
+	if TTL != math.MaxInt64 {
+		cmds = append(cmds, []string{"EXPIRE", key, fmt.Sprint(TTL - time.Now().Unix())})
+	}
+	return
+}
+
 func (this *Db) persistDb() {
 	repersist_cnt := 0
 
 	persist_cmd := func(cmd []string) {
 		cmdline := this.cmd_file_packer.SerializeCmd(cmd)
 		if cmdline != "" {
+			// write cmds are fed to replication in the same order as they are persisted
+			this.on_write(this.name, cmd)
+			// the libraries are saved to their own file, replaying them from the aofs of several dbs
+			// could apply them out of order
+			if cmd[0] == "FUNCTION" {
+				return
+			}
+
 			this.f_lock.Lock()
+			start := time.Now()
 			_, err := this.writer.WriteString(cmdline)
+			metrics.ObserveAofWrite(time.Since(start))
 			this.f_lock.Unlock()
 			if err != nil {
 				return
 			}
 			repersist_cnt++
-			if repersist_cnt > 5 {
+			// read each time, it can be changed by CONFIG SET
+			if rewrite_cmds := utils.GetAofRewriteCmds(); rewrite_cmds > 0 && repersist_cnt > int(rewrite_cmds) {
 				this.rewrite_wg.Wait()
-				go this.reWriteDb()
 				this.rewrite_wg.Add(1)
+				go this.reWriteDb()
 				repersist_cnt = 0
 			}
 		}
@@ -129,6 +308,21 @@ exit:
 		select {
 		case cmd := <-this.cmd_chan:
 			persist_cmd(cmd)
+		case res := <-this.save_chan:
+			// cmds before the save are in the new aof
+			for len(this.cmd_chan) > 0 {
+				persist_cmd(<-this.cmd_chan)
+			}
+			this.rewrite_wg.Wait()
+			this.rewrite_wg.Add(1)
+			res <- this.reWriteDb()
+			repersist_cnt = 0
+		case done := <-this.drain_chan:
+			// no cmds are added while Freeze waits
+			for len(this.cmd_chan) > 0 {
+				persist_cmd(<-this.cmd_chan)
+			}
+			close(done)
 		case <-this.exit_chan:
 			break exit
 		}
@@ -145,16 +339,35 @@ exit:
 			persist_cmd(cmd)
 		default:
 			// no more msg in cmd_chan, all cmds are handled over
-			this.writer.Flush()
+			// wait the running rewrite, it switches this.fd to the new aof
+			this.rewrite_wg.Wait()
+			this.f_lock.Lock()
+			this.flush()
+			// make sure the aof is on disk before exit
+			if err := this.fd.Sync(); err != nil {
+				fmt.Printf("[PERSIST]: fail to fsync database %s, %s\n", this.name, err.Error())
+			}
 			this.fd.Close()
+			this.f_lock.Unlock()
 			this.exit_wg.Done()
 			return
 		}
 	}
 }
 
+// flush the cmds buffered into the aof, called with f_lock
+func (this *Db) flush() error {
+	start := time.Now()
+	err := this.writer.Flush()
+	metrics.ObserveAofFlush(time.Since(start))
+	return err
+}
+
 func (this *Db) recoverDb() {
-	fd, err := os.OpenFile(filepath.Join("database", fmt.Sprintf("db_%s", this.name)), os.O_CREATE|os.O_RDONLY, 0666)
+	// the aof may call the functions
+	functions.Open(filepath.Join(this.dir, "functions"))
+
+	fd, err := os.OpenFile(this.path(), os.O_CREATE|os.O_RDONLY, 0666)
 	if err != nil {
 		fmt.Printf("[RECOVER]: database %s is not find\n, create an empty one", this.name)
 	}
@@ -172,7 +385,7 @@ func (this *Db) recoverDb() {
 }
 
 func (this *Db) persistReset() {
-	fd, err := os.OpenFile(filepath.Join("database", fmt.Sprintf("db_%s", this.name)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	fd, err := os.OpenFile(this.path(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		fmt.Printf("[PERSISIT]: database %s is not find, create an empty one\n", this.name)
 	}
@@ -180,17 +393,32 @@ func (this *Db) persistReset() {
 	this.writer = bufio.NewWriter(fd)
 }
 
-func (this *Db) reWriteDb() {
+func (this *Db) reWriteDb() (err error) {
 	defer this.rewrite_wg.Done()
+
+	this.stats_lock.Lock()
+	this.rewriting = true
+	this.stats_lock.Unlock()
+	start := time.Now()
+	defer func() {
+		this.stats_lock.Lock()
+		this.rewrites++
+		this.rewriting = false
+		this.last_rewrite_err = err
+		this.last_rewrite_at = time.Now().Unix()
+		this.last_rewrite_time = time.Since(start).Milliseconds()
+		metrics.ObserveAofRewrite(time.Since(start))
+		this.stats_lock.Unlock()
+	}()
 	// important bug fix: flush... bufio is so horrible...flush, flush and flush...
 	// flush and get persist endline: cmd to recover is in dbfile[0: size)
 	size := func() int64 {
 		this.f_lock.Lock()
 		defer this.f_lock.Unlock()
 
-		this.writer.Flush()
+		this.flush()
 
-		fd, err := os.OpenFile(filepath.Join("database", fmt.Sprintf("db_%s", this.name)), os.O_CREATE|os.O_RDONLY, 0666)
+		fd, err := os.OpenFile(this.path(), os.O_CREATE|os.O_RDONLY, 0666)
 		if err != nil {
 			fmt.Printf("[RECOVER]: database %s is not find\n, create an empty one", this.name)
 		}
@@ -203,11 +431,11 @@ func (this *Db) reWriteDb() {
 		return finfo.Size()
 	}()
 	if size == 0 {
-		return
+		return nil
 	}
 
 	// read cmds in dbfile[0, size) and recover in a tmp engine [engine execute cmds for rewriting]
-	fd, err := os.OpenFile(filepath.Join("database", fmt.Sprintf("db_%s", this.name)), os.O_CREATE|os.O_RDONLY, 0666)
+	fd, err := os.OpenFile(this.path(), os.O_CREATE|os.O_RDONLY, 0666)
 	if err != nil {
 		fmt.Printf("[RECOVER]: database %s is not find\n, create an empty one", this.name)
 	}
@@ -228,18 +456,19 @@ func (this *Db) reWriteDb() {
 	}
 
 	// persist into a temp file
-	tmp_fd, err := ioutil.TempFile("database", "tmpaof")
+	tmp_fd, err := ioutil.TempFile(this.dir, "tmpaof")
 	if err != nil {
 		fmt.Println("fail to create tmp file...repersist stop")
 		fd.Close()
-		return
+		return err
 	}
 
 	writer := bufio.NewWriter(tmp_fd)
 	// traverse all keys and persist key and generate cmds to persist (key, value)s according to value.(type)
 	engine.Foreach(func(key string, val interface{}, TTL int64) {
-		cmd := this.entry2cmd(key, val, TTL)
-		writer.WriteString(this.cmd_file_packer.SerializeCmd(cmd))
+		for _, cmd := range this.entry2cmds(key, val, TTL) {
+			writer.WriteString(this.cmd_file_packer.SerializeCmd(cmd))
+		}
 	})
 
 	// during replay and write keys into dbfile, f_lock is not hold by rewrite goroutine, thus persist continues...
@@ -247,31 +476,41 @@ func (this *Db) reWriteDb() {
 	this.f_lock.Lock()
 	defer this.f_lock.Unlock()
 
+	// cmds buffered in this.writer since the flush above belong to the rest too
+	this.flush()
 	_, err = io.Copy(writer, reader)
 	if err != nil {
 		fmt.Println("fail to copy new cmds in src dbfile into tmp dbfile...repersist stop")
 		fd.Close()
 		tmp_fd.Close()
 		os.Remove(tmp_fd.Name()) // remember to remove tmp file
-		return
+		return err
 	}
 
 	fd.Close()
 	writer.Flush()
+	tmp_fd.Sync()
 	tmp_fd.Close()
 
 	err = os.Rename(tmp_fd.Name(), fd.Name())
 	if err != nil {
 		fmt.Println("fail to rename tmp aof to aof...repersisit stop")
-		return
+		return err
 	}
 
 	// importent... aof is a new file now, should reset this.fd to the new file and this.fd to the new this.fd...
+	this.fd.Close()
 	this.persistReset()
+	return nil
 }
 
-func (this *Db) entry2cmd(key string, val interface{}, TTL int64) (cmd []string) {
-	cmd = make([]string, 0)
+func (this *Db) entry2cmds(key string, val interface{}, TTL int64) (cmds [][]string) {
+	// a stream needs several cmds to rebuild its groups
+	if stream, ok := val.(siface.IStream); ok {
+		return stream2cmds(key, stream)
+	}
+
+	cmd := make([]string, 0)
 	switch val := val.(type) {
 	case string:
 		cmd = append(cmd, "SET", key, val)
@@ -287,5 +526,5 @@ func (this *Db) entry2cmd(key string, val interface{}, TTL int64) (cmd []string)
 	default:
 		fmt.Printf("invalid...")
 	}
-	return
+	return [][]string{cmd}
 }
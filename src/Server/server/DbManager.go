@@ -3,18 +3,32 @@ package server
 import (
 	"fmt"
 	"gedis/src/Server/siface"
+	"sync"
+	"time"
 )
 
 type DbManager struct {
 	dbs []siface.IDb
+
+	// CLIENT PAUSE, the cmds of the dbs wait until unpause is closed
+	pause_lock  sync.Mutex
+	pause_all   bool
+	pause_until time.Time
+	pause_timer *time.Timer
+	unpause     chan struct{} // nil if not paused
 }
 
 func NewDbManager() *DbManager {
+	return NewDbManagerIn("database")
+}
+
+// the dbs with their aof files in dir
+func NewDbManagerIn(dir string) *DbManager {
 	db_mgr := &DbManager{
 		dbs: make([]siface.IDb, 16),
 	}
 	for i := 0; i < 16; i++ {
-		db_mgr.dbs[i] = NewDb(fmt.Sprint(i))
+		db_mgr.dbs[i] = NewDbIn(dir, fmt.Sprint(i))
 	}
 	return db_mgr
 }
@@ -31,6 +45,125 @@ func (this *DbManager) Stop() {
 	}
 }
 
+// rewrite the aof files of all dbs
+func (this *DbManager) Save() error {
+	for _, db := range this.dbs {
+		if err := db.Save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run fun while the cmds of all the dbs are stopped and passed to OnWrite, like Db.Freeze
+func (this *DbManager) Freeze(fun func()) {
+	var freeze func(id int)
+	freeze = func(id int) {
+		if id == len(this.dbs) {
+			fun()
+			return
+		}
+		this.dbs[id].Freeze(func() { freeze(id + 1) })
+	}
+	freeze(0)
+}
+
+func (this *DbManager) SetOnWrite(fun func(name string, cmd []string)) {
+	for _, db := range this.dbs {
+		db.SetOnWrite(fun)
+	}
+}
+
+func (this *DbManager) SetOnNotify(fun func(name string, class int, event string, key string)) {
+	for _, db := range this.dbs {
+		db.SetOnNotify(fun)
+	}
+}
+
+// the stats of the dbs in order of their ids
+func (this *DbManager) GetStats() []siface.DbStats {
+	stats := make([]siface.DbStats, 0, len(this.dbs))
+	for _, db := range this.dbs {
+		stats = append(stats, db.GetStats())
+	}
+	return stats
+}
+
+func (this *DbManager) GetDbNum() uint32 {
+	return uint32(len(this.dbs))
+}
+
 func (this *DbManager) GetDb(id uint32) siface.IDb {
 	return this.dbs[id]
 }
+
+// the id of db, -1 if it isn't one of the dbs
+func (this *DbManager) GetDbID(db siface.IDb) int {
+	for id, d := range this.dbs {
+		if d == db {
+			return id
+		}
+	}
+	return -1
+}
+
+// pause the write cmds, or all the cmds if all, for d
+// a pause in progress is only made longer and stricter like redis
+func (this *DbManager) Pause(d time.Duration, all bool) {
+	this.pause_lock.Lock()
+	defer this.pause_lock.Unlock()
+
+	until := time.Now().Add(d)
+	if this.unpause == nil {
+		this.unpause = make(chan struct{})
+		this.pause_all, this.pause_until = all, until
+	} else {
+		this.pause_all = this.pause_all || all
+		if until.After(this.pause_until) {
+			this.pause_until = until
+		}
+	}
+	if this.pause_timer != nil {
+		this.pause_timer.Stop()
+	}
+	this.pause_timer = time.AfterFunc(time.Until(this.pause_until), func() {
+		this.pause_lock.Lock()
+		defer this.pause_lock.Unlock()
+		// the timer of a pause made longer may fire before it's stopped
+		if this.unpause != nil && !time.Now().Before(this.pause_until) {
+			this.endPause()
+		}
+	})
+}
+
+func (this *DbManager) Unpause() {
+	this.pause_lock.Lock()
+	defer this.pause_lock.Unlock()
+	if this.unpause != nil {
+		this.endPause()
+	}
+}
+
+// called with pause_lock
+func (this *DbManager) endPause() {
+	this.pause_timer.Stop()
+	close(this.unpause)
+	this.unpause = nil
+}
+
+// a chan closed when the pause of cmd ends, nil if cmd isn't paused
+// scripts may write, they are paused as write cmds, and PUBLISH is paused like redis
+func (this *DbManager) WaitPause(cmd []string) <-chan struct{} {
+	this.pause_lock.Lock()
+	defer this.pause_lock.Unlock()
+	if this.unpause == nil || len(cmd) == 0 {
+		return nil
+	}
+	switch {
+	case this.pause_all, isWriteCmd(cmd[0]):
+	case cmd[0] == "EVAL" || cmd[0] == "EVALSHA" || cmd[0] == "FCALL" || cmd[0] == "PUBLISH":
+	default:
+		return nil
+	}
+	return this.unpause
+}
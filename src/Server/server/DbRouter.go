@@ -4,20 +4,26 @@ import (
 	"gedis/src/Server/siface"
 	"gedis/src/zinx/ziface"
 	"gedis/src/zinx/znet"
+	"time"
 )
 
 type DbRouter struct {
 	znet.BaseRounter
+	acl        *Acl
+	cluster    *Cluster
 	cmd_packer siface.ICmdPack
 }
 
-func NewDbRouter() *DbRouter {
+func NewDbRouter(acl *Acl, cluster *Cluster) *DbRouter {
 	return &DbRouter{
+		acl:        acl,
+		cluster:    cluster,
 		cmd_packer: NewCmdPack(),
 	}
 }
 
 func (this *DbRouter) Handle(req ziface.IRequest) {
+	start := time.Now()
 	conn := req.GetConn()
 	buf := req.GetData()
 	idb, err := conn.GetProperty("db")
@@ -28,8 +34,76 @@ func (this *DbRouter) Handle(req ziface.IRequest) {
 
 	command := this.cmd_packer.UnpackCmd(buf)
 
-	res := db.Exec(command)
+	cmd := make([]string, 0, len(command))
+	for _, v := range command {
+		cmd = append(cmd, string(v))
+	}
+	onCmd(conn, cmd)
+	if err := this.acl.Check(conn, cmd); err != "" {
+		this.reply(conn, cmd, start, [][]byte{[]byte(err)})
+		return
+	}
+	if err := checkMaxMemory(cmd); err != "" {
+		this.reply(conn, cmd, start, [][]byte{[]byte(err)})
+		return
+	}
+
+	// cmds paused by CLIENT PAUSE wait in their own goroutine and park the connection like blocking cmds,
+	// the slots may be moved by a failover meanwhile, so they are redirected after the pause
+	if wait := this.cluster.db_mgr.WaitPause(cmd); wait != nil {
+		resume := req.Park()
+		go func() {
+			for wait != nil {
+				<-wait
+				// paused again
+				wait = this.cluster.db_mgr.WaitPause(cmd)
+			}
+			this.exec(conn, db, command, cmd, start)
+			resume()
+		}()
+		return
+	}
+
+	// a blocking cmd runs in its own goroutine and parks the connection instead of the worker,
+	// the later cmds of the connection wait it but the other connections go on
+	if IsBlockingCmd(cmd) {
+		resume := req.Park()
+		go func() {
+			this.exec(conn, db, command, cmd, start)
+			resume()
+		}()
+		return
+	}
+	this.exec(conn, db, command, cmd, start)
+}
+
+// redirect cmd or execute it in db
+func (this *DbRouter) exec(conn ziface.IConnection, db siface.IDb, command [][]byte, cmd []string, start time.Time) {
+	// keys in the slots of other nodes are redirected
+	if redirect := this.cluster.CheckRedirect(conn, cmd); redirect != "" {
+		this.reply(conn, cmd, start, [][]byte{[]byte(redirect)})
+		return
+	}
 
-	resp := this.cmd_packer.PackCmd(res)
-	conn.SendMsg(0, resp)
+	monitor.Feed(this.cluster.db_mgr.GetDbID(db), conn, cmd)
+	exec_start := time.Now()
+	// the cmds called by scripts are checked like the ones of the client
+	res := db.ExecCheck(command, func(cmd []string) string {
+		if err := this.acl.Check(conn, cmd); err != "" {
+			return err
+		}
+		return this.cluster.CheckScriptKeys(cmd)
+	})
+	// the time blocked isn't slow, it isn't logged by slowlog, but it's observed by the metrics
+	if !IsBlockingCmd(cmd) {
+		slowlog.Observe(cmd, time.Since(exec_start), conn.RemoteAddr().String(), conn.GetConnID())
+	}
+	this.reply(conn, cmd, start, res)
+}
+
+func (this *DbRouter) reply(conn ziface.IConnection, cmd []string, start time.Time, res [][]byte) {
+	if len(cmd) > 0 {
+		metrics.ObserveCmd(cmd[0], time.Since(start), res)
+	}
+	conn.SendMsg(0, this.cmd_packer.PackCmd(res))
 }
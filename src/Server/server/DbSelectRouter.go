@@ -6,22 +6,26 @@ import (
 	"gedis/src/zinx/ziface"
 	"gedis/src/zinx/znet"
 	"strconv"
+	"time"
 )
 
 type DbSelectRouter struct {
 	znet.BaseRounter
+	acl        *Acl
 	db_mgr     *DbManager
 	cmd_packer siface.ICmdPack
 }
 
-func NewDbSelectRouter(db_mgr *DbManager) *DbSelectRouter {
+func NewDbSelectRouter(acl *Acl, db_mgr *DbManager) *DbSelectRouter {
 	return &DbSelectRouter{
+		acl:        acl,
 		db_mgr:     db_mgr,
 		cmd_packer: NewCmdPack(),
 	}
 }
 
 func (this *DbSelectRouter) Handle(req ziface.IRequest) {
+	start := time.Now()
 	conn := req.GetConn()
 	buf := req.GetData()
 
@@ -29,34 +33,36 @@ func (this *DbSelectRouter) Handle(req ziface.IRequest) {
 	cmd := string(cmd_arg[0])
 	args := cmd_arg[1:]
 
-	resp := this.cmd_packer.PackCmd([][]byte{[]byte("OK")})
+	onCmd(conn, []string{cmd})
+	if err := this.acl.Check(conn, []string{cmd}); err != "" {
+		this.reply(conn, 0, cmd, start, err)
+		return
+	}
 	switch cmd {
 	case "SELECT":
 		if len(args) != 1 {
-			str := "(error) ERR wrong number of arguments for 'select' command"
-			resp = this.cmd_packer.PackCmd([][]byte{[]byte(str)})
-			conn.SendMsg(0, resp)
+			this.reply(conn, 0, cmd, start, "(error) ERR wrong number of arguments for 'select' command")
 			return
 		}
 		id, err := strconv.Atoi(string(args[0]))
 		if err != nil {
-			str := "(error) ERR invalid DB index"
-			resp = this.cmd_packer.PackCmd([][]byte{[]byte(str)})
-			conn.SendMsg(0, resp)
+			this.reply(conn, 0, cmd, start, "(error) ERR invalid DB index")
 			return
 		}
 		if id < 0 || id >= 16 {
-			str := "(error) ERR DB index is out of range"
-			resp = this.cmd_packer.PackCmd([][]byte{[]byte(str)})
-			conn.SendMsg(0, resp)
+			this.reply(conn, 0, cmd, start, "(error) ERR DB index is out of range")
 			return
 		}
 		conn.SetProperty("db", this.db_mgr.GetDb(uint32(id)))
-		resp = this.cmd_packer.PackCmd([][]byte{[]byte(fmt.Sprint(id))})
-		conn.SendMsg(1, resp)
+		// the id of the db is replied with msg id 1
+		this.reply(conn, 1, cmd, start, fmt.Sprint(id))
 	default:
-		resp = this.cmd_packer.PackCmd([][]byte{[]byte("Unspported command")})
-		conn.SendMsg(0, resp)
+		this.reply(conn, 0, cmd, start, "Unspported command")
 	}
+}
 
+func (this *DbSelectRouter) reply(conn ziface.IConnection, msg_id uint32, cmd string, start time.Time, res string) {
+	resp := [][]byte{[]byte(res)}
+	metrics.ObserveCmd(cmd, time.Since(start), resp)
+	conn.SendMsg(msg_id, this.cmd_packer.PackCmd(resp))
 }
@@ -3,9 +3,13 @@ package server_test
 import (
 	"fmt"
 	"gedis/src/Server/server"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // single goroutine Set/GET/DEL test
@@ -214,3 +218,37 @@ func TestDb5(t *testing.T) {
 		}(i)
 	}
 }
+
+// the cmds replayed from the aof aren't persisted or fed to OnWrite again
+func TestDb6(t *testing.T) {
+	dir := t.TempDir()
+	db := server.NewDbIn(dir, "reopen")
+	db.Open()
+	for i := 0; i < 300; i++ {
+		db.Exec([][]byte{[]byte("SET"), []byte(fmt.Sprint("k", i)), []byte("v")})
+	}
+	db.Close()
+	before, _ := os.Stat(filepath.Join(dir, "db_reopen"))
+
+	db = server.NewDbIn(dir, "reopen")
+	writes := int32(0)
+	db.SetOnWrite(func(name string, cmd []string) { atomic.AddInt32(&writes, 1) })
+	opened := make(chan bool)
+	go func() {
+		db.Open()
+		close(opened)
+	}()
+	select {
+	case <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestDb6 failed")
+	}
+	if res := db.Exec([][]byte{[]byte("GET"), []byte("k299")}); string(res[0]) != "v" {
+		t.Error("TestDb6 failed")
+	}
+	db.Close()
+	after, _ := os.Stat(filepath.Join(dir, "db_reopen"))
+	if before == nil || after == nil || after.Size() != before.Size() || atomic.LoadInt32(&writes) != 0 {
+		t.Error("TestDb6 failed")
+	}
+}
@@ -3,20 +3,40 @@ package server
 import (
 	"fmt"
 	"gedis/src/Server/siface"
+	"math"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Engine struct {
-	hashmap siface.IHashMap
+	hashmap  siface.IHashMap
+	blocking *BlockingKeys
 
 	handler map[string](func([]string) []string)
+	// handlers which persist other cmds than the one executed
+	prop_handler map[string](func([]string) ([]string, [][]string))
+	// cmds which run alone, like scripts, the others share the lock
+	exclusive   map[string]bool
+	script_lock sync.RWMutex
+	// checks the cmds called by the running script, set while the script holds the lock alone
+	script_check func(cmd []string) string
+
+	on_notify func(class int, event string, key string)
+	on_props  func(props [][]string)
 }
 
 func NewEngine() *Engine {
 	return &Engine{
-		hashmap: NewHashMap(256),
-		handler: make(map[string](func([]string) []string)),
+		hashmap:      NewHashMap(256),
+		blocking:     NewBlockingKeys(),
+		handler:      make(map[string](func([]string) []string)),
+		prop_handler: make(map[string](func([]string) ([]string, [][]string))),
+		exclusive:    make(map[string]bool),
+		on_notify:    func(class int, event string, key string) {},
+		on_props:     func(props [][]string) {},
 	}
 }
 
@@ -30,6 +50,7 @@ func (this *Engine) Start() {
 	this.handler["PERSIST"] = this.persist
 	this.handler["TTL"] = this.ttl
 	this.handler["KEYS"] = this.keys
+	this.handler["FLUSHDB"] = this.flushdb
 	// list
 	this.handler["LPUSH"] = this.lpush
 	this.handler["RPUSH"] = this.rpush
@@ -47,9 +68,59 @@ func (this *Engine) Start() {
 	this.handler["ZCOUNT"] = this.zcount
 	this.handler["ZRANK"] = this.zrank
 	this.handler["ZSCORE"] = this.zscore
+	// geo
+	this.handler["GEOADD"] = this.geoadd
+	this.handler["GEOPOS"] = this.geopos
+	this.handler["GEODIST"] = this.geodist
+	this.handler["GEOHASH"] = this.geohash
+	this.handler["GEOSEARCH"] = this.geosearch
+	this.handler["GEOSEARCHSTORE"] = this.geosearchstore
+	// scripting
+	this.prop_handler["EVAL"] = this.eval
+	this.prop_handler["EVALSHA"] = this.evalsha
+	this.prop_handler["SCRIPT"] = this.script
+	this.exclusive["EVAL"] = true
+	this.exclusive["EVALSHA"] = true
+	this.prop_handler["FUNCTION"] = this.function
+	this.prop_handler["FCALL"] = this.fcall
+	this.prop_handler["FCALL_RO"] = this.fcallRo
+	this.exclusive["FCALL"] = true
+	this.exclusive["FCALL_RO"] = true
+	// hyperloglog
+	this.handler["PFADD"] = this.pfadd
+	this.handler["PFCOUNT"] = this.pfcount
+	this.handler["PFMERGE"] = this.pfmerge
+	this.handler["PFDEBUG"] = this.pfdebug
+	// stream
+	this.prop_handler["XADD"] = this.xadd
+	this.handler["XLEN"] = this.xlen
+	this.handler["XRANGE"] = this.xrange
+	this.handler["XREVRANGE"] = this.xrevrange
+	this.handler["XDEL"] = this.xdel
+	this.prop_handler["XTRIM"] = this.xtrim
+	this.handler["XSETID"] = this.xsetid
+	this.handler["XREAD"] = this.xread
+	this.prop_handler["XGROUP"] = this.xgroup
+	this.prop_handler["XREADGROUP"] = this.xreadgroup
+	this.handler["XACK"] = this.xack
+	this.handler["XPENDING"] = this.xpending
+	this.prop_handler["XCLAIM"] = this.xclaim
+	this.prop_handler["XAUTOCLAIM"] = this.xautoclaim
+	this.handler["XINFO"] = this.xinfo
+	// bitmap
+	this.handler["SETBIT"] = this.setbit
+	this.handler["GETBIT"] = this.getbit
+	this.handler["BITCOUNT"] = this.bitcount
+	this.handler["BITPOS"] = this.bitpos
+	this.handler["BITOP"] = this.bitop
+	this.prop_handler["BITFIELD"] = this.bitfield
+	this.handler["BITFIELD_RO"] = this.bitfieldRo
 	// TODO: hashmap
 	// TODO: set
 
+	this.hashmap.SetOnExpire(func(key string) {
+		this.notify(NOTIFY_EXPIRED, "expired", key)
+	})
 	go this.hashmap.StartTtlMonitor()
 }
 
@@ -57,18 +128,126 @@ func (this *Engine) Stop() {
 	this.hashmap.StopTtlMonitor()
 }
 
+// the props of cmd aren't passed on, for the cmds replayed from the aof, which are persisted already
 func (this *Engine) Handle(cmd []string) []string {
+	res, _ := this.handleLocked(cmd, false, nil)
+	return res
+}
+
+func (this *Engine) HandleProp(cmd []string) (res []string, props [][]string) {
+	return this.handleLocked(cmd, true, nil)
+}
+
+// like HandleProp, but each cmd called by the script of cmd is checked by check first, which returns
+// the error reply if the cmd can't run, like the ACL of the client
+func (this *Engine) HandleCheck(cmd []string, check func(cmd []string) string) (res []string, props [][]string) {
+	return this.handleLocked(cmd, true, check)
+}
+
+// run cmd with the lock, its props are passed to on_props if pass
+func (this *Engine) handleLocked(cmd []string, pass bool, check func(cmd []string) string) (res []string, props [][]string) {
+	// SCRIPT KILL can't wait for the lock held by the script it kills
+	if len(cmd) == 2 && cmd[0] == "SCRIPT" && strings.ToUpper(cmd[1]) == "KILL" {
+		return this.script(cmd[1:])
+	}
+	if scripts.Busy() {
+		return []string{SCRIPT_BUSY_ERR}, nil
+	}
+	if this.exclusive[cmd[0]] {
+		this.script_lock.Lock()
+		defer this.script_lock.Unlock()
+		this.script_check = check
+		defer func() { this.script_check = nil }()
+	} else {
+		this.script_lock.RLock()
+		defer this.script_lock.RUnlock()
+	}
+	res, props = this.handleProp(cmd)
+	// before the lock is released, so the cmds done before Exclusive are all passed on
+	if pass {
+		this.on_props(props)
+	}
+	return
+}
+
+// fun is called with the props of each cmd run by HandleProp
+func (this *Engine) SetOnProps(fun func(props [][]string)) {
+	this.on_props = fun
+}
+
+// run fun while no cmd is running, the blocked cmds don't count as they wait without the lock.
+// the cmds fun runs by handle are passed on like the ones of HandleProp
+func (this *Engine) Exclusive(fun func(handle func(cmd []string) []string)) {
+	this.script_lock.Lock()
+	defer this.script_lock.Unlock()
+	fun(func(cmd []string) []string {
+		res, props := this.handleProp(cmd)
+		this.on_props(props)
+		return res
+	})
+}
+
+// cmds called by scripts run here directly, as the script holds the lock
+func (this *Engine) handleProp(cmd []string) (res []string, props [][]string) {
+	if handler, ok := this.prop_handler[cmd[0]]; ok {
+		return handler(cmd[1:])
+	}
 	handler, ok := this.handler[cmd[0]]
 	if !ok {
-		return []string{"(error) ERR unknown command '" + cmd[0] + "'"}
+		return []string{"(error) ERR unknown command '" + cmd[0] + "'"}, [][]string{}
 	}
-	return handler(cmd[1:])
+	return handler(cmd[1:]), [][]string{cmd}
+}
+
+func (this *Engine) SetOnNotify(fun func(class int, event string, key string)) {
+	this.on_notify = fun
+}
+
+// keyspace notification of a changed key
+func (this *Engine) notify(class int, event string, key string) {
+	this.on_notify(class, event, key)
+}
+
+func (this *Engine) Unblock() {
+	this.blocking.Stop()
 }
 
 func (this *Engine) Foreach(f func(key string, val interface{}, TTL int64)) {
 	this.hashmap.Foreach(f)
 }
 
+func (this *Engine) Count() (keys int, expires int) {
+	return this.hashmap.Count()
+}
+
+func (this *Engine) GetKeyspaceStats() (hits uint64, misses uint64) {
+	return this.hashmap.GetKeyspaceStats()
+}
+
+func (this *Engine) ResetKeyspaceStats() {
+	this.hashmap.ResetKeyspaceStats()
+}
+
+// value and expire time of a single key, err if it doesn't exist
+func (this *Engine) Dump(key string) (val interface{}, TTLat int64, err error) {
+	this.hashmap.Lock(key, false)
+	defer this.hashmap.Unlock(key, false)
+
+	if val, err = this.hashmap.Get(key); err != nil {
+		return
+	}
+	ttl, err := this.hashmap.GetTTL(key)
+	if err != nil {
+		return
+	}
+	if ttl == EXPIRE_FOREVER {
+		TTLat = math.MaxInt64
+	} else {
+		TTLat = time.Now().Unix() + ttl
+	}
+	return
+}
+
 func (this *Engine) set(args []string) (res []string) {
 	res = make([]string, 1)
 	if len(args) != 2 {
@@ -80,6 +259,7 @@ func (this *Engine) set(args []string) (res []string) {
 	this.hashmap.Lock(key, true)
 	defer this.hashmap.Unlock(key, true)
 	this.hashmap.Put(key, val)
+	this.notify(NOTIFY_STRING, "set", key)
 
 	// assert this.hashmap.Get(key) == val
 	// value, err := this.hashmap.Get(key)
@@ -124,6 +304,7 @@ func (this *Engine) del(args []string) (res []string) {
 	dnum := 0 // how many keys are deleted successfully
 	for _, key := range keys {
 		if err := this.hashmap.Del(key); err == nil {
+			this.notify(NOTIFY_GENERIC, "del", key)
 			dnum++
 		}
 	}
@@ -154,6 +335,7 @@ func (this *Engine) mset(args []string) (res []string) {
 
 	for i := 0; i < len(keys); i++ {
 		this.hashmap.Put(keys[i], vals[i])
+		this.notify(NOTIFY_STRING, "set", keys[i])
 	}
 
 	res[0] = "OK"
@@ -174,7 +356,9 @@ func (this *Engine) expire(args []string) (res []string) {
 	}
 	this.hashmap.Lock(key, true)
 	defer this.hashmap.Unlock(key, true)
-	this.hashmap.SetTTL(key, int64(ttl))
+	if err := this.hashmap.SetTTL(key, int64(ttl)); err == nil {
+		this.notify(NOTIFY_GENERIC, "expire", key)
+	}
 
 	res[0] = "(integer) 1"
 	return
@@ -194,6 +378,8 @@ func (this *Engine) persist(args []string) (res []string) {
 	err := this.hashmap.Persist(key)
 	if err != nil {
 		res[0] = "(error) ERR wrong number of arguments for 'persist' command"
+	} else {
+		this.notify(NOTIFY_GENERIC, "persist", key)
 	}
 	res[0] = "(integer) 1"
 	return
@@ -241,6 +427,19 @@ func (this *Engine) keys(args []string) (res []string) {
 	return
 }
 
+func (this *Engine) flushdb(args []string) (res []string) {
+	res = make([]string, 1)
+	if len(args) != 0 {
+		res[0] = "(error) ERR wrong number of arguments for 'flushdb' command"
+		return
+	}
+
+	this.hashmap.Clear()
+
+	res[0] = "OK"
+	return
+}
+
 func (this *Engine) lpush(args []string) (res []string) {
 	res = make([]string, 1)
 	if len(args) < 2 {
@@ -263,6 +462,7 @@ func (this *Engine) lpush(args []string) (res []string) {
 		lst = append([]string{key}, lst...)
 	}
 	this.hashmap.Put(key, lst)
+	this.notify(NOTIFY_LIST, "lpush", key)
 
 	res[0] = fmt.Sprintf("(integer) %d", len(lst))
 	return
@@ -288,6 +488,7 @@ func (this *Engine) rpush(args []string) (res []string) {
 
 	lst = append(lst, args[1:]...)
 	this.hashmap.Put(key, lst)
+	this.notify(NOTIFY_LIST, "rpush", key)
 
 	res[0] = fmt.Sprintf("(integer) %d", len(lst))
 	return
@@ -318,6 +519,7 @@ func (this *Engine) lpop(args []string) (res []string) {
 	res[0] = lst[0]
 	lst = lst[1:]
 	this.hashmap.Put(key, lst)
+	this.notify(NOTIFY_LIST, "lpop", key)
 
 	return
 }
@@ -347,6 +549,7 @@ func (this *Engine) rpop(args []string) (res []string) {
 	res[0] = lst[len(lst)-1]
 	lst = lst[0 : len(lst)-1]
 	this.hashmap.Put(key, lst)
+	this.notify(NOTIFY_LIST, "rpop", key)
 
 	return
 }
@@ -486,6 +689,7 @@ func (this *Engine) zadd(args []string) (res []string) {
 		anum++
 	}
 	this.hashmap.Put(key, zset)
+	this.notify(NOTIFY_ZSET, "zadd", key)
 
 	res[0] = fmt.Sprintf("(integer) %d", anum)
 	return
@@ -516,6 +720,9 @@ func (this *Engine) zrem(args []string) (res []string) {
 	}
 
 	this.hashmap.Put(key, zset)
+	if dnum > 0 {
+		this.notify(NOTIFY_ZSET, "zrem", key)
+	}
 
 	res[0] = fmt.Sprintf("(integer) %d", dnum)
 	return
@@ -0,0 +1,601 @@
+package server
+
+import (
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// bitmap cmds of Engine, bitmaps are string values and bit 0 is the most significant bit of the first byte
+
+// a bitmap can't be larger than 512MB like redis
+const BITMAP_MAX_BITS = 1 << 32
+
+// nil if the key doesn't exist
+func (this *Engine) getBitmap(key string) ([]byte, error) {
+	val, err := this.hashmap.GetString(key)
+	if err != nil {
+		if err.Error() == "(nil)" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return []byte(val), nil
+}
+
+func parseBitOffset(s string) (uint64, bool) {
+	offset, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || offset >= BITMAP_MAX_BITS {
+		return 0, false
+	}
+	return offset, true
+}
+
+// grow buf so that the bit at offset is in it
+func growBitmap(buf []byte, offset uint64) []byte {
+	need := int(offset>>3) + 1
+	if len(buf) >= need {
+		return buf
+	}
+	return append(buf, make([]byte, need-len(buf))...)
+}
+
+func getBit(buf []byte, offset uint64) byte {
+	idx := offset >> 3
+	if idx >= uint64(len(buf)) {
+		return 0
+	}
+	return (buf[idx] >> (7 - offset&7)) & 1
+}
+
+func setBit(buf []byte, offset uint64, bit byte) {
+	mask := byte(1) << (7 - offset&7)
+	if bit == 1 {
+		buf[offset>>3] |= mask
+	} else {
+		buf[offset>>3] &^= mask
+	}
+}
+
+// SETBIT key offset value
+func (this *Engine) setbit(args []string) (res []string) {
+	if len(args) != 3 {
+		return []string{"(error) ERR wrong number of arguments for 'setbit' command"}
+	}
+	key := args[0]
+	offset, ok := parseBitOffset(args[1])
+	if !ok {
+		return []string{"(error) ERR bit offset is not an integer or out of range"}
+	}
+	if args[2] != "0" && args[2] != "1" {
+		return []string{"(error) ERR bit is not an integer or out of range"}
+	}
+
+	this.hashmap.Lock(key, true)
+	defer this.hashmap.Unlock(key, true)
+
+	buf, err := this.getBitmap(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	buf = growBitmap(buf, offset)
+	old := getBit(buf, offset)
+	setBit(buf, offset, args[2][0]-'0')
+	this.putKeepTTL(key, string(buf))
+	this.notify(NOTIFY_STRING, "setbit", key)
+	return []string{integerReply(old)}
+}
+
+// put a string value modified in place, keeping the ttl of the existing key
+func (this *Engine) putKeepTTL(key string, val string) {
+	ttl, err := this.hashmap.GetTTL(key)
+	this.hashmap.Put(key, val)
+	if err == nil && ttl != EXPIRE_FOREVER {
+		this.hashmap.SetTTL(key, ttl)
+	}
+}
+
+// GETBIT key offset
+func (this *Engine) getbit(args []string) (res []string) {
+	if len(args) != 2 {
+		return []string{"(error) ERR wrong number of arguments for 'getbit' command"}
+	}
+	key := args[0]
+	offset, ok := parseBitOffset(args[1])
+	if !ok {
+		return []string{"(error) ERR bit offset is not an integer or out of range"}
+	}
+
+	this.hashmap.Lock(key, false)
+	defer this.hashmap.Unlock(key, false)
+
+	buf, err := this.getBitmap(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return []string{integerReply(getBit(buf, offset))}
+}
+
+// parse [start [end [BYTE|BIT]]] into a bit range [start, end] of a bitmap of size bytes,
+// empty is true if the range has no bit
+func parseBitRange(args []string, size int, need_end bool) (start, end int64, empty bool, err_str string) {
+	is_bit := false
+	if len(args) == 3 {
+		switch strings.ToUpper(args[2]) {
+		case "BIT":
+			is_bit = true
+		case "BYTE":
+		default:
+			return 0, 0, false, "(error) ERR syntax error"
+		}
+	}
+	if len(args) == 1 && need_end {
+		return 0, 0, false, "(error) ERR syntax error"
+	}
+
+	length := int64(size)
+	if is_bit {
+		length *= 8
+	}
+	start, end = 0, length-1
+	if len(args) >= 1 {
+		var err error
+		if start, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+			return 0, 0, false, "(error) ERR value is not an integer or out of range"
+		}
+	}
+	if len(args) >= 2 {
+		var err error
+		if end, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return 0, 0, false, "(error) ERR value is not an integer or out of range"
+		}
+	}
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if start > end || length == 0 {
+		return 0, 0, true, ""
+	}
+	if !is_bit {
+		start, end = start*8, end*8+7
+	}
+	return start, end, false, ""
+}
+
+// BITCOUNT key [start end [BYTE|BIT]]
+func (this *Engine) bitcount(args []string) (res []string) {
+	if len(args) < 1 || len(args) > 4 {
+		return []string{"(error) ERR wrong number of arguments for 'bitcount' command"}
+	}
+	key := args[0]
+
+	this.hashmap.Lock(key, false)
+	defer this.hashmap.Unlock(key, false)
+
+	buf, err := this.getBitmap(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	start, end, empty, err_str := parseBitRange(args[1:], len(buf), true)
+	if err_str != "" {
+		return []string{err_str}
+	}
+	if empty {
+		return []string{integerReply(0)}
+	}
+
+	count := 0
+	for start <= end {
+		// whole bytes at once
+		if start&7 == 0 && end-start >= 7 {
+			count += bits.OnesCount8(buf[start>>3])
+			start += 8
+			continue
+		}
+		count += int(getBit(buf, uint64(start)))
+		start++
+	}
+	return []string{integerReply(count)}
+}
+
+// BITPOS key bit [start [end [BYTE|BIT]]]
+func (this *Engine) bitpos(args []string) (res []string) {
+	if len(args) < 2 || len(args) > 5 {
+		return []string{"(error) ERR wrong number of arguments for 'bitpos' command"}
+	}
+	key := args[0]
+	if args[1] != "0" && args[1] != "1" {
+		return []string{"(error) ERR The bit argument must be 1 or 0."}
+	}
+	bit := args[1][0] - '0'
+
+	this.hashmap.Lock(key, false)
+	defer this.hashmap.Unlock(key, false)
+
+	buf, err := this.getBitmap(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if buf == nil {
+		if bit == 1 {
+			return []string{integerReply(-1)}
+		}
+		return []string{integerReply(0)}
+	}
+	start, end, empty, err_str := parseBitRange(args[2:], len(buf), false)
+	if err_str != "" {
+		return []string{err_str}
+	}
+	if empty {
+		return []string{integerReply(-1)}
+	}
+
+	// bytes without the bit are skipped at once
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xff
+	}
+	for pos := start; pos <= end; {
+		if pos&7 == 0 && end-pos >= 7 && buf[pos>>3] == skip {
+			pos += 8
+			continue
+		}
+		if getBit(buf, uint64(pos)) == bit {
+			return []string{integerReply(pos)}
+		}
+		pos++
+	}
+	// looking for a clear bit without an end, the bits after the string are clear
+	if bit == 0 && len(args) < 4 {
+		return []string{integerReply(end + 1)}
+	}
+	return []string{integerReply(-1)}
+}
+
+// BITOP AND|OR|XOR|NOT destkey key [key ...]
+func (this *Engine) bitop(args []string) (res []string) {
+	if len(args) < 3 {
+		return []string{"(error) ERR wrong number of arguments for 'bitop' command"}
+	}
+	op, dest, keys := strings.ToUpper(args[0]), args[1], args[2:]
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(keys) != 1 {
+			return []string{"(error) ERR BITOP NOT must be called with a single source key."}
+		}
+	default:
+		return []string{"(error) ERR syntax error"}
+	}
+
+	all := append([]string{dest}, keys...)
+	this.hashmap.Locks(all, true)
+	defer this.hashmap.Unlocks(all, true)
+
+	srcs := make([][]byte, 0, len(keys))
+	size := 0
+	for _, key := range keys {
+		buf, err := this.getBitmap(key)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		srcs = append(srcs, buf)
+		if len(buf) > size {
+			size = len(buf)
+		}
+	}
+
+	// missing keys and the shorter strings are padded with zero bytes
+	result := make([]byte, size)
+	for i := 0; i < size; i++ {
+		byteAt := func(src []byte) byte {
+			if i < len(src) {
+				return src[i]
+			}
+			return 0
+		}
+		b := byteAt(srcs[0])
+		for _, src := range srcs[1:] {
+			switch op {
+			case "AND":
+				b &= byteAt(src)
+			case "OR":
+				b |= byteAt(src)
+			case "XOR":
+				b ^= byteAt(src)
+			}
+		}
+		if op == "NOT" {
+			b = ^b
+		}
+		result[i] = b
+	}
+
+	if size == 0 {
+		if this.hashmap.Del(dest) == nil {
+			this.notify(NOTIFY_GENERIC, "del", dest)
+		}
+	} else {
+		this.hashmap.Put(dest, string(result))
+		this.notify(NOTIFY_STRING, "set", dest)
+	}
+	return []string{integerReply(size)}
+}
+
+type bitfieldOp struct {
+	op       string // GET, SET or INCRBY
+	signed   bool
+	bits     uint
+	offset   uint64
+	value    int64
+	overflow string // WRAP, SAT or FAIL
+}
+
+// i1-i64 or u1-u63
+func parseBitfieldType(s string) (signed bool, width uint, ok bool) {
+	if len(s) < 2 || (s[0] != 'i' && s[0] != 'I' && s[0] != 'u' && s[0] != 'U') {
+		return false, 0, false
+	}
+	signed = s[0] == 'i' || s[0] == 'I'
+	n, err := strconv.ParseUint(s[1:], 10, 8)
+	if err != nil || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return false, 0, false
+	}
+	return signed, uint(n), true
+}
+
+// offset in bits, or #n for the n-th field of the width
+func parseBitfieldOffset(s string, width uint) (uint64, bool) {
+	mul := uint64(1)
+	if strings.HasPrefix(s, "#") {
+		s = s[1:]
+		mul = uint64(width)
+	}
+	offset, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || offset > math.MaxUint64/mul {
+		return 0, false
+	}
+	offset *= mul
+	if offset+uint64(width) > BITMAP_MAX_BITS {
+		return 0, false
+	}
+	return offset, true
+}
+
+func parseBitfieldOps(args []string, read_only bool) ([]bitfieldOp, string) {
+	ops := make([]bitfieldOp, 0)
+	overflow := "WRAP"
+	for i := 0; i < len(args); i++ {
+		op := strings.ToUpper(args[i])
+		switch op {
+		case "OVERFLOW":
+			if i+1 >= len(args) {
+				return nil, "(error) ERR syntax error"
+			}
+			overflow = strings.ToUpper(args[i+1])
+			if overflow != "WRAP" && overflow != "SAT" && overflow != "FAIL" {
+				return nil, "(error) ERR Invalid OVERFLOW type specified"
+			}
+			i++
+		case "GET", "SET", "INCRBY":
+			if read_only && op != "GET" {
+				return nil, "(error) ERR BITFIELD_RO only supports the GET subcommand"
+			}
+			nargs := 2
+			if op != "GET" {
+				nargs = 3
+			}
+			if i+nargs >= len(args) {
+				return nil, "(error) ERR syntax error"
+			}
+			signed, width, ok := parseBitfieldType(args[i+1])
+			if !ok {
+				return nil, "(error) ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."
+			}
+			offset, ok := parseBitfieldOffset(args[i+2], width)
+			if !ok {
+				return nil, "(error) ERR bit offset is not an integer or out of range"
+			}
+			var value int64
+			if op != "GET" {
+				var err error
+				if value, err = strconv.ParseInt(args[i+3], 10, 64); err != nil {
+					return nil, "(error) ERR value is not an integer or out of range"
+				}
+			}
+			ops = append(ops, bitfieldOp{op: op, signed: signed, bits: width, offset: offset, value: value, overflow: overflow})
+			i += nargs
+		default:
+			return nil, "(error) ERR syntax error"
+		}
+	}
+	return ops, ""
+}
+
+func getBitfield(buf []byte, offset uint64, width uint, signed bool) int64 {
+	var val uint64
+	for i := uint64(0); i < uint64(width); i++ {
+		val = val<<1 | uint64(getBit(buf, offset+i))
+	}
+	if signed && width < 64 && val&(1<<(width-1)) != 0 {
+		// sign extension
+		val |= ^uint64(0) << width
+	}
+	return int64(val)
+}
+
+func setBitfield(buf []byte, offset uint64, width uint, val int64) {
+	for i := uint64(0); i < uint64(width); i++ {
+		setBit(buf, offset+i, byte(uint64(val)>>(uint64(width)-1-i))&1)
+	}
+}
+
+// value + incr in a unsigned field of width, returns false if it overflows with FAIL
+func unsignedBitfieldAdd(value uint64, incr int64, width uint, overflow string) (uint64, bool) {
+	max := uint64(1)<<width - 1
+	maxincr := int64(max - value)
+	minincr := -int64(value)
+	wrap := (value + uint64(incr)) & max
+
+	if value > max || (incr > 0 && incr > maxincr) {
+		switch overflow {
+		case "WRAP":
+			return wrap, true
+		case "SAT":
+			return max, true
+		}
+		return 0, false
+	} else if incr < 0 && incr < minincr {
+		switch overflow {
+		case "WRAP":
+			return wrap, true
+		case "SAT":
+			return 0, true
+		}
+		return 0, false
+	}
+	return value + uint64(incr), true
+}
+
+// value + incr in a signed field of width, returns false if it overflows with FAIL
+func signedBitfieldAdd(value int64, incr int64, width uint, overflow string) (int64, bool) {
+	max := int64(math.MaxInt64)
+	if width < 64 {
+		max = int64(1)<<(width-1) - 1
+	}
+	min := -max - 1
+	maxincr := max - value
+	minincr := min - value
+
+	wrap := func() int64 {
+		c := uint64(value) + uint64(incr)
+		if width < 64 {
+			mask := ^uint64(0) << width
+			if c&(1<<(width-1)) != 0 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		return int64(c)
+	}
+
+	if value > max || (width != 64 && incr > maxincr) || (value >= 0 && incr > 0 && incr > maxincr) {
+		switch overflow {
+		case "WRAP":
+			return wrap(), true
+		case "SAT":
+			return max, true
+		}
+		return 0, false
+	} else if value < min || (width != 64 && incr < minincr) || (value < 0 && incr < 0 && incr < minincr) {
+		switch overflow {
+		case "WRAP":
+			return wrap(), true
+		case "SAT":
+			return min, true
+		}
+		return 0, false
+	}
+	return value + incr, true
+}
+
+// BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment] [OVERFLOW WRAP|SAT|FAIL] ...
+// it's persisted only if it writes
+func (this *Engine) bitfield(args []string) (res []string, props [][]string) {
+	if len(args) < 1 {
+		return []string{"(error) ERR wrong number of arguments for 'bitfield' command"}, nil
+	}
+	return this.bitfieldGeneric(args, false)
+}
+
+// BITFIELD_RO key [GET type offset] ...
+func (this *Engine) bitfieldRo(args []string) (res []string) {
+	if len(args) < 1 {
+		return []string{"(error) ERR wrong number of arguments for 'bitfield_ro' command"}
+	}
+	res, _ = this.bitfieldGeneric(args, true)
+	return res
+}
+
+func (this *Engine) bitfieldGeneric(args []string, read_only bool) (res []string, props [][]string) {
+	key := args[0]
+	ops, err_str := parseBitfieldOps(args[1:], read_only)
+	if err_str != "" {
+		return []string{err_str}, nil
+	}
+	write := false
+	for _, op := range ops {
+		if op.op != "GET" {
+			write = true
+		}
+	}
+
+	this.hashmap.Lock(key, write)
+	defer this.hashmap.Unlock(key, write)
+
+	buf, err := this.getBitmap(key)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	if len(ops) == 0 {
+		return []string{"(empty array)"}, nil
+	}
+
+	changed := false
+	res = make([]string, 0, len(ops))
+	for _, op := range ops {
+		old := getBitfield(buf, op.offset, op.bits, op.signed)
+		if op.op == "GET" {
+			res = append(res, integerReply(old))
+			continue
+		}
+
+		var val int64
+		var ok bool
+		switch {
+		case op.op == "SET" && op.signed:
+			val, ok = signedBitfieldAdd(op.value, 0, op.bits, op.overflow)
+		case op.op == "SET":
+			var uval uint64
+			uval, ok = unsignedBitfieldAdd(uint64(op.value), 0, op.bits, op.overflow)
+			val = int64(uval)
+		case op.signed:
+			val, ok = signedBitfieldAdd(old, op.value, op.bits, op.overflow)
+		default:
+			var uval uint64
+			uval, ok = unsignedBitfieldAdd(uint64(old), op.value, op.bits, op.overflow)
+			val = int64(uval)
+		}
+		if !ok {
+			res = append(res, "(nil)")
+			continue
+		}
+
+		buf = growBitmap(buf, op.offset+uint64(op.bits)-1)
+		setBitfield(buf, op.offset, op.bits, val)
+		changed = true
+		if op.op == "SET" {
+			res = append(res, integerReply(old))
+		} else {
+			res = append(res, integerReply(val))
+		}
+	}
+
+	if changed {
+		this.putKeepTTL(key, string(buf))
+		this.notify(NOTIFY_STRING, "setbit", key)
+		props = [][]string{append([]string{"BITFIELD"}, args...)}
+	}
+	return res, props
+}
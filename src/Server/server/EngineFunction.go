@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// function cmds of Engine
+// FUNCTION changes the libraries shared by all dbs, which are saved to their own file. Its props are
+// fed to the replicas but aren't written to the aof.
+// FCALL runs like EVAL and is propagated by its effects.
+
+// FUNCTION LOAD [REPLACE] code | LIST [LIBRARYNAME pattern] [WITHCODE] | DELETE library |
+// FLUSH [ASYNC|SYNC] | DUMP | RESTORE payload [FLUSH|APPEND|REPLACE]
+func (this *Engine) function(args []string) (res []string, props [][]string) {
+	if len(args) < 1 {
+		return []string{"(error) ERR wrong number of arguments for 'function' command"}, nil
+	}
+	sub := strings.ToUpper(args[0])
+	wrong_args := []string{fmt.Sprintf("(error) ERR wrong number of arguments for 'function|%s' command", strings.ToLower(sub))}
+	switch sub {
+	case "LOAD":
+		if len(args) != 2 && !(len(args) == 3 && strings.ToUpper(args[1]) == "REPLACE") {
+			return wrong_args, nil
+		}
+		name, err := functions.Load(args[len(args)-1], len(args) == 3)
+		if err != nil {
+			return []string{err.Error()}, nil
+		}
+		// the replica has the same libraries, REPLACE is the same but doesn't fail if it loaded it already
+		return []string{name}, [][]string{{"FUNCTION", "LOAD", "REPLACE", args[len(args)-1]}}
+	case "LIST":
+		return functionList(args[1:]), nil
+	case "DELETE":
+		if len(args) != 2 {
+			return wrong_args, nil
+		}
+		if err := functions.Delete(args[1]); err != nil {
+			return []string{err.Error()}, nil
+		}
+		return []string{"OK"}, [][]string{{"FUNCTION", "DELETE", args[1]}}
+	case "FLUSH":
+		if len(args) > 2 {
+			return wrong_args, nil
+		}
+		if len(args) == 2 && strings.ToUpper(args[1]) != "ASYNC" && strings.ToUpper(args[1]) != "SYNC" {
+			return []string{"(error) ERR FUNCTION FLUSH only supports SYNC|ASYNC option"}, nil
+		}
+		if err := functions.Flush(); err != nil {
+			return []string{err.Error()}, nil
+		}
+		return []string{"OK"}, [][]string{{"FUNCTION", "FLUSH"}}
+	case "DUMP":
+		if len(args) != 1 {
+			return wrong_args, nil
+		}
+		return []string{functions.Dump()}, nil
+	case "RESTORE":
+		if len(args) != 2 && len(args) != 3 {
+			return wrong_args, nil
+		}
+		policy := "APPEND"
+		if len(args) == 3 {
+			policy = strings.ToUpper(args[2])
+			if policy != "FLUSH" && policy != "APPEND" && policy != "REPLACE" {
+				return []string{"(error) ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE."}, nil
+			}
+		}
+		if err := functions.Restore(args[1], policy); err != nil {
+			return []string{err.Error()}, nil
+		}
+		if policy == "APPEND" {
+			policy = "REPLACE"
+		}
+		return []string{"OK"}, [][]string{{"FUNCTION", "RESTORE", args[1], policy}}
+	}
+	return []string{fmt.Sprintf("(error) ERR unknown subcommand '%s'. Try FUNCTION HELP.", args[0])}, nil
+}
+
+// [LIBRARYNAME pattern] [WITHCODE]
+func functionList(args []string) []string {
+	pattern, with_code := "*", false
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "WITHCODE" && !with_code:
+			with_code = true
+		case opt == "LIBRARYNAME" && i+1 < len(args):
+			pattern = args[i+1]
+			i++
+		default:
+			return []string{"(error) ERR Unknown argument " + args[i]}
+		}
+	}
+
+	items := make([]interface{}, 0)
+	for _, lib := range functions.List() {
+		if ismatch, _ := filepath.Match(pattern, lib.name); !ismatch {
+			continue
+		}
+		names := make([]string, 0, len(lib.functions))
+		for name := range lib.functions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fns := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			fn := lib.functions[name]
+			var desc interface{}
+			if fn.description != "" {
+				desc = fn.description
+			}
+			fns = append(fns, []interface{}{"name", fn.name, "description", desc, "flags", fn.flags})
+		}
+		item := []interface{}{"library_name", lib.name, "engine", "LUA", "functions", fns}
+		if with_code {
+			item = append(item, "library_code", lib.code)
+		}
+		items = append(items, item)
+	}
+	return formatNested(items)
+}
+
+// FCALL function numkeys [key [key ...]] [arg [arg ...]]
+func (this *Engine) fcall(args []string) (res []string, props [][]string) {
+	return this.callFunction(args, false)
+}
+
+// FCALL_RO function numkeys [key [key ...]] [arg [arg ...]]
+func (this *Engine) fcallRo(args []string) (res []string, props [][]string) {
+	return this.callFunction(args, true)
+}
+
+// the library is run again in a new state to get the callback of the function, which is called with
+// the keys and args
+func (this *Engine) callFunction(args []string, ro bool) (res []string, props [][]string) {
+	if len(args) < 2 {
+		name := "fcall"
+		if ro {
+			name = "fcall_ro"
+		}
+		return []string{fmt.Sprintf("(error) ERR wrong number of arguments for '%s' command", name)}, nil
+	}
+	fn, lib := functions.Get(args[0])
+	if fn == nil {
+		return []string{"(error) ERR Function not found"}, nil
+	}
+	read_only := fn.hasFlag("no-writes")
+	if ro && !read_only {
+		return []string{"(error) ERR Can not execute a script with write flag using *_ro command."}, nil
+	}
+	keys, argv, err_str := parseScriptKeys(args[1:])
+	if err_str != "" {
+		return []string{err_str}, nil
+	}
+
+	L, run := this.newScriptState(&props, read_only)
+	defer L.Close()
+	defer scripts.Finish(run)
+	callbacks := make(map[string]*lua.LFunction)
+	setRegisterFunction(L, L.GetGlobal("redis").(*lua.LTable), lib, callbacks)
+	L.Push(L.NewFunctionFromProto(lib.proto))
+	if err := L.PCall(0, 0, nil); err != nil || callbacks[fn.name] == nil {
+		return []string{"(error) ERR Function not found"}, props
+	}
+	res = callScript(L, run, callbacks[fn.name], fn.name, stringsToLua(L, keys), stringsToLua(L, argv))
+	// the writes of an aborted function are left out of the aof and the replicas like scripts
+	if run.getState() == SCRIPT_ABORTED {
+		return res, nil
+	}
+	return res, props
+}
@@ -0,0 +1,470 @@
+package server
+
+import (
+	"fmt"
+	"gedis/src/Server/siface"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// geo cmds of Engine, the members are stored in a zset with their geohashes as scores
+
+// meters of the unit
+func geoUnit(unit string) (float64, bool) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	}
+	return 0, false
+}
+
+func geoFloat(val float64) string {
+	return strconv.FormatFloat(val, 'f', -1, 64)
+}
+
+func geoDistReply(dist float64) string {
+	return fmt.Sprintf("%.4f", dist)
+}
+
+// nil zset if the key doesn't exist
+func (this *Engine) getGeo(key string) (zset siface.IAVLTree, err error) {
+	zset, err = this.hashmap.GetZset(key, false)
+	if err != nil && err.Error() == "(nil)" {
+		return nil, nil
+	}
+	return
+}
+
+// GEOADD key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+func (this *Engine) geoadd(args []string) (res []string) {
+	if len(args) < 4 {
+		return []string{"(error) ERR wrong number of arguments for 'geoadd' command"}
+	}
+	key := args[0]
+
+	nx, xx, ch := false, false, false
+	i := 1
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+			continue
+		case "XX":
+			xx = true
+			continue
+		case "CH":
+			ch = true
+			continue
+		}
+		break
+	}
+	if nx && xx {
+		return []string{"(error) ERR XX and NX options at the same time are not compatible"}
+	}
+	items := args[i:]
+	if len(items) == 0 || len(items)%3 != 0 {
+		return []string{"(error) ERR syntax error"}
+	}
+
+	scores := make([]float64, 0, len(items)/3)
+	for j := 0; j < len(items); j += 3 {
+		long, err1 := strconv.ParseFloat(items[j], 64)
+		lat, err2 := strconv.ParseFloat(items[j+1], 64)
+		if err1 != nil || err2 != nil {
+			return []string{"(error) ERR value is not a valid float"}
+		}
+		if !geoValid(long, lat) {
+			return []string{fmt.Sprintf("(error) ERR invalid longitude,latitude pair %f,%f", long, lat)}
+		}
+		scores = append(scores, float64(geoEncode(long, lat, GEO_STEP_MAX)))
+	}
+
+	this.hashmap.Lock(key, true)
+	defer this.hashmap.Unlock(key, true)
+
+	zset, err := this.hashmap.GetZset(key, true)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	added, changed := 0, 0
+	for j, score := range scores {
+		member := items[j*3+2]
+		old, err := zset.GetScore(member)
+		exists := err == nil
+		if (nx && exists) || (xx && !exists) {
+			continue
+		}
+		if !exists {
+			added++
+		} else if old == score {
+			continue
+		}
+		changed++
+		zset.Add(score, member)
+	}
+	// an existing zset is updated in place and keeps its ttl
+	if _, err := this.hashmap.Get(key); err != nil && zset.GetSize() > 0 {
+		this.hashmap.Put(key, zset)
+	}
+	// like redis, the members are added to the zset
+	if changed > 0 {
+		this.notify(NOTIFY_ZSET, "zadd", key)
+	}
+
+	if ch {
+		return []string{integerReply(changed)}
+	}
+	return []string{integerReply(added)}
+}
+
+// GEOPOS key [member [member ...]]
+func (this *Engine) geopos(args []string) (res []string) {
+	if len(args) < 1 {
+		return []string{"(error) ERR wrong number of arguments for 'geopos' command"}
+	}
+	key := args[0]
+
+	this.hashmap.Lock(key, false)
+	defer this.hashmap.Unlock(key, false)
+
+	zset, err := this.getGeo(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	items := make([]interface{}, 0, len(args)-1)
+	for _, member := range args[1:] {
+		if zset == nil {
+			items = append(items, nil)
+			continue
+		}
+		score, err := zset.GetScore(member)
+		if err != nil {
+			items = append(items, nil)
+			continue
+		}
+		long, lat := geoDecodeScore(score)
+		items = append(items, []string{geoFloat(long), geoFloat(lat)})
+	}
+	return formatNested(items)
+}
+
+// GEODIST key member1 member2 [M|KM|FT|MI]
+func (this *Engine) geodist(args []string) (res []string) {
+	if len(args) != 3 && len(args) != 4 {
+		return []string{"(error) ERR wrong number of arguments for 'geodist' command"}
+	}
+	key := args[0]
+	unit := 1.0
+	if len(args) == 4 {
+		var ok bool
+		if unit, ok = geoUnit(args[3]); !ok {
+			return []string{"(error) ERR unsupported unit provided. please use M, KM, FT, MI"}
+		}
+	}
+
+	this.hashmap.Lock(key, false)
+	defer this.hashmap.Unlock(key, false)
+
+	zset, err := this.getGeo(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if zset == nil {
+		return []string{"(nil)"}
+	}
+	score1, err1 := zset.GetScore(args[1])
+	score2, err2 := zset.GetScore(args[2])
+	if err1 != nil || err2 != nil {
+		return []string{"(nil)"}
+	}
+	long1, lat1 := geoDecodeScore(score1)
+	long2, lat2 := geoDecodeScore(score2)
+	return []string{geoDistReply(geoDistance(long1, lat1, long2, lat2) / unit)}
+}
+
+// GEOHASH key [member [member ...]]
+func (this *Engine) geohash(args []string) (res []string) {
+	if len(args) < 1 {
+		return []string{"(error) ERR wrong number of arguments for 'geohash' command"}
+	}
+	key := args[0]
+
+	this.hashmap.Lock(key, false)
+	defer this.hashmap.Unlock(key, false)
+
+	zset, err := this.getGeo(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	items := make([]interface{}, 0, len(args)-1)
+	for _, member := range args[1:] {
+		if zset == nil {
+			items = append(items, nil)
+			continue
+		}
+		score, err := zset.GetScore(member)
+		if err != nil {
+			items = append(items, nil)
+			continue
+		}
+		items = append(items, geoHashString(score))
+	}
+	return formatNested(items)
+}
+
+type geoSearchArgs struct {
+	from_member bool
+	member      string
+	shape       geoShape
+	unit        float64
+	desc, sort  bool
+	count       int // 0 for all
+	any         bool
+	with_coord  bool
+	with_dist   bool
+	with_hash   bool
+	store_dist  bool
+}
+
+type geoResult struct {
+	member string
+	score  float64
+	dist   float64 // in the unit
+}
+
+// FROMMEMBER member | FROMLONLAT longitude latitude
+// BYRADIUS radius unit | BYBOX width height unit
+// [ASC|DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH], or [STOREDIST] for GEOSEARCHSTORE
+func parseGeoSearchArgs(args []string, store bool) (sargs *geoSearchArgs, err error) {
+	sargs = &geoSearchArgs{}
+	from, by := 0, 0
+	for i := 0; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "FROMMEMBER" && left >= 1:
+			sargs.from_member, sargs.member = true, args[i+1]
+			from++
+			i++
+		case opt == "FROMLONLAT" && left >= 2:
+			long, err1 := strconv.ParseFloat(args[i+1], 64)
+			lat, err2 := strconv.ParseFloat(args[i+2], 64)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("(error) ERR value is not a valid float")
+			}
+			if !geoValid(long, lat) {
+				return nil, fmt.Errorf("(error) ERR invalid longitude,latitude pair %f,%f", long, lat)
+			}
+			sargs.shape.long, sargs.shape.lat = long, lat
+			from++
+			i += 2
+		case opt == "BYRADIUS" && left >= 2:
+			radius, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil || radius < 0 {
+				return nil, fmt.Errorf("(error) ERR need numeric radius")
+			}
+			unit, ok := geoUnit(args[i+2])
+			if !ok {
+				return nil, fmt.Errorf("(error) ERR unsupported unit provided. please use M, KM, FT, MI")
+			}
+			sargs.shape.radius, sargs.unit = radius*unit, unit
+			by++
+			i += 2
+		case opt == "BYBOX" && left >= 3:
+			width, err1 := strconv.ParseFloat(args[i+1], 64)
+			height, err2 := strconv.ParseFloat(args[i+2], 64)
+			if err1 != nil || err2 != nil || width < 0 || height < 0 {
+				return nil, fmt.Errorf("(error) ERR need numeric width and height")
+			}
+			unit, ok := geoUnit(args[i+3])
+			if !ok {
+				return nil, fmt.Errorf("(error) ERR unsupported unit provided. please use M, KM, FT, MI")
+			}
+			sargs.shape.by_box = true
+			sargs.shape.width, sargs.shape.height, sargs.unit = width*unit, height*unit, unit
+			by++
+			i += 3
+		case opt == "ASC" || opt == "DESC":
+			sargs.sort, sargs.desc = true, opt == "DESC"
+		case opt == "COUNT" && left >= 1:
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("(error) ERR value is not an integer or out of range")
+			}
+			if count <= 0 {
+				return nil, fmt.Errorf("(error) ERR COUNT must be > 0")
+			}
+			sargs.count = count
+			i++
+			if i+1 < len(args) && strings.ToUpper(args[i+1]) == "ANY" {
+				sargs.any = true
+				i++
+			}
+		case opt == "ANY":
+			return nil, fmt.Errorf("(error) ERR the ANY argument requires COUNT argument")
+		case opt == "WITHCOORD" && !store:
+			sargs.with_coord = true
+		case opt == "WITHDIST" && !store:
+			sargs.with_dist = true
+		case opt == "WITHHASH" && !store:
+			sargs.with_hash = true
+		case opt == "STOREDIST" && store:
+			sargs.store_dist = true
+		default:
+			return nil, fmt.Errorf("(error) ERR syntax error")
+		}
+	}
+	if from != 1 {
+		return nil, fmt.Errorf("(error) ERR exactly one of FROMMEMBER or FROMLONLAT can be specified")
+	}
+	if by != 1 {
+		return nil, fmt.Errorf("(error) ERR exactly one of BYRADIUS and BYBOX arguments must be provided")
+	}
+	// the nearest ones are returned for COUNT without ANY
+	if sargs.count > 0 && !sargs.any && !sargs.sort {
+		sargs.sort = true
+	}
+	return sargs, nil
+}
+
+// the members in the shape, only the cells around the center are scanned
+func (this *Engine) geoSearch(key string, sargs *geoSearchArgs) (results []geoResult, err error) {
+	zset, err := this.hashmap.GetZset(key, false)
+	if err != nil {
+		if err.Error() == "(nil)" {
+			return []geoResult{}, nil
+		}
+		return nil, err
+	}
+	if sargs.from_member {
+		score, err := zset.GetScore(sargs.member)
+		if err != nil {
+			return nil, fmt.Errorf("(error) ERR could not decode requested zset member")
+		}
+		sargs.shape.long, sargs.shape.lat = geoDecodeScore(score)
+	}
+
+	results = make([]geoResult, 0)
+	for _, r := range sargs.shape.scoreRanges() {
+		for _, entry := range zset.GetRangeByScore(r[0], r[1]) {
+			long, lat := geoDecodeScore(entry.Score)
+			dist, ok := sargs.shape.contains(long, lat)
+			if !ok {
+				continue
+			}
+			results = append(results, geoResult{member: entry.Key, score: entry.Score, dist: dist / sargs.unit})
+			if sargs.any && len(results) == sargs.count {
+				break
+			}
+		}
+		if sargs.any && len(results) == sargs.count {
+			break
+		}
+	}
+
+	if sargs.sort {
+		sort.SliceStable(results, func(i, j int) bool {
+			if sargs.desc {
+				return results[i].dist > results[j].dist
+			}
+			return results[i].dist < results[j].dist
+		})
+	}
+	if sargs.count > 0 && len(results) > sargs.count {
+		results = results[:sargs.count]
+	}
+	return results, nil
+}
+
+// GEOSEARCH key FROMMEMBER member | FROMLONLAT longitude latitude BYRADIUS radius unit | BYBOX width height unit
+// [ASC|DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func (this *Engine) geosearch(args []string) (res []string) {
+	if len(args) < 5 {
+		return []string{"(error) ERR wrong number of arguments for 'geosearch' command"}
+	}
+	key := args[0]
+	sargs, err := parseGeoSearchArgs(args[1:], false)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	this.hashmap.Lock(key, false)
+	defer this.hashmap.Unlock(key, false)
+
+	results, err := this.geoSearch(key, sargs)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if len(results) == 0 {
+		return []string{"(empty array)"}
+	}
+
+	if !sargs.with_coord && !sargs.with_dist && !sargs.with_hash {
+		for _, result := range results {
+			res = append(res, result.member)
+		}
+		return
+	}
+	items := make([]interface{}, 0, len(results))
+	for _, result := range results {
+		item := []interface{}{result.member}
+		if sargs.with_dist {
+			item = append(item, geoDistReply(result.dist))
+		}
+		if sargs.with_hash {
+			item = append(item, integerReply(uint64(result.score)))
+		}
+		if sargs.with_coord {
+			long, lat := geoDecodeScore(result.score)
+			item = append(item, []string{geoFloat(long), geoFloat(lat)})
+		}
+		items = append(items, item)
+	}
+	return formatNested(items)
+}
+
+// GEOSEARCHSTORE destination source FROMMEMBER member | FROMLONLAT longitude latitude
+// BYRADIUS radius unit | BYBOX width height unit [ASC|DESC] [COUNT count [ANY]] [STOREDIST]
+func (this *Engine) geosearchstore(args []string) (res []string) {
+	if len(args) < 6 {
+		return []string{"(error) ERR wrong number of arguments for 'geosearchstore' command"}
+	}
+	dest, key := args[0], args[1]
+	sargs, err := parseGeoSearchArgs(args[2:], true)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	this.hashmap.Locks(args[:2], true)
+	defer this.hashmap.Unlocks(args[:2], true)
+
+	results, err := this.geoSearch(key, sargs)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if len(results) == 0 {
+		if this.hashmap.Del(dest) == nil {
+			this.notify(NOTIFY_GENERIC, "del", dest)
+		}
+		return []string{integerReply(0)}
+	}
+
+	zset := NewAvlTree()
+	for _, result := range results {
+		if sargs.store_dist {
+			zset.Add(result.dist, result.member)
+		} else {
+			zset.Add(result.score, result.member)
+		}
+	}
+	this.hashmap.Put(dest, zset)
+	this.notify(NOTIFY_ZSET, "geosearchstore", dest)
+	return []string{integerReply(len(results))}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// hyperloglog cmds of Engine
+
+// nil if the key doesn't exist
+func (this *Engine) getHyperLogLog(key string) (*HyperLogLog, error) {
+	val, err := this.hashmap.GetString(key)
+	if err != nil {
+		if err.Error() == "(nil)" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ParseHyperLogLog(val)
+}
+
+// PFADD key [element [element ...]]
+func (this *Engine) pfadd(args []string) (res []string) {
+	if len(args) < 1 {
+		return []string{"(error) ERR wrong number of arguments for 'pfadd' command"}
+	}
+	key := args[0]
+
+	this.hashmap.Lock(key, true)
+	defer this.hashmap.Unlock(key, true)
+
+	hll, err := this.getHyperLogLog(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	changed := false
+	if hll == nil {
+		hll = NewHyperLogLog()
+		changed = true
+	}
+	for _, element := range args[1:] {
+		if hll.Add(element) {
+			changed = true
+		}
+	}
+	if !changed {
+		return []string{integerReply(0)}
+	}
+	this.putKeepTTL(key, hll.String())
+	this.notify(NOTIFY_STRING, "pfadd", key)
+	return []string{integerReply(1)}
+}
+
+// PFCOUNT key [key ...]
+// the cardinality of a single key is cached in its value, the union of several keys is not
+func (this *Engine) pfcount(args []string) (res []string) {
+	if len(args) < 1 {
+		return []string{"(error) ERR wrong number of arguments for 'pfcount' command"}
+	}
+
+	if len(args) == 1 {
+		key := args[0]
+		this.hashmap.Lock(key, true)
+		defer this.hashmap.Unlock(key, true)
+
+		hll, err := this.getHyperLogLog(key)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		if hll == nil {
+			return []string{integerReply(0)}
+		}
+		if hll.card_valid {
+			return []string{integerReply(hll.card)}
+		}
+		card := hll.Count()
+		this.putKeepTTL(key, hll.String())
+		return []string{integerReply(card)}
+	}
+
+	this.hashmap.Locks(args, false)
+	defer this.hashmap.Unlocks(args, false)
+
+	union := NewHyperLogLog()
+	for _, key := range args {
+		hll, err := this.getHyperLogLog(key)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		if hll != nil {
+			union.Merge(hll)
+		}
+	}
+	return []string{integerReply(union.Count())}
+}
+
+// PFMERGE destkey [sourcekey [sourcekey ...]]
+func (this *Engine) pfmerge(args []string) (res []string) {
+	if len(args) < 1 {
+		return []string{"(error) ERR wrong number of arguments for 'pfmerge' command"}
+	}
+	dest := args[0]
+
+	this.hashmap.Locks(args, true)
+	defer this.hashmap.Unlocks(args, true)
+
+	// destkey is merged too if it exists
+	merged := NewHyperLogLog()
+	for _, key := range args {
+		hll, err := this.getHyperLogLog(key)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		if hll != nil {
+			merged.Merge(hll)
+		}
+	}
+	this.putKeepTTL(dest, merged.String())
+	this.notify(NOTIFY_STRING, "pfadd", dest)
+	return []string{"OK"}
+}
+
+// PFDEBUG ENCODING key, the encoding of the hyperloglog for tests and debugging
+func (this *Engine) pfdebug(args []string) (res []string) {
+	if len(args) != 2 {
+		return []string{"(error) ERR wrong number of arguments for 'pfdebug' command"}
+	}
+	if strings.ToUpper(args[0]) != "ENCODING" {
+		return []string{fmt.Sprintf("(error) ERR Unknown PFDEBUG subcommand '%s'", args[0])}
+	}
+	key := args[1]
+
+	this.hashmap.Lock(key, false)
+	defer this.hashmap.Unlock(key, false)
+
+	hll, err := this.getHyperLogLog(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if hll == nil {
+		return []string{"(error) ERR The specified key does not exist"}
+	}
+	if hll.dense {
+		return []string{"dense"}
+	}
+	return []string{"sparse"}
+}
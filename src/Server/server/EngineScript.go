@@ -0,0 +1,292 @@
+package server
+
+import (
+	"fmt"
+	"gedis/src/zinx/utils"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// scripting cmds of Engine
+// a script runs with the script lock of the engine, so no other cmd interleaves with it.
+// Its effects, i.e. the cmds it calls, are persisted and replicated instead of the script itself.
+// A script holding the lock too long is stopped by SCRIPT KILL or after LuaTimeLimit if it hasn't written yet.
+// One that has written goes on, the other cmds get BUSY after LuaTimeLimit until it returns or SHUTDOWN NOSAVE aborts it.
+
+// cmds that can't be called by scripts
+var script_denied_cmds = map[string]bool{
+	"EVAL": true, "EVALSHA": true, "SCRIPT": true,
+	"FCALL": true, "FCALL_RO": true, "FUNCTION": true,
+}
+
+// EVAL script numkeys [key [key ...]] [arg [arg ...]]
+func (this *Engine) eval(args []string) (res []string, props [][]string) {
+	if len(args) < 2 {
+		return []string{"(error) ERR wrong number of arguments for 'eval' command"}, nil
+	}
+	sha, proto, err := scripts.Load(args[0])
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	return this.runScript(sha, proto, args[1:])
+}
+
+// EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+func (this *Engine) evalsha(args []string) (res []string, props [][]string) {
+	if len(args) < 2 {
+		return []string{"(error) ERR wrong number of arguments for 'evalsha' command"}, nil
+	}
+	proto := scripts.Get(args[0])
+	if proto == nil {
+		return []string{"(error) NOSCRIPT No matching script. Please use EVAL."}, nil
+	}
+	return this.runScript(strings.ToLower(args[0]), proto, args[1:])
+}
+
+// SCRIPT LOAD script | EXISTS sha1 [sha1 ...] | FLUSH [ASYNC|SYNC] | KILL
+// the cache isn't persisted, as the scripts are replicated by their effects
+func (this *Engine) script(args []string) (res []string, props [][]string) {
+	if len(args) < 1 {
+		return []string{"(error) ERR wrong number of arguments for 'script' command"}, nil
+	}
+	switch sub := strings.ToUpper(args[0]); {
+	case sub == "LOAD" && len(args) == 2:
+		sha, _, err := scripts.Load(args[1])
+		if err != nil {
+			return []string{err.Error()}, nil
+		}
+		return []string{sha}, nil
+	case sub == "EXISTS" && len(args) >= 2:
+		items := make([]interface{}, 0, len(args)-1)
+		for _, sha := range args[1:] {
+			if scripts.Get(sha) != nil {
+				items = append(items, integerReply(1))
+			} else {
+				items = append(items, integerReply(0))
+			}
+		}
+		return formatNested(items), nil
+	case sub == "FLUSH" && len(args) <= 2:
+		if len(args) == 2 && strings.ToUpper(args[1]) != "ASYNC" && strings.ToUpper(args[1]) != "SYNC" {
+			return []string{"(error) ERR SCRIPT FLUSH only support SYNC|ASYNC option"}, nil
+		}
+		scripts.Flush()
+		return []string{"OK"}, nil
+	case sub == "KILL" && len(args) == 1:
+		return []string{scripts.Kill()}, nil
+	case sub == "LOAD" || sub == "EXISTS" || sub == "FLUSH" || sub == "KILL":
+		return []string{fmt.Sprintf("(error) ERR wrong number of arguments for 'script|%s' command", strings.ToLower(sub))}, nil
+	}
+	return []string{fmt.Sprintf("(error) ERR unknown subcommand '%s'. Try SCRIPT HELP.", args[0])}, nil
+}
+
+// numkeys [key [key ...]] [arg [arg ...]]
+func parseScriptKeys(args []string) (keys []string, argv []string, err_str string) {
+	numkeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, nil, "(error) ERR value is not an integer or out of range"
+	}
+	if numkeys < 0 {
+		return nil, nil, "(error) ERR Number of keys can't be negative"
+	}
+	if numkeys > len(args)-1 {
+		return nil, nil, "(error) ERR Number of keys can't be greater than number of args"
+	}
+	return args[1 : 1+numkeys], args[1+numkeys:], ""
+}
+
+func (this *Engine) runScript(sha string, proto *lua.FunctionProto, args []string) (res []string, props [][]string) {
+	keys, argv, err_str := parseScriptKeys(args)
+	if err_str != "" {
+		return []string{err_str}, nil
+	}
+
+	L, run := this.newScriptState(&props, false)
+	defer L.Close()
+	defer scripts.Finish(run)
+	L.SetGlobal("KEYS", stringsToLua(L, keys))
+	L.SetGlobal("ARGV", stringsToLua(L, argv))
+
+	res = callScript(L, run, L.NewFunctionFromProto(proto), "f_"+sha)
+	// the writes of an aborted script are left out of the aof and the replicas
+	if run.getState() == SCRIPT_ABORTED {
+		return res, nil
+	}
+	return res, props
+}
+
+// call fn with args and reply its result, name is the function in the error message
+func callScript(L *lua.LState, run *runningScript, fn *lua.LFunction, name string, args ...lua.LValue) []string {
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	if err := L.PCall(len(args), 1, nil); err != nil {
+		switch run.getState() {
+		case SCRIPT_KILLED:
+			return []string{"(error) ERR Script killed by user with SCRIPT KILL..."}
+		case SCRIPT_TIMEDOUT:
+			return []string{fmt.Sprintf("(error) ERR Script killed after running for more than lua-time-limit (%d ms)", utils.GetLuaTimeLimit())}
+		case SCRIPT_ABORTED:
+			return []string{"(error) ERR Script aborted by SHUTDOWN NOSAVE"}
+		}
+		// errors raised by redis.call are replied as they are
+		if msg, ok := luaErrorReply(err); ok {
+			return []string{msg}
+		}
+		return []string{fmt.Sprintf("(error) ERR Error running script (call to %s): %s", name, scriptErrorMsg(err))}
+	}
+	return scriptReply(L.Get(-1))
+}
+
+// raise an error reply like redis.error_reply, which is replied as it is
+func raiseErrorReply(L *lua.LState, msg string) {
+	tbl := L.NewTable()
+	tbl.RawSetString("err", lua.LString(msg))
+	L.Error(tbl, 1)
+}
+
+// the error reply raised by raiseErrorReply or a script
+func luaErrorReply(err error) (string, bool) {
+	if api_err, ok := err.(*lua.ApiError); ok {
+		if tbl, ok := api_err.Object.(*lua.LTable); ok {
+			if msg, ok := tbl.RawGetString("err").(lua.LString); ok {
+				return "(error) " + string(msg), true
+			}
+		}
+	}
+	return "", false
+}
+
+// the first line of the lua error without the stack traceback
+func scriptErrorMsg(err error) string {
+	if api_err, ok := err.(*lua.ApiError); ok {
+		return strings.TrimSpace(api_err.Object.String())
+	}
+	return strings.SplitN(err.Error(), "\n", 2)[0]
+}
+
+func stringsToLua(L *lua.LState, strs []string) *lua.LTable {
+	tbl := L.NewTable()
+	for _, str := range strs {
+		tbl.Append(lua.LString(str))
+	}
+	return tbl
+}
+
+// a lua state with the base, table, string and math libs
+func newSandboxState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// no access to the file system
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "module", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	return L
+}
+
+// a sandboxed lua state with the redis lib, props collects the effects of the script.
+// Write cmds fail if read_only. the script is running until scripts.Finish(run)
+func (this *Engine) newScriptState(props *[][]string, read_only bool) (*lua.LState, *runningScript) {
+	L := newSandboxState()
+	run := scripts.Start(L)
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call": func(L *lua.LState) int {
+			return this.scriptCall(L, run, props, true, read_only)
+		},
+		"pcall": func(L *lua.LState) int {
+			return this.scriptCall(L, run, props, false, read_only)
+		},
+		"error_reply": func(L *lua.LState) int {
+			tbl := L.NewTable()
+			tbl.RawSetString("err", lua.LString(L.CheckString(1)))
+			L.Push(tbl)
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			tbl := L.NewTable()
+			tbl.RawSetString("ok", lua.LString(L.CheckString(1)))
+			L.Push(tbl)
+			return 1
+		},
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(ScriptSha(L.CheckString(1))))
+			return 1
+		},
+	})
+	L.SetGlobal("redis", redis)
+	return L, run
+}
+
+// redis.call raises the error replies, redis.pcall returns them as tables
+func (this *Engine) scriptCall(L *lua.LState, run *runningScript, props *[][]string, raise bool, read_only bool) int {
+	fail := func(msg string) int {
+		if raise {
+			raiseErrorReply(L, msg)
+			return 0
+		}
+		tbl := L.NewTable()
+		tbl.RawSetString("err", lua.LString(msg))
+		L.Push(tbl)
+		return 1
+	}
+
+	if L.GetTop() == 0 {
+		return fail("ERR Please specify at least one argument for this redis lib call")
+	}
+	cmd := make([]string, 0, L.GetTop())
+	for i := 1; i <= L.GetTop(); i++ {
+		switch arg := L.Get(i).(type) {
+		case lua.LString, lua.LNumber:
+			cmd = append(cmd, arg.String())
+		default:
+			return fail("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+	cmd[0] = strings.ToUpper(cmd[0])
+	// a blocking cmd would wait forever, as nothing else runs during the script
+	if script_denied_cmds[cmd[0]] || IsBlockingCmd(cmd) {
+		return fail("ERR This Redis command is not allowed from script")
+	}
+	if read_only && isWriteCmd(cmd[0]) {
+		return fail("ERR Write commands are not allowed from read-only scripts.")
+	}
+	// the permissions and the slots of the client running the script
+	if this.script_check != nil {
+		if err := this.script_check(cmd); err != "" {
+			return fail(strings.TrimPrefix(err, "(error) "))
+		}
+	}
+	// once it writes SCRIPT KILL can't stop it
+	if isWriteCmd(cmd[0]) && !run.write() {
+		L.RaiseError("Script killed by user with SCRIPT KILL...")
+		return 0
+	}
+
+	res, cmd_props := this.handleProp(cmd)
+	*props = append(*props, cmd_props...)
+	val := replyToLua(L, cmd[0], res)
+	if tbl, ok := val.(*lua.LTable); ok && raise {
+		if _, ok := tbl.RawGetString("err").(lua.LString); ok {
+			L.Error(tbl, 1)
+			return 0
+		}
+	}
+	L.Push(val)
+	return 1
+}
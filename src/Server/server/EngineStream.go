@@ -0,0 +1,1194 @@
+package server
+
+import (
+	"fmt"
+	"gedis/src/Server/siface"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stream cmds of Engine
+
+// nil if the key doesn't exist
+func (this *Engine) getStream(key string) (siface.IStream, error) {
+	stream, err := this.hashmap.GetStream(key, false)
+	if err != nil {
+		if err.Error() == "(nil)" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return stream, nil
+}
+
+func streamEntryReply(entry siface.StreamEntry) interface{} {
+	if entry.Fields == nil {
+		return []interface{}{streamIDString(entry.ID), nil}
+	}
+	return []interface{}{streamIDString(entry.ID), entry.Fields}
+}
+
+func streamEntriesReply(entries []siface.StreamEntry) []interface{} {
+	res := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		res = append(res, streamEntryReply(entry))
+	}
+	return res
+}
+
+func nowMs() int64 {
+	return time.Now().UnixMilli()
+}
+
+// XREAD and XREADGROUP with BLOCK may block, they are executed without holding the worker
+func IsBlockingCmd(cmd []string) bool {
+	if cmd[0] != "XREAD" && cmd[0] != "XREADGROUP" {
+		return false
+	}
+	for _, arg := range cmd[1:] {
+		switch strings.ToUpper(arg) {
+		case "BLOCK":
+			return true
+		case "STREAMS":
+			return false
+		}
+	}
+	return false
+}
+
+// MAXLEN|MINID [=|~] threshold [LIMIT count] from args[i], returns the index after them.
+// trimming is always exact, so ~ trims like = and the LIMIT of ~ is checked but ignored
+func parseStreamTrim(args []string, i int) (strategy string, threshold string, next int, err string) {
+	strategy = strings.ToUpper(args[i])
+	i++
+	approx := false
+	if i < len(args) && (args[i] == "=" || args[i] == "~") {
+		approx = args[i] == "~"
+		i++
+	}
+	if i >= len(args) {
+		return "", "", i, "(error) ERR syntax error"
+	}
+	threshold = args[i]
+	i++
+	if i+1 < len(args) && strings.ToUpper(args[i]) == "LIMIT" {
+		if !approx {
+			return "", "", i, "(error) ERR syntax error, LIMIT cannot be used without the special ~ option"
+		}
+		if limit, e := strconv.ParseInt(args[i+1], 10, 64); e != nil || limit < 0 {
+			return "", "", i, "(error) ERR The LIMIT argument must be >= 0."
+		}
+		i += 2
+	}
+
+	if strategy == "MAXLEN" {
+		if maxlen, e := strconv.ParseInt(threshold, 10, 64); e != nil || maxlen < 0 {
+			return "", "", i, "(error) ERR The MAXLEN argument must be >= 0."
+		}
+	} else if _, e := parseStreamID(threshold, 0); e != nil {
+		return "", "", i, e.Error()
+	}
+	return strategy, threshold, i, ""
+}
+
+func streamTrim(stream siface.IStream, strategy string, threshold string) int {
+	if strategy == "MAXLEN" {
+		maxlen, _ := strconv.ParseUint(threshold, 10, 64)
+		return stream.TrimMaxLen(maxlen)
+	}
+	minid, _ := parseStreamID(threshold, 0)
+	return stream.TrimMinID(minid)
+}
+
+// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id field value [field value ...]
+func (this *Engine) xadd(args []string) (res []string, props [][]string) {
+	if len(args) < 4 {
+		return []string{"(error) ERR wrong number of arguments for 'xadd' command"}, nil
+	}
+	key := args[0]
+	nomkstream := false
+	strategy, threshold := "", ""
+	i := 1
+options:
+	for i < len(args) {
+		switch strings.ToUpper(args[i]) {
+		case "NOMKSTREAM":
+			nomkstream = true
+			i++
+		case "MAXLEN", "MINID":
+			var err string
+			if strategy, threshold, i, err = parseStreamTrim(args, i); err != "" {
+				return []string{err}, nil
+			}
+		default:
+			break options
+		}
+	}
+	if i >= len(args) || len(args[i+1:]) == 0 || len(args[i+1:])%2 != 0 {
+		return []string{"(error) ERR wrong number of arguments for 'xadd' command"}, nil
+	}
+	id_str, fields := args[i], args[i+1:]
+
+	this.hashmap.Lock(key, true)
+	defer this.hashmap.Unlock(key, true)
+
+	stream, err := this.getStream(key)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	create := stream == nil
+	if create {
+		if nomkstream {
+			return []string{"(nil)"}, nil
+		}
+		stream = NewStream()
+	}
+	id, err := stream.Add(id_str, fields)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	if create {
+		this.hashmap.Put(key, stream)
+	}
+
+	props = [][]string{append([]string{"XADD", key, streamIDString(id)}, fields...)}
+	this.notify(NOTIFY_STREAM, "xadd", key)
+	if strategy != "" && streamTrim(stream, strategy, threshold) > 0 {
+		props = append(props, []string{"XTRIM", key, strategy, threshold})
+		this.notify(NOTIFY_STREAM, "xtrim", key)
+	}
+	this.blocking.Signal(key)
+	return []string{streamIDString(id)}, props
+}
+
+func (this *Engine) xlen(args []string) (res []string) {
+	if len(args) != 1 {
+		return []string{"(error) ERR wrong number of arguments for 'xlen' command"}
+	}
+	key := args[0]
+	this.hashmap.Lock(key, false)
+	defer this.hashmap.Unlock(key, false)
+
+	stream, err := this.getStream(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if stream == nil {
+		return []string{integerReply(0)}
+	}
+	return []string{integerReply(stream.Len())}
+}
+
+// XRANGE key start end [COUNT count]
+func (this *Engine) xrange(args []string) (res []string) {
+	return this.xrangeGeneric(args, false)
+}
+
+// XREVRANGE key end start [COUNT count]
+func (this *Engine) xrevrange(args []string) (res []string) {
+	return this.xrangeGeneric(args, true)
+}
+
+func (this *Engine) xrangeGeneric(args []string, rev bool) (res []string) {
+	name := "xrange"
+	if rev {
+		name = "xrevrange"
+	}
+	if len(args) != 3 && len(args) != 5 {
+		return []string{fmt.Sprintf("(error) ERR wrong number of arguments for '%s' command", name)}
+	}
+	key, start_str, end_str := args[0], args[1], args[2]
+	if rev {
+		start_str, end_str = end_str, start_str
+	}
+	start, err := parseStreamRangeID(start_str, true)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	end, err := parseStreamRangeID(end_str, false)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	count := -1
+	if len(args) == 5 {
+		if strings.ToUpper(args[3]) != "COUNT" {
+			return []string{"(error) ERR syntax error"}
+		}
+		if count, err = strconv.Atoi(args[4]); err != nil {
+			return []string{"(error) ERR value is not an integer or out of range"}
+		}
+		if count == 0 {
+			return []string{"(empty array)"}
+		}
+	}
+
+	this.hashmap.Lock(key, false)
+	defer this.hashmap.Unlock(key, false)
+
+	stream, err := this.getStream(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if stream == nil {
+		return []string{"(empty array)"}
+	}
+	return formatNested(streamEntriesReply(stream.Range(start, end, count, rev)))
+}
+
+func parseStreamIDs(args []string) ([]siface.StreamID, string) {
+	ids := make([]siface.StreamID, 0, len(args))
+	for _, arg := range args {
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			return nil, err.Error()
+		}
+		ids = append(ids, id)
+	}
+	return ids, ""
+}
+
+// XDEL key id [id ...]
+func (this *Engine) xdel(args []string) (res []string) {
+	if len(args) < 2 {
+		return []string{"(error) ERR wrong number of arguments for 'xdel' command"}
+	}
+	key := args[0]
+	ids, err_str := parseStreamIDs(args[1:])
+	if err_str != "" {
+		return []string{err_str}
+	}
+
+	this.hashmap.Lock(key, true)
+	defer this.hashmap.Unlock(key, true)
+
+	stream, err := this.getStream(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if stream == nil {
+		return []string{integerReply(0)}
+	}
+	num := stream.Delete(ids)
+	if num > 0 {
+		this.notify(NOTIFY_STREAM, "xdel", key)
+	}
+	return []string{integerReply(num)}
+}
+
+// XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+func (this *Engine) xtrim(args []string) (res []string, props [][]string) {
+	if len(args) < 3 {
+		return []string{"(error) ERR wrong number of arguments for 'xtrim' command"}, nil
+	}
+	key := args[0]
+	strategy := strings.ToUpper(args[1])
+	if strategy != "MAXLEN" && strategy != "MINID" {
+		return []string{"(error) ERR syntax error"}, nil
+	}
+	strategy, threshold, next, err_str := parseStreamTrim(args, 1)
+	if err_str != "" {
+		return []string{err_str}, nil
+	}
+	if next != len(args) {
+		return []string{"(error) ERR syntax error"}, nil
+	}
+
+	this.hashmap.Lock(key, true)
+	defer this.hashmap.Unlock(key, true)
+
+	stream, err := this.getStream(key)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	if stream == nil {
+		return []string{integerReply(0)}, nil
+	}
+	num := streamTrim(stream, strategy, threshold)
+	if num > 0 {
+		props = [][]string{{"XTRIM", key, strategy, threshold}}
+		this.notify(NOTIFY_STREAM, "xtrim", key)
+	}
+	return []string{integerReply(num)}, props
+}
+
+// XSETID key last-id [ENTRIESADDED entries-added] [MAXDELETEDID max-deleted-id], MAXDELETEDID is ignored
+func (this *Engine) xsetid(args []string) (res []string) {
+	if len(args) != 2 && len(args) != 4 && len(args) != 6 {
+		return []string{"(error) ERR wrong number of arguments for 'xsetid' command"}
+	}
+	key := args[0]
+	id, err := parseStreamID(args[1], 0)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var entries_added int64 = -1
+	for i := 2; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "ENTRIESADDED":
+			if entries_added, err = strconv.ParseInt(args[i+1], 10, 64); err != nil || entries_added < 0 {
+				return []string{"(error) ERR entries_added must be positive"}
+			}
+		case "MAXDELETEDID":
+			if _, err = parseStreamID(args[i+1], 0); err != nil {
+				return []string{err.Error()}
+			}
+		default:
+			return []string{"(error) ERR syntax error"}
+		}
+	}
+
+	this.hashmap.Lock(key, true)
+	defer this.hashmap.Unlock(key, true)
+
+	stream, err := this.getStream(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if stream == nil {
+		return []string{"(error) ERR no such key"}
+	}
+	if entries_added >= 0 && uint64(entries_added) < stream.Len() {
+		return []string{"(error) ERR The entries_added specified in XSETID is smaller than the target stream length"}
+	}
+	if err = stream.SetLastID(id); err != nil {
+		return []string{err.Error()}
+	}
+	if entries_added >= 0 {
+		stream.SetEntriesAdded(uint64(entries_added))
+	}
+	this.notify(NOTIFY_STREAM, "xsetid", key)
+	return []string{"OK"}
+}
+
+type streamReadArgs struct {
+	group    string
+	consumer string
+	count    int
+	block    int64 // ms, -1 if not blocking
+	noack    bool
+	keys     []string
+	ids      []string
+}
+
+// [GROUP group consumer] [COUNT count] [BLOCK ms] [NOACK] STREAMS key [key ...] id [id ...]
+func parseStreamReadArgs(name string, args []string, with_group bool) (parsed streamReadArgs, err_str string) {
+	parsed.count = -1
+	parsed.block = -1
+	i := 0
+	if with_group {
+		if len(args) < 3 || strings.ToUpper(args[0]) != "GROUP" {
+			return parsed, "(error) ERR syntax error"
+		}
+		parsed.group, parsed.consumer = args[1], args[2]
+		i = 3
+	}
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return parsed, "(error) ERR syntax error"
+			}
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return parsed, "(error) ERR value is not an integer or out of range"
+			}
+			if count > 0 {
+				parsed.count = count
+			}
+			i++
+		case "BLOCK":
+			if i+1 >= len(args) {
+				return parsed, "(error) ERR syntax error"
+			}
+			block, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || block < 0 {
+				return parsed, "(error) ERR timeout is not an integer or out of range"
+			}
+			parsed.block = block
+			i++
+		case "NOACK":
+			if !with_group {
+				return parsed, "(error) ERR syntax error"
+			}
+			parsed.noack = true
+		case "STREAMS":
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return parsed, fmt.Sprintf("(error) ERR Unbalanced '%s' list of streams: for each stream key an ID or '$' must be specified.", name)
+			}
+			parsed.keys = rest[:len(rest)/2]
+			parsed.ids = rest[len(rest)/2:]
+			return parsed, ""
+		default:
+			return parsed, "(error) ERR syntax error"
+		}
+	}
+	return parsed, "(error) ERR syntax error"
+}
+
+// run try until it returns something, waiting for the keys to be written between tries.
+// block is in ms, -1 runs try once and 0 blocks forever
+func (this *Engine) blockOn(keys []string, block int64, try func() bool) {
+	if block < 0 {
+		try()
+		return
+	}
+	var deadline time.Time
+	if block > 0 {
+		deadline = time.Now().Add(time.Duration(block) * time.Millisecond)
+	}
+	for {
+		ch := this.blocking.Register(keys)
+		done := try()
+		if done || this.blocking.IsStopped() {
+			this.blocking.Unregister(keys, ch)
+			return
+		}
+		// scripts can run while it's waiting
+		this.script_lock.RUnlock()
+		ok := this.blocking.Wait(ch, deadline)
+		this.script_lock.RLock()
+		this.blocking.Unregister(keys, ch)
+		if !ok {
+			return
+		}
+	}
+}
+
+// XREAD [COUNT count] [BLOCK ms] STREAMS key [key ...] id [id ...]
+func (this *Engine) xread(args []string) (res []string) {
+	parsed, err_str := parseStreamReadArgs("xread", args, false)
+	if err_str != "" {
+		return []string{err_str}
+	}
+
+	// $ is the last id when the cmd is called, so only entries added later are read
+	ids := make([]siface.StreamID, len(parsed.keys))
+	for i, key := range parsed.keys {
+		if parsed.ids[i] != "$" {
+			id, err := parseStreamID(parsed.ids[i], 0)
+			if err != nil {
+				return []string{err.Error()}
+			}
+			ids[i] = id
+			continue
+		}
+		this.hashmap.Lock(key, false)
+		stream, err := this.getStream(key)
+		if stream != nil {
+			ids[i] = stream.LastID()
+		}
+		this.hashmap.Unlock(key, false)
+		if err != nil {
+			return []string{err.Error()}
+		}
+	}
+
+	var reply []interface{}
+	this.blockOn(parsed.keys, parsed.block, func() bool {
+		this.hashmap.Locks(parsed.keys, false)
+		defer this.hashmap.Unlocks(parsed.keys, false)
+
+		reply = make([]interface{}, 0)
+		for i, key := range parsed.keys {
+			stream, err := this.getStream(key)
+			if err != nil {
+				res = []string{err.Error()}
+				return true
+			}
+			if stream == nil || ids[i] == STREAM_ID_MAX {
+				continue
+			}
+			entries := stream.Range(streamIDIncr(ids[i]), STREAM_ID_MAX, parsed.count, false)
+			if len(entries) > 0 {
+				reply = append(reply, []interface{}{key, streamEntriesReply(entries)})
+			}
+		}
+		return len(reply) > 0
+	})
+	if res != nil {
+		return res
+	}
+	if len(reply) == 0 {
+		return []string{"(nil)"}
+	}
+	return formatNested(reply)
+}
+
+// the cmd to persist the delivery of a pending entry
+func streamClaimProp(key string, group string, consumer string, id siface.StreamID, delivery_time int64, delivery_count uint64) []string {
+	return []string{"XCLAIM", key, group, consumer, "0", streamIDString(id),
+		"TIME", fmt.Sprint(delivery_time), "RETRYCOUNT", fmt.Sprint(delivery_count), "FORCE", "JUSTID"}
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK ms] [NOACK] STREAMS key [key ...] id [id ...]
+// it's persisted as XCLAIMs of the delivered entries and XGROUP SETID, so the replay doesn't depend on timing
+func (this *Engine) xreadgroup(args []string) (res []string, props [][]string) {
+	parsed, err_str := parseStreamReadArgs("xreadgroup", args, true)
+	if err_str != "" {
+		return []string{err_str}, nil
+	}
+	// only reading new entries blocks
+	for _, id := range parsed.ids {
+		if id != ">" {
+			if _, err := parseStreamID(id, 0); err != nil {
+				return []string{err.Error()}, nil
+			}
+			parsed.block = -1
+		}
+	}
+
+	props = make([][]string, 0)
+	var reply []interface{}
+	this.blockOn(parsed.keys, parsed.block, func() bool {
+		this.hashmap.Locks(parsed.keys, true)
+		defer this.hashmap.Unlocks(parsed.keys, true)
+
+		reply = make([]interface{}, 0)
+		found := false
+		for i, key := range parsed.keys {
+			stream, err := this.getStream(key)
+			if err != nil {
+				res = []string{err.Error()}
+				return true
+			}
+			var group siface.IStreamGroup
+			if stream != nil {
+				group, err = stream.GetGroup(parsed.group)
+			}
+			if stream == nil || err != nil {
+				res = []string{fmt.Sprintf("(error) NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, parsed.group)}
+				return true
+			}
+
+			now := nowMs()
+			if group.CreateConsumer(parsed.consumer, now) {
+				props = append(props, []string{"XGROUP", "CREATECONSUMER", key, parsed.group, parsed.consumer})
+			}
+			if parsed.ids[i] == ">" {
+				entries := group.ReadNew(parsed.consumer, parsed.count, parsed.noack, now)
+				if len(entries) == 0 {
+					continue
+				}
+				found = true
+				reply = append(reply, []interface{}{key, streamEntriesReply(entries)})
+				if !parsed.noack {
+					for _, entry := range entries {
+						pending, _ := group.GetPending(entry.ID)
+						props = append(props, streamClaimProp(key, parsed.group, parsed.consumer, entry.ID, pending.DeliveryTime, pending.DeliveryCount))
+					}
+				}
+				props = append(props, []string{"XGROUP", "SETID", key, parsed.group, streamIDString(group.LastID())})
+			} else {
+				// history of the consumer is replied even if empty
+				start, _ := parseStreamID(parsed.ids[i], 0)
+				found = true
+				reply = append(reply, []interface{}{key, streamEntriesReply(group.ReadHistory(parsed.consumer, start, parsed.count, now))})
+			}
+		}
+		return found
+	})
+	if res != nil {
+		return res, props
+	}
+	if len(reply) == 0 {
+		return []string{"(nil)"}, props
+	}
+	return formatNested(reply), props
+}
+
+// stream and group of the key, err is replied if either doesn't exist
+func (this *Engine) getStreamGroup(key string, name string) (siface.IStream, siface.IStreamGroup, string) {
+	stream, err := this.getStream(key)
+	if err != nil {
+		return nil, nil, err.Error()
+	}
+	if stream == nil {
+		return nil, nil, fmt.Sprintf("(error) NOGROUP No such key '%s' or consumer group '%s'", key, name)
+	}
+	group, err := stream.GetGroup(name)
+	if err != nil {
+		return nil, nil, fmt.Sprintf("(error) NOGROUP No such key '%s' or consumer group '%s'", key, name)
+	}
+	return stream, group, ""
+}
+
+// XGROUP CREATE|SETID|DESTROY|CREATECONSUMER|DELCONSUMER key group ...
+func (this *Engine) xgroup(args []string) (res []string, props [][]string) {
+	if len(args) == 1 && strings.ToUpper(args[0]) == "HELP" {
+		return []string{
+			"CREATE <key> <groupname> <id|$> [MKSTREAM]",
+			"SETID <key> <groupname> <id|$>",
+			"DESTROY <key> <groupname>",
+			"CREATECONSUMER <key> <groupname> <consumer>",
+			"DELCONSUMER <key> <groupname> <consumer>",
+		}, nil
+	}
+	if len(args) < 3 {
+		return []string{"(error) ERR wrong number of arguments for 'xgroup' command"}, nil
+	}
+	subcmd, key, name := strings.ToUpper(args[0]), args[1], args[2]
+	wrong_args := []string{fmt.Sprintf("(error) ERR wrong number of arguments for 'xgroup|%s' command", strings.ToLower(subcmd))}
+
+	this.hashmap.Lock(key, true)
+	defer this.hashmap.Unlock(key, true)
+
+	stream, err := this.getStream(key)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+
+	switch subcmd {
+	case "CREATE", "SETID":
+		// ENTRIESREAD n is accepted and ignored
+		if len(args) < 4 {
+			return wrong_args, nil
+		}
+		mkstream := false
+		for i := 4; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "MKSTREAM":
+				mkstream = subcmd == "CREATE"
+			case "ENTRIESREAD":
+				i++
+			default:
+				return []string{"(error) ERR syntax error"}, nil
+			}
+		}
+		if stream == nil {
+			if !mkstream {
+				return []string{"(error) ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."}, nil
+			}
+			stream = NewStream()
+			this.hashmap.Put(key, stream)
+		}
+		id := stream.LastID()
+		if args[3] != "$" {
+			if id, err = parseStreamID(args[3], 0); err != nil {
+				return []string{err.Error()}, nil
+			}
+		}
+		if subcmd == "CREATE" {
+			if err = stream.CreateGroup(name, id); err != nil {
+				return []string{err.Error()}, nil
+			}
+			this.notify(NOTIFY_STREAM, "xgroup-create", key)
+			return []string{"OK"}, [][]string{{"XGROUP", "CREATE", key, name, streamIDString(id), "MKSTREAM"}}
+		}
+		group, err := stream.GetGroup(name)
+		if err != nil {
+			return []string{err.Error()}, nil
+		}
+		group.SetLastID(id)
+		this.notify(NOTIFY_STREAM, "xgroup-setid", key)
+		return []string{"OK"}, [][]string{{"XGROUP", "SETID", key, name, streamIDString(id)}}
+	case "DESTROY":
+		if len(args) != 3 {
+			return wrong_args, nil
+		}
+		if stream == nil || !stream.DestroyGroup(name) {
+			return []string{integerReply(0)}, nil
+		}
+		this.notify(NOTIFY_STREAM, "xgroup-destroy", key)
+		// the blocked readers of the group get NOGROUP
+		this.blocking.Signal(key)
+		return []string{integerReply(1)}, [][]string{{"XGROUP", "DESTROY", key, name}}
+	case "CREATECONSUMER", "DELCONSUMER":
+		if len(args) != 4 {
+			return wrong_args, nil
+		}
+		_, group, err_str := this.getStreamGroup(key, name)
+		if err_str != "" {
+			return []string{err_str}, nil
+		}
+		props = [][]string{{"XGROUP", subcmd, key, name, args[3]}}
+		if subcmd == "DELCONSUMER" {
+			this.notify(NOTIFY_STREAM, "xgroup-delconsumer", key)
+			return []string{integerReply(group.DelConsumer(args[3]))}, props
+		}
+		if !group.CreateConsumer(args[3], nowMs()) {
+			return []string{integerReply(0)}, nil
+		}
+		this.notify(NOTIFY_STREAM, "xgroup-createconsumer", key)
+		return []string{integerReply(1)}, props
+	default:
+		return []string{fmt.Sprintf("(error) ERR unknown subcommand '%s'. Try XGROUP HELP.", args[0])}, nil
+	}
+}
+
+// XACK key group id [id ...]
+func (this *Engine) xack(args []string) (res []string) {
+	if len(args) < 3 {
+		return []string{"(error) ERR wrong number of arguments for 'xack' command"}
+	}
+	key := args[0]
+	ids, err_str := parseStreamIDs(args[2:])
+	if err_str != "" {
+		return []string{err_str}
+	}
+
+	this.hashmap.Lock(key, true)
+	defer this.hashmap.Unlock(key, true)
+
+	stream, err := this.getStream(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if stream == nil {
+		return []string{integerReply(0)}
+	}
+	group, err := stream.GetGroup(args[1])
+	if err != nil {
+		return []string{integerReply(0)}
+	}
+	return []string{integerReply(group.Ack(ids))}
+}
+
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func (this *Engine) xpending(args []string) (res []string) {
+	if len(args) < 2 {
+		return []string{"(error) ERR wrong number of arguments for 'xpending' command"}
+	}
+	key, name := args[0], args[1]
+
+	// extended form
+	var min_idle int64 = 0
+	start, end := STREAM_ID_MIN, STREAM_ID_MAX
+	count := -1
+	consumer := ""
+	rest := args[2:]
+	if len(rest) > 0 {
+		if strings.ToUpper(rest[0]) == "IDLE" {
+			if len(rest) < 2 {
+				return []string{"(error) ERR syntax error"}
+			}
+			var err error
+			if min_idle, err = strconv.ParseInt(rest[1], 10, 64); err != nil {
+				return []string{"(error) ERR value is not an integer or out of range"}
+			}
+			rest = rest[2:]
+		}
+		if len(rest) != 3 && len(rest) != 4 {
+			return []string{"(error) ERR syntax error"}
+		}
+		var err error
+		if start, err = parseStreamRangeID(rest[0], true); err != nil {
+			return []string{err.Error()}
+		}
+		if end, err = parseStreamRangeID(rest[1], false); err != nil {
+			return []string{err.Error()}
+		}
+		if count, err = strconv.Atoi(rest[2]); err != nil {
+			return []string{"(error) ERR value is not an integer or out of range"}
+		}
+		if len(rest) == 4 {
+			consumer = rest[3]
+		}
+	}
+
+	this.hashmap.Lock(key, false)
+	defer this.hashmap.Unlock(key, false)
+
+	_, group, err_str := this.getStreamGroup(key, name)
+	if err_str != "" {
+		return []string{err_str}
+	}
+	pendings := group.Pending()
+
+	if len(args) == 2 {
+		if len(pendings) == 0 {
+			return formatNested([]interface{}{integerReply(0), nil, nil, nil})
+		}
+		counts := make(map[string]int)
+		for _, pending := range pendings {
+			counts[pending.Consumer]++
+		}
+		names := make([]string, 0, len(counts))
+		for name := range counts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		consumers := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			consumers = append(consumers, []interface{}{name, fmt.Sprint(counts[name])})
+		}
+		return formatNested([]interface{}{
+			integerReply(len(pendings)),
+			streamIDString(pendings[0].ID),
+			streamIDString(pendings[len(pendings)-1].ID),
+			consumers,
+		})
+	}
+
+	now := nowMs()
+	reply := make([]interface{}, 0)
+	for _, pending := range pendings {
+		if count >= 0 && len(reply) >= count {
+			break
+		}
+		if streamIDLess(pending.ID, start) || streamIDLess(end, pending.ID) {
+			continue
+		}
+		if consumer != "" && pending.Consumer != consumer {
+			continue
+		}
+		idle := now - pending.DeliveryTime
+		if idle < min_idle {
+			continue
+		}
+		reply = append(reply, []interface{}{streamIDString(pending.ID), pending.Consumer, integerReply(idle), integerReply(pending.DeliveryCount)})
+	}
+	return formatNested(reply)
+}
+
+type streamClaimArgs struct {
+	delivery_time int64 // -1 for now
+	// TIME is given, the consumer is seen at it instead of now. the persisted XCLAIMs carry the time
+	// of the delivery, so a replay gets the seen-time of the master instead of the time it runs
+	by_time bool
+	retry   int64 // -1 for increasing the count
+	force   bool
+	justid  bool
+	lastid  *siface.StreamID
+}
+
+// claim an entry if it's idle long enough, returns the reply of it (nil if not claimed) and the cmd to persist
+func (this *Engine) streamClaim(key string, group siface.IStreamGroup, consumer string, id siface.StreamID, min_idle int64, opts streamClaimArgs, now int64) (interface{}, []string) {
+	pending, is_pending := group.GetPending(id)
+	if is_pending && now-pending.DeliveryTime < min_idle {
+		return nil, nil
+	}
+
+	delivery_time := now
+	if opts.delivery_time >= 0 {
+		delivery_time = opts.delivery_time
+	}
+	delivery_count := pending.DeliveryCount
+	if opts.retry >= 0 {
+		delivery_count = uint64(opts.retry)
+	} else if !opts.justid {
+		delivery_count++
+	}
+
+	seen_time := now
+	if opts.by_time {
+		seen_time = delivery_time
+	}
+	entry, deleted := group.Claim(consumer, id, delivery_time, delivery_count, opts.force, seen_time)
+	if entry == nil {
+		if deleted {
+			// replays to the same removal from the pending list
+			return nil, streamClaimProp(key, group.Name(), consumer, id, delivery_time, delivery_count)
+		}
+		return nil, nil
+	}
+	prop := streamClaimProp(key, group.Name(), consumer, id, delivery_time, delivery_count)
+	if opts.justid {
+		return streamIDString(id), prop
+	}
+	return streamEntryReply(*entry), prop
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-ms] [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]
+func (this *Engine) xclaim(args []string) (res []string, props [][]string) {
+	if len(args) < 5 {
+		return []string{"(error) ERR wrong number of arguments for 'xclaim' command"}, nil
+	}
+	key, name, consumer := args[0], args[1], args[2]
+	min_idle, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || min_idle < 0 {
+		return []string{"(error) ERR Invalid min-idle-time argument for XCLAIM"}, nil
+	}
+
+	now := nowMs()
+	ids := make([]siface.StreamID, 0)
+	opts := streamClaimArgs{delivery_time: -1, retry: -1}
+	i := 4
+	for ; i < len(args); i++ {
+		id, err := parseStreamID(args[i], 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch option {
+		case "FORCE":
+			opts.force = true
+		case "JUSTID":
+			opts.justid = true
+		case "IDLE", "TIME", "RETRYCOUNT", "LASTID":
+			if i+1 >= len(args) {
+				return []string{"(error) ERR syntax error"}, nil
+			}
+			i++
+			if option == "LASTID" {
+				id, err := parseStreamID(args[i], 0)
+				if err != nil {
+					return []string{err.Error()}, nil
+				}
+				opts.lastid = &id
+				continue
+			}
+			val, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || val < 0 {
+				return []string{fmt.Sprintf("(error) ERR Invalid %s option argument for XCLAIM", option)}, nil
+			}
+			switch option {
+			case "IDLE":
+				opts.delivery_time = now - val
+			case "TIME":
+				opts.delivery_time = val
+				opts.by_time = true
+			case "RETRYCOUNT":
+				opts.retry = val
+			}
+		default:
+			return []string{fmt.Sprintf("(error) ERR Unrecognized XCLAIM option '%s'", args[i])}, nil
+		}
+	}
+	if len(ids) == 0 {
+		return []string{"(error) ERR wrong number of arguments for 'xclaim' command"}, nil
+	}
+
+	this.hashmap.Lock(key, true)
+	defer this.hashmap.Unlock(key, true)
+
+	_, group, err_str := this.getStreamGroup(key, name)
+	if err_str != "" {
+		return []string{err_str}, nil
+	}
+	if opts.lastid != nil && streamIDLess(group.LastID(), *opts.lastid) {
+		group.SetLastID(*opts.lastid)
+		props = append(props, []string{"XGROUP", "SETID", key, name, streamIDString(*opts.lastid)})
+	}
+
+	reply := make([]interface{}, 0)
+	for _, id := range ids {
+		item, prop := this.streamClaim(key, group, consumer, id, min_idle, opts, now)
+		if prop != nil {
+			props = append(props, prop)
+		}
+		if item != nil {
+			reply = append(reply, item)
+		}
+	}
+	return formatNested(reply), props
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func (this *Engine) xautoclaim(args []string) (res []string, props [][]string) {
+	if len(args) < 5 {
+		return []string{"(error) ERR wrong number of arguments for 'xautoclaim' command"}, nil
+	}
+	key, name, consumer := args[0], args[1], args[2]
+	min_idle, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || min_idle < 0 {
+		return []string{"(error) ERR Invalid min-idle-time argument for XAUTOCLAIM"}, nil
+	}
+	start, err := parseStreamRangeID(args[4], true)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	count := 100
+	opts := streamClaimArgs{delivery_time: -1, retry: -1}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return []string{"(error) ERR syntax error"}, nil
+			}
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return []string{"(error) ERR COUNT must be > 0"}, nil
+			}
+			i++
+		case "JUSTID":
+			opts.justid = true
+		default:
+			return []string{"(error) ERR syntax error"}, nil
+		}
+	}
+
+	this.hashmap.Lock(key, true)
+	defer this.hashmap.Unlock(key, true)
+
+	_, group, err_str := this.getStreamGroup(key, name)
+	if err_str != "" {
+		return []string{err_str}, nil
+	}
+
+	now := nowMs()
+	claimed := make([]interface{}, 0)
+	deleted := make([]interface{}, 0)
+	next := STREAM_ID_MIN
+	// scan at most count*10 pending entries, like redis
+	attempts := count * 10
+	for _, pending := range group.Pending() {
+		if streamIDLess(pending.ID, start) {
+			continue
+		}
+		if attempts == 0 || len(claimed) >= count {
+			next = pending.ID
+			break
+		}
+		attempts--
+		item, prop := this.streamClaim(key, group, consumer, pending.ID, min_idle, opts, now)
+		if prop != nil {
+			props = append(props, prop)
+			if item == nil {
+				deleted = append(deleted, streamIDString(pending.ID))
+			}
+		}
+		if item != nil {
+			claimed = append(claimed, item)
+		}
+	}
+	return formatNested([]interface{}{streamIDString(next), claimed, deleted}), props
+}
+
+// XINFO STREAM key [FULL [COUNT count]] | GROUPS key | CONSUMERS key group
+func (this *Engine) xinfo(args []string) (res []string) {
+	if len(args) == 1 && strings.ToUpper(args[0]) == "HELP" {
+		return []string{
+			"CONSUMERS <key> <groupname>",
+			"GROUPS <key>",
+			"STREAM <key> [FULL [COUNT <count>]]",
+		}
+	}
+	if len(args) < 2 {
+		return []string{"(error) ERR wrong number of arguments for 'xinfo' command"}
+	}
+	subcmd, key := strings.ToUpper(args[0]), args[1]
+
+	this.hashmap.Lock(key, false)
+	defer this.hashmap.Unlock(key, false)
+
+	stream, err := this.getStream(key)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if stream == nil {
+		return []string{"(error) ERR no such key"}
+	}
+	now := nowMs()
+
+	switch subcmd {
+	case "STREAM":
+		full := false
+		count := 10
+		if len(args) >= 3 {
+			if strings.ToUpper(args[2]) != "FULL" {
+				return []string{"(error) ERR syntax error"}
+			}
+			full = true
+			if len(args) == 5 && strings.ToUpper(args[3]) == "COUNT" {
+				if count, err = strconv.Atoi(args[4]); err != nil {
+					return []string{"(error) ERR value is not an integer or out of range"}
+				}
+			} else if len(args) != 3 {
+				return []string{"(error) ERR syntax error"}
+			}
+		}
+		reply := []interface{}{
+			"length", integerReply(stream.Len()),
+			"entries-added", integerReply(stream.EntriesAdded()),
+			"last-generated-id", streamIDString(stream.LastID()),
+		}
+		if !full {
+			var first, last interface{}
+			if entries := stream.Range(STREAM_ID_MIN, STREAM_ID_MAX, 1, false); len(entries) > 0 {
+				first = streamEntryReply(entries[0])
+			}
+			if entries := stream.Range(STREAM_ID_MIN, STREAM_ID_MAX, 1, true); len(entries) > 0 {
+				last = streamEntryReply(entries[0])
+			}
+			reply = append(reply, "groups", integerReply(len(stream.Groups())), "first-entry", first, "last-entry", last)
+			return formatNested(reply)
+		}
+
+		if count <= 0 {
+			count = -1
+		}
+		groups := make([]interface{}, 0)
+		for _, group := range stream.Groups() {
+			pel := make([]interface{}, 0)
+			for _, pending := range group.Pending() {
+				pel = append(pel, []interface{}{streamIDString(pending.ID), pending.Consumer, integerReply(pending.DeliveryTime), integerReply(pending.DeliveryCount)})
+			}
+			consumers := make([]interface{}, 0)
+			for _, consumer := range group.Consumers() {
+				consumers = append(consumers, []interface{}{"name", consumer.Name, "seen-time", integerReply(consumer.SeenTime), "pel-count", integerReply(consumer.Pending)})
+			}
+			groups = append(groups, []interface{}{
+				"name", group.Name(),
+				"last-delivered-id", streamIDString(group.LastID()),
+				"pel-count", integerReply(len(pel)),
+				"pending", pel,
+				"consumers", consumers,
+			})
+		}
+		reply = append(reply, "entries", streamEntriesReply(stream.Range(STREAM_ID_MIN, STREAM_ID_MAX, count, false)), "groups", groups)
+		return formatNested(reply)
+	case "GROUPS":
+		if len(args) != 2 {
+			return []string{"(error) ERR wrong number of arguments for 'xinfo|groups' command"}
+		}
+		reply := make([]interface{}, 0)
+		for _, group := range stream.Groups() {
+			reply = append(reply, []interface{}{
+				"name", group.Name(),
+				"consumers", integerReply(len(group.Consumers())),
+				"pending", integerReply(len(group.Pending())),
+				"last-delivered-id", streamIDString(group.LastID()),
+			})
+		}
+		return formatNested(reply)
+	case "CONSUMERS":
+		if len(args) != 3 {
+			return []string{"(error) ERR wrong number of arguments for 'xinfo|consumers' command"}
+		}
+		group, err := stream.GetGroup(args[2])
+		if err != nil {
+			return []string{err.Error()}
+		}
+		reply := make([]interface{}, 0)
+		for _, consumer := range group.Consumers() {
+			reply = append(reply, []interface{}{
+				"name", consumer.Name,
+				"pending", integerReply(consumer.Pending),
+				"idle", integerReply(now - consumer.SeenTime),
+			})
+		}
+		return formatNested(reply)
+	default:
+		return []string{fmt.Sprintf("(error) ERR unknown subcommand '%s'. Try XINFO HELP.", args[0])}
+	}
+}
+
+// cmds to rebuild a stream, used by the aof rewrite, full resync and MIGRATE
+func stream2cmds(key string, stream siface.IStream) (cmds [][]string) {
+	cmds = make([][]string, 0)
+	entries := stream.Range(STREAM_ID_MIN, STREAM_ID_MAX, -1, false)
+	if len(entries) == 0 {
+		// an empty stream is created by adding an entry and trimming it
+		cmds = append(cmds, []string{"XADD", key, "MAXLEN", "0", "0-1", "_", "_"})
+	}
+	for _, entry := range entries {
+		cmds = append(cmds, append([]string{"XADD", key, streamIDString(entry.ID)}, entry.Fields...))
+	}
+	cmds = append(cmds, []string{"XSETID", key, streamIDString(stream.LastID()), "ENTRIESADDED", fmt.Sprint(stream.EntriesAdded())})
+
+	for _, group := range stream.Groups() {
+		cmds = append(cmds, []string{"XGROUP", "CREATE", key, group.Name(), streamIDString(group.LastID())})
+		for _, consumer := range group.Consumers() {
+			cmds = append(cmds, []string{"XGROUP", "CREATECONSUMER", key, group.Name(), consumer.Name})
+		}
+		for _, pending := range group.Pending() {
+			cmds = append(cmds, streamClaimProp(key, group.Name(), pending.Consumer, pending.ID, pending.DeliveryTime, pending.DeliveryCount))
+		}
+	}
+	return
+}
@@ -0,0 +1,435 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// function libraries, shared by all dbs like the scripts.
+// A library is lua code starting with "#!lua name=<library>", which registers its functions by
+// redis.register_function. The libraries are persisted in database/functions as FUNCTION LOAD cmdlines
+// instead of the aofs, and loaded before the aof is replayed. The FUNCTION cmds changing them are fed
+// to the replicas, and a full resync sends all of them by FUNCTION RESTORE.
+
+type Function struct {
+	name        string
+	description string
+	flags       []string
+}
+
+type FunctionLib struct {
+	name      string
+	code      string
+	proto     *lua.FunctionProto
+	functions map[string]*Function
+}
+
+type FunctionRegistry struct {
+	lock sync.RWMutex
+	libs map[string]*FunctionLib
+	// function name -> library
+	funcs map[string]*FunctionLib
+	// file the libraries are saved to, empty if they aren't persisted
+	path string
+	// dbs opened with the file
+	refs int
+}
+
+var functions = NewFunctionRegistry()
+
+var (
+	errFuncPayload     = errors.New("(error) ERR payload version or checksum are wrong")
+	function_name_re   = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+	function_flags     = map[string]bool{"no-writes": true, "allow-oom": true, "allow-stale": true, "no-cluster": true, "allow-cross-slot-keys": true}
+	function_dump_head = "GFUN"
+)
+
+func NewFunctionRegistry() *FunctionRegistry {
+	return &FunctionRegistry{
+		libs:  make(map[string]*FunctionLib),
+		funcs: make(map[string]*FunctionLib),
+	}
+}
+
+func (this *Function) hasFlag(flag string) bool {
+	for _, f := range this.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// parse the metadata, compile the code and run it to collect the registered functions
+func NewFunctionLib(code string) (*FunctionLib, error) {
+	if !strings.HasPrefix(code, "#!") {
+		return nil, fmt.Errorf("(error) ERR Missing library metadata")
+	}
+	shebang := code
+	if i := strings.IndexByte(code, '\n'); i >= 0 {
+		shebang = code[:i]
+	}
+	meta := strings.Fields(shebang[2:])
+	if len(meta) == 0 {
+		return nil, fmt.Errorf("(error) ERR Missing library metadata")
+	}
+	if strings.ToLower(meta[0]) != "lua" {
+		return nil, fmt.Errorf("(error) ERR Engine '%s' not found", meta[0])
+	}
+	lib := &FunctionLib{code: code, functions: make(map[string]*Function)}
+	for _, kv := range meta[1:] {
+		if !strings.HasPrefix(kv, "name=") {
+			return nil, fmt.Errorf("(error) ERR Invalid metadata value given: %s", kv)
+		}
+		lib.name = strings.TrimPrefix(kv, "name=")
+	}
+	if lib.name == "" {
+		return nil, fmt.Errorf("(error) ERR Library name was not given")
+	}
+	if !function_name_re.MatchString(lib.name) {
+		return nil, fmt.Errorf("(error) ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+
+	// the shebang isn't lua, it's blanked to keep the line numbers
+	body := code[len(shebang):]
+	chunk, err := parse.Parse(strings.NewReader(body), "user_function")
+	if err != nil {
+		return nil, fmt.Errorf("(error) ERR Error compiling function: %s", strings.TrimSpace(err.Error()))
+	}
+	if lib.proto, err = lua.Compile(chunk, "user_function"); err != nil {
+		return nil, fmt.Errorf("(error) ERR Error compiling function: %s", err.Error())
+	}
+
+	L := newSandboxState()
+	defer L.Close()
+	redis := L.NewTable()
+	L.SetGlobal("redis", redis)
+	setRegisterFunction(L, redis, lib, nil)
+	L.Push(L.NewFunctionFromProto(lib.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		if msg, ok := luaErrorReply(err); ok {
+			return nil, errors.New(msg)
+		}
+		return nil, fmt.Errorf("(error) ERR Error registering functions: %s", scriptErrorMsg(err))
+	}
+	if len(lib.functions) == 0 {
+		return nil, fmt.Errorf("(error) ERR No functions registered")
+	}
+	return lib, nil
+}
+
+// set redis.register_function, which is called by the library code.
+// The functions are added to lib when the library is loaded the first time, otherwise their callbacks
+// are collected by callbacks for FCALL
+func setRegisterFunction(L *lua.LState, redis *lua.LTable, lib *FunctionLib, callbacks map[string]*lua.LFunction) {
+	L.SetField(redis, "register_function", L.NewFunction(func(L *lua.LState) int {
+		fn := &Function{}
+		var callback *lua.LFunction
+		if tbl, ok := L.Get(1).(*lua.LTable); ok && L.GetTop() == 1 {
+			name, ok1 := tbl.RawGetString("function_name").(lua.LString)
+			callback, _ = tbl.RawGetString("callback").(*lua.LFunction)
+			if !ok1 || callback == nil {
+				raiseErrorReply(L, "ERR function_name and callback are required")
+			}
+			fn.name = string(name)
+			if desc, ok := tbl.RawGetString("description").(lua.LString); ok {
+				fn.description = string(desc)
+			}
+			if flags, ok := tbl.RawGetString("flags").(*lua.LTable); ok {
+				for i := 1; i <= flags.Len(); i++ {
+					flag := flags.RawGetInt(i).String()
+					if !function_flags[flag] {
+						raiseErrorReply(L, "ERR unknown flag given")
+					}
+					fn.flags = append(fn.flags, flag)
+				}
+			}
+		} else {
+			fn.name = L.CheckString(1)
+			callback = L.CheckFunction(2)
+		}
+		if callbacks != nil {
+			callbacks[fn.name] = callback
+			return 0
+		}
+		if !function_name_re.MatchString(fn.name) {
+			raiseErrorReply(L, "ERR Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+		}
+		if _, ok := lib.functions[fn.name]; ok {
+			raiseErrorReply(L, "ERR Function already exists in the library")
+		}
+		lib.functions[fn.name] = fn
+		return 0
+	}))
+}
+
+// the library replaces the one of the same name if replace, its functions can't be in other libraries.
+// Like Delete, Flush and Restore, nothing is changed if the libraries fail to be saved
+func (this *FunctionRegistry) Load(code string, replace bool) (string, error) {
+	lib, err := NewFunctionLib(code)
+	if err != nil {
+		return "", err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if err := this.check(lib, replace); err != nil {
+		return "", err
+	}
+	libs, funcs := copyLibs(this.libs), copyLibs(this.funcs)
+	this.add(lib)
+	if err := this.save(); err != nil {
+		// the libraries in memory stay the same as the ones in the file
+		this.libs, this.funcs = libs, funcs
+		return "", err
+	}
+	return lib.name, nil
+}
+
+func (this *FunctionRegistry) check(lib *FunctionLib, replace bool) error {
+	if _, ok := this.libs[lib.name]; ok && !replace {
+		return fmt.Errorf("(error) ERR Library '%s' already exists", lib.name)
+	}
+	for name := range lib.functions {
+		if other, ok := this.funcs[name]; ok && other.name != lib.name {
+			return fmt.Errorf("(error) ERR Function %s already exists", name)
+		}
+	}
+	return nil
+}
+
+func (this *FunctionRegistry) add(lib *FunctionLib) {
+	this.remove(lib.name)
+	this.libs[lib.name] = lib
+	for name := range lib.functions {
+		this.funcs[name] = lib
+	}
+}
+
+func (this *FunctionRegistry) remove(name string) bool {
+	lib, ok := this.libs[name]
+	if !ok {
+		return false
+	}
+	for fname := range lib.functions {
+		delete(this.funcs, fname)
+	}
+	delete(this.libs, name)
+	return true
+}
+
+func (this *FunctionRegistry) Delete(name string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	libs, funcs := copyLibs(this.libs), copyLibs(this.funcs)
+	if !this.remove(name) {
+		return fmt.Errorf("(error) ERR Library not found")
+	}
+	if err := this.save(); err != nil {
+		this.libs, this.funcs = libs, funcs
+		return err
+	}
+	return nil
+}
+
+func (this *FunctionRegistry) Flush() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	libs, funcs := this.libs, this.funcs
+	this.libs = make(map[string]*FunctionLib)
+	this.funcs = make(map[string]*FunctionLib)
+	if err := this.save(); err != nil {
+		this.libs, this.funcs = libs, funcs
+		return err
+	}
+	return nil
+}
+
+// the function and its library, nil if not found
+func (this *FunctionRegistry) Get(name string) (*Function, *FunctionLib) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	lib, ok := this.funcs[name]
+	if !ok {
+		return nil, nil
+	}
+	return lib.functions[name], lib
+}
+
+// libraries sorted by name
+func (this *FunctionRegistry) List() []*FunctionLib {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	libs := make([]*FunctionLib, 0, len(this.libs))
+	for _, lib := range this.libs {
+		libs = append(libs, lib)
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].name < libs[j].name })
+	return libs
+}
+
+// "GFUN" | (code length (uvarint) | code)... | crc32 of the former (4 bytes, LE)
+func (this *FunctionRegistry) Dump() string {
+	buf := []byte(function_dump_head)
+	for _, lib := range this.List() {
+		buf = binary.AppendUvarint(buf, uint64(len(lib.code)))
+		buf = append(buf, lib.code...)
+	}
+	return string(binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf)))
+}
+
+// policy is FLUSH, APPEND or REPLACE, nothing is changed if any library fails
+func (this *FunctionRegistry) Restore(payload string, policy string) error {
+	if len(payload) < len(function_dump_head)+4 || !strings.HasPrefix(payload, function_dump_head) {
+		return errFuncPayload
+	}
+	body := payload[:len(payload)-4]
+	if crc32.ChecksumIEEE([]byte(body)) != binary.LittleEndian.Uint32([]byte(payload[len(body):])) {
+		return errFuncPayload
+	}
+	libs := make([]*FunctionLib, 0)
+	data := []byte(body[len(function_dump_head):])
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return errFuncPayload
+		}
+		lib, err := NewFunctionLib(string(data[n : n+int(size)]))
+		if err != nil {
+			return err
+		}
+		libs = append(libs, lib)
+		data = data[n+int(size):]
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	// the libraries are added to a copy, which replaces the current ones if all of them are added
+	staged := NewFunctionRegistry()
+	if policy != "FLUSH" {
+		staged.libs, staged.funcs = copyLibs(this.libs), copyLibs(this.funcs)
+	}
+	for _, lib := range libs {
+		if err := staged.check(lib, policy == "REPLACE"); err != nil {
+			return err
+		}
+		staged.add(lib)
+	}
+	old_libs, old_funcs := this.libs, this.funcs
+	this.libs, this.funcs = staged.libs, staged.funcs
+	if err := this.save(); err != nil {
+		this.libs, this.funcs = old_libs, old_funcs
+		return err
+	}
+	return nil
+}
+
+func copyLibs(libs map[string]*FunctionLib) map[string]*FunctionLib {
+	copied := make(map[string]*FunctionLib, len(libs))
+	for k, v := range libs {
+		copied[k] = v
+	}
+	return copied
+}
+
+// load the libraries from the file when the first db is opened, and save them to it until all the dbs
+// are closed
+func (this *FunctionRegistry) Open(path string) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	this.lock.Lock()
+	if this.refs > 0 && this.path == path {
+		this.refs++
+		this.lock.Unlock()
+		return
+	}
+	this.path = ""
+	this.refs = 0
+	this.libs = make(map[string]*FunctionLib)
+	this.funcs = make(map[string]*FunctionLib)
+	this.lock.Unlock()
+
+	fd, err := os.Open(path)
+	if err == nil {
+		packer := NewCmdFilePack()
+		reader := bufio.NewReader(fd)
+		for {
+			cmdline, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			cmd := packer.UnserializeCmd(cmdline)
+			if len(cmd) != 4 || cmd[0] != "FUNCTION" || cmd[1] != "LOAD" {
+				continue
+			}
+			if _, err := this.Load(cmd[3], true); err != nil {
+				fmt.Printf("[RECOVER]: fail to load function library, %s\n", err.Error())
+			}
+		}
+		fd.Close()
+	}
+
+	this.lock.Lock()
+	this.path = path
+	this.refs++
+	this.lock.Unlock()
+}
+
+// the libraries are kept but not saved since all the dbs are closed
+func (this *FunctionRegistry) Close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.refs > 0 {
+		this.refs--
+	}
+	if this.refs == 0 {
+		this.path = ""
+	}
+}
+
+// write the libraries to a temp file and rename it, called with the lock
+func (this *FunctionRegistry) save() error {
+	if this.path == "" {
+		return nil
+	}
+	names := make([]string, 0, len(this.libs))
+	for name := range this.libs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	packer := NewCmdFilePack()
+	tmp := filepath.Join(filepath.Dir(this.path), "temp_"+filepath.Base(this.path))
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("(error) ERR fail to save functions, %s", err.Error())
+	}
+	writer := bufio.NewWriter(fd)
+	for _, name := range names {
+		writer.WriteString(packer.SerializeCmd([]string{"FUNCTION", "LOAD", "REPLACE", this.libs[name].code}))
+	}
+	if err := writer.Flush(); err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err != nil {
+		return fmt.Errorf("(error) ERR fail to save functions, %s", err.Error())
+	}
+	if err := os.Rename(tmp, this.path); err != nil {
+		return fmt.Errorf("(error) ERR fail to save functions, %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package server_test
+
+import (
+	"gedis/src/Server/server"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var test_lib = `#!lua name=mylib
+redis.register_function('myset', function(keys, args)
+	return redis.call('SET', keys[1], args[1])
+end)
+redis.register_function{
+	function_name = 'myget',
+	callback = function(keys, args) return redis.call('GET', keys[1]) end,
+	description = 'get a key',
+	flags = {'no-writes'},
+}
+redis.register_function{
+	function_name = 'badget',
+	callback = function(keys, args) return redis.call('SET', keys[1], 'x') end,
+	flags = {'no-writes'},
+}
+`
+
+// FUNCTION LOAD/LIST/DELETE and FCALL/FCALL_RO
+func TestFunction1(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+	handle(engine, "FUNCTION FLUSH")
+
+	if res := engine.Handle([]string{"FUNCTION", "LOAD", test_lib}); res[0] != "mylib" {
+		t.Error("TestFunction1 failed")
+	}
+	if res := engine.Handle([]string{"FUNCTION", "LOAD", test_lib}); res[0] != "(error) ERR Library 'mylib' already exists" {
+		t.Error("TestFunction1 failed")
+	}
+	if res := engine.Handle([]string{"FUNCTION", "LOAD", "REPLACE", test_lib}); res[0] != "mylib" {
+		t.Error("TestFunction1 failed")
+	}
+	other := "#!lua name=other\nredis.register_function('myset', function() return 1 end)"
+	if res := engine.Handle([]string{"FUNCTION", "LOAD", other}); res[0] != "(error) ERR Function myset already exists" {
+		t.Error("TestFunction1 failed")
+	}
+
+	if res := handle(engine, "FCALL myset 1 k v"); res[0] != "OK" {
+		t.Error("TestFunction1 failed")
+	}
+	if res := handle(engine, "FCALL_RO myget 1 k"); res[0] != "v" {
+		t.Error("TestFunction1 failed")
+	}
+	if res := handle(engine, "FCALL_RO myset 1 k v"); res[0] != "(error) ERR Can not execute a script with write flag using *_ro command." {
+		t.Error("TestFunction1 failed")
+	}
+	if res := handle(engine, "FCALL badget 1 k"); res[0] != "(error) ERR Write commands are not allowed from read-only scripts." {
+		t.Error("TestFunction1 failed")
+	}
+	if res := handle(engine, "FCALL nofunc 0"); res[0] != "(error) ERR Function not found" {
+		t.Error("TestFunction1 failed")
+	}
+	// functions are propagated by their effects
+	if _, props := engine.HandleProp([]string{"FCALL", "myset", "1", "k", "v2"}); !reflect.DeepEqual(props, [][]string{{"SET", "k", "v2"}}) {
+		t.Error("TestFunction1 failed")
+	}
+
+	expected := []string{
+		"1) 1) library_name",
+		"   2) mylib",
+		"   3) engine",
+		"   4) LUA",
+		"   5) functions",
+		"   6) 1) 1) name",
+		"         2) badget",
+		"         3) description",
+		"         4) (nil)",
+		"         5) flags",
+		"         6) 1) no-writes",
+		"      2) 1) name",
+		"         2) myget",
+		"         3) description",
+		"         4) get a key",
+		"         5) flags",
+		"         6) 1) no-writes",
+		"      3) 1) name",
+		"         2) myset",
+		"         3) description",
+		"         4) (nil)",
+		"         5) flags",
+		"         6) (empty array)",
+		"   7) library_code",
+	}
+	if res := handle(engine, "FUNCTION LIST LIBRARYNAME my* WITHCODE"); len(res) < len(expected) || !reflect.DeepEqual(res[:len(expected)], expected) || res[len(expected)] != "   8) "+test_lib {
+		t.Error("TestFunction1 failed")
+	}
+	if res := handle(engine, "FUNCTION LIST LIBRARYNAME x*"); res[0] != "(empty array)" {
+		t.Error("TestFunction1 failed")
+	}
+	if res := handle(engine, "FUNCTION DELETE mylib"); res[0] != "OK" {
+		t.Error("TestFunction1 failed")
+	}
+	if res := handle(engine, "FUNCTION DELETE mylib"); res[0] != "(error) ERR Library not found" {
+		t.Error("TestFunction1 failed")
+	}
+	if res := handle(engine, "FCALL myset 1 k v"); res[0] != "(error) ERR Function not found" {
+		t.Error("TestFunction1 failed")
+	}
+}
+
+// errors of the library code
+func TestFunction2(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+	handle(engine, "FUNCTION FLUSH")
+
+	cases := []struct {
+		code     string
+		expected string
+	}{
+		{"return 1", "(error) ERR Missing library metadata"},
+		{"#!js name=lib\nreturn 1", "(error) ERR Engine 'js' not found"},
+		{"#!lua\nreturn 1", "(error) ERR Library name was not given"},
+		{"#!lua name=lib foo=bar\nreturn 1", "(error) ERR Invalid metadata value given: foo=bar"},
+		{"#!lua name=lib\nreturn 1", "(error) ERR No functions registered"},
+		{"#!lua name=lib\nredis.register_function('f', function() end)\nredis.register_function('f', function() end)", "(error) ERR Function already exists in the library"},
+		{"#!lua name=lib\nredis.register_function('f-1', function() end)", "(error) ERR Function names can only contain letters, numbers, or underscores(_) and must be at least one character long"},
+		{"#!lua name=lib\nredis.register_function{function_name='f', callback=function() end, flags={'bad'}}", "(error) ERR unknown flag given"},
+		{"#!lua name=lib\nredis.call('SET', 'k', 'v')", "(error) ERR Error registering functions"},
+		{"#!lua name=lib\nreturn +", "(error) ERR Error compiling function"},
+	}
+	for _, c := range cases {
+		if res := engine.Handle([]string{"FUNCTION", "LOAD", c.code}); !strings.HasPrefix(res[0], c.expected) {
+			t.Error("TestFunction2 failed")
+		}
+	}
+	if res := handle(engine, "FUNCTION LIST"); res[0] != "(empty array)" {
+		t.Error("TestFunction2 failed")
+	}
+}
+
+// FUNCTION DUMP and RESTORE with the policies
+func TestFunction3(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+	handle(engine, "FUNCTION FLUSH")
+
+	engine.Handle([]string{"FUNCTION", "LOAD", test_lib})
+	payload := engine.Handle([]string{"FUNCTION", "DUMP"})[0]
+	handle(engine, "FUNCTION FLUSH")
+	lib2 := "#!lua name=lib2\nredis.register_function('myset', function() return 2 end)"
+	engine.Handle([]string{"FUNCTION", "LOAD", lib2})
+
+	if res := engine.Handle([]string{"FUNCTION", "RESTORE", payload}); res[0] != "(error) ERR Function myset already exists" {
+		t.Error("TestFunction3 failed")
+	}
+	// nothing is restored on errors
+	if res := handle(engine, "FCALL_RO myget 1 k"); res[0] != "(error) ERR Function not found" {
+		t.Error("TestFunction3 failed")
+	}
+	if res := engine.Handle([]string{"FUNCTION", "RESTORE", payload, "FLUSH"}); res[0] != "OK" {
+		t.Error("TestFunction3 failed")
+	}
+	if res := handle(engine, "FCALL myset 1 k v"); res[0] != "OK" {
+		t.Error("TestFunction3 failed")
+	}
+	if res := handle(engine, "FUNCTION LIST LIBRARYNAME lib2"); res[0] != "(empty array)" {
+		t.Error("TestFunction3 failed")
+	}
+	if res := engine.Handle([]string{"FUNCTION", "RESTORE", payload, "REPLACE"}); res[0] != "OK" {
+		t.Error("TestFunction3 failed")
+	}
+	if res := engine.Handle([]string{"FUNCTION", "RESTORE", payload + "x"}); res[0] != "(error) ERR payload version or checksum are wrong" {
+		t.Error("TestFunction3 failed")
+	}
+	if res := engine.Handle([]string{"FUNCTION", "RESTORE", payload, "MERGE"}); !strings.HasPrefix(res[0], "(error) ERR Wrong restore policy") {
+		t.Error("TestFunction3 failed")
+	}
+}
+
+// the libraries are saved, and loaded before the aof is replayed
+func TestFunction4(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	db := server.NewDb("test_function")
+	db.Open()
+	db.Exec([][]byte{[]byte("FUNCTION"), []byte("LOAD"), []byte(test_lib)})
+	db.Exec([][]byte{[]byte("FCALL"), []byte("myset"), []byte("1"), []byte("k"), []byte("v")})
+	db.Close()
+
+	data, _ := os.ReadFile(filepath.Join(dir, "database", "functions"))
+	if !strings.Contains(string(data), "#!lua name=mylib") {
+		t.Error("TestFunction4 failed")
+	}
+	aof, _ := os.ReadFile(filepath.Join(dir, "database", "db_test_function"))
+	if strings.Contains(string(aof), "FUNCTION") || strings.Contains(string(aof), "FCALL") {
+		t.Error("TestFunction4 failed")
+	}
+
+	db = server.NewDb("test_function")
+	db.Open()
+	if res := db.Exec([][]byte{[]byte("FCALL_RO"), []byte("myget"), []byte("1"), []byte("k")}); string(res[0]) != "v" {
+		t.Error("TestFunction4 failed")
+	}
+	db.Exec([][]byte{[]byte("FUNCTION"), []byte("FLUSH")})
+	db.Close()
+
+	db = server.NewDb("test_function")
+	db.Open()
+	defer db.Close()
+	if res := db.Exec([][]byte{[]byte("FCALL_RO"), []byte("myget"), []byte("1"), []byte("k")}); string(res[0]) != "(error) ERR Function not found" {
+		t.Error("TestFunction4 failed")
+	}
+}
+
+// nothing is changed when the libraries fail to be saved
+func TestFunction5(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	db := server.NewDb("test_function")
+	db.Open()
+	defer db.Close()
+	db.Exec([][]byte{[]byte("FUNCTION"), []byte("FLUSH")})
+	db.Exec([][]byte{[]byte("FUNCTION"), []byte("LOAD"), []byte(test_lib)})
+
+	// the temp file can't be created
+	os.RemoveAll(filepath.Join(dir, "database"))
+	lib2 := "#!lua name=lib2\nredis.register_function('other', function() return 2 end)"
+	if res := db.Exec([][]byte{[]byte("FUNCTION"), []byte("LOAD"), []byte(lib2)}); !strings.HasPrefix(string(res[0]), "(error) ERR fail to save functions") {
+		t.Error("TestFunction5 failed")
+	}
+	if res := db.Exec([][]byte{[]byte("FCALL"), []byte("other"), []byte("0")}); string(res[0]) != "(error) ERR Function not found" {
+		t.Error("TestFunction5 failed")
+	}
+	if res := db.Exec([][]byte{[]byte("FUNCTION"), []byte("DELETE"), []byte("mylib")}); !strings.HasPrefix(string(res[0]), "(error) ERR fail to save functions") {
+		t.Error("TestFunction5 failed")
+	}
+	if res := db.Exec([][]byte{[]byte("FUNCTION"), []byte("FLUSH")}); !strings.HasPrefix(string(res[0]), "(error) ERR fail to save functions") {
+		t.Error("TestFunction5 failed")
+	}
+	if res := db.Exec([][]byte{[]byte("FCALL"), []byte("myset"), []byte("1"), []byte("k"), []byte("v")}); string(res[0]) != "OK" {
+		t.Error("TestFunction5 failed")
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"math"
+)
+
+// geohash of redis: the longitude and latitude are quantized to 26 bits each and interleaved
+// into a 52-bit integer, which is stored as the score of a zset member.
+// The latitude is limited to the range of EPSG:3785 (web mercator), so that the cells are square-ish.
+const (
+	GEO_STEP_MAX      = 26
+	GEO_LAT_MIN       = -85.05112878
+	GEO_LAT_MAX       = 85.05112878
+	GEO_LONG_MIN      = -180.0
+	GEO_LONG_MAX      = 180.0
+	GEO_EARTH_RADIUS  = 6372797.560856 // meters, same as redis
+	GEO_MERCATOR_MAX  = 20037726.37
+	GEO_HASH_ALPHABET = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// range of a geohash cell in degrees
+type geoArea struct {
+	min_long, max_long float64
+	min_lat, max_lat   float64
+}
+
+// spread the low 32 bits of x to the even bits
+func geoSpread(x uint64) uint64 {
+	x &= 0xffffffff
+	x = (x | x<<16) & 0x0000ffff0000ffff
+	x = (x | x<<8) & 0x00ff00ff00ff00ff
+	x = (x | x<<4) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+// gather the even bits of x to the low 32 bits
+func geoSqueeze(x uint64) uint64 {
+	x &= 0x5555555555555555
+	x = (x | x>>1) & 0x3333333333333333
+	x = (x | x>>2) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x>>4) & 0x00ff00ff00ff00ff
+	x = (x | x>>8) & 0x0000ffff0000ffff
+	x = (x | x>>16) & 0x00000000ffffffff
+	return x
+}
+
+// the latitude takes the even bits and the longitude takes the odd bits
+func geoInterleave(ilat, ilong uint64) uint64 {
+	return geoSpread(ilat) | geoSpread(ilong)<<1
+}
+
+func geoDeinterleave(bits uint64) (ilat, ilong uint64) {
+	return geoSqueeze(bits), geoSqueeze(bits >> 1)
+}
+
+func geoValid(long, lat float64) bool {
+	return long >= GEO_LONG_MIN && long <= GEO_LONG_MAX && lat >= GEO_LAT_MIN && lat <= GEO_LAT_MAX
+}
+
+// index of the cell of the value in [min, max] at the step
+func geoQuantize(val, min, max float64, step uint) uint64 {
+	cells := uint64(1) << step
+	idx := uint64((val - min) / (max - min) * float64(cells))
+	// max itself falls in the last cell
+	if idx >= cells {
+		idx = cells - 1
+	}
+	return idx
+}
+
+func geoEncodeRange(long, lat float64, lat_min, lat_max float64, step uint) uint64 {
+	ilat := geoQuantize(lat, lat_min, lat_max, step)
+	ilong := geoQuantize(long, GEO_LONG_MIN, GEO_LONG_MAX, step)
+	return geoInterleave(ilat, ilong)
+}
+
+// the geohash of the coordinate with 2*step bits
+func geoEncode(long, lat float64, step uint) uint64 {
+	return geoEncodeRange(long, lat, GEO_LAT_MIN, GEO_LAT_MAX, step)
+}
+
+func geoDecode(bits uint64, step uint) geoArea {
+	ilat, ilong := geoDeinterleave(bits)
+	cells := float64(uint64(1) << step)
+	lat_scale := GEO_LAT_MAX - GEO_LAT_MIN
+	long_scale := GEO_LONG_MAX - GEO_LONG_MIN
+	return geoArea{
+		min_lat:  GEO_LAT_MIN + float64(ilat)/cells*lat_scale,
+		max_lat:  GEO_LAT_MIN + float64(ilat+1)/cells*lat_scale,
+		min_long: GEO_LONG_MIN + float64(ilong)/cells*long_scale,
+		max_long: GEO_LONG_MIN + float64(ilong+1)/cells*long_scale,
+	}
+}
+
+// the center of the cell of a 52-bit geohash, which is what GEOPOS returns
+func geoDecodeScore(score float64) (long, lat float64) {
+	area := geoDecode(uint64(score), GEO_STEP_MAX)
+	long = math.Max(GEO_LONG_MIN, math.Min(GEO_LONG_MAX, (area.min_long+area.max_long)/2))
+	lat = math.Max(GEO_LAT_MIN, math.Min(GEO_LAT_MAX, (area.min_lat+area.max_lat)/2))
+	return
+}
+
+// the standard 11 characters geohash, whose latitude range is [-90, 90] instead of the mercator one
+func geoHashString(score float64) string {
+	long, lat := geoDecodeScore(score)
+	bits := geoEncodeRange(long, lat, -90, 90, GEO_STEP_MAX)
+	buf := make([]byte, 11)
+	for i := 0; i < 11; i++ {
+		idx := 0
+		// only 52 bits, the last character is padded with zeros like redis
+		if i < 10 {
+			idx = int(bits>>(52-(i+1)*5)) & 0x1f
+		}
+		buf[i] = GEO_HASH_ALPHABET[idx]
+	}
+	return string(buf)
+}
+
+func geoDegRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func geoRadDeg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+// haversine distance in meters
+func geoDistance(long1, lat1, long2, lat2 float64) float64 {
+	lat1r, lat2r := geoDegRad(lat1), geoDegRad(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin(geoDegRad(long2-long1) / 2)
+	return 2 * GEO_EARTH_RADIUS * math.Asin(math.Sqrt(u*u+math.Cos(lat1r)*math.Cos(lat2r)*v*v))
+}
+
+// the shape of GEOSEARCH, a circle of radius or a box of width * height around the center
+type geoShape struct {
+	long, lat     float64
+	by_box        bool
+	radius        float64 // meters
+	width, height float64 // meters
+}
+
+// the distance to the center if the point is in the shape
+func (this *geoShape) contains(long, lat float64) (float64, bool) {
+	dist := geoDistance(this.long, this.lat, long, lat)
+	if !this.by_box {
+		return dist, dist <= this.radius
+	}
+	if geoDistance(this.long, this.lat, this.long, lat) > this.height/2 {
+		return dist, false
+	}
+	if geoDistance(this.long, lat, long, lat) > this.width/2 {
+		return dist, false
+	}
+	return dist, true
+}
+
+// degrees the shape spans around the center
+func (this *geoShape) boundingBox() geoArea {
+	half_width, half_height := this.width/2, this.height/2
+	if !this.by_box {
+		half_width, half_height = this.radius, this.radius
+	}
+	lat_delta := geoRadDeg(half_height / GEO_EARTH_RADIUS)
+	// the longitude spans more degrees at the edge closer to the pole
+	long_delta_top := geoRadDeg(half_width / GEO_EARTH_RADIUS / math.Cos(geoDegRad(this.lat+lat_delta)))
+	long_delta_bottom := geoRadDeg(half_width / GEO_EARTH_RADIUS / math.Cos(geoDegRad(this.lat-lat_delta)))
+	long_delta := math.Max(long_delta_top, long_delta_bottom)
+	// all the longitudes if the shape reaches a pole
+	if this.lat+lat_delta >= 90 || this.lat-lat_delta <= -90 {
+		long_delta = 180
+	}
+	return geoArea{
+		min_long: this.long - long_delta,
+		max_long: this.long + long_delta,
+		min_lat:  this.lat - lat_delta,
+		max_lat:  this.lat + lat_delta,
+	}
+}
+
+// the largest step whose cells are not smaller than the range
+func geoEstimateStep(range_meters, lat float64) uint {
+	if range_meters == 0 {
+		return GEO_STEP_MAX
+	}
+	step := 1
+	for range_meters < GEO_MERCATOR_MAX {
+		range_meters *= 2
+		step++
+	}
+	step -= 2
+	// the cells are narrower near the poles
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	if step < 1 {
+		step = 1
+	}
+	if step > GEO_STEP_MAX {
+		step = GEO_STEP_MAX
+	}
+	return uint(step)
+}
+
+// score ranges [min, max] of the cell of the center and its 8 neighbors, which cover the shape
+func (this *geoShape) scoreRanges() [][2]float64 {
+	bbox := this.boundingBox()
+	half := this.radius
+	if this.by_box {
+		half = math.Max(this.width, this.height) / 2
+	}
+	step := geoEstimateStep(half, this.lat)
+
+	// the neighbors may not cover the shape if the center is near the edge of its cell
+	for ; step > 1; step-- {
+		area := geoDecode(geoEncode(this.long, this.lat, step), step)
+		lat_size, long_size := area.max_lat-area.min_lat, area.max_long-area.min_long
+		if area.min_lat-lat_size <= bbox.min_lat && area.max_lat+lat_size >= bbox.max_lat &&
+			area.min_long-long_size <= bbox.min_long && area.max_long+long_size >= bbox.max_long {
+			break
+		}
+	}
+
+	cells := int64(1) << step
+	ilat, ilong := geoDeinterleave(geoEncode(this.long, this.lat, step))
+	shift := uint(GEO_STEP_MAX-step) * 2
+	seen := make(map[uint64]bool)
+	ranges := make([][2]float64, 0, 9)
+	for dlat := int64(-1); dlat <= 1; dlat++ {
+		nlat := int64(ilat) + dlat
+		// no cells beyond the poles
+		if nlat < 0 || nlat >= cells {
+			continue
+		}
+		for dlong := int64(-1); dlong <= 1; dlong++ {
+			// the longitude wraps around
+			nlong := (int64(ilong) + dlong + cells) % cells
+			bits := geoInterleave(uint64(nlat), uint64(nlong))
+			if seen[bits] {
+				continue
+			}
+			seen[bits] = true
+			min := bits << shift
+			max := (bits+1)<<shift - 1
+			ranges = append(ranges, [2]float64{float64(min), float64(max)})
+		}
+	}
+	return ranges
+}
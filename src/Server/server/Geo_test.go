@@ -0,0 +1,179 @@
+package server_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// GEOADD, GEOPOS, GEODIST and GEOHASH with the example of redis
+func TestGeo1(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	if res := handle(engine, "GEOADD Sicily 13.361389 38.115556 Palermo 15.087269 37.502669 Catania"); res[0] != "(integer) 2" {
+		t.Error("TestGeo1 failed")
+	}
+	cases := []struct {
+		cmdline  string
+		expected []string
+	}{
+		{"GEODIST Sicily Palermo Catania", []string{"166274.1516"}},
+		{"GEODIST Sicily Palermo Catania km", []string{"166.2742"}},
+		{"GEODIST Sicily Palermo Catania mi", []string{"103.3182"}},
+		{"GEODIST Sicily Palermo nomember", []string{"(nil)"}},
+		{"GEODIST Sicily Palermo Catania ly", []string{"(error) ERR unsupported unit provided. please use M, KM, FT, MI"}},
+		{"GEOHASH Sicily Palermo Catania nomember", []string{"1) sqc8b49rny0", "2) sqdtr74hyu0", "3) (nil)"}},
+		{"GEOADD Sicily NX 13.361389 38.115556 Palermo 12.758489 38.788135 edge1", []string{"(integer) 1"}},
+		{"GEOADD Sicily XX CH 13 38 Palermo 17.241510 38.788135 edge2", []string{"(integer) 1"}},
+		{"GEOADD Sicily XX NX 13 38 Palermo", []string{"(error) ERR XX and NX options at the same time are not compatible"}},
+		{"GEOADD Sicily 181 38 Palermo", []string{"(error) ERR invalid longitude,latitude pair 181.000000,38.000000"}},
+		{"GEOADD Sicily NX 13 38", []string{"(error) ERR syntax error"}},
+		{"ZCARD Sicily", []string{"(integer) 3"}},
+	}
+	for _, c := range cases {
+		if res := handle(engine, c.cmdline); !reflect.DeepEqual(res, c.expected) {
+			t.Error("TestGeo1 failed")
+		}
+	}
+
+	// the position is the center of the 52-bit cell
+	res := handle(engine, "GEOPOS Sicily Catania nomember")
+	if len(res) != 3 || res[2] != "2) (nil)" {
+		t.Error("TestGeo1 failed")
+	}
+	long, _ := strconv.ParseFloat(strings.TrimPrefix(res[0], "1) 1) "), 64)
+	lat, _ := strconv.ParseFloat(strings.TrimPrefix(res[1], "   2) "), 64)
+	if math.Abs(long-15.087269) > 1e-5 || math.Abs(lat-37.502669) > 1e-5 {
+		t.Error("TestGeo1 failed")
+	}
+	// the geohash is the score of the zset
+	if res := handle(engine, "ZSCORE Sicily Catania"); res[0] != "(float) 3479447370796909" {
+		t.Error("TestGeo1 failed")
+	}
+}
+
+// GEOSEARCH by radius and box
+func TestGeo2(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	handle(engine, "GEOADD Sicily 13.361389 38.115556 Palermo 15.087269 37.502669 Catania")
+	handle(engine, "GEOADD Sicily 12.758489 38.788135 edge1 17.241510 38.788135 edge2")
+	cases := []struct {
+		cmdline  string
+		expected []string
+	}{
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km ASC", []string{"Catania", "Palermo"}},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km DESC WITHDIST", []string{
+			"1) 1) Palermo", "   2) 190.4424", "2) 1) Catania", "   2) 56.4413"}},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYBOX 400 400 km ASC WITHDIST", []string{
+			"1) 1) Catania", "   2) 56.4413", "2) 1) Palermo", "   2) 190.4424",
+			"3) 1) edge2", "   2) 279.7403", "4) 1) edge1", "   2) 279.7405"}},
+		{"GEOSEARCH Sicily FROMMEMBER Palermo BYRADIUS 50 km", []string{"Palermo"}},
+		{"GEOSEARCH Sicily FROMMEMBER Palermo BYRADIUS 200 km COUNT 1 WITHHASH", []string{
+			"1) 1) Palermo", "   2) (integer) 3479099956230698"}},
+		{"GEOSEARCH Sicily FROMLONLAT 0 0 BYRADIUS 10 km", []string{"(empty array)"}},
+		{"GEOSEARCH nokey FROMLONLAT 0 0 BYRADIUS 10 km", []string{"(empty array)"}},
+		{"GEOSEARCH Sicily FROMMEMBER nomember BYRADIUS 10 km", []string{"(error) ERR could not decode requested zset member"}},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km BYBOX 1 1 km", []string{"(error) ERR exactly one of BYRADIUS and BYBOX arguments must be provided"}},
+		{"GEOSEARCH Sicily BYRADIUS 200 km ASC", []string{"(error) ERR exactly one of FROMMEMBER or FROMLONLAT can be specified"}},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km ANY", []string{"(error) ERR the ANY argument requires COUNT argument"}},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km COUNT 0", []string{"(error) ERR COUNT must be > 0"}},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km STOREDIST", []string{"(error) ERR syntax error"}},
+	}
+	for _, c := range cases {
+		if res := handle(engine, c.cmdline); !reflect.DeepEqual(res, c.expected) {
+			t.Error("TestGeo2 failed")
+		}
+	}
+
+	// coordinates are nested in the item
+	res := handle(engine, "GEOSEARCH Sicily FROMMEMBER Catania BYRADIUS 1 m WITHCOORD WITHDIST")
+	if len(res) != 4 || res[0] != "1) 1) Catania" || res[1] != "   2) 0.0000" || !strings.HasPrefix(res[2], "   3) 1) 15.0872") {
+		t.Error("TestGeo2 failed")
+	}
+	// COUNT ANY returns any members in the shape
+	if res := handle(engine, "GEOSEARCH Sicily FROMLONLAT 15 37 BYBOX 400 400 km COUNT 2 ANY"); len(res) != 2 {
+		t.Error("TestGeo2 failed")
+	}
+}
+
+// GEOSEARCHSTORE
+func TestGeo3(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	handle(engine, "GEOADD Sicily 13.361389 38.115556 Palermo 15.087269 37.502669 Catania")
+	cases := []struct {
+		cmdline  string
+		expected []string
+	}{
+		{"GEOSEARCHSTORE dest Sicily FROMLONLAT 15 37 BYRADIUS 200 km", []string{"(integer) 2"}},
+		{"GEOPOS dest Palermo", []string{"1) 1) 13.361389338970184", "   2) 38.1155563954963"}},
+		{"GEOSEARCHSTORE dist Sicily FROMLONLAT 15 37 BYRADIUS 200 km ASC COUNT 1 STOREDIST", []string{"(integer) 1"}},
+		{"ZRANGE dist 0 -1", []string{"Catania"}},
+		{"ZSCORE dist Catania", []string{"(float) 56.44125787015818"}},
+		{"GEOSEARCHSTORE dest Sicily FROMLONLAT 0 0 BYRADIUS 1 km", []string{"(integer) 0"}},
+		{"ZCARD dest", []string{"(nil)"}},
+		{"GEOSEARCHSTORE dest Sicily FROMLONLAT 0 0 BYRADIUS 1 km WITHDIST", []string{"(error) ERR syntax error"}},
+	}
+	for _, c := range cases {
+		if res := handle(engine, c.cmdline); !reflect.DeepEqual(res, c.expected) {
+			t.Error("TestGeo3 failed")
+		}
+	}
+}
+
+// GEOSEARCH finds the same members as the brute force, also near the poles and the antimeridian
+func TestGeo4(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	rnd := rand.New(rand.NewSource(1))
+	type point struct{ long, lat float64 }
+	points := make(map[string]point)
+	cmd := []string{"GEOADD", "points"}
+	for i := 0; i < 5000; i++ {
+		p := point{rnd.Float64()*360 - 180, rnd.Float64()*170 - 85}
+		member := "p" + strconv.Itoa(i)
+		points[member] = p
+		cmd = append(cmd, fmt.Sprint(p.long), fmt.Sprint(p.lat), member)
+	}
+	engine.Handle(cmd)
+
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dist := func(long1, lat1, long2, lat2 float64) float64 {
+		u := math.Sin((rad(lat2) - rad(lat1)) / 2)
+		v := math.Sin(rad(long2-long1) / 2)
+		return 2 * 6372797.560856 * math.Asin(math.Sqrt(u*u+math.Cos(rad(lat1))*math.Cos(rad(lat2))*v*v))
+	}
+
+	centers := []point{{0, 0}, {179.9, 10}, {-179.9, -10}, {30, 84}, {-120, -84}, {116.4, 39.9}}
+	for _, center := range centers {
+		for _, radius := range []float64{50, 500, 3000} {
+			cmdline := fmt.Sprintf("GEOSEARCH points FROMLONLAT %v %v BYRADIUS %v km", center.long, center.lat, radius)
+			res := handle(engine, cmdline)
+			found := make(map[string]bool)
+			for _, member := range res {
+				if member != "(empty array)" {
+					found[member] = true
+				}
+			}
+			for member, p := range points {
+				// the points are compared by the positions decoded from the geohashes, a margin avoids the rounding
+				d := dist(center.long, center.lat, p.long, p.lat)
+				if d < radius*1000-1 && !found[member] {
+					t.Error("TestGeo4 failed")
+				}
+				if d > radius*1000+1 && found[member] {
+					t.Error("TestGeo4 failed")
+				}
+			}
+		}
+	}
+}
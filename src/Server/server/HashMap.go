@@ -6,12 +6,22 @@ import (
 	"math"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type kvMap struct {
-	Kvs  map[string]value
-	Lock sync.RWMutex
+	Kvs     map[string]value
+	Expires int // keys with ttl in Kvs
+	Lock    sync.RWMutex
+}
+
+// delete key whose value is val, called with the lock
+func (this *kvMap) remove(key string, val value) {
+	delete(this.Kvs, key)
+	if val.TTLat != math.MaxInt64 {
+		this.Expires--
+	}
 }
 
 type value struct {
@@ -20,11 +30,17 @@ type value struct {
 }
 
 type HashMap struct {
+	// lookups of the read cmds, accessed atomically
+	hits   uint64
+	misses uint64
+
 	maps []kvMap
 	size uint32
 
 	exit_chan      chan bool
 	ttl_check_time uint32
+	// called when an expired key is deleted
+	on_expire func(key string)
 }
 
 func NewHashMap(size uint32) *HashMap {
@@ -34,6 +50,7 @@ func NewHashMap(size uint32) *HashMap {
 
 		exit_chan:      make(chan bool),
 		ttl_check_time: 5,
+		on_expire:      func(key string) {},
 	}
 
 	for i := 0; i < int(size); i++ {
@@ -44,8 +61,9 @@ func NewHashMap(size uint32) *HashMap {
 
 func (this *HashMap) key2idx(key string) uint32 {
 	var code uint32 = 1
-	for _, ch := range key {
-		code = code*31 + uint32(ch)
+	// keys are binary-safe, hash the bytes instead of the runes
+	for i := 0; i < len(key); i++ {
+		code = code*31 + uint32(key[i])
 	}
 	return code % this.size
 }
@@ -67,8 +85,18 @@ func (this *HashMap) Get(key string) (interface{}, error) {
 	return val.Data, err
 }
 
+// count a lookup of a read cmd
+func (this *HashMap) countLookup(found bool) {
+	if found {
+		atomic.AddUint64(&this.hits, 1)
+	} else {
+		atomic.AddUint64(&this.misses, 1)
+	}
+}
+
 func (this *HashMap) GetString(key string) (string, error) {
 	val, err := this.Get(key)
+	this.countLookup(err == nil)
 	if err != nil {
 		return "", fmt.Errorf("(nil)")
 	}
@@ -80,6 +108,10 @@ func (this *HashMap) GetString(key string) (string, error) {
 
 func (this *HashMap) GetList(key string, create bool) ([]string, error) {
 	val, err := this.Get(key)
+	// looked up with create by the write cmds
+	if !create {
+		this.countLookup(err == nil)
+	}
 	if err != nil {
 		if create {
 			return []string{}, nil
@@ -95,6 +127,10 @@ func (this *HashMap) GetList(key string, create bool) ([]string, error) {
 
 func (this *HashMap) GetZset(key string, create bool) (siface.IAVLTree, error) {
 	val, err := this.Get(key)
+	// looked up with create by the write cmds
+	if !create {
+		this.countLookup(err == nil)
+	}
 	if err != nil {
 		if create {
 			return NewAvlTree(), nil
@@ -108,8 +144,30 @@ func (this *HashMap) GetZset(key string, create bool) (siface.IAVLTree, error) {
 	return val.(siface.IAVLTree), nil
 }
 
+func (this *HashMap) GetStream(key string, create bool) (siface.IStream, error) {
+	val, err := this.Get(key)
+	// looked up with create by the write cmds
+	if !create {
+		this.countLookup(err == nil)
+	}
+	if err != nil {
+		if create {
+			return NewStream(), nil
+		} else {
+			return nil, fmt.Errorf("(nil)")
+		}
+	}
+	if _, ok := val.(siface.IStream); !ok {
+		return nil, fmt.Errorf("(error) WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	return val.(siface.IStream), nil
+}
+
 func (this *HashMap) Put(key string, val interface{}) {
 	idx := this.key2idx(key)
+	if old, ok := this.maps[idx].Kvs[key]; ok && old.TTLat != math.MaxInt64 {
+		this.maps[idx].Expires--
+	}
 	this.maps[idx].Kvs[key] = value{Data: val, TTLat: math.MaxInt64}
 }
 
@@ -122,13 +180,24 @@ func (this *HashMap) Del(key string) (err error) {
 	}
 	if time.Now().Unix() > val.TTLat {
 		err = fmt.Errorf("key %s is not found", key)
-		delete(this.maps[idx].Kvs, key)
+		this.maps[idx].remove(key, val)
+		this.on_expire(key)
 		return
 	}
-	delete(this.maps[idx].Kvs, key)
+	this.maps[idx].remove(key, val)
 	return
 }
 
+// remove all the keys, each bucket is locked by itself
+func (this *HashMap) Clear() {
+	for idx := 0; idx < int(this.size); idx++ {
+		this.maps[idx].Lock.Lock()
+		this.maps[idx].Kvs = make(map[string]value)
+		this.maps[idx].Expires = 0
+		this.maps[idx].Lock.Unlock()
+	}
+}
+
 func (this *HashMap) Lock(key string, write bool) {
 	idx := this.key2idx(key)
 	if write {
@@ -215,10 +284,14 @@ func (this *HashMap) SetTTL(key string, ttl int64) (err error) {
 	}
 	if time.Now().Unix() > val.TTLat {
 		err = fmt.Errorf("key %s is not found", key)
-		delete(this.maps[idx].Kvs, key)
+		this.maps[idx].remove(key, val)
+		this.on_expire(key)
 		return
 	}
 
+	if val.TTLat == math.MaxInt64 {
+		this.maps[idx].Expires++
+	}
 	val.TTLat = time.Now().Unix() + ttl
 	this.maps[idx].Kvs[key] = val
 	return
@@ -238,7 +311,8 @@ func (this *HashMap) GetTTL(key string) (ttl int64, err error) {
 	// expired
 	if time.Now().Unix() > val.TTLat {
 		err = fmt.Errorf("key %s is not found", key)
-		delete(this.maps[idx].Kvs, key)
+		this.maps[idx].remove(key, val)
+		this.on_expire(key)
 		return
 	}
 	// not expired
@@ -255,9 +329,13 @@ func (this *HashMap) Persist(key string) (err error) {
 	}
 	if time.Now().Unix() > val.TTLat {
 		err = fmt.Errorf("key %s is not found", key)
-		delete(this.maps[idx].Kvs, key)
+		this.maps[idx].remove(key, val)
+		this.on_expire(key)
 		return
 	}
+	if val.TTLat != math.MaxInt64 {
+		this.maps[idx].Expires--
+	}
 	val.TTLat = math.MaxInt64
 	this.maps[idx].Kvs[key] = val
 	return
@@ -269,13 +347,18 @@ func (this *HashMap) StartTtlMonitor() {
 		select {
 		case <-ticker:
 			for i := 0; i < int(this.size); i++ {
+				expired := make([]string, 0)
 				this.maps[i].Lock.Lock()
 				for k, v := range this.maps[i].Kvs {
 					if time.Now().Unix() > v.TTLat {
-						delete(this.maps[i].Kvs, k)
+						this.maps[i].remove(k, v)
+						expired = append(expired, k)
 					}
 				}
 				this.maps[i].Lock.Unlock()
+				for _, k := range expired {
+					this.on_expire(k)
+				}
 			}
 		case <-this.exit_chan:
 			return
@@ -283,10 +366,36 @@ func (this *HashMap) StartTtlMonitor() {
 	}
 }
 
+// fun is called after an expired key is deleted, by the ttl monitor or the cmd accessing it
+func (this *HashMap) SetOnExpire(fun func(key string)) {
+	this.on_expire = fun
+}
+
 func (this *HashMap) StopTtlMonitor() {
 	this.exit_chan <- true
 }
 
+// the number of the keys and of the keys with ttl, expired keys are counted until they are deleted
+func (this *HashMap) Count() (keys int, expires int) {
+	for idx := 0; idx < int(this.size); idx++ {
+		this.maps[idx].Lock.RLock()
+		keys += len(this.maps[idx].Kvs)
+		expires += this.maps[idx].Expires
+		this.maps[idx].Lock.RUnlock()
+	}
+	return
+}
+
+// the lookups of the read cmds which found the key or not
+func (this *HashMap) GetKeyspaceStats() (hits uint64, misses uint64) {
+	return atomic.LoadUint64(&this.hits), atomic.LoadUint64(&this.misses)
+}
+
+func (this *HashMap) ResetKeyspaceStats() {
+	atomic.StoreUint64(&this.hits, 0)
+	atomic.StoreUint64(&this.misses, 0)
+}
+
 func (this *HashMap) Foreach(f func(key string, val interface{}, TTLat int64)) {
 	for idx := 0; idx < int(this.size); idx++ {
 		this.maps[idx].Lock.RLock()
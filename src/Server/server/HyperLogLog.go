@@ -0,0 +1,316 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLog is stored as a string value in the layout of redis:
+// "HYLL" | encoding (1 byte) | unused (3 bytes) | cached cardinality (8 bytes, LE) | registers
+// dense registers are 6 bits each, sparse registers are run length encoded by the opcodes
+//
+//	ZERO   00xxxxxx           1-64 registers set to 0
+//	XZERO  01xxxxxx yyyyyyyy  1-16384 registers set to 0
+//	VAL    1vvvvvxx           1-4 registers set to value 1-32
+const (
+	HLL_P             = 14
+	HLL_Q             = 64 - HLL_P
+	HLL_REGISTERS     = 1 << HLL_P
+	HLL_BITS          = 6
+	HLL_HDR_SIZE      = 16
+	HLL_DENSE_SIZE    = HLL_HDR_SIZE + (HLL_REGISTERS*HLL_BITS+7)/8
+	HLL_DENSE         = 0
+	HLL_SPARSE        = 1
+	HLL_SPARSE_MAX    = 3000 // bytes of the sparse registers, larger ones are converted to dense
+	HLL_SPARSE_VALMAX = 32
+	HLL_ALPHA_INF     = 0.721347520444481703680
+)
+
+var (
+	errHllInvalid   = errors.New("(error) WRONGTYPE Key is not a valid HyperLogLog string value.")
+	errHllCorrupted = errors.New("(error) INVALIDOBJ Corrupted HLL object detected")
+)
+
+type HyperLogLog struct {
+	dense     bool
+	registers []uint8
+	// cardinality cached in the header, invalid after registers change
+	card       uint64
+	card_valid bool
+}
+
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{
+		dense:      false,
+		registers:  make([]uint8, HLL_REGISTERS),
+		card:       0,
+		card_valid: true,
+	}
+}
+
+func ParseHyperLogLog(val string) (*HyperLogLog, error) {
+	if len(val) < HLL_HDR_SIZE || val[:4] != "HYLL" {
+		return nil, errHllInvalid
+	}
+	hll := &HyperLogLog{registers: make([]uint8, HLL_REGISTERS)}
+	card := []byte(val[8:HLL_HDR_SIZE])
+	hll.card_valid = card[7]&0x80 == 0
+	hll.card = binary.LittleEndian.Uint64(card)
+
+	data := val[HLL_HDR_SIZE:]
+	switch val[4] {
+	case HLL_DENSE:
+		if len(val) != HLL_DENSE_SIZE {
+			return nil, errHllInvalid
+		}
+		hll.dense = true
+		for i := 0; i < HLL_REGISTERS; i++ {
+			hll.registers[i] = getDenseRegister(data, i)
+		}
+	case HLL_SPARSE:
+		idx := 0
+		for i := 0; i < len(data); i++ {
+			op := data[i]
+			run, value := 0, uint8(0)
+			switch {
+			case op&0xc0 == 0x00: // ZERO
+				run = int(op&0x3f) + 1
+			case op&0xc0 == 0x40: // XZERO
+				if i+1 >= len(data) {
+					return nil, errHllCorrupted
+				}
+				i++
+				run = (int(op&0x3f)<<8 | int(data[i])) + 1
+			default: // VAL
+				run = int(op&0x3) + 1
+				value = (op>>2)&0x1f + 1
+			}
+			if idx+run > HLL_REGISTERS {
+				return nil, errHllCorrupted
+			}
+			for j := 0; j < run; j++ {
+				hll.registers[idx+j] = value
+			}
+			idx += run
+		}
+		if idx != HLL_REGISTERS {
+			return nil, errHllCorrupted
+		}
+	default:
+		return nil, errHllInvalid
+	}
+	return hll, nil
+}
+
+func getDenseRegister(data string, i int) uint8 {
+	byte_i := i * HLL_BITS / 8
+	fb := uint(i*HLL_BITS) & 7
+	val := uint16(data[byte_i])
+	if byte_i+1 < len(data) {
+		val |= uint16(data[byte_i+1]) << 8
+	}
+	return uint8(val>>fb) & 63
+}
+
+func setDenseRegister(data []byte, i int, val uint8) {
+	byte_i := i * HLL_BITS / 8
+	fb := uint(i*HLL_BITS) & 7
+	word := uint16(val) << fb
+	data[byte_i] |= byte(word)
+	if byte_i+1 < len(data) {
+		data[byte_i+1] |= byte(word >> 8)
+	}
+}
+
+// the string value, sparse if the registers fit in it
+func (this *HyperLogLog) String() string {
+	buf := make([]byte, HLL_HDR_SIZE, HLL_DENSE_SIZE)
+	copy(buf, "HYLL")
+	binary.LittleEndian.PutUint64(buf[8:], this.card)
+	if !this.card_valid {
+		buf[15] |= 0x80
+	}
+
+	if !this.dense {
+		if sparse := this.encodeSparse(); sparse != nil {
+			buf[4] = HLL_SPARSE
+			return string(append(buf, sparse...))
+		}
+		// it's dense since now, the registers never decrease
+		this.dense = true
+	}
+	buf[4] = HLL_DENSE
+	buf = buf[:HLL_DENSE_SIZE]
+	for i, val := range this.registers {
+		setDenseRegister(buf[HLL_HDR_SIZE:], i, val)
+	}
+	return string(buf)
+}
+
+// nil if a register is too large for sparse or the registers take too many bytes
+func (this *HyperLogLog) encodeSparse() []byte {
+	buf := make([]byte, 0, 64)
+	for i := 0; i < HLL_REGISTERS; {
+		val := this.registers[i]
+		run := 1
+		for i+run < HLL_REGISTERS && this.registers[i+run] == val {
+			run++
+		}
+		i += run
+
+		if val > HLL_SPARSE_VALMAX {
+			return nil
+		}
+		for run > 0 {
+			switch {
+			case val != 0:
+				n := min(run, 4)
+				buf = append(buf, 0x80|(val-1)<<2|byte(n-1))
+				run -= n
+			case run > 64:
+				n := min(run, HLL_REGISTERS)
+				buf = append(buf, 0x40|byte((n-1)>>8), byte(n-1))
+				run -= n
+			default:
+				buf = append(buf, byte(run-1))
+				run = 0
+			}
+		}
+		if len(buf) > HLL_SPARSE_MAX {
+			return nil
+		}
+	}
+	return buf
+}
+
+// returns true if a register changes
+func (this *HyperLogLog) Add(element string) bool {
+	hash := murmurHash64A([]byte(element), 0xadc83b19)
+	idx := hash & (HLL_REGISTERS - 1)
+	// the run of zeros of the rest bits, the sentinel bit makes it at most HLL_Q
+	count := uint8(bits.TrailingZeros64(hash>>HLL_P|1<<HLL_Q)) + 1
+	if count <= this.registers[idx] {
+		return false
+	}
+	this.registers[idx] = count
+	this.card_valid = false
+	return true
+}
+
+// max of the registers of both
+func (this *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, val := range other.registers {
+		if val > this.registers[i] {
+			this.registers[i] = val
+			this.card_valid = false
+		}
+	}
+	if other.dense {
+		this.dense = true
+	}
+}
+
+// cardinality estimated by the improved estimator of Otmar Ertl, same as redis
+func (this *HyperLogLog) Count() uint64 {
+	if this.card_valid {
+		return this.card
+	}
+
+	var histogram [HLL_Q + 2]int
+	for _, val := range this.registers {
+		histogram[val]++
+	}
+	m := float64(HLL_REGISTERS)
+	z := m * hllTau((m-float64(histogram[HLL_Q+1]))/m)
+	for j := HLL_Q; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+
+	this.card = uint64(math.Round(HLL_ALPHA_INF * m * m / z))
+	this.card_valid = true
+	return this.card
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if prev == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
+
+// MurmurHash2, 64-bit versions, by Austin Appleby
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ uint64(len(key))*m
+
+	for len(key) >= 8 {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		key = key[8:]
+	}
+
+	switch len(key) {
+	case 7:
+		h ^= uint64(key[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(key[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(key[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(key[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(key[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(key[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(key[0])
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
@@ -0,0 +1,198 @@
+package server_test
+
+import (
+	"gedis/src/Server/server"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/znet"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// PFADD element:from ... element:to-1 in batches
+func pfadd(engine *server.Engine, key string, from int, to int) {
+	cmd := []string{"PFADD", key}
+	for i := from; i < to; i++ {
+		cmd = append(cmd, "element:"+strconv.Itoa(i))
+		if len(cmd) == 1002 || i == to-1 {
+			engine.Handle(cmd)
+			cmd = cmd[:2]
+		}
+	}
+}
+
+func pfcount(engine *server.Engine, keys ...string) int {
+	res := engine.Handle(append([]string{"PFCOUNT"}, keys...))
+	n, _ := strconv.Atoi(strings.TrimPrefix(res[0], "(integer) "))
+	return n
+}
+
+// the estimation is within 3 standard errors (0.81%) at different cardinalities
+func TestHyperLogLog1(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	prev := 0
+	for _, n := range []int{1, 10, 100, 1000, 10000, 100000, 1000000} {
+		pfadd(engine, "hll1", prev, n)
+		prev = n
+
+		count := pfcount(engine, "hll1")
+		err := math.Abs(float64(count-n)) / float64(n)
+		if err > 3*0.0081 {
+			t.Error("TestHyperLogLog1 failed")
+		}
+		// cached in the value
+		if pfcount(engine, "hll1") != count {
+			t.Error("TestHyperLogLog1 failed")
+		}
+	}
+}
+
+// sparse is promoted to dense
+func TestHyperLogLog2(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	if res := engine.Handle([]string{"PFADD", "hll2"}); res[0] != "(integer) 1" {
+		t.Error("TestHyperLogLog2 failed")
+	}
+	if res := engine.Handle([]string{"PFADD", "hll2"}); res[0] != "(integer) 0" {
+		t.Error("TestHyperLogLog2 failed")
+	}
+	if res := engine.Handle([]string{"PFADD", "hll2", "a", "b"}); res[0] != "(integer) 1" {
+		t.Error("TestHyperLogLog2 failed")
+	}
+	if res := engine.Handle([]string{"PFADD", "hll2", "a", "b"}); res[0] != "(integer) 0" {
+		t.Error("TestHyperLogLog2 failed")
+	}
+	if res := engine.Handle([]string{"PFDEBUG", "ENCODING", "hll2"}); res[0] != "sparse" {
+		t.Error("TestHyperLogLog2 failed")
+	}
+	val := engine.Handle([]string{"GET", "hll2"})[0]
+	if !strings.HasPrefix(val, "HYLL") || len(val) > 100 {
+		t.Error("TestHyperLogLog2 failed")
+	}
+
+	pfadd(engine, "hll2", 0, 5000)
+	if res := engine.Handle([]string{"PFDEBUG", "ENCODING", "hll2"}); res[0] != "dense" {
+		t.Error("TestHyperLogLog2 failed")
+	}
+	if val := engine.Handle([]string{"GET", "hll2"})[0]; len(val) != 16+12288 {
+		t.Error("TestHyperLogLog2 failed")
+	}
+
+	// the value can be copied by GET and SET
+	val = engine.Handle([]string{"GET", "hll2"})[0]
+	engine.Handle([]string{"SET", "hll2copy", val})
+	if pfcount(engine, "hll2copy") != pfcount(engine, "hll2") {
+		t.Error("TestHyperLogLog2 failed")
+	}
+}
+
+// union of keys by PFCOUNT and PFMERGE
+func TestHyperLogLog3(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	pfadd(engine, "hll3a", 0, 20000)
+	pfadd(engine, "hll3b", 10000, 30000)
+	pfadd(engine, "hll3c", 0, 10)
+
+	union := pfcount(engine, "hll3a", "hll3b", "hll3c", "nokey")
+	if math.Abs(float64(union-30000))/30000 > 3*0.0081 {
+		t.Error("TestHyperLogLog3 failed")
+	}
+	if res := engine.Handle([]string{"PFMERGE", "hll3", "hll3a", "hll3b"}); res[0] != "OK" {
+		t.Error("TestHyperLogLog3 failed")
+	}
+	if pfcount(engine, "hll3") != union {
+		t.Error("TestHyperLogLog3 failed")
+	}
+	// destkey is merged too
+	engine.Handle([]string{"PFMERGE", "hll3c", "nokey"})
+	if count := pfcount(engine, "hll3c"); count != 10 {
+		t.Error("TestHyperLogLog3 failed")
+	}
+	// small merges keep sparse
+	if res := engine.Handle([]string{"PFDEBUG", "ENCODING", "hll3c"}); res[0] != "sparse" {
+		t.Error("TestHyperLogLog3 failed")
+	}
+	if pfcount(engine, "nokey") != 0 {
+		t.Error("TestHyperLogLog3 failed")
+	}
+}
+
+// values which are not hyperloglogs
+func TestHyperLogLog4(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	engine.Handle([]string{"SET", "str", "value"})
+	engine.Handle([]string{"LPUSH", "list", "value"})
+	engine.Handle([]string{"PFADD", "hll4", "a"})
+	val := engine.Handle([]string{"GET", "hll4"})[0]
+	// a sparse opcode covers more registers than there are
+	engine.Handle([]string{"SET", "corrupted", val + "\x7f\xff"})
+
+	cases := map[string]string{
+		"PFADD str a":            "(error) WRONGTYPE Key is not a valid HyperLogLog string value.",
+		"PFCOUNT hll4 str":       "(error) WRONGTYPE Key is not a valid HyperLogLog string value.",
+		"PFMERGE hll4 list":      "(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+		"PFCOUNT corrupted":      "(error) INVALIDOBJ Corrupted HLL object detected",
+		"PFDEBUG ENCODING nokey": "(error) ERR The specified key does not exist",
+		"PFCOUNT":                "(error) ERR wrong number of arguments for 'pfcount' command",
+	}
+	for cmdline, expected := range cases {
+		if res := handle(engine, cmdline); res[0] != expected {
+			t.Error("TestHyperLogLog4 failed")
+		}
+	}
+}
+
+// a dense value is longer than a msg, GET sends it in several frames
+func TestHyperLogLog5(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data_pack, cmd_packer := znet.NewDataPack(), server.NewCmdPack()
+	call := func(cmd [][]byte) [][]byte {
+		buf, err := data_pack.Pack(znet.NewMessage(0, cmd_packer.PackCmd(cmd)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(buf)
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		msg, err := data_pack.ReadMsg(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cmd_packer.UnpackCmd(msg.GetMsgData())
+	}
+
+	for i := 0; i < 5000; i += 200 {
+		cmd := [][]byte{[]byte("PFADD"), []byte("hll5")}
+		for j := i; j < i+200; j++ {
+			cmd = append(cmd, []byte("element:"+strconv.Itoa(j)))
+		}
+		call(cmd)
+	}
+	if server.HLL_DENSE_SIZE <= int(utils.Global_obj.MaxDataLen) {
+		t.Fatal("TestHyperLogLog5 failed, dense value fits in a msg")
+	}
+	res := call([][]byte{[]byte("GET"), []byte("hll5")})
+	if len(res) != 1 || len(res[0]) != server.HLL_DENSE_SIZE || string(res[0][:4]) != "HYLL" || res[0][4] != server.HLL_DENSE {
+		t.Fatal("TestHyperLogLog5 failed")
+	}
+	// the key is still counted after it
+	n, _ := strconv.Atoi(strings.TrimPrefix(string(call([][]byte{[]byte("PFCOUNT"), []byte("hll5")})[0]), "(integer) "))
+	if math.Abs(float64(n-5000))/5000 > 3*0.0081 {
+		t.Error("TestHyperLogLog5 failed", n)
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"fmt"
+	"gedis/src/Server/siface"
+	"gedis/src/zinx/utils"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// the sections of INFO in order, all of them are shown by default
+var info_sections = []string{"server", "clients", "memory", "persistence", "stats", "keyspace"}
+
+// INFO [section ...]
+// each section is a "# Section" line followed by "field:value" lines, sections are separated by an empty line
+func (this *ServerRouter) info(args []string) []string {
+	names := make(map[string]bool)
+	for _, arg := range args {
+		names[strings.ToLower(arg)] = true
+	}
+	all := len(args) == 0 || names["all"] || names["everything"] || names["default"]
+
+	lines := make([]string, 0)
+	var db_stats []siface.DbStats
+	for _, section := range info_sections {
+		if !all && !names[section] {
+			continue
+		}
+		if db_stats == nil && (section == "persistence" || section == "stats" || section == "keyspace") {
+			db_stats = this.db_mgr.GetStats()
+		}
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "# "+strings.ToUpper(section[:1])+section[1:])
+		switch section {
+		case "server":
+			lines = append(lines, this.infoServer()...)
+		case "clients":
+			lines = append(lines, this.infoClients()...)
+		case "memory":
+			lines = append(lines, infoMemory()...)
+		case "persistence":
+			lines = append(lines, infoPersistence(db_stats)...)
+		case "stats":
+			lines = append(lines, this.infoStats(db_stats)...)
+		case "keyspace":
+			lines = append(lines, infoKeyspace(db_stats)...)
+		}
+	}
+	if len(lines) == 0 {
+		// unknown sections are empty
+		return []string{""}
+	}
+	return lines
+}
+
+func infoField(name string, value interface{}) string {
+	return fmt.Sprintf("%s:%v", name, value)
+}
+
+func (this *ServerRouter) infoServer() []string {
+	uptime := int64(time.Since(this.server.GetStartTime()).Seconds())
+	return []string{
+		infoField("go_version", runtime.Version()),
+		infoField("os", runtime.GOOS),
+		infoField("arch", runtime.GOARCH),
+		infoField("process_id", os.Getpid()),
+		infoField("tcp_port", utils.Global_obj.Port),
+		infoField("uptime_in_seconds", uptime),
+		infoField("uptime_in_days", uptime/86400),
+	}
+}
+
+func (this *ServerRouter) infoClients() []string {
+	return []string{
+		infoField("connected_clients", this.server.GetConnectionManager().Size()),
+		infoField("maxclients", utils.GetMaxConnSize()),
+	}
+}
+
+// the memory of the go runtime, the data of the dbs is most of the heap
+func infoMemory() []string {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return []string{
+		infoField("used_memory", mem.HeapAlloc),
+		infoField("used_memory_human", bytesToHuman(mem.HeapAlloc)),
+		infoField("used_memory_sys", mem.Sys),
+		infoField("used_memory_sys_human", bytesToHuman(mem.Sys)),
+		infoField("maxmemory", utils.GetMaxMemory()),
+		infoField("maxmemory_human", bytesToHuman(utils.GetMaxMemory())),
+		infoField("maxmemory_policy", "noeviction"),
+		infoField("mem_gc_count", mem.NumGC),
+		infoField("mem_allocator", "go"),
+	}
+}
+
+// 1.50K like redis
+func bytesToHuman(n uint64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(n)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.2f%s", value, units[i])
+}
+
+// each db has its own aof, the status is the one of all of them
+func infoPersistence(db_stats []siface.DbStats) []string {
+	var size int64
+	var rewrites uint64
+	in_progress, status := 0, "ok"
+	last_at, last_time := int64(0), int64(-1)
+	for _, stats := range db_stats {
+		size += stats.AofSize
+		rewrites += stats.AofRewrites
+		if stats.AofRewriteInProgress {
+			in_progress = 1
+		}
+		if !stats.AofLastRewriteOk {
+			status = "err"
+		}
+		if stats.AofLastRewriteAt > last_at {
+			last_at, last_time = stats.AofLastRewriteAt, stats.AofLastRewriteTime
+		}
+	}
+	if last_time >= 0 {
+		last_time /= 1000
+	}
+	return []string{
+		infoField("loading", 0),
+		infoField("aof_enabled", 1),
+		infoField("aof_rewrite_in_progress", in_progress),
+		infoField("aof_rewrites", rewrites),
+		infoField("aof_last_rewrite_time_sec", last_time),
+		infoField("aof_last_bgrewrite_status", status),
+		infoField("aof_current_size", size),
+	}
+}
+
+func (this *ServerRouter) infoStats(db_stats []siface.DbStats) []string {
+	var hits, misses uint64
+	for _, stats := range db_stats {
+		hits += stats.KeyspaceHits
+		misses += stats.KeyspaceMisses
+	}
+	work_pool := this.server.GetWorkPool()
+	return []string{
+		infoField("total_connections_received", this.server.GetTotalConns()),
+		infoField("total_commands_processed", work_pool.GetProcessed()),
+		infoField("instantaneous_ops_per_sec", work_pool.GetOpsPerSec()),
+		infoField("rejected_connections", this.server.GetRejectedConns()),
+		infoField("keyspace_hits", hits),
+		infoField("keyspace_misses", misses),
+		infoField("work_pool_size", work_pool.GetPoolSize()),
+		infoField("work_pool_queue_depth", work_pool.GetQueueDepth()),
+		infoField("work_pool_busy_workers", work_pool.GetBusyWorkers()),
+	}
+}
+
+// only the dbs having keys
+func infoKeyspace(db_stats []siface.DbStats) []string {
+	lines := make([]string, 0)
+	for id, stats := range db_stats {
+		if stats.Keys > 0 {
+			lines = append(lines, fmt.Sprintf("db%d:keys=%d,expires=%d", id, stats.Keys, stats.Expires))
+		}
+	}
+	return lines
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"gedis/src/zinx/utils"
+	rt_metrics "runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// the write cmds which can't grow the dbs, they still run when maxmemory is reached like DEL in redis
+var oom_allowed_cmds = map[string]bool{
+	"DEL": true, "LPOP": true, "RPOP": true, "ZREM": true, "EXPIRE": true, "PERSIST": true,
+	"FLUSHDB": true, "XDEL": true, "XTRIM": true, "XACK": true,
+}
+
+// the heap in use, sampled at most every 100ms as write cmds check it
+var used_memory, used_memory_at int64
+
+func usedMemory() uint64 {
+	now := time.Now().UnixNano()
+	if now-atomic.LoadInt64(&used_memory_at) < int64(100*time.Millisecond) {
+		return uint64(atomic.LoadInt64(&used_memory))
+	}
+	sample := []rt_metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	rt_metrics.Read(sample)
+	used := int64(sample[0].Value.Uint64())
+	atomic.StoreInt64(&used_memory, used)
+	atomic.StoreInt64(&used_memory_at, now)
+	return uint64(used)
+}
+
+// the error to reply if cmd is denied as the heap is over maxmemory, "" if it can run.
+// nothing is evicted, it's the noeviction policy of redis, so the evicted event of keyspace notifications never happens
+func checkMaxMemory(cmd []string) string {
+	max_memory := utils.GetMaxMemory()
+	if max_memory == 0 || len(cmd) == 0 || !isWriteCmd(cmd[0]) || oom_allowed_cmds[cmd[0]] {
+		return ""
+	}
+	if usedMemory() <= max_memory {
+		return ""
+	}
+	return "(error) OOM command not allowed when used memory > 'maxmemory'."
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// aof rewrites replay and write the whole db, they take much longer than cmds
+var aof_rewrite_bounds = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second,
+	10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+// the metrics of the cmds and dbs, observed by the routers and dbs of all the servers in the process
+var metrics = NewMetrics()
+
+// the calls and latency of a cmd
+type cmdMetrics struct {
+	calls   uint64
+	latency *znet.Histogram
+}
+
+type Metrics struct {
+	// accessed atomically, first for the alignment
+	expired_keys uint64
+
+	lock   sync.RWMutex
+	cmds   map[string]*cmdMetrics
+	errors map[string]uint64 // by the first word of the error, like ERR or WRONGTYPE
+
+	aof_write   *znet.Histogram
+	aof_flush   *znet.Histogram
+	aof_rewrite *znet.Histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		cmds:   make(map[string]*cmdMetrics),
+		errors: make(map[string]uint64),
+
+		aof_write:   znet.NewHistogram(znet.DefaultLatencyBounds),
+		aof_flush:   znet.NewHistogram(znet.DefaultLatencyBounds),
+		aof_rewrite: znet.NewHistogram(aof_rewrite_bounds),
+	}
+}
+
+// the metrics shared by the process
+func GetMetrics() *Metrics {
+	return metrics
+}
+
+// a cmd is handled in d and replied with res, nil if it has no reply like SUBSCRIBE
+func (this *Metrics) ObserveCmd(name string, d time.Duration, res [][]byte) {
+	// names sent by clients aren't labels unless they are cmds
+	if !IsCmdExist(name) {
+		name = "unknown"
+	}
+	err_type := ""
+	if len(res) > 0 && bytes.HasPrefix(res[0], []byte("(error) ")) {
+		err_type = errorType(string(res[0][len("(error) "):]))
+	}
+
+	this.lock.RLock()
+	cmd, ok := this.cmds[name]
+	this.lock.RUnlock()
+	if !ok {
+		this.lock.Lock()
+		if cmd, ok = this.cmds[name]; !ok {
+			cmd = &cmdMetrics{latency: znet.NewHistogram(znet.DefaultLatencyBounds)}
+			this.cmds[name] = cmd
+		}
+		this.lock.Unlock()
+	}
+	atomic.AddUint64(&cmd.calls, 1)
+	cmd.latency.Observe(d)
+
+	if err_type != "" {
+		this.lock.Lock()
+		this.errors[err_type]++
+		this.lock.Unlock()
+	}
+}
+
+// the first word of an error like "WRONGTYPE Operation against...", ERR if it isn't a code
+func errorType(err string) string {
+	code := strings.SplitN(err, " ", 2)[0]
+	if code == "" {
+		return "ERR"
+	}
+	for _, c := range code {
+		if (c < 'A' || c > 'Z') && c != '_' {
+			return "ERR"
+		}
+	}
+	return code
+}
+
+func (this *Metrics) ObserveAofWrite(d time.Duration) {
+	this.aof_write.Observe(d)
+}
+
+func (this *Metrics) ObserveAofFlush(d time.Duration) {
+	this.aof_flush.Observe(d)
+}
+
+func (this *Metrics) ObserveAofRewrite(d time.Duration) {
+	this.aof_rewrite.Observe(d)
+}
+
+func (this *Metrics) AddExpiredKey() {
+	atomic.AddUint64(&this.expired_keys, 1)
+}
+
+// the calls of a cmd, used by tests
+func (this *Metrics) GetCmdCalls(name string) uint64 {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if cmd, ok := this.cmds[name]; ok {
+		return atomic.LoadUint64(&cmd.calls)
+	}
+	return 0
+}
+
+// the handler of /metrics in the text format of prometheus, with the metrics of s as well
+func (this *Metrics) Handler(s ziface.IServer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		this.Write(w, s)
+	})
+}
+
+func (this *Metrics) Write(w io.Writer, s ziface.IServer) {
+	conn_mgr := s.GetConnectionManager()
+	work_pool := s.GetWorkPool()
+
+	writeMetric(w, "gedis_uptime_seconds", "gauge", "Seconds since the server started.",
+		"", time.Since(s.GetStartTime()).Seconds())
+	writeMetric(w, "gedis_connected_clients", "gauge", "Connections open.", "", conn_mgr.Size())
+	writeMetric(w, "gedis_connections_received_total", "counter", "Connections accepted, including the rejected ones.",
+		"", s.GetTotalConns())
+	writeMetric(w, "gedis_connections_rejected_total", "counter", "Connections rejected as MaxConnSize is reached.",
+		"", s.GetRejectedConns())
+
+	this.lock.RLock()
+	names := make([]string, 0, len(this.cmds))
+	for name := range this.cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cmds := make([]*cmdMetrics, 0, len(names))
+	for _, name := range names {
+		cmds = append(cmds, this.cmds[name])
+	}
+	err_types := make([]string, 0, len(this.errors))
+	for err_type := range this.errors {
+		err_types = append(err_types, err_type)
+	}
+	sort.Strings(err_types)
+	errors := make([]uint64, 0, len(err_types))
+	for _, err_type := range err_types {
+		errors = append(errors, this.errors[err_type])
+	}
+	this.lock.RUnlock()
+
+	writeHeader(w, "gedis_commands_total", "counter", "Calls of each cmd.")
+	for i, name := range names {
+		writeSample(w, "gedis_commands_total", fmt.Sprintf(`cmd="%s"`, strings.ToLower(name)), atomic.LoadUint64(&cmds[i].calls))
+	}
+	writeHeader(w, "gedis_command_duration_seconds", "histogram", "Time each cmd is handled.")
+	for i, name := range names {
+		writeHistogram(w, "gedis_command_duration_seconds", fmt.Sprintf(`cmd="%s"`, strings.ToLower(name)), cmds[i].latency)
+	}
+	writeHeader(w, "gedis_errors_total", "counter", "Error replies by the type of the error.")
+	for i, err_type := range err_types {
+		writeSample(w, "gedis_errors_total", fmt.Sprintf(`type="%s"`, err_type), errors[i])
+	}
+
+	writeMetric(w, "gedis_expired_keys_total", "counter", "Keys deleted as they expired.", "", atomic.LoadUint64(&this.expired_keys))
+	writeHeader(w, "gedis_aof_write_duration_seconds", "histogram", "Time a cmd is written to the aof buffer.")
+	writeHistogram(w, "gedis_aof_write_duration_seconds", "", this.aof_write)
+	writeHeader(w, "gedis_aof_flush_duration_seconds", "histogram", "Time the aof buffer is flushed into the file.")
+	writeHistogram(w, "gedis_aof_flush_duration_seconds", "", this.aof_flush)
+	writeHeader(w, "gedis_aof_rewrite_duration_seconds", "histogram", "Time the aof is rewritten.")
+	writeHistogram(w, "gedis_aof_rewrite_duration_seconds", "", this.aof_rewrite)
+
+	writeMetric(w, "gedis_work_pool_queue_depth", "gauge", "Requests queued in the work pool.", "", work_pool.GetQueueDepth())
+	writeMetric(w, "gedis_work_pool_busy_workers", "gauge", "Workers handling a request.", "", work_pool.GetBusyWorkers())
+	writeHeader(w, "gedis_request_wait_duration_seconds", "histogram", "Time requests wait in the work pool.")
+	writeHistogram(w, "gedis_request_wait_duration_seconds", "", work_pool.GetWaitLatency())
+	writeHeader(w, "gedis_request_exec_duration_seconds", "histogram", "Time requests are handled by the routers.")
+	writeHistogram(w, "gedis_request_exec_duration_seconds", "", work_pool.GetExecLatency())
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name string, labels string, value interface{}) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s %v\n", name, value)
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, labels string, value interface{}) {
+	writeHeader(w, name, kind, help)
+	writeSample(w, name, labels, value)
+}
+
+func writeHistogram(w io.Writer, name string, labels string, h ziface.IHistogram) {
+	bounds, counts, sum, count := h.Snapshot()
+	prefix := ""
+	if labels != "" {
+		prefix = labels + ","
+	}
+	for i, bound := range bounds {
+		le := "+Inf"
+		if i < len(bounds)-1 {
+			le = fmt.Sprint(bound.Seconds())
+		}
+		writeSample(w, name+"_bucket", fmt.Sprintf(`%sle="%s"`, prefix, le), counts[i])
+	}
+	writeSample(w, name+"_sum", labels, sum.Seconds())
+	writeSample(w, name+"_count", labels, count)
+}
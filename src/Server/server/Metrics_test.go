@@ -0,0 +1,74 @@
+package server_test
+
+import (
+	"bytes"
+	"gedis/src/Server/server"
+	"gedis/src/zinx/znet"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the text format of prometheus
+func TestMetrics1(t *testing.T) {
+	metrics := server.NewMetrics()
+	metrics.ObserveCmd("GET", 300*time.Microsecond, [][]byte{[]byte("v")})
+	metrics.ObserveCmd("GET", 2*time.Millisecond, [][]byte{[]byte("(nil)")})
+	metrics.ObserveCmd("LPUSH", time.Millisecond, [][]byte{[]byte("(error) WRONGTYPE Operation against a key holding the wrong kind of value")})
+	metrics.ObserveCmd("NOCMD", time.Millisecond, [][]byte{[]byte("(error) ERR unknown command 'NOCMD'")})
+	metrics.ObserveCmd("SUBSCRIBE", time.Millisecond, nil)
+	metrics.ObserveCmd("GET", time.Millisecond, [][]byte{[]byte("(error) MOVED 866 127.0.0.1:7001")})
+	metrics.ObserveCmd("GET", time.Millisecond, [][]byte{[]byte("(error) wrong number")})
+	metrics.AddExpiredKey()
+	metrics.ObserveAofRewrite(2 * time.Second)
+
+	buf := &bytes.Buffer{}
+	metrics.Write(buf, znet.NewServer())
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		lines[line] = true
+	}
+	for _, line := range []string{
+		"# TYPE gedis_commands_total counter",
+		`gedis_commands_total{cmd="get"} 4`,
+		`gedis_commands_total{cmd="lpush"} 1`,
+		`gedis_commands_total{cmd="unknown"} 1`,
+		`gedis_commands_total{cmd="subscribe"} 1`,
+		"# TYPE gedis_command_duration_seconds histogram",
+		`gedis_command_duration_seconds_bucket{cmd="get",le="0.0005"} 1`,
+		`gedis_command_duration_seconds_bucket{cmd="get",le="0.001"} 3`,
+		`gedis_command_duration_seconds_bucket{cmd="get",le="+Inf"} 4`,
+		`gedis_command_duration_seconds_sum{cmd="get"} 0.0043`,
+		`gedis_command_duration_seconds_count{cmd="get"} 4`,
+		`gedis_errors_total{type="ERR"} 2`,
+		`gedis_errors_total{type="MOVED"} 1`,
+		`gedis_errors_total{type="WRONGTYPE"} 1`,
+		"gedis_expired_keys_total 1",
+		`gedis_aof_rewrite_duration_seconds_bucket{le="1"} 0`,
+		`gedis_aof_rewrite_duration_seconds_bucket{le="5"} 1`,
+		"gedis_aof_rewrite_duration_seconds_count 1",
+		"gedis_connected_clients 0",
+		"gedis_connections_rejected_total 0",
+		"gedis_work_pool_queue_depth 0",
+		"gedis_request_exec_duration_seconds_count 0",
+	} {
+		if !lines[line] {
+			t.Error("TestMetrics1 failed", line)
+		}
+	}
+}
+
+// the cmds handled by the routers are observed
+func TestMetrics2(t *testing.T) {
+	acl := newTestAcl(t, "")
+	router := server.NewServerRouter(acl, nil, nil)
+	conn := newMsgConn(1)
+	acl.OnConnStart(conn)
+
+	calls := server.GetMetrics().GetCmdCalls("COMMAND")
+	router.Handle(newFakeRequest(conn, "COMMAND COUNT"))
+	conn.next()
+	if server.GetMetrics().GetCmdCalls("COMMAND") != calls+1 {
+		t.Error("TestMetrics2 failed")
+	}
+}
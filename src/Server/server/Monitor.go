@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the id of the msgs pushed to the monitors
+const MONITOR_MSG_ID = 7
+
+// a monitor is disconnected once this many lines in a row are dropped
+const MONITOR_MAX_DROPS = 1024
+
+// the connections watching the cmds of the dbs, shared by the process
+var monitor = NewMonitor()
+
+type monitorConn struct {
+	drops uint64 // lines dropped in a row, accessed atomically
+	conn  ziface.IConnection
+}
+
+type Monitor struct {
+	lock  sync.RWMutex
+	conns map[uint32]*monitorConn
+}
+
+func NewMonitor() *Monitor {
+	return &Monitor{conns: make(map[uint32]*monitorConn)}
+}
+
+// the monitor shared by the process
+func GetMonitor() *Monitor {
+	return monitor
+}
+
+func (this *Monitor) Add(conn ziface.IConnection) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.conns[conn.GetConnID()] = &monitorConn{conn: conn}
+}
+
+func (this *Monitor) Remove(conn ziface.IConnection) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.conns, conn.GetConnID())
+}
+
+func (this *Monitor) Size() int {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return len(this.conns)
+}
+
+// push a cmd of conn executed in db to the monitors, a line like
+// 1700000000.123456 [0 127.0.0.1:50000] "SET" "k" "v"
+// the lines never wait for a slow monitor, they are dropped if it backs up
+func (this *Monitor) Feed(db int, conn ziface.IConnection, args []string) {
+	this.lock.RLock()
+	if len(this.conns) == 0 {
+		this.lock.RUnlock()
+		return
+	}
+	conns := make([]*monitorConn, 0, len(this.conns))
+	for _, mc := range this.conns {
+		conns = append(conns, mc)
+	}
+	this.lock.RUnlock()
+
+	now := time.Now()
+	quoted := make([]string, 0, len(args))
+	// a line must fit in a msg, the args are truncated like slowlog
+	for _, arg := range truncateArgs(args) {
+		quoted = append(quoted, strconv.Quote(arg))
+	}
+	line := fmt.Sprintf("%d.%06d [%d %s] %s", now.Unix(), now.Nanosecond()/1000, db, conn.RemoteAddr().String(), strings.Join(quoted, " "))
+	data := NewCmdPack().PackCmd([][]byte{[]byte(line)})
+	if over := len(data) - int(utils.Global_obj.MaxDataLen); over > 0 {
+		if over+len("...") > len(line) {
+			return
+		}
+		line = line[:len(line)-over-len("...")] + "..."
+		data = NewCmdPack().PackCmd([][]byte{[]byte(line)})
+	}
+
+	for _, mc := range conns {
+		err := mc.conn.TrySendMsg(MONITOR_MSG_ID, data)
+		if err == nil {
+			atomic.StoreUint64(&mc.drops, 0)
+		} else if err != znet.ErrMsgChanFull {
+			// the connection is closed
+			this.Remove(mc.conn)
+		} else if atomic.AddUint64(&mc.drops, 1) == MONITOR_MAX_DROPS {
+			// too slow, stopping may wait the writer to flush, which mustn't block the cmd
+			fmt.Printf("Connection %d is disconnected as a slow monitor, %d lines are dropped\n", mc.conn.GetConnID(), MONITOR_MAX_DROPS)
+			this.Remove(mc.conn)
+			go mc.conn.Stop()
+		}
+	}
+}
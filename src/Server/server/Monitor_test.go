@@ -0,0 +1,97 @@
+package server_test
+
+import (
+	"gedis/src/Server/server"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/znet"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the cmds of the dbs are pushed to the monitors
+func TestMonitor1(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	acl := newTestAcl(t, "")
+	db_mgr := server.NewDbManager()
+	db_mgr.Start()
+	defer db_mgr.Stop()
+	s := znet.NewServer()
+	router := server.NewServerRouter(acl, s, db_mgr)
+	db_router := server.NewDbRouter(acl, server.NewCluster(db_mgr))
+	mon, c := newClientConn(1, s.GetConnectionManager()), newClientConn(2, s.GetConnectionManager())
+	mon.SetProperty("db", db_mgr.GetDb(0))
+	c.SetProperty("db", db_mgr.GetDb(3))
+	acl.OnConnStart(mon)
+	acl.OnConnStart(c)
+	defer server.GetMonitor().Remove(mon)
+
+	if router.Handle(newFakeRequest(mon, "MONITOR x")); mon.next()[0] != "(error) ERR wrong number of arguments for 'monitor' command" {
+		t.Error("TestMonitor1 failed")
+	}
+	if router.Handle(newFakeRequest(mon, "MONITOR")); mon.next()[0] != "OK" {
+		t.Fatal("TestMonitor1 failed")
+	}
+	db_router.Handle(newFakeRequest(c, "SET k a\"b"))
+	c.next()
+	line := mon.next()
+	if len(line) != 1 || !regexp.MustCompile(`^\d+\.\d{6} \[3 127\.0\.0\.1:1002\] "SET" "k" "a\\"b"$`).MatchString(line[0]) {
+		t.Error("TestMonitor1 failed", line)
+	}
+	// the cmds of the other routers aren't pushed
+	router.Handle(newFakeRequest(c, "CLIENT ID"))
+	c.next()
+	if !mon.empty() {
+		t.Error("TestMonitor1 failed")
+	}
+
+	// long lines are cut to fit in a msg
+	args := []string{"MSET"}
+	for i := 0; i < 40; i++ {
+		args = append(args, strings.Repeat("v", 200))
+	}
+	server.GetMonitor().Feed(0, c, args)
+	line = mon.next()
+	if len(line) != 1 || len(server.NewCmdPack().PackCmd([][]byte{[]byte(line[0])})) > int(utils.Global_obj.MaxDataLen) ||
+		!strings.HasSuffix(line[0], "...") {
+		t.Error("TestMonitor1 failed")
+	}
+}
+
+// lines are dropped when a monitor backs up, it's disconnected after MONITOR_MAX_DROPS lines in a row are dropped
+func TestMonitor2(t *testing.T) {
+	s := znet.NewServer()
+	mon, c := newClientConn(1, s.GetConnectionManager()), newClientConn(2, s.GetConnectionManager())
+	monitor := server.GetMonitor()
+	monitor.Add(mon)
+	defer monitor.Remove(mon)
+
+	feed := func(n int) {
+		for i := 0; i < n; i++ {
+			monitor.Feed(0, c, []string{"GET", "k"})
+		}
+	}
+	// 64 lines fill the msgs of mon
+	feed(64 + server.MONITOR_MAX_DROPS - 1)
+	mon.next()
+	feed(1)
+	feed(server.MONITOR_MAX_DROPS - 1)
+	if monitor.Size() != 1 || s.GetConnectionManager().Size() != 2 {
+		t.Fatal("TestMonitor2 failed")
+	}
+	feed(1)
+	for i := 0; i < 50 && s.GetConnectionManager().Size() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if monitor.Size() != 0 || s.GetConnectionManager().Size() != 1 {
+		t.Error("TestMonitor2 failed")
+	}
+}
@@ -0,0 +1,109 @@
+package server_test
+
+import (
+	"fmt"
+	"gedis/src/Server/server"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// start a server with the db router in a temp dir, dbs are persisted into its database dir
+func startTestServer(t *testing.T) string {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	old_port, old_acl := utils.Global_obj.Port, utils.Global_obj.AclFile
+	utils.Global_obj.Port = uint32(port)
+	utils.Global_obj.AclFile = filepath.Join(dir, "users.acl")
+
+	acl := server.NewAcl()
+	db_mgr := server.NewDbManager()
+	db_mgr.Start()
+	cluster := server.NewCluster(db_mgr)
+
+	s := znet.NewServer()
+	s.AddRounter(0, server.NewDbRouter(acl, cluster))
+	s.SetOnConnStart(func(conn ziface.IConnection) {
+		conn.SetProperty("db", db_mgr.GetDb(0))
+		acl.OnConnStart(conn)
+	})
+	go s.Start()
+	t.Cleanup(func() {
+		s.Stop()
+		db_mgr.Stop()
+		utils.Global_obj.Port, utils.Global_obj.AclFile = old_port, old_acl
+		os.Chdir(wd)
+	})
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return addr
+}
+
+// pipeline 10k cmds over one socket without waiting for replies, the replies must come back in order
+func TestPipeline(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const N = 10000
+	msg_packer := znet.NewDataPack()
+	cmd_packer := server.NewCmdPack()
+
+	// SET k i and then GET k, GET gets the value of the SET right before it only if they are in order
+	go func() {
+		for i := 0; i < N/2; i++ {
+			for _, cmd := range [][][]byte{
+				{[]byte("SET"), []byte("k"), []byte(fmt.Sprint(i))},
+				{[]byte("GET"), []byte("k")},
+			} {
+				buf, _ := msg_packer.Pack(znet.NewMessage(0, cmd_packer.PackCmd(cmd)))
+				if _, err := conn.Write(buf); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	for i := 0; i < N; i++ {
+		head := make([]byte, msg_packer.GetHeadLen())
+		if _, err := io.ReadFull(conn, head); err != nil {
+			t.Fatal("TestPipeline failed", i, err)
+		}
+		msg, _ := msg_packer.UnpackHead(head)
+		if _, err := io.ReadFull(conn, msg.GetMsgData()); err != nil {
+			t.Fatal("TestPipeline failed", i, err)
+		}
+		res := string(cmd_packer.UnpackCmd(msg.GetMsgData())[0])
+
+		expect := "OK"
+		if i%2 == 1 {
+			expect = fmt.Sprint(i / 2)
+		}
+		if res != expect {
+			t.Fatalf("TestPipeline failed, reply %d is %s, expect %s", i, res, expect)
+		}
+	}
+}
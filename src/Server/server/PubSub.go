@@ -0,0 +1,324 @@
+package server
+
+import (
+	"fmt"
+	"gedis/src/Server/siface"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const PUBSUB_MSG_ID = 6
+
+// a subscriber is disconnected once this many messages in a row are dropped
+const PUBSUB_MAX_DROPS = 1024
+
+// classes of keyspace notifications, enabled by the chars of notify-keyspace-events
+const (
+	NOTIFY_KEYSPACE = 1 << iota // K, __keyspace@<db>__:<key> with the event
+	NOTIFY_KEYEVENT             // E, __keyevent@<db>__:<event> with the key
+	NOTIFY_GENERIC              // g, DEL EXPIRE PERSIST...
+	NOTIFY_STRING               // $
+	NOTIFY_LIST                 // l
+	NOTIFY_SET                  // s
+	NOTIFY_HASH                 // h
+	NOTIFY_ZSET                 // z
+	NOTIFY_EXPIRED              // x
+	NOTIFY_EVICTED              // e, accepted like redis but never notified, nothing is evicted under noeviction
+	NOTIFY_STREAM               // t
+
+	NOTIFY_ALL = NOTIFY_GENERIC | NOTIFY_STRING | NOTIFY_LIST | NOTIFY_SET | NOTIFY_HASH | NOTIFY_ZSET |
+		NOTIFY_EXPIRED | NOTIFY_EVICTED | NOTIFY_STREAM // A
+)
+
+var notify_chars = []struct {
+	char  byte
+	class int
+}{
+	{'A', NOTIFY_ALL}, {'g', NOTIFY_GENERIC}, {'$', NOTIFY_STRING}, {'l', NOTIFY_LIST}, {'s', NOTIFY_SET},
+	{'h', NOTIFY_HASH}, {'z', NOTIFY_ZSET}, {'x', NOTIFY_EXPIRED}, {'e', NOTIFY_EVICTED}, {'t', NOTIFY_STREAM},
+	{'K', NOTIFY_KEYSPACE}, {'E', NOTIFY_KEYEVENT},
+}
+
+// parse notify-keyspace-events, nothing is notified unless K or E is given
+func ParseNotifyFlags(str string) (int, error) {
+	flags := 0
+	for i := 0; i < len(str); i++ {
+		found := false
+		for _, c := range notify_chars {
+			if c.char == str[i] {
+				flags |= c.class
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid notify-keyspace-events char '%c'", str[i])
+		}
+	}
+	return flags, nil
+}
+
+// the notify-keyspace-events string of flags, A stands for all the classes
+func NotifyFlagsString(flags int) string {
+	str := ""
+	for _, c := range notify_chars {
+		if flags&c.class == c.class {
+			str += string(c.char)
+			flags &^= c.class
+		}
+	}
+	return str
+}
+
+// channels and patterns subscribed by a connection
+type pubsubConn struct {
+	drops    uint64 // messages dropped in a row, accessed atomically
+	conn     ziface.IConnection
+	channels map[string]bool
+	patterns map[string]bool
+}
+
+// publish/subscribe shared by all dbs, keyspace notifications are published here too.
+// Messages never wait for a slow subscriber like the lines of the monitors, they are dropped if it
+// backs up, so PUBLISH and the cmds notifying keyspace events are never blocked
+type PubSub struct {
+	lock sync.RWMutex
+	// channel or pattern -> ids of the subscribed connections
+	channels map[string]map[uint32]bool
+	patterns map[string]map[uint32]bool
+	conns    map[uint32]*pubsubConn
+
+	notify_flags int32
+	cmd_packer   siface.ICmdPack
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels:   make(map[string]map[uint32]bool),
+		patterns:   make(map[string]map[uint32]bool),
+		conns:      make(map[uint32]*pubsubConn),
+		cmd_packer: NewCmdPack(),
+	}
+}
+
+func (this *PubSub) SetNotifyFlags(str string) error {
+	flags, err := ParseNotifyFlags(str)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&this.notify_flags, int32(flags))
+	return nil
+}
+
+func (this *PubSub) GetNotifyFlags() string {
+	return NotifyFlagsString(int(atomic.LoadInt32(&this.notify_flags)))
+}
+
+// called with the lock, the messages to a connection are in the order they are sent
+func (this *PubSub) send(sub *pubsubConn, reply ...string) {
+	resp := make([][]byte, 0, len(reply))
+	for _, r := range reply {
+		resp = append(resp, []byte(r))
+	}
+	// a closed connection is removed by OnConnStop
+	err := sub.conn.TrySendMsg(PUBSUB_MSG_ID, this.cmd_packer.PackCmd(resp))
+	if err == nil {
+		atomic.StoreUint64(&sub.drops, 0)
+	} else if err == znet.ErrMsgChanFull && atomic.AddUint64(&sub.drops, 1) == PUBSUB_MAX_DROPS {
+		// too slow, stopping may wait the writer to flush, which mustn't block the publisher
+		fmt.Printf("Connection %d is disconnected as a slow subscriber, %d messages are dropped\n", sub.conn.GetConnID(), PUBSUB_MAX_DROPS)
+		go sub.conn.Stop()
+	}
+}
+
+// called with the lock
+func (this *PubSub) getConn(conn ziface.IConnection) *pubsubConn {
+	sub, ok := this.conns[conn.GetConnID()]
+	if !ok {
+		sub = &pubsubConn{conn: conn, channels: make(map[string]bool), patterns: make(map[string]bool)}
+		this.conns[conn.GetConnID()] = sub
+	}
+	return sub
+}
+
+func (sub *pubsubConn) count() int {
+	return len(sub.channels) + len(sub.patterns)
+}
+
+// the replies of SUBSCRIBE and PSUBSCRIBE are sent like the messages, one for each channel
+func (this *PubSub) Subscribe(conn ziface.IConnection, channels []string, pattern bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	sub := this.getConn(conn)
+	subs, all, kind := sub.channels, this.channels, "subscribe"
+	if pattern {
+		subs, all, kind = sub.patterns, this.patterns, "psubscribe"
+	}
+	for _, channel := range channels {
+		if !subs[channel] {
+			subs[channel] = true
+			if all[channel] == nil {
+				all[channel] = make(map[uint32]bool)
+			}
+			all[channel][conn.GetConnID()] = true
+		}
+		this.send(sub, kind, channel, integerReply(sub.count()))
+	}
+}
+
+// all the channels or patterns are unsubscribed if none is given
+func (this *PubSub) Unsubscribe(conn ziface.IConnection, channels []string, pattern bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	sub := this.getConn(conn)
+	subs, all, kind := sub.channels, this.channels, "unsubscribe"
+	if pattern {
+		subs, all, kind = sub.patterns, this.patterns, "punsubscribe"
+	}
+	if len(channels) == 0 {
+		for channel := range subs {
+			channels = append(channels, channel)
+		}
+		sort.Strings(channels)
+		if len(channels) == 0 {
+			this.send(sub, kind, "(nil)", integerReply(sub.count()))
+		}
+	}
+	for _, channel := range channels {
+		if subs[channel] {
+			delete(subs, channel)
+			delete(all[channel], conn.GetConnID())
+			if len(all[channel]) == 0 {
+				delete(all, channel)
+			}
+		}
+		this.send(sub, kind, channel, integerReply(sub.count()))
+	}
+	if sub.count() == 0 {
+		delete(this.conns, conn.GetConnID())
+	}
+}
+
+// unsubscribe everything of a closed connection
+func (this *PubSub) RemoveConn(conn ziface.IConnection) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	sub, ok := this.conns[conn.GetConnID()]
+	if !ok {
+		return
+	}
+	for channel := range sub.channels {
+		delete(this.channels[channel], conn.GetConnID())
+		if len(this.channels[channel]) == 0 {
+			delete(this.channels, channel)
+		}
+	}
+	for pattern := range sub.patterns {
+		delete(this.patterns[pattern], conn.GetConnID())
+		if len(this.patterns[pattern]) == 0 {
+			delete(this.patterns, pattern)
+		}
+	}
+	delete(this.conns, conn.GetConnID())
+}
+
+// returns the number of the receivers
+func (this *PubSub) Publish(channel string, message string) int {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	num := 0
+	for id := range this.channels[channel] {
+		this.send(this.conns[id], "message", channel, message)
+		num++
+	}
+	for pattern, ids := range this.patterns {
+		if ismatch, _ := filepath.Match(pattern, channel); !ismatch {
+			continue
+		}
+		for id := range ids {
+			this.send(this.conns[id], "pmessage", pattern, channel, message)
+			num++
+		}
+	}
+	return num
+}
+
+// publish the keyspace notification of key in db if class is enabled
+func (this *PubSub) Notify(db string, class int, event string, key string) {
+	flags := int(atomic.LoadInt32(&this.notify_flags))
+	if flags&class == 0 {
+		return
+	}
+	if flags&NOTIFY_KEYSPACE != 0 {
+		this.Publish("__keyspace@"+db+"__:"+key, event)
+	}
+	if flags&NOTIFY_KEYEVENT != 0 {
+		this.Publish("__keyevent@"+db+"__:"+event, key)
+	}
+}
+
+// active channels matching pattern, all if pattern is empty
+func (this *PubSub) Channels(pattern string) []string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	channels := make([]string, 0)
+	for channel := range this.channels {
+		if ismatch, _ := filepath.Match(pattern, channel); pattern == "" || ismatch {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+func (this *PubSub) NumSub(channel string) int {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return len(this.channels[channel])
+}
+
+func (this *PubSub) NumPat() int {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return len(this.patterns)
+}
+
+// PUBSUB CHANNELS [pattern] | NUMSUB [channel [channel ...]] | NUMPAT
+func (this *PubSub) pubsubCmd(args []string) []string {
+	if len(args) < 1 {
+		return []string{"(error) ERR wrong number of arguments for 'pubsub' command"}
+	}
+	switch sub := strings.ToUpper(args[0]); {
+	case sub == "CHANNELS" && len(args) <= 2:
+		pattern := ""
+		if len(args) == 2 {
+			pattern = args[1]
+		}
+		channels := this.Channels(pattern)
+		if len(channels) == 0 {
+			return []string{"(empty array)"}
+		}
+		return channels
+	case sub == "NUMSUB":
+		items := make([]interface{}, 0, 2*(len(args)-1))
+		for _, channel := range args[1:] {
+			items = append(items, channel, integerReply(this.NumSub(channel)))
+		}
+		return formatNested(items)
+	case sub == "NUMPAT" && len(args) == 1:
+		return []string{integerReply(this.NumPat())}
+	case sub == "CHANNELS" || sub == "NUMPAT":
+		return []string{fmt.Sprintf("(error) ERR wrong number of arguments for 'pubsub|%s' command", strings.ToLower(sub))}
+	}
+	return []string{fmt.Sprintf("(error) ERR unknown subcommand '%s'. Try PUBSUB HELP.", args[0])}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"gedis/src/Server/siface"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"strings"
+	"time"
+)
+
+type PubSubRouter struct {
+	znet.BaseRounter
+	acl        *Acl
+	pubsub     *PubSub
+	db_mgr     *DbManager
+	cmd_packer siface.ICmdPack
+}
+
+// db_mgr pauses the cmds like the ones of the dbs
+func NewPubSubRouter(acl *Acl, pubsub *PubSub, db_mgr *DbManager) *PubSubRouter {
+	return &PubSubRouter{
+		acl:        acl,
+		pubsub:     pubsub,
+		db_mgr:     db_mgr,
+		cmd_packer: NewCmdPack(),
+	}
+}
+
+func (this *PubSubRouter) Handle(req ziface.IRequest) {
+	start := time.Now()
+	conn := req.GetConn()
+	buf := req.GetData()
+
+	cmd_arg := this.cmd_packer.UnpackCmd(buf)
+	args := make([]string, 0, len(cmd_arg))
+	for _, v := range cmd_arg {
+		args = append(args, string(v))
+	}
+
+	onCmd(conn, args)
+	if len(args) == 0 {
+		this.reply(conn, "", start, []string{"(error) ERR empty command"})
+		return
+	}
+	if err := this.acl.Check(conn, args); err != "" {
+		this.reply(conn, args[0], start, []string{err})
+		return
+	}
+
+	// paused cmds park the connection like DbRouter
+	if wait := this.db_mgr.WaitPause(args); wait != nil {
+		resume := req.Park()
+		go func() {
+			for wait != nil {
+				<-wait
+				wait = this.db_mgr.WaitPause(args)
+			}
+			this.exec(conn, args, start)
+			resume()
+		}()
+		return
+	}
+	this.exec(conn, args, start)
+}
+
+func (this *PubSubRouter) exec(conn ziface.IConnection, args []string, start time.Time) {
+	var res []string
+	switch args[0] {
+	// the replies of (un)subscribing are sent by pubsub in order with the messages
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(args) < 2 {
+			res = []string{"(error) ERR wrong number of arguments for '" + strings.ToLower(args[0]) + "' command"}
+			break
+		}
+		this.pubsub.Subscribe(conn, args[1:], args[0] == "PSUBSCRIBE")
+		metrics.ObserveCmd(args[0], time.Since(start), nil)
+		return
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		this.pubsub.Unsubscribe(conn, args[1:], args[0] == "PUNSUBSCRIBE")
+		metrics.ObserveCmd(args[0], time.Since(start), nil)
+		return
+	case "PUBLISH":
+		if len(args) != 3 {
+			res = []string{"(error) ERR wrong number of arguments for 'publish' command"}
+			break
+		}
+		res = []string{integerReply(this.pubsub.Publish(args[1], args[2]))}
+	case "PUBSUB":
+		res = this.pubsub.pubsubCmd(args[1:])
+	default:
+		res = []string{"Unspported command"}
+	}
+	this.reply(conn, args[0], start, res)
+}
+
+func (this *PubSubRouter) reply(conn ziface.IConnection, cmd string, start time.Time, res []string) {
+	resp := make([][]byte, 0, len(res))
+	for _, r := range res {
+		resp = append(resp, []byte(r))
+	}
+	if cmd != "" {
+		metrics.ObserveCmd(cmd, time.Since(start), resp)
+	}
+	conn.SendMsg(0, this.cmd_packer.PackCmd(resp))
+}
@@ -0,0 +1,283 @@
+package server_test
+
+import (
+	"gedis/src/Server/server"
+	"gedis/src/zinx/znet"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// connection receiving the messages of pubsub
+type msgConn struct {
+	*fakeConn
+	id   uint32
+	msgs chan []string
+}
+
+func newMsgConn(id uint32) *msgConn {
+	return &msgConn{fakeConn: newFakeConn(), id: id, msgs: make(chan []string, 64)}
+}
+
+func (this *msgConn) GetConnID() uint32 { return this.id }
+func (this *msgConn) SendMsg(id uint32, data []byte) error {
+	msg := make([]string, 0)
+	for _, v := range server.NewCmdPack().UnpackCmd(data) {
+		msg = append(msg, string(v))
+	}
+	this.msgs <- msg
+	return nil
+}
+
+func (this *msgConn) SendMsgWait(id uint32, data []byte) error {
+	return this.SendMsg(id, data)
+}
+
+// the messages are dropped once msgs is full
+func (this *msgConn) TrySendMsg(id uint32, data []byte) error {
+	if len(this.msgs) == cap(this.msgs) {
+		return znet.ErrMsgChanFull
+	}
+	return this.SendMsg(id, data)
+}
+
+// the next message, nil if none arrives in time
+func (this *msgConn) next() []string {
+	select {
+	case msg := <-this.msgs:
+		return msg
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+func (this *msgConn) empty() bool {
+	select {
+	case <-this.msgs:
+		return false
+	case <-time.After(50 * time.Millisecond):
+		return true
+	}
+}
+
+// notify-keyspace-events flags
+func TestPubSub1(t *testing.T) {
+	cases := []struct {
+		str      string
+		expected string
+	}{
+		{"", ""},
+		{"KEA", "AKE"},
+		{"Elg", "glE"},
+		{"Kg$lshzxet", "AK"},
+	}
+	for _, c := range cases {
+		flags, err := server.ParseNotifyFlags(c.str)
+		if err != nil || server.NotifyFlagsString(flags) != c.expected {
+			t.Error("TestPubSub1 failed")
+		}
+	}
+	if _, err := server.ParseNotifyFlags("KEQ"); err == nil {
+		t.Error("TestPubSub1 failed")
+	}
+	if flags, _ := server.ParseNotifyFlags("KEg"); flags&server.NOTIFY_LIST != 0 || flags&server.NOTIFY_GENERIC == 0 {
+		t.Error("TestPubSub1 failed")
+	}
+}
+
+// SUBSCRIBE, PSUBSCRIBE, UNSUBSCRIBE and PUBLISH
+func TestPubSub2(t *testing.T) {
+	pubsub := server.NewPubSub()
+	c1, c2 := newMsgConn(1), newMsgConn(2)
+
+	pubsub.Subscribe(c1, []string{"news", "sport"}, false)
+	if !reflect.DeepEqual(c1.next(), []string{"subscribe", "news", "(integer) 1"}) || !reflect.DeepEqual(c1.next(), []string{"subscribe", "sport", "(integer) 2"}) {
+		t.Error("TestPubSub2 failed")
+	}
+	pubsub.Subscribe(c2, []string{"n*"}, true)
+	if !reflect.DeepEqual(c2.next(), []string{"psubscribe", "n*", "(integer) 1"}) {
+		t.Error("TestPubSub2 failed")
+	}
+
+	if pubsub.Publish("news", "hello") != 2 {
+		t.Error("TestPubSub2 failed")
+	}
+	if !reflect.DeepEqual(c1.next(), []string{"message", "news", "hello"}) || !reflect.DeepEqual(c2.next(), []string{"pmessage", "n*", "news", "hello"}) {
+		t.Error("TestPubSub2 failed")
+	}
+	if pubsub.Publish("sport", "goal") != 1 || !reflect.DeepEqual(c1.next(), []string{"message", "sport", "goal"}) || !c2.empty() {
+		t.Error("TestPubSub2 failed")
+	}
+	if pubsub.Publish("weather", "sunny") != 0 {
+		t.Error("TestPubSub2 failed")
+	}
+
+	if !reflect.DeepEqual(pubsub.Channels(""), []string{"news", "sport"}) || !reflect.DeepEqual(pubsub.Channels("s*"), []string{"sport"}) {
+		t.Error("TestPubSub2 failed")
+	}
+	if pubsub.NumSub("news") != 1 || pubsub.NumSub("weather") != 0 || pubsub.NumPat() != 1 {
+		t.Error("TestPubSub2 failed")
+	}
+
+	// all the channels are unsubscribed without args
+	pubsub.Unsubscribe(c1, nil, false)
+	if !reflect.DeepEqual(c1.next(), []string{"unsubscribe", "news", "(integer) 1"}) || !reflect.DeepEqual(c1.next(), []string{"unsubscribe", "sport", "(integer) 0"}) {
+		t.Error("TestPubSub2 failed")
+	}
+	pubsub.Unsubscribe(c1, nil, false)
+	if !reflect.DeepEqual(c1.next(), []string{"unsubscribe", "(nil)", "(integer) 0"}) {
+		t.Error("TestPubSub2 failed")
+	}
+	if pubsub.Publish("news", "bye") != 1 || !c1.empty() {
+		t.Error("TestPubSub2 failed")
+	}
+	c2.next()
+
+	// closed connections are removed
+	pubsub.RemoveConn(c2)
+	if pubsub.Publish("news", "bye") != 0 || pubsub.NumPat() != 0 {
+		t.Error("TestPubSub2 failed")
+	}
+}
+
+// keyspace notifications of the engine
+func TestPubSub3(t *testing.T) {
+	pubsub := server.NewPubSub()
+	engine := newStreamEngine()
+	defer engine.Stop()
+	engine.SetOnNotify(func(class int, event string, key string) {
+		pubsub.Notify("0", class, event, key)
+	})
+
+	c := newMsgConn(1)
+	pubsub.Subscribe(c, []string{"__keyspace@0__:*", "__keyevent@0__:*"}, true)
+	c.next()
+	c.next()
+
+	// disabled by default
+	handle(engine, "SET k v")
+	if !c.empty() {
+		t.Error("TestPubSub3 failed")
+	}
+
+	pubsub.SetNotifyFlags("KEA")
+	if pubsub.GetNotifyFlags() != "AKE" {
+		t.Error("TestPubSub3 failed")
+	}
+	handle(engine, "SET k v")
+	if !reflect.DeepEqual(c.next(), []string{"pmessage", "__keyspace@0__:*", "__keyspace@0__:k", "set"}) ||
+		!reflect.DeepEqual(c.next(), []string{"pmessage", "__keyevent@0__:*", "__keyevent@0__:set", "k"}) {
+		t.Error("TestPubSub3 failed")
+	}
+
+	// only the key events of lists and generic cmds
+	pubsub.SetNotifyFlags("Elg")
+	cases := []struct {
+		cmdline string
+		events  []string
+	}{
+		{"SET k v", nil},
+		{"LPUSH l a b", []string{"lpush"}},
+		{"RPOP l", []string{"rpop"}},
+		{"DEL k nokey l", []string{"del", "del"}},
+		{"LPUSH l a", []string{"lpush"}},
+		{"EXPIRE nokey 10", nil},
+		{"EXPIRE l 10", []string{"expire"}},
+		{"ZADD z 1 a", nil},
+		{"LPUSH l", nil},
+	}
+	for _, c_ := range cases {
+		handle(engine, c_.cmdline)
+		for _, event := range c_.events {
+			if msg := c.next(); len(msg) != 4 || msg[2] != "__keyevent@0__:"+event {
+				t.Error("TestPubSub3 failed")
+			}
+		}
+		if !c.empty() {
+			t.Error("TestPubSub3 failed")
+		}
+	}
+
+	// expired keys are notified when they are deleted
+	pubsub.SetNotifyFlags("Ex")
+	handle(engine, "SET e v")
+	handle(engine, "EXPIRE e -1")
+	handle(engine, "TTL e")
+	if !reflect.DeepEqual(c.next(), []string{"pmessage", "__keyevent@0__:*", "__keyevent@0__:expired", "e"}) || !c.empty() {
+		t.Error("TestPubSub3 failed")
+	}
+
+	// writes of other types
+	pubsub.SetNotifyFlags("E$zt")
+	cases = []struct {
+		cmdline string
+		events  []string
+	}{
+		{"SETBIT b 7 1", []string{"setbit"}},
+		{"PFADD h a", []string{"pfadd"}},
+		{"PFADD h a", nil},
+		{"GEOADD g 13.361389 38.115556 Palermo", []string{"zadd"}},
+		{"ZREM g nomember", nil},
+		{"ZREM g Palermo", []string{"zrem"}},
+		{"XADD s MAXLEN 1 1-0 f v", []string{"xadd"}},
+		{"XADD s MAXLEN 1 2-0 f v", []string{"xadd", "xtrim"}},
+		{"XGROUP CREATE s g $", []string{"xgroup-create"}},
+		{"XDEL s 2-0", []string{"xdel"}},
+	}
+	for _, c_ := range cases {
+		handle(engine, c_.cmdline)
+		for _, event := range c_.events {
+			if msg := c.next(); len(msg) != 4 || msg[2] != "__keyevent@0__:"+event {
+				t.Error("TestPubSub3 failed")
+			}
+		}
+		if !c.empty() {
+			t.Error("TestPubSub3 failed")
+		}
+	}
+}
+
+// messages are dropped when a subscriber backs up, it's disconnected after PUBSUB_MAX_DROPS messages
+// in a row are dropped, and the publisher is never blocked
+func TestPubSub4(t *testing.T) {
+	pubsub := server.NewPubSub()
+	s := znet.NewServer()
+	c := newClientConn(1, s.GetConnectionManager())
+	pubsub.Subscribe(c, []string{"news"}, false)
+	c.next()
+
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			if pubsub.Publish("news", "hello") != 1 {
+				t.Fatal("TestPubSub4 failed")
+			}
+		}
+	}
+	// 64 messages fill the msgs of c
+	publish(64 + server.PUBSUB_MAX_DROPS - 1)
+	c.next()
+	publish(1)
+	publish(server.PUBSUB_MAX_DROPS - 1)
+	if s.GetConnectionManager().Size() != 1 {
+		t.Fatal("TestPubSub4 failed")
+	}
+	publish(1)
+	for i := 0; i < 50 && s.GetConnectionManager().Size() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.GetConnectionManager().Size() != 0 {
+		t.Error("TestPubSub4 failed")
+	}
+}
+
+// an empty cmd frame gets an error instead of panicking the worker
+func TestPubSub5(t *testing.T) {
+	acl := newTestAcl(t, "")
+	router := server.NewPubSubRouter(acl, server.NewPubSub(), server.NewDbManager())
+	conn := newMsgConn(1)
+	acl.OnConnStart(conn)
+	router.Handle(newEmptyRequest(conn))
+	if res := conn.next(); !reflect.DeepEqual(res, []string{"(error) ERR empty command"}) {
+		t.Error("TestPubSub5 failed", res)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ring buffer keeps the latest bytes of the replication stream,
+// a replica reconnects with its offset can continue from here instead of a full resync
+type ReplBacklog struct {
+	buf     []byte
+	size    int64
+	offset  int64 // replication offset of the next byte to write
+	histlen int64 // valid bytes in buf, the stream [offset - histlen, offset) is kept
+	lock    sync.RWMutex
+}
+
+func NewReplBacklog(size uint32) *ReplBacklog {
+	if size == 0 {
+		size = 1
+	}
+	return &ReplBacklog{
+		buf:     make([]byte, size),
+		size:    int64(size),
+		offset:  0,
+		histlen: 0,
+		lock:    sync.RWMutex{},
+	}
+}
+
+func (this *ReplBacklog) Write(data []byte) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	n := int64(len(data))
+	// only the last size bytes can be kept anyway
+	if n > this.size {
+		this.offset += n - this.size
+		data = data[n-this.size:]
+	}
+	for len(data) > 0 {
+		pos := this.offset % this.size
+		copied := copy(this.buf[pos:], data)
+		data = data[copied:]
+		this.offset += int64(copied)
+	}
+
+	this.histlen += n
+	if this.histlen > this.size {
+		this.histlen = this.size
+	}
+}
+
+func (this *ReplBacklog) ReadFrom(offset int64) ([]byte, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if offset > this.offset || offset < this.offset-this.histlen {
+		return nil, fmt.Errorf("offset %d is out of backlog [%d, %d]", offset, this.offset-this.histlen, this.offset)
+	}
+
+	n := this.offset - offset
+	data := make([]byte, n)
+	pos := offset % this.size
+	copied := copy(data, this.buf[pos:])
+	copy(data[copied:], this.buf[:n-int64(copied)])
+	return data, nil
+}
+
+func (this *ReplBacklog) GetOffset() int64 {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.offset
+}
@@ -0,0 +1,114 @@
+package server_test
+
+import (
+	"fmt"
+	"gedis/src/Server/server"
+	"testing"
+)
+
+// read back what is written, the whole stream is kept when it is smaller than the backlog
+func TestReplBacklog1(t *testing.T) {
+	backlog := server.NewReplBacklog(64)
+	backlog.Write([]byte("hello "))
+	backlog.Write([]byte("world"))
+
+	if backlog.GetOffset() != 11 {
+		t.Error("TestReplBacklog1 failed")
+	}
+	data, err := backlog.ReadFrom(0)
+	if err != nil || string(data) != "hello world" {
+		t.Error("TestReplBacklog1 failed")
+	}
+	data, err = backlog.ReadFrom(6)
+	if err != nil || string(data) != "world" {
+		t.Error("TestReplBacklog1 failed")
+	}
+	data, err = backlog.ReadFrom(11)
+	if err != nil || len(data) != 0 {
+		t.Error("TestReplBacklog1 failed")
+	}
+	// offset in the future
+	if _, err = backlog.ReadFrom(12); err == nil {
+		t.Error("TestReplBacklog1 failed")
+	}
+}
+
+// the ring wraps around, only the latest size bytes can be read
+func TestReplBacklog2(t *testing.T) {
+	backlog := server.NewReplBacklog(10)
+	stream := ""
+	for i := 0; i < 100; i++ {
+		str := fmt.Sprint(i)
+		backlog.Write([]byte(str))
+		stream += str
+	}
+
+	offset := int64(len(stream))
+	if backlog.GetOffset() != offset {
+		t.Error("TestReplBacklog2 failed")
+	}
+	data, err := backlog.ReadFrom(offset - 10)
+	if err != nil || string(data) != stream[len(stream)-10:] {
+		t.Error("TestReplBacklog2 failed")
+	}
+	data, err = backlog.ReadFrom(offset - 3)
+	if err != nil || string(data) != stream[len(stream)-3:] {
+		t.Error("TestReplBacklog2 failed")
+	}
+	// already overwritten
+	if _, err = backlog.ReadFrom(offset - 11); err == nil {
+		t.Error("TestReplBacklog2 failed")
+	}
+}
+
+// a write larger than the backlog keeps its tail
+func TestReplBacklog3(t *testing.T) {
+	backlog := server.NewReplBacklog(4)
+	backlog.Write([]byte("ab"))
+	backlog.Write([]byte("0123456789"))
+
+	if backlog.GetOffset() != 12 {
+		t.Error("TestReplBacklog3 failed")
+	}
+	data, err := backlog.ReadFrom(8)
+	if err != nil || string(data) != "6789" {
+		t.Error("TestReplBacklog3 failed")
+	}
+	// the bytes overwritten are gone
+	if _, err = backlog.ReadFrom(7); err == nil {
+		t.Error("TestReplBacklog3 failed")
+	}
+}
+
+// the replication stream in backlog is a sequence of packed cmds
+func TestReplBacklog4(t *testing.T) {
+	cmd_packer := server.NewCmdPack()
+	backlog := server.NewReplBacklog(1024)
+	cmds := [][][]byte{
+		{[]byte("0"), []byte("SET"), []byte("key"), []byte("value")},
+		{[]byte("3"), []byte("LPUSH"), []byte("list"), []byte("a"), []byte("b")},
+		{[]byte("15"), []byte("FLUSHDB")},
+	}
+	offsets := make([]int64, 0)
+	for _, cmd := range cmds {
+		offsets = append(offsets, backlog.GetOffset())
+		backlog.Write(cmd_packer.PackCmd(cmd))
+	}
+
+	data, err := backlog.ReadFrom(offsets[1])
+	if err != nil {
+		t.Error("TestReplBacklog4 failed")
+	}
+	unpacked := cmd_packer.UnpackCmds(data)
+	if len(unpacked) != 2 {
+		t.Error("TestReplBacklog4 failed")
+		return
+	}
+	for i, cmd := range unpacked {
+		for j, v := range cmd {
+			if string(v) != string(cmds[i+1][j]) {
+				t.Error("TestReplBacklog4 failed")
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"gedis/src/Server/siface"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"strings"
+	"time"
+)
+
+type ReplRouter struct {
+	znet.BaseRounter
+	acl        *Acl
+	repl       *Replication
+	cmd_packer siface.ICmdPack
+}
+
+func NewReplRouter(acl *Acl, repl *Replication) *ReplRouter {
+	return &ReplRouter{
+		acl:        acl,
+		repl:       repl,
+		cmd_packer: NewCmdPack(),
+	}
+}
+
+func (this *ReplRouter) Handle(req ziface.IRequest) {
+	start := time.Now()
+	conn := req.GetConn()
+	buf := req.GetData()
+
+	cmd_arg := this.cmd_packer.UnpackCmd(buf)
+	if len(cmd_arg) == 0 {
+		onCmd(conn, nil)
+		this.reply(conn, "", start, []string{"(error) ERR empty command"})
+		return
+	}
+	cmd := string(cmd_arg[0])
+	args := cmd_arg[1:]
+
+	onCmd(conn, []string{cmd})
+	if err := this.acl.Check(conn, []string{cmd}); err != "" {
+		this.reply(conn, cmd, start, []string{err})
+		return
+	}
+
+	var res []string
+	switch cmd {
+	case "PSYNC":
+		// replies and the stream are sent by replication itself
+		if len(args) != 2 {
+			res = []string{"(error) ERR wrong number of arguments for 'psync' command"}
+			break
+		}
+		this.repl.Psync(conn, string(args[0]), string(args[1]))
+		metrics.ObserveCmd(cmd, time.Since(start), nil)
+		return
+	case "REPLICAOF":
+		if len(args) != 2 {
+			res = []string{"(error) ERR wrong number of arguments for 'replicaof' command"}
+			break
+		}
+		if strings.ToUpper(string(args[0])) == "NO" && strings.ToUpper(string(args[1])) == "ONE" {
+			this.repl.ReplicaOf("")
+		} else {
+			this.repl.ReplicaOf(fmt.Sprintf("%s:%s", args[0], args[1]))
+		}
+		res = []string{"OK"}
+	case "ROLE":
+		role, master_addr, offset := this.repl.GetRole()
+		if role == "master" {
+			res = []string{role, this.repl.GetReplid(), fmt.Sprintf("(integer) %d", offset)}
+		} else {
+			res = []string{role, master_addr, fmt.Sprintf("(integer) %d", offset)}
+		}
+	default:
+		res = []string{"Unspported command"}
+	}
+	this.reply(conn, cmd, start, res)
+}
+
+func (this *ReplRouter) reply(conn ziface.IConnection, cmd string, start time.Time, res []string) {
+	resp := make([][]byte, 0, len(res))
+	for _, r := range res {
+		resp = append(resp, []byte(r))
+	}
+	if cmd != "" {
+		metrics.ObserveCmd(cmd, time.Since(start), resp)
+	}
+	conn.SendMsg(0, this.cmd_packer.PackCmd(resp))
+}
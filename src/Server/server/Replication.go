@@ -0,0 +1,387 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"gedis/src/Server/siface"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// replication stream and PSYNC handshake are sent with this msg id
+const REPL_MSG_ID = 2
+
+// Replication works as both sides of the master-replica link:
+//
+// master: every write cmd of any db is packed as [db, cmd, args...] and appended to the stream,
+// the stream is kept in the backlog and sent to all the replicas. replication offset is the byte offset in the stream.
+//
+// replica: connects to the master with PSYNC replid offset, if the master still keeps the stream from offset
+// in its backlog, it answers CONTINUE and sends the rest of the stream (partial resync),
+// otherwise it answers FULLRESYNC replid offset, sends the snapshot of all the dbs ended with ENDSYNC, then the stream.
+//
+// each replica has its own goroutine sending the stream from the backlog, so a slow replica doesn't block the writes,
+// it is disconnected when it falls behind out of the backlog and does a full resync when it comes back.
+type Replication struct {
+	db_mgr     *DbManager
+	cmd_packer siface.ICmdPack
+
+	// master side
+	replid   string
+	backlog  siface.IReplBacklog
+	replicas map[uint32]*replica
+	lock     sync.Mutex
+
+	// replica side
+	master_addr   string
+	master_replid string
+	master_offset int64
+	master_conn   net.Conn
+	exit_chan     chan bool
+	slave_lock    sync.Mutex
+}
+
+func NewReplication(db_mgr *DbManager) *Replication {
+	return &Replication{
+		db_mgr:     db_mgr,
+		cmd_packer: NewCmdPack(),
+
+		replid:   newRandomId(),
+		backlog:  NewReplBacklog(utils.Global_obj.ReplBacklogSize),
+		replicas: make(map[uint32]*replica),
+		lock:     sync.Mutex{},
+
+		master_addr:   "",
+		master_replid: "?",
+		master_offset: -1,
+		slave_lock:    sync.Mutex{},
+	}
+}
+
+// a connected replica on the master side
+type replica struct {
+	conn   ziface.IConnection
+	offset int64     // offset of the next byte in the stream to send
+	wake   chan bool // the stream has new bytes
+	exit   chan bool
+}
+
+// 40 hex chars, used as replid and cluster node id
+func newRandomId() string {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err.Error())
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (this *Replication) GetReplid() string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.replid
+}
+
+func (this *Replication) GetOffset() int64 {
+	return this.backlog.GetOffset()
+}
+
+// feed a write cmd executed in db into the replication stream, used as the OnWrite callback of dbs
+func (this *Replication) Feed(db string, cmd []string) {
+	packed := this.packStrs(append([]string{db}, cmd...))
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.backlog.Write(packed)
+	for _, r := range this.replicas {
+		select {
+		case r.wake <- true:
+		default:
+		}
+	}
+}
+
+// handle PSYNC replid offset from a replica, the replies and the stream are sent by the goroutine of the replica
+func (this *Replication) Psync(conn ziface.IConnection, replid string, offset string) {
+	if off, err := strconv.ParseInt(offset, 10, 64); err == nil {
+		this.lock.Lock()
+		if _, err = this.backlog.ReadFrom(off); err == nil && replid == this.replid {
+			this.addReplica(conn, off, [][]byte{this.packStrs([]string{"CONTINUE", this.replid})})
+			this.lock.Unlock()
+			return
+		}
+		this.lock.Unlock()
+	}
+
+	// the snapshot is taken while no cmds run and the cmds done are all fed,
+	// so it is the data at the offset of the stream, the cmds after it are sent by the stream
+	this.db_mgr.Freeze(func() {
+		this.lock.Lock()
+		defer this.lock.Unlock()
+
+		off := this.backlog.GetOffset()
+		head := [][]byte{this.packStrs([]string{"FULLRESYNC", this.replid, fmt.Sprint(off)})}
+		// the function libraries are shared by the dbs, they are applied by db 0
+		head = append(head, this.packStrs([]string{"0", "FUNCTION", "RESTORE", functions.Dump(), "FLUSH"}))
+		for id := uint32(0); id < this.db_mgr.GetDbNum(); id++ {
+			head = append(head, this.packStrs([]string{fmt.Sprint(id), "FLUSHDB"}))
+			for _, cmd := range this.db_mgr.GetDb(id).Snapshot() {
+				head = append(head, this.packStrs(append([]string{fmt.Sprint(id)}, cmd...)))
+			}
+		}
+		head = append(head, this.packStrs([]string{"ENDSYNC"}))
+		this.addReplica(conn, off, head)
+	})
+}
+
+// lock should be held, the replica gets head and then the stream from offset
+func (this *Replication) addReplica(conn ziface.IConnection, offset int64, head [][]byte) {
+	if old, ok := this.replicas[conn.GetConnID()]; ok {
+		close(old.exit)
+	}
+	r := &replica{
+		conn:   conn,
+		offset: offset,
+		wake:   make(chan bool, 1),
+		exit:   make(chan bool),
+	}
+	// send the stream written before it is added
+	r.wake <- true
+	this.replicas[conn.GetConnID()] = r
+	go this.sendStream(r, head)
+}
+
+func (this *Replication) sendStream(r *replica, head [][]byte) {
+	for _, msg := range head {
+		if err := r.conn.SendMsgWait(REPL_MSG_ID, msg); err != nil {
+			this.dropReplica(r, err)
+			return
+		}
+	}
+	for {
+		select {
+		case <-r.exit:
+			return
+		case <-r.wake:
+		}
+		data, err := this.backlog.ReadFrom(r.offset)
+		if err != nil {
+			// the stream it needs is overwritten, it does a full resync when it reconnects
+			this.dropReplica(r, err)
+			return
+		}
+		for _, cmd := range this.cmd_packer.UnpackCmds(data) {
+			if err = r.conn.SendMsgWait(REPL_MSG_ID, this.cmd_packer.PackCmd(cmd)); err != nil {
+				this.dropReplica(r, err)
+				return
+			}
+		}
+		r.offset += int64(len(data))
+	}
+}
+
+// the sync with the replica fails, it reconnects later
+func (this *Replication) dropReplica(r *replica, err error) {
+	fmt.Printf("[REPLICATION]: drop replica %s, %s\n", r.conn.RemoteAddr(), err.Error())
+	r.conn.Stop()
+}
+
+func (this *Replication) RemoveReplica(conn ziface.IConnection) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if r, ok := this.replicas[conn.GetConnID()]; ok {
+		close(r.exit)
+		delete(this.replicas, conn.GetConnID())
+	}
+}
+
+// start to replicate from the master at addr, an empty addr turns this server back into a master
+func (this *Replication) ReplicaOf(addr string) {
+	this.slave_lock.Lock()
+	defer this.slave_lock.Unlock()
+
+	this.stopSync()
+	this.master_addr = addr
+	if addr == "" {
+		// the data may be different from the old master now, replicas of us must do a full resync
+		this.lock.Lock()
+		this.replid = newRandomId()
+		this.lock.Unlock()
+		return
+	}
+
+	this.exit_chan = make(chan bool)
+	go this.syncWithMaster(addr, this.exit_chan)
+}
+
+func (this *Replication) GetRole() (role string, master_addr string, master_offset int64) {
+	this.slave_lock.Lock()
+	defer this.slave_lock.Unlock()
+
+	if this.master_addr == "" {
+		return "master", "", this.backlog.GetOffset()
+	}
+	return "slave", this.master_addr, this.master_offset
+}
+
+func (this *Replication) Stop() {
+	this.slave_lock.Lock()
+	defer this.slave_lock.Unlock()
+
+	this.stopSync()
+	this.master_addr = ""
+}
+
+// slave_lock should be held
+func (this *Replication) stopSync() {
+	if this.exit_chan == nil {
+		return
+	}
+	close(this.exit_chan)
+	this.exit_chan = nil
+	if this.master_conn != nil {
+		this.master_conn.Close()
+		this.master_conn = nil
+	}
+}
+
+// keep connecting to the master until stopped, each reconnection tries a partial resync first
+func (this *Replication) syncWithMaster(addr string, exit_chan chan bool) {
+	for {
+		conn, err := znet.DialPeer(addr, 5*time.Second)
+		if err != nil {
+			fmt.Printf("[REPLICATION]: fail to connect master %s, %s\n", addr, err.Error())
+		} else {
+			this.slave_lock.Lock()
+			select {
+			case <-exit_chan:
+				this.slave_lock.Unlock()
+				conn.Close()
+				return
+			default:
+				this.master_conn = conn
+			}
+			this.slave_lock.Unlock()
+
+			if err = this.replicate(conn); err != nil {
+				fmt.Printf("[REPLICATION]: link with master %s is broken, %s\n", addr, err.Error())
+			}
+			conn.Close()
+		}
+
+		select {
+		case <-exit_chan:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (this *Replication) replicate(conn net.Conn) error {
+	data_pack := znet.NewDataPack()
+
+	if user, pass := utils.GetMasterAuth(); pass != "" {
+		if err := this.auth(conn, user, pass); err != nil {
+			return err
+		}
+	}
+
+	this.slave_lock.Lock()
+	psync := []string{"PSYNC", this.master_replid, fmt.Sprint(this.master_offset)}
+	this.slave_lock.Unlock()
+	buf, err := data_pack.Pack(znet.NewMessage(REPL_MSG_ID, this.packStrs(psync)))
+	if err != nil {
+		return err
+	}
+	if _, err = conn.Write(buf); err != nil {
+		return err
+	}
+
+	syncing := false
+	for {
+		msg, err := data_pack.ReadMsg(conn)
+		if err != nil {
+			return err
+		}
+		cmd := this.cmd_packer.UnpackCmd(msg.GetMsgData())
+		if len(cmd) == 0 {
+			continue
+		}
+
+		switch string(cmd[0]) {
+		case "FULLRESYNC":
+			if len(cmd) != 3 {
+				return fmt.Errorf("invalid FULLRESYNC reply")
+			}
+			offset, err := strconv.ParseInt(string(cmd[2]), 10, 64)
+			if err != nil {
+				return err
+			}
+			this.slave_lock.Lock()
+			this.master_replid = string(cmd[1])
+			this.master_offset = offset
+			this.slave_lock.Unlock()
+			syncing = true
+		case "CONTINUE":
+			syncing = false
+		case "ENDSYNC":
+			syncing = false
+		default:
+			this.apply(cmd)
+			// cmds in the snapshot are not part of the stream
+			if !syncing {
+				this.slave_lock.Lock()
+				this.master_offset += int64(len(msg.GetMsgData()))
+				this.slave_lock.Unlock()
+			}
+		}
+	}
+}
+
+// AUTH as MasterUser with MasterAuth before PSYNC
+func (this *Replication) auth(conn net.Conn, user string, pass string) error {
+	data_pack := znet.NewDataPack()
+	auth := []string{"AUTH", user, pass}
+	buf, err := data_pack.Pack(znet.NewMessage(ACL_MSG_ID, this.packStrs(auth)))
+	if err != nil {
+		return err
+	}
+	if _, err = conn.Write(buf); err != nil {
+		return err
+	}
+
+	msg, err := data_pack.ReadMsg(conn)
+	if err != nil {
+		return err
+	}
+	if res := this.cmd_packer.UnpackCmd(msg.GetMsgData()); len(res) != 1 || string(res[0]) != "OK" {
+		return fmt.Errorf("fail to auth with master")
+	}
+	return nil
+}
+
+// apply [db, cmd, args...] from the master
+func (this *Replication) apply(cmd [][]byte) {
+	id, err := strconv.Atoi(string(cmd[0]))
+	if err != nil || id < 0 || id >= int(this.db_mgr.GetDbNum()) || len(cmd) < 2 {
+		fmt.Printf("[REPLICATION]: invalid cmd from master\n")
+		return
+	}
+	this.db_mgr.GetDb(uint32(id)).Exec(cmd[1:])
+}
+
+func (this *Replication) packStrs(strs []string) []byte {
+	bcmd := make([][]byte, 0, len(strs))
+	for _, str := range strs {
+		bcmd = append(bcmd, []byte(str))
+	}
+	return this.cmd_packer.PackCmd(bcmd)
+}
@@ -0,0 +1,196 @@
+package server_test
+
+import (
+	"fmt"
+	"gedis/src/Server/server"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// start a master with the db and repl routers, its dbs are in dir/master
+func startReplMaster(t *testing.T, dir string) (addr string, db_mgr *server.DbManager) {
+	os.Mkdir(filepath.Join(dir, "master"), 0755)
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	old_port, old_acl := utils.Global_obj.Port, utils.Global_obj.AclFile
+	utils.Global_obj.Port = uint32(port)
+	utils.Global_obj.AclFile = filepath.Join(dir, "users.acl")
+
+	acl := server.NewAcl()
+	db_mgr = server.NewDbManagerIn(filepath.Join(dir, "master"))
+	repl := server.NewReplication(db_mgr)
+	db_mgr.SetOnWrite(repl.Feed)
+	db_mgr.Start()
+
+	s := znet.NewServer()
+	s.AddRounter(0, server.NewDbRouter(acl, server.NewCluster(db_mgr)))
+	s.AddRounter(server.REPL_MSG_ID, server.NewReplRouter(acl, repl))
+	s.SetOnConnStart(func(conn ziface.IConnection) {
+		conn.SetProperty("db", db_mgr.GetDb(0))
+		acl.OnConnStart(conn)
+	})
+	s.SetOnConnStop(func(conn ziface.IConnection) {
+		repl.RemoveReplica(conn)
+	})
+	go s.Start()
+	t.Cleanup(func() {
+		s.Stop()
+		db_mgr.Stop()
+		utils.Global_obj.Port, utils.Global_obj.AclFile = old_port, old_acl
+	})
+
+	addr = fmt.Sprintf("127.0.0.1:%d", port)
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return
+}
+
+func execStrs(db_mgr *server.DbManager, cmdline ...string) []string {
+	bcmd := make([][]byte, 0, len(cmdline))
+	for _, arg := range cmdline {
+		bcmd = append(bcmd, []byte(arg))
+	}
+	res := make([]string, 0)
+	for _, r := range db_mgr.GetDb(0).Exec(bcmd) {
+		res = append(res, string(r))
+	}
+	return res
+}
+
+// wait until the replica has the same LRANGE l and GET big as the master
+func waitReplSynced(master *server.DbManager, replica *server.DbManager) bool {
+	for i := 0; i < 250; i++ {
+		if reflect.DeepEqual(execStrs(master, "LRANGE", "l", "0", "-1"), execStrs(replica, "LRANGE", "l", "0", "-1")) &&
+			reflect.DeepEqual(execStrs(master, "GET", "big"), execStrs(replica, "GET", "big")) {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+// PSYNC over a real connection: a full resync while the master is written, then a partial resync
+func TestReplication1(t *testing.T) {
+	dir := t.TempDir()
+	addr, master := startReplMaster(t, dir)
+	os.Mkdir(filepath.Join(dir, "replica"), 0755)
+	replica := server.NewDbManagerIn(filepath.Join(dir, "replica"))
+	replica.Start()
+	defer replica.Stop()
+	repl := server.NewReplication(replica)
+	defer repl.Stop()
+
+	// values longer than a msg are sent in the snapshot and in the stream
+	execStrs(master, "SET", "big", strings.Repeat("a", 3*int(utils.Global_obj.MaxDataLen)))
+	execStrs(master, "LPUSH", "l", "init")
+
+	// the LPUSHs running during the full resync are in the snapshot or in the stream, never in both
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 500; i++ {
+			execStrs(master, "LPUSH", "l", fmt.Sprint(i))
+		}
+		close(done)
+	}()
+	repl.ReplicaOf(addr)
+	<-done
+	execStrs(master, "SET", "big", strings.Repeat("b", 3*int(utils.Global_obj.MaxDataLen)))
+	if !waitReplSynced(master, replica) {
+		t.Fatal("TestReplication1 failed")
+	}
+	if res := execStrs(replica, "LLEN", "l"); res[0] != "(integer) 501" {
+		t.Error("TestReplication1 failed", res)
+	}
+
+	// reconnects with its replid and offset, the master continues the stream without a FLUSHDB
+	repl.Stop()
+	execStrs(replica, "SET", "local", "x")
+	execStrs(master, "LPUSH", "l", "after")
+	repl.ReplicaOf(addr)
+	if !waitReplSynced(master, replica) {
+		t.Fatal("TestReplication1 failed")
+	}
+	if res := execStrs(replica, "GET", "local"); res[0] != "x" {
+		t.Error("TestReplication1 failed", res)
+	}
+	if role, _, offset := repl.GetRole(); role != "slave" || offset <= 0 {
+		t.Error("TestReplication1 failed")
+	}
+}
+
+// the libraries are sent in the full resync and the FUNCTION cmds in the stream
+func TestReplication2(t *testing.T) {
+	dir := t.TempDir()
+	addr, master := startReplMaster(t, dir)
+	execStrs(master, "FUNCTION", "FLUSH")
+	defer execStrs(master, "FUNCTION", "FLUSH")
+	lib := "#!lua name=repllib\nredis.register_function('f', function() return 1 end)"
+	execStrs(master, "FUNCTION", "LOAD", lib)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("TestReplication2 failed")
+	}
+	defer conn.Close()
+	data_pack, cmd_packer := znet.NewDataPack(), server.NewCmdPack()
+	psync := cmd_packer.PackCmd([][]byte{[]byte("PSYNC"), []byte("?"), []byte("-1")})
+	buf, _ := data_pack.Pack(znet.NewMessage(server.REPL_MSG_ID, psync))
+	conn.Write(buf)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	next := func() []string {
+		msg, err := data_pack.ReadMsg(conn)
+		if err != nil {
+			t.Fatal("TestReplication2 failed", err)
+		}
+		cmd := make([]string, 0)
+		for _, arg := range cmd_packer.UnpackCmd(msg.GetMsgData()) {
+			cmd = append(cmd, string(arg))
+		}
+		return cmd
+	}
+
+	if cmd := next(); cmd[0] != "FULLRESYNC" {
+		t.Fatal("TestReplication2 failed", cmd)
+	}
+	payload := execStrs(master, "FUNCTION", "DUMP")[0]
+	if cmd := next(); !reflect.DeepEqual(cmd, []string{"0", "FUNCTION", "RESTORE", payload, "FLUSH"}) {
+		t.Error("TestReplication2 failed", cmd)
+	}
+	for cmd := next(); cmd[0] != "ENDSYNC"; cmd = next() {
+	}
+
+	execStrs(master, "FUNCTION", "DELETE", "repllib")
+	execStrs(master, "FUNCTION", "LOAD", lib)
+	if cmd := next(); !reflect.DeepEqual(cmd, []string{"0", "FUNCTION", "DELETE", "repllib"}) {
+		t.Error("TestReplication2 failed", cmd)
+	}
+	if cmd := next(); !reflect.DeepEqual(cmd, []string{"0", "FUNCTION", "LOAD", "REPLACE", lib}) {
+		t.Error("TestReplication2 failed", cmd)
+	}
+}
+
+// an empty cmd frame gets an error instead of panicking the worker
+func TestReplication3(t *testing.T) {
+	acl := newTestAcl(t, "")
+	router := server.NewReplRouter(acl, server.NewReplication(server.NewDbManager()))
+	conn := newMsgConn(1)
+	acl.OnConnStart(conn)
+	router.Handle(newEmptyRequest(conn))
+	if res := conn.next(); !reflect.DeepEqual(res, []string{"(error) ERR empty command"}) {
+		t.Error("TestReplication3 failed", res)
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// replies are flat lists of strings, nested replies are formatted like redis-cli,
+// e.g. an entry of XRANGE is the lines `1) 1) 1-0`, `   2) 1) field` and `      2) value`.
+// items are string, nil or []interface{} for a nested array
+func formatNested(items []interface{}) []string {
+	return nestedLines(items)
+}
+
+func nestedLines(item interface{}) []string {
+	switch item := item.(type) {
+	case nil:
+		return []string{"(nil)"}
+	case string:
+		return []string{item}
+	case []string:
+		items := make([]interface{}, 0, len(item))
+		for _, v := range item {
+			items = append(items, v)
+		}
+		return nestedLines(items)
+	case []interface{}:
+		if len(item) == 0 {
+			return []string{"(empty array)"}
+		}
+		width := len(strconv.Itoa(len(item)))
+		lines := make([]string, 0, len(item))
+		for i, v := range item {
+			prefix := fmt.Sprintf("%*d) ", width, i+1)
+			pad := strings.Repeat(" ", len(prefix))
+			for j, line := range nestedLines(v) {
+				if j == 0 {
+					lines = append(lines, prefix+line)
+				} else {
+					lines = append(lines, pad+line)
+				}
+			}
+		}
+		return lines
+	default:
+		return []string{fmt.Sprint(item)}
+	}
+}
+
+// reverse of formatNested, items are strings or nested []interface{}.
+// Each item is prefixed by "i) " and its following lines are padded
+func ParseNested(lines []string) []interface{} {
+	items := make([]interface{}, 0)
+	if len(lines) == 0 || lines[0] == "(empty array)" {
+		return items
+	}
+	item := make([]string, 0)
+	flush := func() {
+		if len(item) == 1 && !isNestedItem(item[0]) {
+			items = append(items, item[0])
+		} else if len(item) > 0 {
+			items = append(items, ParseNested(item))
+		}
+		item = make([]string, 0)
+	}
+
+	pad := strings.Repeat(" ", strings.Index(lines[0], ") ")+2)
+	for _, line := range lines {
+		if strings.HasPrefix(line, pad) {
+			item = append(item, line[len(pad):])
+			continue
+		}
+		flush()
+		item = append(item, line[strings.Index(line, ") ")+2:])
+	}
+	flush()
+	return items
+}
+
+func isNestedItem(line string) bool {
+	return strings.HasPrefix(strings.TrimLeft(line, " "), "1) ") || line == "(empty array)"
+}
+
+func integerReply(n interface{}) string {
+	return fmt.Sprintf("(integer) %d", n)
+}
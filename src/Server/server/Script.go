@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"gedis/src/zinx/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// lua scripts are cached by their sha1 and shared by all dbs, like redis
+type ScriptCache struct {
+	lock    sync.RWMutex
+	scripts map[string]*lua.FunctionProto
+	// scripts and functions running in the dbs, SCRIPT KILL stops the ones which haven't written
+	running map[*runningScript]bool
+}
+
+var scripts = NewScriptCache()
+
+func NewScriptCache() *ScriptCache {
+	return &ScriptCache{
+		scripts: make(map[string]*lua.FunctionProto),
+		running: make(map[*runningScript]bool),
+	}
+}
+
+const (
+	SCRIPT_RUNNING = iota
+	SCRIPT_WRITTEN // it can't be killed, the cmds it has run would be left half done
+	SCRIPT_KILLED  // by SCRIPT KILL
+	SCRIPT_TIMEDOUT
+	SCRIPT_ABORTED // by SHUTDOWN NOSAVE, even if it has written
+)
+
+// the reply of the cmds while a script which has written runs over LuaTimeLimit
+const SCRIPT_BUSY_ERR = "(error) BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."
+
+type runningScript struct {
+	state  int32 // accessed atomically
+	busy   int32 // over LuaTimeLimit after it has written, accessed atomically
+	cancel context.CancelFunc
+	timer  *time.Timer
+}
+
+// the script run by L is stopped by SCRIPT KILL or after LuaTimeLimit unless it has written,
+// Finish it after it returns
+func (this *ScriptCache) Start(L *lua.LState) *runningScript {
+	ctx, cancel := context.WithCancel(context.Background())
+	L.SetContext(ctx)
+	run := &runningScript{state: SCRIPT_RUNNING, cancel: cancel}
+	if limit := utils.GetLuaTimeLimit(); limit > 0 {
+		run.timer = time.AfterFunc(time.Duration(limit)*time.Millisecond, run.timeout)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.running[run] = true
+	return run
+}
+
+func (this *ScriptCache) Finish(run *runningScript) {
+	if run.timer != nil {
+		run.timer.Stop()
+	}
+	run.cancel()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.running, run)
+}
+
+// a script which has written goes on, so the writes are all done, the other cmds are denied meanwhile
+func (this *runningScript) timeout() {
+	if atomic.CompareAndSwapInt32(&this.state, SCRIPT_RUNNING, SCRIPT_TIMEDOUT) {
+		this.cancel()
+	} else if atomic.LoadInt32(&this.state) == SCRIPT_WRITTEN {
+		atomic.StoreInt32(&this.busy, 1)
+	}
+}
+
+// false if the script is stopped, it must not write then
+func (this *runningScript) write() bool {
+	return atomic.CompareAndSwapInt32(&this.state, SCRIPT_RUNNING, SCRIPT_WRITTEN) ||
+		atomic.LoadInt32(&this.state) == SCRIPT_WRITTEN
+}
+
+func (this *runningScript) getState() int32 {
+	return atomic.LoadInt32(&this.state)
+}
+
+// whether a script which has written runs over LuaTimeLimit
+func (this *ScriptCache) Busy() bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	for run := range this.running {
+		if atomic.LoadInt32(&run.busy) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// stop all the scripts for SHUTDOWN NOSAVE, the writes of the ones which have written aren't persisted
+func (this *ScriptCache) Abort() {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	for run := range this.running {
+		atomic.StoreInt32(&run.state, SCRIPT_ABORTED)
+		run.cancel()
+	}
+}
+
+// SCRIPT KILL, the scripts which have written go on
+func (this *ScriptCache) Kill() string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if len(this.running) == 0 {
+		return "(error) NOTBUSY No scripts in execution right now."
+	}
+	unkillable := false
+	for run := range this.running {
+		if atomic.CompareAndSwapInt32(&run.state, SCRIPT_RUNNING, SCRIPT_KILLED) {
+			run.cancel()
+		} else if atomic.LoadInt32(&run.state) == SCRIPT_WRITTEN {
+			unkillable = true
+		}
+	}
+	if unkillable {
+		return "(error) UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+			"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command."
+	}
+	return "OK"
+}
+
+func ScriptSha(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// compile and cache the script, returns its sha1
+func (this *ScriptCache) Load(body string) (sha string, proto *lua.FunctionProto, err error) {
+	sha = ScriptSha(body)
+	if proto = this.Get(sha); proto != nil {
+		return
+	}
+	chunk, err := parse.Parse(strings.NewReader(body), "user_script")
+	if err != nil {
+		return "", nil, fmt.Errorf("(error) ERR Error compiling script (new function): %s", strings.TrimSpace(err.Error()))
+	}
+	if proto, err = lua.Compile(chunk, "user_script"); err != nil {
+		return "", nil, fmt.Errorf("(error) ERR Error compiling script (new function): %s", err.Error())
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.scripts[sha] = proto
+	return
+}
+
+// nil if the script isn't cached
+func (this *ScriptCache) Get(sha string) *lua.FunctionProto {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.scripts[strings.ToLower(sha)]
+}
+
+func (this *ScriptCache) Flush() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.scripts = make(map[string]*lua.FunctionProto)
+}
+
+// cmds replying flat arrays, a single element of them can't be told from a single value by the reply itself
+var array_reply_cmds = map[string]bool{
+	"KEYS": true, "LRANGE": true, "ZRANGE": true, "ZRANGEBYSCORE": true,
+	"GEOSEARCH": true, "BITFIELD": true, "BITFIELD_RO": true,
+}
+
+// the reply of a cmd as a lua value, errors are tables of {err = msg} as redis does
+func replyToLua(L *lua.LState, cmd string, res []string) lua.LValue {
+	if len(res) == 1 && strings.HasPrefix(res[0], "(error) ") {
+		return valueToLua(L, res[0])
+	}
+	if len(res) > 0 && strings.HasPrefix(res[0], "1) ") {
+		return nestedToLua(L, res)
+	}
+	if len(res) == 1 && !array_reply_cmds[cmd] {
+		return valueToLua(L, res[0])
+	}
+
+	tbl := L.NewTable()
+	for _, r := range res {
+		if r == "(empty array)" {
+			continue
+		}
+		tbl.Append(valueToLua(L, r))
+	}
+	return tbl
+}
+
+func valueToLua(L *lua.LState, val string) lua.LValue {
+	switch {
+	case val == "(nil)":
+		return lua.LFalse
+	case val == "(empty array)":
+		return L.NewTable()
+	case strings.HasPrefix(val, "(integer) "):
+		n, _ := strconv.ParseInt(strings.TrimPrefix(val, "(integer) "), 10, 64)
+		return lua.LNumber(n)
+	case strings.HasPrefix(val, "(float) "):
+		return lua.LString(strings.TrimPrefix(val, "(float) "))
+	case strings.HasPrefix(val, "(error) "):
+		tbl := L.NewTable()
+		tbl.RawSetString("err", lua.LString(strings.TrimPrefix(val, "(error) ")))
+		return tbl
+	}
+	return lua.LString(val)
+}
+
+func nestedToLua(L *lua.LState, lines []string) lua.LValue {
+	return itemsToLua(L, ParseNested(lines))
+}
+
+func itemsToLua(L *lua.LState, items []interface{}) lua.LValue {
+	tbl := L.NewTable()
+	for _, item := range items {
+		if item, ok := item.([]interface{}); ok {
+			tbl.Append(itemsToLua(L, item))
+			continue
+		}
+		tbl.Append(valueToLua(L, item.(string)))
+	}
+	return tbl
+}
+
+// the value returned by a script as a reply item, nil, string or []interface{}
+func luaToReply(val lua.LValue) interface{} {
+	switch val := val.(type) {
+	case lua.LString:
+		return string(val)
+	case lua.LNumber:
+		// numbers are integers in the reply, the fraction is dropped like redis
+		return integerReply(int64(val))
+	case lua.LBool:
+		if val {
+			return integerReply(1)
+		}
+		return nil
+	case *lua.LTable:
+		if err, ok := val.RawGetString("err").(lua.LString); ok {
+			return "(error) " + string(err)
+		}
+		if ok, ok_ := val.RawGetString("ok").(lua.LString); ok_ {
+			return string(ok)
+		}
+		// the array stops at the first nil
+		items := make([]interface{}, 0)
+		for i := 1; ; i++ {
+			item := val.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			items = append(items, luaToReply(item))
+		}
+		return items
+	}
+	return nil
+}
+
+// a flat array of values is replied like ZRANGE, nested ones are formatted
+func scriptReply(val lua.LValue) []string {
+	items, ok := luaToReply(val).([]interface{})
+	if !ok {
+		return nestedLines(luaToReply(val))
+	}
+	flat := make([]string, 0, len(items))
+	for _, item := range items {
+		str, ok := item.(string)
+		if !ok {
+			return formatNested(items)
+		}
+		flat = append(flat, str)
+	}
+	if len(flat) == 0 {
+		return []string{"(empty array)"}
+	}
+	return flat
+}
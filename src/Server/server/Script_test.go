@@ -0,0 +1,341 @@
+package server_test
+
+import (
+	"gedis/src/Server/server"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/znet"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func eval(engine *server.Engine, script string, numkeys string, args ...string) []string {
+	return engine.Handle(append([]string{"EVAL", script, numkeys}, args...))
+}
+
+// lua values are converted to replies
+func TestScript1(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	cases := []struct {
+		script   string
+		expected []string
+	}{
+		{"return 1", []string{"(integer) 1"}},
+		{"return 3.7", []string{"(integer) 3"}},
+		{"return 'a b'", []string{"a b"}},
+		{"return true", []string{"(integer) 1"}},
+		{"return false", []string{"(nil)"}},
+		{"return nil", []string{"(nil)"}},
+		{"return {}", []string{"(empty array)"}},
+		{"return {1, 'x', nil, 'y'}", []string{"(integer) 1", "x"}},
+		{"return {1, {'x', {}}}", []string{"1) (integer) 1", "2) 1) x", "   2) (empty array)"}},
+		{"return redis.status_reply('PONG')", []string{"PONG"}},
+		{"return redis.error_reply('MY error')", []string{"(error) MY error"}},
+		{"return redis.sha1hex('')", []string{"da39a3ee5e6b4b0d3255bfef95601890afd80709"}},
+		{"return {KEYS[1], KEYS[2], ARGV[1]}", []string{"k1", "k2", "a1"}},
+	}
+	for _, c := range cases {
+		if res := eval(engine, c.script, "2", "k1", "k2", "a1"); !reflect.DeepEqual(res, c.expected) {
+			t.Error("TestScript1 failed")
+		}
+	}
+}
+
+// replies are converted to lua values by redis.call and redis.pcall
+func TestScript2(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	handle(engine, "SET str value")
+	handle(engine, "GEOADD geo 13.361389 38.115556 Palermo")
+	cases := []struct {
+		script   string
+		expected []string
+	}{
+		{"return redis.call('set', KEYS[1], ARGV[1])", []string{"OK"}},
+		{"return redis.call('GET', KEYS[1])", []string{"v"}},
+		{"return redis.call('GET', 'nokey') == false", []string{"(integer) 1"}},
+		{"return redis.call('RPUSH', 'list', 'a') + 10", []string{"(integer) 11"}},
+		{"return #redis.call('LRANGE', 'list', 0, -1)", []string{"(integer) 1"}},
+		{"return redis.call('GEOPOS', 'geo', 'Palermo', 'nomember')[1][1]", []string{"13.361389338970184"}},
+		{"return redis.call('GEOPOS', 'geo', 'Palermo', 'nomember')[2]", []string{"(nil)"}},
+		{"return type(redis.call('ZSCORE', 'geo', 'Palermo'))", []string{"string"}},
+		{"return redis.pcall('RPUSH', 'str', 'a')['err']", []string{"WRONGTYPE Operation against a key holding the wrong kind of value"}},
+		{"redis.call('RPUSH', 'str', 'a'); return 1", []string{"(error) WRONGTYPE Operation against a key holding the wrong kind of value"}},
+		{"return redis.call('NOCMD')", []string{"(error) ERR unknown command 'NOCMD'"}},
+		{"return redis.call('EVAL', 'return 1', 0)", []string{"(error) ERR This Redis command is not allowed from script"}},
+		{"return redis.call('XREAD', 'BLOCK', 0, 'STREAMS', 's', '$')", []string{"(error) ERR This Redis command is not allowed from script"}},
+		{"return redis.call('GET', {})", []string{"(error) ERR Lua redis lib command arguments must be strings or integers"}},
+	}
+	for _, c := range cases {
+		if res := eval(engine, c.script, "1", "k", "v"); !reflect.DeepEqual(res, c.expected) {
+			t.Error("TestScript2 failed")
+		}
+	}
+
+	// errors of the script itself
+	if res := eval(engine, "return +", "0"); !strings.HasPrefix(res[0], "(error) ERR Error compiling script") {
+		t.Error("TestScript2 failed")
+	}
+	if res := eval(engine, "return nil + 1", "0"); !strings.HasPrefix(res[0], "(error) ERR Error running script (call to f_") {
+		t.Error("TestScript2 failed")
+	}
+	if res := eval(engine, "error('boom')", "0"); !strings.Contains(res[0], "boom") {
+		t.Error("TestScript2 failed")
+	}
+	if res := eval(engine, "return dofile", "0"); res[0] != "(nil)" {
+		t.Error("TestScript2 failed")
+	}
+	if res := eval(engine, "return 1", "2", "k"); res[0] != "(error) ERR Number of keys can't be greater than number of args" {
+		t.Error("TestScript2 failed")
+	}
+	if res := eval(engine, "return 1", "-1"); res[0] != "(error) ERR Number of keys can't be negative" {
+		t.Error("TestScript2 failed")
+	}
+}
+
+// SCRIPT LOAD/EXISTS/FLUSH and EVALSHA
+func TestScript3(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	body := "return ARGV[1]"
+	sha := server.ScriptSha(body)
+	if res := engine.Handle([]string{"SCRIPT", "LOAD", body}); res[0] != sha {
+		t.Error("TestScript3 failed")
+	}
+	if res := handle(engine, "EVALSHA "+strings.ToUpper(sha)+" 0 hello"); res[0] != "hello" {
+		t.Error("TestScript3 failed")
+	}
+	if res := handle(engine, "SCRIPT EXISTS "+sha+" 0000"); !reflect.DeepEqual(res, []string{"1) (integer) 1", "2) (integer) 0"}) {
+		t.Error("TestScript3 failed")
+	}
+	// scripts are shared by all the engines
+	other := newStreamEngine()
+	defer other.Stop()
+	if res := handle(other, "EVALSHA "+sha+" 0 hi"); res[0] != "hi" {
+		t.Error("TestScript3 failed")
+	}
+	if res := handle(engine, "SCRIPT FLUSH"); res[0] != "OK" {
+		t.Error("TestScript3 failed")
+	}
+	if res := handle(engine, "EVALSHA "+sha+" 0"); res[0] != "(error) NOSCRIPT No matching script. Please use EVAL." {
+		t.Error("TestScript3 failed")
+	}
+	// EVAL caches the script too
+	eval(engine, body, "0", "x")
+	if res := handle(engine, "EVALSHA "+sha+" 0 hello"); res[0] != "hello" {
+		t.Error("TestScript3 failed")
+	}
+	if res := handle(engine, "SCRIPT DEBUG YES"); !strings.HasPrefix(res[0], "(error) ERR unknown subcommand") {
+		t.Error("TestScript3 failed")
+	}
+	if _, props := engine.HandleProp([]string{"SCRIPT", "LOAD", body}); len(props) != 0 {
+		t.Error("TestScript3 failed")
+	}
+}
+
+// scripts are atomic, and propagated by their effects
+func TestScript4(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	// read-modify-write without races
+	incr := "local v = tonumber(redis.call('GET', KEYS[1]) or '0'); return redis.call('SET', KEYS[1], v + 1)"
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				eval(engine, incr, "1", "counter")
+				handle(engine, "GET counter")
+			}
+		}()
+	}
+	wg.Wait()
+	if res := handle(engine, "GET counter"); res[0] != "1000" {
+		t.Error("TestScript4 failed")
+	}
+
+	_, props := engine.HandleProp([]string{"EVAL", "redis.call('SET', KEYS[1], 'a'); redis.pcall('RPUSH', KEYS[1], 'b'); return redis.call('GET', KEYS[1])", "1", "k"})
+	if !reflect.DeepEqual(props, [][]string{{"SET", "k", "a"}, {"RPUSH", "k", "b"}, {"GET", "k"}}) {
+		t.Error("TestScript4 failed")
+	}
+
+	// a blocked XREAD doesn't stop the scripts
+	done := make(chan []string)
+	go func() {
+		done <- handle(engine, "XREAD BLOCK 0 STREAMS s $")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	eval(engine, "return redis.call('XADD', KEYS[1], '1-0', 'f', 'v')", "1", "s")
+	select {
+	case res := <-done:
+		if len(res) == 0 || res[0] != "1) 1) s" {
+			t.Error("TestScript4 failed")
+		}
+	case <-time.After(time.Second):
+		t.Error("TestScript4 failed")
+	}
+}
+
+// the effects of a script are recovered from the aof
+func TestScript5(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	db := server.NewDb("test_script")
+	db.Open()
+	db.Exec([][]byte{[]byte("EVAL"), []byte("redis.call('SET', KEYS[1], ARGV[1]); redis.call('RPUSH', 'l', 'x')"), []byte("1"), []byte("k"), []byte("v")})
+	db.Close()
+
+	db = server.NewDb("test_script")
+	db.Open()
+	defer db.Close()
+	if res := db.Exec([][]byte{[]byte("GET"), []byte("k")}); string(res[0]) != "v" {
+		t.Error("TestScript5 failed")
+	}
+	if res := db.Exec([][]byte{[]byte("LLEN"), []byte("l")}); string(res[0]) != "(integer) 1" {
+		t.Error("TestScript5 failed")
+	}
+	if res := server.GetCmdKeys([]string{"EVAL", "return 1", "2", "a", "b", "c"}); !reflect.DeepEqual(res, []string{"a", "b"}) {
+		t.Error("TestScript5 failed")
+	}
+}
+
+// SCRIPT KILL and LuaTimeLimit stop a script which hasn't written,
+// a script which has written makes the other cmds BUSY after LuaTimeLimit until SHUTDOWN NOSAVE
+func TestScript6(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+	old_limit := utils.Global_obj.LuaTimeLimit
+	defer func() { utils.Global_obj.LuaTimeLimit = old_limit }()
+	utils.Global_obj.LuaTimeLimit = 300
+
+	if res := engine.Handle([]string{"SCRIPT", "KILL"}); res[0] != "(error) NOTBUSY No scripts in execution right now." {
+		t.Error("TestScript6 failed")
+	}
+
+	res := make(chan []string)
+	go func() { res <- eval(engine, "redis.call('GET', 'k') while true do end", "0") }()
+	time.Sleep(50 * time.Millisecond)
+	// not blocked by the lock held by the script
+	if kill := engine.Handle([]string{"SCRIPT", "KILL"}); kill[0] != "OK" {
+		t.Error("TestScript6 failed", kill)
+	}
+	select {
+	case r := <-res:
+		if r[0] != "(error) ERR Script killed by user with SCRIPT KILL..." {
+			t.Error("TestScript6 failed", r)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("TestScript6 failed, script isn't killed")
+	}
+
+	start := time.Now()
+	go func() { res <- eval(engine, "redis.call('GET', 'k') while true do end", "0") }()
+	if r := <-res; r[0] != "(error) ERR Script killed after running for more than lua-time-limit (300 ms)" || time.Since(start) < 300*time.Millisecond {
+		t.Error("TestScript6 failed", r)
+	}
+
+	props := make(chan []string, 16)
+	engine.SetOnProps(func(ps [][]string) {
+		for _, p := range ps {
+			props <- p
+		}
+	})
+	go func() { res <- eval(engine, "redis.call('SET', 'k', 'v') while true do end", "0") }()
+	time.Sleep(50 * time.Millisecond)
+	if kill := engine.Handle([]string{"SCRIPT", "KILL"}); !strings.HasPrefix(kill[0], "(error) UNKILLABLE") {
+		t.Error("TestScript6 failed", kill)
+	}
+	time.Sleep(350 * time.Millisecond)
+	// it isn't stopped by LuaTimeLimit, the other cmds are denied instead of waiting for it
+	busy := "(error) BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."
+	if r := engine.Handle([]string{"GET", "k"}); r[0] != busy {
+		t.Error("TestScript6 failed", r)
+	}
+	acl := newTestAcl(t, "")
+	router := server.NewServerRouter(acl, znet.NewServer(), server.NewDbManager())
+	conn := newMsgConn(1)
+	acl.OnConnStart(conn)
+	router.Handle(newFakeRequest(conn, "SHUTDOWN"))
+	if r := conn.next(); r[0] != busy {
+		t.Error("TestScript6 failed", r)
+	}
+	select {
+	case r := <-res:
+		t.Fatal("TestScript6 failed, script is stopped", r)
+	default:
+	}
+
+	router.Handle(newFakeRequest(conn, "SHUTDOWN NOSAVE"))
+	select {
+	case r := <-res:
+		if r[0] != "(error) ERR Script aborted by SHUTDOWN NOSAVE" {
+			t.Error("TestScript6 failed", r)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("TestScript6 failed, script isn't aborted")
+	}
+	// the writes of the aborted script aren't passed on
+	select {
+	case p := <-props:
+		t.Error("TestScript6 failed", p)
+	default:
+	}
+	if r := engine.Handle([]string{"GET", "k"}); r[0] == busy {
+		t.Error("TestScript6 failed", r)
+	}
+}
+
+// the cmds called by a script are checked by the acl of the caller
+func TestScript7(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	acl := newTestAcl(t, "")
+	if err := acl.SetUser("alice", []string{"on", "nopass", "~pub:*", "+@all"}); err != nil {
+		t.Fatal(err)
+	}
+	db_mgr := server.NewDbManager()
+	db_mgr.Start()
+	defer db_mgr.Stop()
+	router := server.NewDbRouter(acl, server.NewCluster(db_mgr))
+	c := newClientConn(1, znet.NewServer().GetConnectionManager())
+	c.SetProperty("db", db_mgr.GetDb(0))
+	acl.OnConnStart(c)
+	if err := acl.Auth(c, "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	db := func(cmd string) string {
+		router.Handle(newFakeRequest(c, cmd))
+		return c.next()[0]
+	}
+
+	if res := db("EVAL redis.call('SET','pub:1','x') 0"); res != "(nil)" {
+		t.Error("TestScript7 failed", res)
+	}
+	if res := db("EVAL redis.call('SET','secret','x') 0"); !strings.Contains(res, "NOPERM") {
+		t.Error("TestScript7 failed", res)
+	}
+	if res := db("EVAL return(redis.pcall('GET','secret')['err']) 0"); !strings.Contains(res, "NOPERM") {
+		t.Error("TestScript7 failed", res)
+	}
+	if res := db_mgr.GetDb(0).Exec([][]byte{[]byte("GET"), []byte("secret")}); string(res[0]) != "(nil)" {
+		t.Error("TestScript7 failed", string(res[0]))
+	}
+}
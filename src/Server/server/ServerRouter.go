@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"gedis/src/Server/siface"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"strings"
+	"time"
+)
+
+const SERVER_MSG_ID = 5
+
+// server-wide cmds, which manage the server itself rather than a db
+type ServerRouter struct {
+	znet.BaseRounter
+	acl        *Acl
+	server     ziface.IServer
+	db_mgr     *DbManager
+	cmd_packer siface.ICmdPack
+}
+
+func NewServerRouter(acl *Acl, server ziface.IServer, db_mgr *DbManager) *ServerRouter {
+	return &ServerRouter{
+		acl:        acl,
+		server:     server,
+		db_mgr:     db_mgr,
+		cmd_packer: NewCmdPack(),
+	}
+}
+
+func (this *ServerRouter) Handle(req ziface.IRequest) {
+	start := time.Now()
+	conn := req.GetConn()
+	buf := req.GetData()
+
+	cmd_arg := this.cmd_packer.UnpackCmd(buf)
+	args := make([]string, 0, len(cmd_arg))
+	for _, v := range cmd_arg {
+		args = append(args, string(v))
+	}
+
+	onCmd(conn, args)
+	if len(args) == 0 {
+		this.reply(conn, "", start, []string{"(error) ERR empty command"})
+		return
+	}
+	if err := this.acl.Check(conn, args); err != "" {
+		this.reply(conn, args[0], start, []string{err})
+		return
+	}
+
+	var res []string
+	switch args[0] {
+	case "SHUTDOWN":
+		res = this.shutdown(args[1:])
+		if res == nil {
+			// no reply, the connection is closed by the shutdown
+			metrics.ObserveCmd(args[0], time.Since(start), nil)
+			return
+		}
+	case "COMMAND":
+		res = this.command(args[1:])
+	case "INFO":
+		res = this.info(args[1:])
+	case "SLOWLOG":
+		res = slowlog.slowlogCmd(args[1:])
+	case "MONITOR":
+		if len(args) != 1 {
+			res = []string{"(error) ERR wrong number of arguments for 'monitor' command"}
+			break
+		}
+		// added once OK is replied, so OK comes before the lines
+		this.reply(conn, args[0], start, []string{"OK"})
+		monitor.Add(conn)
+		return
+	case "CONFIG":
+		res = config.configCmd(args[1:])
+	case "CLIENT":
+		var stop bool
+		if res, stop = this.client(conn, args[1:]); stop {
+			// killed by itself, stopped once it's replied
+			this.reply(conn, args[0], start, res)
+			conn.Stop()
+			return
+		}
+	default:
+		res = []string{"Unspported command"}
+	}
+	this.reply(conn, args[0], start, res)
+}
+
+func (this *ServerRouter) reply(conn ziface.IConnection, cmd string, start time.Time, res []string) {
+	resp := make([][]byte, 0, len(res))
+	for _, r := range res {
+		resp = append(resp, []byte(r))
+	}
+	if cmd != "" {
+		metrics.ObserveCmd(cmd, time.Since(start), resp)
+	}
+	conn.SendMsg(0, this.cmd_packer.PackCmd(resp))
+}
+
+// SHUTDOWN [SAVE|NOSAVE]
+// aof files are always flushed and fsynced when the dbs are closed, SAVE also rewrites them before shutdown
+// returns nil if the server is going to shutdown
+func (this *ServerRouter) shutdown(args []string) []string {
+	save, nosave := false, false
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && strings.ToUpper(args[0]) == "SAVE":
+		save = true
+	case len(args) == 1 && strings.ToUpper(args[0]) == "NOSAVE":
+		nosave = true
+	default:
+		return []string{"(error) ERR syntax error"}
+	}
+	// a script over lua-time-limit which has written is only stopped by NOSAVE, the dbs would wait it
+	if scripts.Busy() {
+		if !nosave {
+			return []string{SCRIPT_BUSY_ERR}
+		}
+		scripts.Abort()
+	}
+
+	if save {
+		if err := this.db_mgr.Save(); err != nil {
+			return []string{fmt.Sprintf("(error) ERR Errors trying to SHUTDOWN. %s", err.Error())}
+		}
+	}
+	this.server.Shutdown()
+	return nil
+}
+
+// COMMAND [COUNT | LIST | DOCS [command-name ...]]
+// the docs of a cmd are its group and the id of the msg to send it with, clients use them for routing and completion
+func (this *ServerRouter) command(args []string) []string {
+	sub, name := "DOCS", "DOCS"
+	if len(args) > 0 {
+		sub, name = strings.ToUpper(args[0]), args[0]
+		args = args[1:]
+	}
+	switch {
+	case sub == "COUNT" && len(args) == 0:
+		return []string{integerReply(len(cmd_specs))}
+	case sub == "LIST" && len(args) == 0:
+		names := GetCmdNames()
+		for i, name := range names {
+			names[i] = strings.ToLower(name)
+		}
+		return names
+	case sub == "DOCS":
+		names := GetCmdNames()
+		if len(args) > 0 {
+			names = make([]string, 0, len(args))
+			for _, arg := range args {
+				if IsCmdExist(strings.ToUpper(arg)) {
+					names = append(names, strings.ToUpper(arg))
+				}
+			}
+		}
+		items := make([]interface{}, 0, 2*len(names))
+		for _, name := range names {
+			items = append(items, strings.ToLower(name),
+				[]string{"group", getCmdGroup(name), "msg_id", integerReply(GetCmdMsgID(name))})
+		}
+		return formatNested(items)
+	case sub == "COUNT" || sub == "LIST":
+		return []string{fmt.Sprintf("(error) ERR wrong number of arguments for 'command|%s' command", strings.ToLower(sub))}
+	}
+	return []string{fmt.Sprintf("(error) ERR unknown subcommand '%s'. Try COMMAND HELP.", name)}
+}
@@ -0,0 +1,176 @@
+package server_test
+
+import (
+	"gedis/src/Server/server"
+	"gedis/src/zinx/ziface"
+	"gedis/src/zinx/znet"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// request of a cmd sent by conn
+type fakeRequest struct {
+	conn ziface.IConnection
+	data []byte
+}
+
+func newFakeRequest(conn ziface.IConnection, cmdline string) *fakeRequest {
+	cmd := make([][]byte, 0)
+	for _, arg := range strings.Split(cmdline, " ") {
+		cmd = append(cmd, []byte(arg))
+	}
+	return &fakeRequest{conn: conn, data: server.NewCmdPack().PackCmd(cmd)}
+}
+
+// request of an empty cmd frame
+func newEmptyRequest(conn ziface.IConnection) *fakeRequest {
+	return &fakeRequest{conn: conn, data: server.NewCmdPack().PackCmd(nil)}
+}
+
+func (this *fakeRequest) GetConn() ziface.IConnection { return this.conn }
+func (this *fakeRequest) GetDataLen() uint32          { return uint32(len(this.data)) }
+func (this *fakeRequest) GetMsgId() uint32            { return server.SERVER_MSG_ID }
+func (this *fakeRequest) GetData() []byte             { return this.data }
+func (this *fakeRequest) Done()                       {}
+func (this *fakeRequest) Park() (resume func())       { return func() {} }
+
+// an empty cmd frame gets an error instead of panicking the worker
+func TestServerEmptyCmd(t *testing.T) {
+	acl := newTestAcl(t, "")
+	router := server.NewServerRouter(acl, nil, nil)
+	conn := newMsgConn(1)
+	acl.OnConnStart(conn)
+	router.Handle(newEmptyRequest(conn))
+	if res := conn.next(); !reflect.DeepEqual(res, []string{"(error) ERR empty command"}) {
+		t.Error("TestServerEmptyCmd failed", res)
+	}
+}
+
+// COMMAND COUNT/LIST/DOCS
+func TestCommand1(t *testing.T) {
+	acl := newTestAcl(t, "")
+	router := server.NewServerRouter(acl, nil, nil)
+	conn := newMsgConn(1)
+	acl.OnConnStart(conn)
+	command := func(cmdline string) []string {
+		router.Handle(newFakeRequest(conn, cmdline))
+		return conn.next()
+	}
+
+	list := command("COMMAND LIST")
+	if res := command("COMMAND COUNT"); res[0] != "(integer) "+strconv.Itoa(len(list)) {
+		t.Error("TestCommand1 failed")
+	}
+	found := false
+	for _, name := range list {
+		found = found || name == "get"
+	}
+	if !found {
+		t.Error("TestCommand1 failed")
+	}
+
+	expected := []string{
+		"1) get",
+		"2) 1) group",
+		"   2) string",
+		"   3) msg_id",
+		"   4) (integer) 0",
+		"3) select",
+		"4) 1) group",
+		"   2) connection",
+		"   3) msg_id",
+		"   4) (integer) 1",
+	}
+	if res := command("COMMAND DOCS get SELECT nocmd"); !reflect.DeepEqual(res, expected) {
+		t.Error("TestCommand1 failed")
+	}
+	docs := server.ParseNested(command("COMMAND DOCS"))
+	if len(docs) != 2*len(list) {
+		t.Error("TestCommand1 failed")
+	}
+	for i := 0; i+1 < len(docs); i += 2 {
+		doc := docs[i+1].([]interface{})
+		if docs[i] == "publish" && doc[3] != "(integer) 6" {
+			t.Error("TestCommand1 failed")
+		}
+	}
+	if res := command("COMMAND COUNT x"); res[0] != "(error) ERR wrong number of arguments for 'command|count' command" {
+		t.Error("TestCommand1 failed")
+	}
+	if res := command("COMMAND foo"); res[0] != "(error) ERR unknown subcommand 'foo'. Try COMMAND HELP." {
+		t.Error("TestCommand1 failed")
+	}
+}
+
+// INFO [section ...]
+func TestInfo1(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	db_mgr := server.NewDbManager()
+	db_mgr.Start()
+	defer db_mgr.Stop()
+	exec := func(db uint32, cmdline string) {
+		bcmd := make([][]byte, 0)
+		for _, arg := range strings.Split(cmdline, " ") {
+			bcmd = append(bcmd, []byte(arg))
+		}
+		db_mgr.GetDb(db).Exec(bcmd)
+	}
+	exec(0, "SET a 1")
+	exec(0, "SET b 2")
+	exec(0, "EXPIRE b 100")
+	exec(0, "GET a")
+	exec(0, "GET nokey")
+	exec(3, "RPUSH l x")
+
+	acl := newTestAcl(t, "")
+	router := server.NewServerRouter(acl, znet.NewServer(), db_mgr)
+	conn := newMsgConn(1)
+	acl.OnConnStart(conn)
+	info := func(cmdline string) []string {
+		router.Handle(newFakeRequest(conn, cmdline))
+		return conn.next()
+	}
+
+	fields := make(map[string]string)
+	sections := make([]string, 0)
+	for _, line := range info("INFO") {
+		if strings.HasPrefix(line, "# ") {
+			sections = append(sections, line)
+		} else if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	if !reflect.DeepEqual(sections, []string{"# Server", "# Clients", "# Memory", "# Persistence", "# Stats", "# Keyspace"}) {
+		t.Error("TestInfo1 failed")
+	}
+	if fields["connected_clients"] != "0" || fields["aof_enabled"] != "1" || fields["uptime_in_seconds"] != "0" {
+		t.Error("TestInfo1 failed")
+	}
+	if fields["keyspace_hits"] != "1" || fields["keyspace_misses"] != "1" {
+		t.Error("TestInfo1 failed")
+	}
+	if fields["db0"] != "keys=2,expires=1" || fields["db3"] != "keys=1,expires=0" || fields["db1"] != "" {
+		t.Error("TestInfo1 failed")
+	}
+
+	exec(0, "PERSIST b")
+	exec(3, "DEL l")
+	if res := info("INFO keyspace"); !reflect.DeepEqual(res, []string{"# Keyspace", "db0:keys=2,expires=0"}) {
+		t.Error("TestInfo1 failed")
+	}
+	if res := info("INFO CLIENTS memory"); res[0] != "# Clients" || res[3] != "" || res[4] != "# Memory" {
+		t.Error("TestInfo1 failed")
+	}
+	if res := info("INFO nosection"); !reflect.DeepEqual(res, []string{""}) {
+		t.Error("TestInfo1 failed")
+	}
+}
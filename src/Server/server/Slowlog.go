@@ -0,0 +1,194 @@
+package server
+
+import (
+	"fmt"
+	"gedis/src/zinx/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the args of an entry are truncated like redis
+const (
+	SLOWLOG_MAX_ARGC = 32
+	SLOWLOG_MAX_LEN  = 128
+)
+
+// the cmds of the dbs slower than SlowlogLogSlowerThan, shared by the process
+var slowlog = NewSlowlog()
+
+type SlowlogEntry struct {
+	ID       int64
+	Time     int64 // unix time the cmd is executed
+	Duration time.Duration
+	Args     []string
+	Addr     string // address of the client
+	ConnID   uint32
+}
+
+// the latest entries in a ring buffer of SlowlogMaxLen, which grows as the entries are added
+type Slowlog struct {
+	lock    sync.Mutex
+	entries []SlowlogEntry
+	max_len int
+	next    int // index in entries of the next entry
+	size    int // entries in use
+	next_id int64
+}
+
+func NewSlowlog() *Slowlog {
+	return &Slowlog{entries: make([]SlowlogEntry, 0)}
+}
+
+// the slowlog shared by the process
+func GetSlowlog() *Slowlog {
+	return slowlog
+}
+
+// add an entry if d exceeds the threshold, the thresholds are read each time so they can be changed at runtime
+func (this *Slowlog) Observe(args []string, d time.Duration, addr string, conn_id uint32) {
+	slower_than, max_len := utils.GetSlowlogConfig()
+	if slower_than < 0 || d < time.Duration(slower_than)*time.Microsecond {
+		return
+	}
+	entry := SlowlogEntry{
+		Time:     time.Now().Unix(),
+		Duration: d,
+		Args:     truncateArgs(args),
+		Addr:     addr,
+		ConnID:   conn_id,
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.resize(int(max_len))
+	entry.ID = this.next_id
+	this.next_id++
+	if this.max_len == 0 {
+		return
+	}
+	if len(this.entries) < this.max_len {
+		this.entries = append(this.entries, entry)
+	} else {
+		this.entries[this.next] = entry
+	}
+	this.next = (this.next + 1) % this.max_len
+	if this.size < this.max_len {
+		this.size++
+	}
+}
+
+// keep the latest entries if the max len is changed, called with the lock
+func (this *Slowlog) resize(max_len int) {
+	if max_len == this.max_len {
+		return
+	}
+	latest := this.get(max_len)
+	// only the entries in use are allocated, a large max len doesn't take memory until it's reached
+	this.entries = make([]SlowlogEntry, len(latest))
+	// latest is from the newest to the oldest
+	for i := range latest {
+		this.entries[i] = latest[len(latest)-1-i]
+	}
+	this.max_len = max_len
+	this.size = len(latest)
+	this.next = 0
+	if max_len > 0 {
+		this.next = this.size % max_len
+	}
+}
+
+// at most n entries from the newest, all of them if n < 0
+func (this *Slowlog) Get(n int) []SlowlogEntry {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.get(n)
+}
+
+func (this *Slowlog) get(n int) []SlowlogEntry {
+	if n < 0 || n > this.size {
+		n = this.size
+	}
+	entries := make([]SlowlogEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		entries = append(entries, this.entries[(this.next-i+len(this.entries))%len(this.entries)])
+	}
+	return entries
+}
+
+func (this *Slowlog) Len() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.size
+}
+
+// the ids go on after reset
+func (this *Slowlog) Reset() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.entries = nil
+	this.size = 0
+	this.next = 0
+}
+
+// at most SLOWLOG_MAX_ARGC args, each of them at most SLOWLOG_MAX_LEN bytes
+func truncateArgs(args []string) []string {
+	argc := len(args)
+	if argc > SLOWLOG_MAX_ARGC {
+		argc = SLOWLOG_MAX_ARGC
+	}
+	truncated := make([]string, 0, argc)
+	for i := 0; i < argc; i++ {
+		// the last one tells how many args are left
+		if i == argc-1 && argc < len(args) {
+			truncated = append(truncated, fmt.Sprintf("... (%d more arguments)", len(args)-argc+1))
+			break
+		}
+		arg := args[i]
+		if len(arg) > SLOWLOG_MAX_LEN {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:SLOWLOG_MAX_LEN], len(arg)-SLOWLOG_MAX_LEN)
+		}
+		truncated = append(truncated, arg)
+	}
+	return truncated
+}
+
+// SLOWLOG GET [count] | LEN | RESET
+// an entry of GET is its id, unix time, duration in microseconds, args, client address and connection id
+func (this *Slowlog) slowlogCmd(args []string) []string {
+	if len(args) == 0 {
+		return []string{"(error) ERR wrong number of arguments for 'slowlog' command"}
+	}
+	sub := strings.ToUpper(args[0])
+	switch {
+	case sub == "GET" && len(args) <= 2:
+		count := 10
+		if len(args) == 2 {
+			var err error
+			if count, err = strconv.Atoi(args[1]); err != nil || count < -1 {
+				return []string{"(error) ERR count should be greater than or equal to -1"}
+			}
+		}
+		items := make([]interface{}, 0)
+		for _, entry := range this.Get(count) {
+			items = append(items, []interface{}{
+				integerReply(entry.ID),
+				integerReply(entry.Time),
+				integerReply(entry.Duration.Microseconds()),
+				entry.Args,
+				entry.Addr,
+				integerReply(entry.ConnID),
+			})
+		}
+		return formatNested(items)
+	case sub == "LEN" && len(args) == 1:
+		return []string{integerReply(this.Len())}
+	case sub == "RESET" && len(args) == 1:
+		this.Reset()
+		return []string{"OK"}
+	case sub == "GET" || sub == "LEN" || sub == "RESET":
+		return []string{fmt.Sprintf("(error) ERR wrong number of arguments for 'slowlog|%s' command", strings.ToLower(sub))}
+	}
+	return []string{fmt.Sprintf("(error) ERR unknown subcommand '%s'. Try SLOWLOG HELP.", args[0])}
+}
@@ -0,0 +1,149 @@
+package server_test
+
+import (
+	"fmt"
+	"gedis/src/Server/server"
+	"gedis/src/zinx/utils"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the latest entries are kept, from the newest
+func TestSlowlog1(t *testing.T) {
+	old_slower_than, old_max_len := utils.Global_obj.SlowlogLogSlowerThan, utils.Global_obj.SlowlogMaxLen
+	defer func() {
+		utils.Global_obj.SlowlogLogSlowerThan, utils.Global_obj.SlowlogMaxLen = old_slower_than, old_max_len
+	}()
+	utils.Global_obj.SlowlogLogSlowerThan = 1000
+	utils.Global_obj.SlowlogMaxLen = 3
+
+	slowlog := server.NewSlowlog()
+	slowlog.Observe([]string{"GET", "fast"}, 999*time.Microsecond, "127.0.0.1:1", 1)
+	for i := 0; i < 5; i++ {
+		slowlog.Observe([]string{"GET", fmt.Sprint(i)}, time.Duration(i+1)*time.Millisecond, "127.0.0.1:1", 1)
+	}
+	entries := slowlog.Get(-1)
+	if slowlog.Len() != 3 || len(entries) != 3 {
+		t.Fatal("TestSlowlog1 failed")
+	}
+	for i, entry := range entries {
+		if entry.ID != int64(4-i) || entry.Args[1] != fmt.Sprint(4-i) || entry.Duration != time.Duration(5-i)*time.Millisecond {
+			t.Error("TestSlowlog1 failed")
+		}
+	}
+	if entries := slowlog.Get(1); len(entries) != 1 || entries[0].ID != 4 {
+		t.Error("TestSlowlog1 failed")
+	}
+
+	// the latest entries are kept when the max len changes
+	utils.Global_obj.SlowlogMaxLen = 2
+	slowlog.Observe([]string{"GET", "5"}, time.Second, "127.0.0.1:1", 1)
+	if entries := slowlog.Get(-1); len(entries) != 2 || entries[0].ID != 5 || entries[1].ID != 4 {
+		t.Error("TestSlowlog1 failed")
+	}
+	utils.Global_obj.SlowlogMaxLen = 4
+	slowlog.Observe([]string{"GET", "6"}, time.Second, "127.0.0.1:1", 1)
+	if entries := slowlog.Get(-1); len(entries) != 3 || entries[0].ID != 6 || entries[2].ID != 4 {
+		t.Error("TestSlowlog1 failed")
+	}
+
+	slowlog.Reset()
+	if slowlog.Len() != 0 {
+		t.Error("TestSlowlog1 failed")
+	}
+	// disabled
+	utils.Global_obj.SlowlogLogSlowerThan = -1
+	slowlog.Observe([]string{"GET", "7"}, time.Second, "127.0.0.1:1", 1)
+	if slowlog.Len() != 0 {
+		t.Error("TestSlowlog1 failed")
+	}
+}
+
+// the args are truncated
+func TestSlowlog2(t *testing.T) {
+	old_slower_than := utils.Global_obj.SlowlogLogSlowerThan
+	defer func() { utils.Global_obj.SlowlogLogSlowerThan = old_slower_than }()
+	utils.Global_obj.SlowlogLogSlowerThan = 0
+
+	slowlog := server.NewSlowlog()
+	args := []string{"MSET", strings.Repeat("a", 130)}
+	for i := 0; i < 40; i++ {
+		args = append(args, "v")
+	}
+	slowlog.Observe(args, 0, "127.0.0.1:1", 1)
+	entry := slowlog.Get(-1)[0]
+	if len(entry.Args) != 32 || entry.Args[1] != strings.Repeat("a", 128)+"... (2 more bytes)" || entry.Args[31] != "... (11 more arguments)" {
+		t.Error("TestSlowlog2 failed")
+	}
+}
+
+// SLOWLOG GET/LEN/RESET
+func TestSlowlog3(t *testing.T) {
+	old_slower_than := utils.Global_obj.SlowlogLogSlowerThan
+	defer func() { utils.Global_obj.SlowlogLogSlowerThan = old_slower_than }()
+	utils.Global_obj.SlowlogLogSlowerThan = 0
+
+	acl := newTestAcl(t, "")
+	router := server.NewServerRouter(acl, nil, nil)
+	conn := newMsgConn(1)
+	acl.OnConnStart(conn)
+	slowlog := func(cmdline string) []string {
+		router.Handle(newFakeRequest(conn, cmdline))
+		return conn.next()
+	}
+
+	slowlog("SLOWLOG RESET")
+	server.GetSlowlog().Observe([]string{"SET", "k", "v"}, 1500*time.Microsecond, "127.0.0.1:1234", 7)
+	if res := slowlog("SLOWLOG LEN"); res[0] != "(integer) 1" {
+		t.Error("TestSlowlog3 failed")
+	}
+	entries := server.ParseNested(slowlog("SLOWLOG GET"))
+	if len(entries) != 1 {
+		t.Fatal("TestSlowlog3 failed")
+	}
+	entry := entries[0].([]interface{})
+	if len(entry) != 6 || entry[2] != "(integer) 1500" || !reflect.DeepEqual(entry[3], []interface{}{"SET", "k", "v"}) ||
+		entry[4] != "127.0.0.1:1234" || entry[5] != "(integer) 7" {
+		t.Error("TestSlowlog3 failed")
+	}
+	if res := slowlog("SLOWLOG GET 0"); res[0] != "(empty array)" {
+		t.Error("TestSlowlog3 failed")
+	}
+	if res := slowlog("SLOWLOG GET -2"); res[0] != "(error) ERR count should be greater than or equal to -1" {
+		t.Error("TestSlowlog3 failed")
+	}
+	if res := slowlog("SLOWLOG LEN x"); res[0] != "(error) ERR wrong number of arguments for 'slowlog|len' command" {
+		t.Error("TestSlowlog3 failed")
+	}
+	if res := slowlog("SLOWLOG foo"); res[0] != "(error) ERR unknown subcommand 'foo'. Try SLOWLOG HELP." {
+		t.Error("TestSlowlog3 failed")
+	}
+	if res := slowlog("SLOWLOG RESET"); res[0] != "OK" || slowlog("SLOWLOG LEN")[0] != "(integer) 0" {
+		t.Error("TestSlowlog3 failed")
+	}
+}
+
+// the entries are allocated as they are added, a large max len takes no memory
+func TestSlowlog4(t *testing.T) {
+	old_slower_than, old_max_len := utils.Global_obj.SlowlogLogSlowerThan, utils.Global_obj.SlowlogMaxLen
+	defer func() {
+		utils.Global_obj.SlowlogLogSlowerThan, utils.Global_obj.SlowlogMaxLen = old_slower_than, old_max_len
+	}()
+	utils.Global_obj.SlowlogLogSlowerThan = 0
+	utils.Global_obj.SlowlogMaxLen = 1 << 31
+
+	slowlog := server.NewSlowlog()
+	for i := 0; i < 3; i++ {
+		slowlog.Observe([]string{"GET", fmt.Sprint(i)}, time.Millisecond, "127.0.0.1:1", 1)
+	}
+	if entries := slowlog.Get(-1); len(entries) != 3 || entries[0].ID != 2 || entries[2].ID != 0 {
+		t.Error("TestSlowlog4 failed")
+	}
+	slowlog.Reset()
+	slowlog.Observe([]string{"GET", "3"}, time.Millisecond, "127.0.0.1:1", 1)
+	if entries := slowlog.Get(-1); len(entries) != 1 || entries[0].ID != 3 {
+		t.Error("TestSlowlog4 failed")
+	}
+}
@@ -0,0 +1,457 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"gedis/src/Server/siface"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	STREAM_ID_MIN = siface.StreamID{Ms: 0, Seq: 0}
+	STREAM_ID_MAX = siface.StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}
+)
+
+func streamIDLess(a, b siface.StreamID) bool {
+	return a.Ms < b.Ms || (a.Ms == b.Ms && a.Seq < b.Seq)
+}
+
+func streamIDString(id siface.StreamID) string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+// parse ms-seq or ms, seq is default_seq if omitted
+func parseStreamID(s string, default_seq uint64) (id siface.StreamID, err error) {
+	ms_str, seq_str, has_seq := strings.Cut(s, "-")
+	if id.Ms, err = strconv.ParseUint(ms_str, 10, 64); err != nil {
+		return id, errors.New("(error) ERR Invalid stream ID specified as stream command argument")
+	}
+	id.Seq = default_seq
+	if has_seq {
+		if id.Seq, err = strconv.ParseUint(seq_str, 10, 64); err != nil {
+			return id, errors.New("(error) ERR Invalid stream ID specified as stream command argument")
+		}
+	}
+	return id, nil
+}
+
+// parse the start or end of a range, - and + are the min and max, ( makes it exclusive
+func parseStreamRangeID(s string, is_start bool) (id siface.StreamID, err error) {
+	switch s {
+	case "-":
+		return STREAM_ID_MIN, nil
+	case "+":
+		return STREAM_ID_MAX, nil
+	}
+
+	exclusive := strings.HasPrefix(s, "(")
+	s = strings.TrimPrefix(s, "(")
+	var default_seq uint64 = 0
+	if !is_start {
+		default_seq = math.MaxUint64
+	}
+	if id, err = parseStreamID(s, default_seq); err != nil {
+		return
+	}
+	if exclusive {
+		if is_start {
+			if id == STREAM_ID_MAX {
+				return id, errors.New("(error) ERR invalid start ID for the interval")
+			}
+			id = streamIDIncr(id)
+		} else {
+			if id == STREAM_ID_MIN {
+				return id, errors.New("(error) ERR invalid end ID for the interval")
+			}
+			id = streamIDDecr(id)
+		}
+	}
+	return id, nil
+}
+
+func streamIDIncr(id siface.StreamID) siface.StreamID {
+	if id.Seq == math.MaxUint64 {
+		return siface.StreamID{Ms: id.Ms + 1, Seq: 0}
+	}
+	return siface.StreamID{Ms: id.Ms, Seq: id.Seq + 1}
+}
+
+func streamIDDecr(id siface.StreamID) siface.StreamID {
+	if id.Seq == 0 {
+		return siface.StreamID{Ms: id.Ms - 1, Seq: math.MaxUint64}
+	}
+	return siface.StreamID{Ms: id.Ms, Seq: id.Seq - 1}
+}
+
+type streamPending struct {
+	consumer       string
+	delivery_time  int64
+	delivery_count uint64
+}
+
+type streamConsumer struct {
+	name      string
+	seen_time int64
+	pending   map[siface.StreamID]bool
+}
+
+type StreamGroup struct {
+	name      string
+	stream    *Stream
+	last_id   siface.StreamID
+	pending   map[siface.StreamID]*streamPending
+	consumers map[string]*streamConsumer
+}
+
+// entries are kept in a slice sorted by id, appended at the end in most cases
+type Stream struct {
+	entries       []siface.StreamEntry
+	last_id       siface.StreamID
+	entries_added uint64
+	groups        map[string]*StreamGroup
+}
+
+func NewStream() *Stream {
+	return &Stream{
+		entries: make([]siface.StreamEntry, 0),
+		groups:  make(map[string]*StreamGroup),
+	}
+}
+
+// index of the first entry with id >= id
+func (this *Stream) search(id siface.StreamID) int {
+	return sort.Search(len(this.entries), func(i int) bool {
+		return !streamIDLess(this.entries[i].ID, id)
+	})
+}
+
+func (this *Stream) get(id siface.StreamID) (siface.StreamEntry, bool) {
+	idx := this.search(id)
+	if idx < len(this.entries) && this.entries[idx].ID == id {
+		return this.entries[idx], true
+	}
+	return siface.StreamEntry{}, false
+}
+
+func (this *Stream) Add(id_str string, fields []string) (id siface.StreamID, err error) {
+	switch {
+	case id_str == "*":
+		now := uint64(time.Now().UnixMilli())
+		if now > this.last_id.Ms {
+			id = siface.StreamID{Ms: now, Seq: 0}
+		} else {
+			// clock goes back or many entries in the same ms
+			if this.last_id == STREAM_ID_MAX {
+				return id, errors.New("(error) ERR The stream has exhausted the last possible ID, unable to add more items")
+			}
+			id = streamIDIncr(this.last_id)
+		}
+	case strings.HasSuffix(id_str, "-*"):
+		ms, err := strconv.ParseUint(strings.TrimSuffix(id_str, "-*"), 10, 64)
+		if err != nil {
+			return id, errors.New("(error) ERR Invalid stream ID specified as stream command argument")
+		}
+		id = siface.StreamID{Ms: ms, Seq: 0}
+		if ms == this.last_id.Ms {
+			if this.last_id.Seq == math.MaxUint64 {
+				return id, errors.New("(error) ERR The ID specified in XADD is equal or smaller than the target stream top item")
+			}
+			id.Seq = this.last_id.Seq + 1
+		}
+	default:
+		if id, err = parseStreamID(id_str, 0); err != nil {
+			return
+		}
+	}
+
+	if id == STREAM_ID_MIN {
+		return id, errors.New("(error) ERR The ID specified in XADD must be greater than 0-0")
+	}
+	if !streamIDLess(this.last_id, id) {
+		return id, errors.New("(error) ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+
+	this.entries = append(this.entries, siface.StreamEntry{ID: id, Fields: append([]string{}, fields...)})
+	this.last_id = id
+	this.entries_added++
+	return id, nil
+}
+
+func (this *Stream) Len() uint64 {
+	return uint64(len(this.entries))
+}
+
+func (this *Stream) LastID() siface.StreamID {
+	return this.last_id
+}
+
+func (this *Stream) SetLastID(id siface.StreamID) error {
+	if len(this.entries) > 0 && streamIDLess(id, this.entries[len(this.entries)-1].ID) {
+		return errors.New("(error) ERR The ID specified in XSETID is smaller than the target stream top item")
+	}
+	this.last_id = id
+	return nil
+}
+
+func (this *Stream) EntriesAdded() uint64 {
+	return this.entries_added
+}
+
+func (this *Stream) SetEntriesAdded(n uint64) {
+	this.entries_added = n
+}
+
+func (this *Stream) Range(start, end siface.StreamID, count int, rev bool) []siface.StreamEntry {
+	res := make([]siface.StreamEntry, 0)
+	if streamIDLess(end, start) {
+		return res
+	}
+	from := this.search(start)
+	to := this.search(end) // first entry > end is at to or to+1
+	if to < len(this.entries) && this.entries[to].ID == end {
+		to++
+	}
+
+	if !rev {
+		for i := from; i < to && (count <= 0 || len(res) < count); i++ {
+			res = append(res, this.entries[i])
+		}
+	} else {
+		for i := to - 1; i >= from && (count <= 0 || len(res) < count); i-- {
+			res = append(res, this.entries[i])
+		}
+	}
+	return res
+}
+
+func (this *Stream) Delete(ids []siface.StreamID) int {
+	num := 0
+	for _, id := range ids {
+		idx := this.search(id)
+		if idx < len(this.entries) && this.entries[idx].ID == id {
+			this.entries = append(this.entries[:idx], this.entries[idx+1:]...)
+			num++
+		}
+	}
+	return num
+}
+
+func (this *Stream) TrimMaxLen(maxlen uint64) int {
+	if uint64(len(this.entries)) <= maxlen {
+		return 0
+	}
+	num := len(this.entries) - int(maxlen)
+	this.entries = append([]siface.StreamEntry{}, this.entries[num:]...)
+	return num
+}
+
+func (this *Stream) TrimMinID(minid siface.StreamID) int {
+	num := this.search(minid)
+	this.entries = append([]siface.StreamEntry{}, this.entries[num:]...)
+	return num
+}
+
+func (this *Stream) CreateGroup(name string, id siface.StreamID) error {
+	if _, ok := this.groups[name]; ok {
+		return errors.New("(error) BUSYGROUP Consumer Group name already exists")
+	}
+	this.groups[name] = &StreamGroup{
+		name:      name,
+		stream:    this,
+		last_id:   id,
+		pending:   make(map[siface.StreamID]*streamPending),
+		consumers: make(map[string]*streamConsumer),
+	}
+	return nil
+}
+
+func (this *Stream) DestroyGroup(name string) bool {
+	if _, ok := this.groups[name]; !ok {
+		return false
+	}
+	delete(this.groups, name)
+	return true
+}
+
+func (this *Stream) GetGroup(name string) (siface.IStreamGroup, error) {
+	group, ok := this.groups[name]
+	if !ok {
+		return nil, fmt.Errorf("(error) NOGROUP No such consumer group '%s' for key name", name)
+	}
+	return group, nil
+}
+
+func (this *Stream) Groups() []siface.IStreamGroup {
+	names := make([]string, 0, len(this.groups))
+	for name := range this.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	groups := make([]siface.IStreamGroup, 0, len(names))
+	for _, name := range names {
+		groups = append(groups, this.groups[name])
+	}
+	return groups
+}
+
+func (this *StreamGroup) Name() string {
+	return this.name
+}
+
+func (this *StreamGroup) LastID() siface.StreamID {
+	return this.last_id
+}
+
+func (this *StreamGroup) SetLastID(id siface.StreamID) {
+	this.last_id = id
+}
+
+func (this *StreamGroup) consumer(name string, now int64) *streamConsumer {
+	consumer, ok := this.consumers[name]
+	if !ok {
+		consumer = &streamConsumer{name: name, pending: make(map[siface.StreamID]bool)}
+		this.consumers[name] = consumer
+	}
+	consumer.seen_time = now
+	return consumer
+}
+
+func (this *StreamGroup) CreateConsumer(name string, now int64) bool {
+	if _, ok := this.consumers[name]; ok {
+		return false
+	}
+	this.consumer(name, now)
+	return true
+}
+
+func (this *StreamGroup) DelConsumer(name string) int {
+	consumer, ok := this.consumers[name]
+	if !ok {
+		return 0
+	}
+	for id := range consumer.pending {
+		delete(this.pending, id)
+	}
+	delete(this.consumers, name)
+	return len(consumer.pending)
+}
+
+func (this *StreamGroup) Consumers() []siface.StreamConsumer {
+	res := make([]siface.StreamConsumer, 0, len(this.consumers))
+	for _, consumer := range this.consumers {
+		res = append(res, siface.StreamConsumer{Name: consumer.name, SeenTime: consumer.seen_time, Pending: len(consumer.pending)})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// move the pending entry to consumer, or add it if it's not pending
+func (this *StreamGroup) deliver(consumer *streamConsumer, id siface.StreamID, delivery_time int64, delivery_count uint64) {
+	pending, ok := this.pending[id]
+	if ok {
+		delete(this.consumers[pending.consumer].pending, id)
+	} else {
+		pending = &streamPending{}
+		this.pending[id] = pending
+	}
+	pending.consumer = consumer.name
+	pending.delivery_time = delivery_time
+	pending.delivery_count = delivery_count
+	consumer.pending[id] = true
+}
+
+func (this *StreamGroup) ReadNew(consumer_name string, count int, noack bool, now int64) []siface.StreamEntry {
+	consumer := this.consumer(consumer_name, now)
+	entries := this.stream.Range(streamIDIncr(this.last_id), STREAM_ID_MAX, count, false)
+	if this.last_id == STREAM_ID_MAX {
+		entries = entries[:0]
+	}
+	for _, entry := range entries {
+		this.last_id = entry.ID
+		if noack {
+			continue
+		}
+		var delivery_count uint64 = 1
+		if pending, ok := this.pending[entry.ID]; ok {
+			delivery_count = pending.delivery_count + 1
+		}
+		this.deliver(consumer, entry.ID, now, delivery_count)
+	}
+	return entries
+}
+
+func (this *StreamGroup) ReadHistory(consumer_name string, start siface.StreamID, count int, now int64) []siface.StreamEntry {
+	consumer := this.consumer(consumer_name, now)
+	ids := make([]siface.StreamID, 0, len(consumer.pending))
+	for id := range consumer.pending {
+		if streamIDLess(start, id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return streamIDLess(ids[i], ids[j]) })
+	if count > 0 && len(ids) > count {
+		ids = ids[:count]
+	}
+
+	res := make([]siface.StreamEntry, 0, len(ids))
+	for _, id := range ids {
+		if entry, ok := this.stream.get(id); ok {
+			res = append(res, entry)
+		} else {
+			res = append(res, siface.StreamEntry{ID: id})
+		}
+	}
+	return res
+}
+
+func (this *StreamGroup) Ack(ids []siface.StreamID) int {
+	num := 0
+	for _, id := range ids {
+		pending, ok := this.pending[id]
+		if !ok {
+			continue
+		}
+		delete(this.consumers[pending.consumer].pending, id)
+		delete(this.pending, id)
+		num++
+	}
+	return num
+}
+
+func (this *StreamGroup) Pending() []siface.StreamPending {
+	res := make([]siface.StreamPending, 0, len(this.pending))
+	for id, pending := range this.pending {
+		res = append(res, siface.StreamPending{ID: id, Consumer: pending.consumer, DeliveryTime: pending.delivery_time, DeliveryCount: pending.delivery_count})
+	}
+	sort.Slice(res, func(i, j int) bool { return streamIDLess(res[i].ID, res[j].ID) })
+	return res
+}
+
+func (this *StreamGroup) GetPending(id siface.StreamID) (siface.StreamPending, bool) {
+	pending, ok := this.pending[id]
+	if !ok {
+		return siface.StreamPending{}, false
+	}
+	return siface.StreamPending{ID: id, Consumer: pending.consumer, DeliveryTime: pending.delivery_time, DeliveryCount: pending.delivery_count}, true
+}
+
+func (this *StreamGroup) Claim(consumer_name string, id siface.StreamID, delivery_time int64, delivery_count uint64, force bool, now int64) (*siface.StreamEntry, bool) {
+	entry, exist := this.stream.get(id)
+	_, pending := this.pending[id]
+	if !exist {
+		if pending {
+			this.Ack([]siface.StreamID{id})
+		}
+		return nil, pending
+	}
+	if !pending && !force {
+		return nil, false
+	}
+
+	this.deliver(this.consumer(consumer_name, now), id, delivery_time, delivery_count)
+	return &entry, false
+}
@@ -0,0 +1,319 @@
+package server_test
+
+import (
+	"gedis/src/Server/server"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newStreamEngine() *server.Engine {
+	engine := server.NewEngine()
+	engine.Start()
+	return engine
+}
+
+func handle(engine *server.Engine, cmdline string) []string {
+	return engine.Handle(strings.Fields(cmdline))
+}
+
+// XADD ids and XRANGE/XREVRANGE
+func TestStream1(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	if res := handle(engine, "XADD s 1-1 a 1"); res[0] != "1-1" {
+		t.Error("TestStream1 failed")
+	}
+	if res := handle(engine, "XADD s 1-* b 2"); res[0] != "1-2" {
+		t.Error("TestStream1 failed")
+	}
+	if res := handle(engine, "XADD s 1-1 c 3"); !strings.HasPrefix(res[0], "(error)") {
+		t.Error("TestStream1 failed")
+	}
+	if res := handle(engine, "XADD s 0-0 c 3"); !strings.HasPrefix(res[0], "(error)") {
+		t.Error("TestStream1 failed")
+	}
+	if res := handle(engine, "XADD s * c 3"); res[0] <= "1-2" {
+		t.Error("TestStream1 failed")
+	}
+	if res := handle(engine, "XLEN s"); res[0] != "(integer) 3" {
+		t.Error("TestStream1 failed")
+	}
+
+	res := handle(engine, "XRANGE s - + COUNT 1")
+	if !reflect.DeepEqual(res, []string{"1) 1) 1-1", "   2) 1) a", "      2) 1"}) {
+		t.Error("TestStream1 failed")
+	}
+	res = handle(engine, "XRANGE s (1-1 1-2")
+	if !reflect.DeepEqual(res, []string{"1) 1) 1-2", "   2) 1) b", "      2) 2"}) {
+		t.Error("TestStream1 failed")
+	}
+	res = handle(engine, "XREVRANGE s + - COUNT 2")
+	if len(res) != 6 || res[0] == "1) 1) 1-1" || res[3] != "2) 1) 1-2" {
+		t.Error("TestStream1 failed")
+	}
+	if res := handle(engine, "XRANGE nokey - +"); res[0] != "(empty array)" {
+		t.Error("TestStream1 failed")
+	}
+
+	if res := handle(engine, "XDEL s 1-1 9-9"); res[0] != "(integer) 1" {
+		t.Error("TestStream1 failed")
+	}
+	if res := handle(engine, "XLEN s"); res[0] != "(integer) 2" {
+		t.Error("TestStream1 failed")
+	}
+}
+
+// trimming
+func TestStream2(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	for _, id := range []string{"1-0", "2-0", "3-0", "4-0", "5-0"} {
+		handle(engine, "XADD s MAXLEN ~ 3 "+id+" f v")
+	}
+	if res := handle(engine, "XLEN s"); res[0] != "(integer) 3" {
+		t.Error("TestStream2 failed")
+	}
+	// LIMIT needs ~, and ~ trims exactly like =
+	if res := handle(engine, "XTRIM s MAXLEN 1 LIMIT 10"); res[0] != "(error) ERR syntax error, LIMIT cannot be used without the special ~ option" {
+		t.Error("TestStream2 failed", res)
+	}
+	if res := handle(engine, "XADD s MAXLEN = 1 LIMIT 10 6-0 f v"); res[0] != "(error) ERR syntax error, LIMIT cannot be used without the special ~ option" {
+		t.Error("TestStream2 failed", res)
+	}
+	if res := handle(engine, "XTRIM s MAXLEN ~ 1 LIMIT -1"); res[0] != "(error) ERR The LIMIT argument must be >= 0." {
+		t.Error("TestStream2 failed", res)
+	}
+	if res := handle(engine, "XTRIM s MAXLEN ~ 3 LIMIT 10"); res[0] != "(integer) 0" {
+		t.Error("TestStream2 failed", res)
+	}
+	if res := handle(engine, "XTRIM s MINID 5-0"); res[0] != "(integer) 2" {
+		t.Error("TestStream2 failed")
+	}
+	if res := handle(engine, "XTRIM s MAXLEN 0"); res[0] != "(integer) 1" {
+		t.Error("TestStream2 failed")
+	}
+	// the last id is kept after all entries are trimmed
+	if res := handle(engine, "XADD s 5-0 f v"); !strings.HasPrefix(res[0], "(error)") {
+		t.Error("TestStream2 failed")
+	}
+	if res := handle(engine, "XADD nokey NOMKSTREAM * f v"); res[0] != "(nil)" {
+		t.Error("TestStream2 failed")
+	}
+	if res := handle(engine, "XLEN nokey"); res[0] != "(integer) 0" {
+		t.Error("TestStream2 failed")
+	}
+}
+
+// consumer groups
+func TestStream3(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+
+	if res := handle(engine, "XGROUP CREATE s g $"); !strings.HasPrefix(res[0], "(error)") {
+		t.Error("TestStream3 failed")
+	}
+	if res := handle(engine, "XGROUP CREATE s g $ MKSTREAM"); res[0] != "OK" {
+		t.Error("TestStream3 failed")
+	}
+	handle(engine, "XADD s 1-0 a 1")
+	handle(engine, "XADD s 2-0 b 2")
+
+	res := handle(engine, "XREADGROUP GROUP g alice COUNT 1 STREAMS s >")
+	if !reflect.DeepEqual(res, []string{"1) 1) s", "   2) 1) 1) 1-0", "         2) 1) a", "            2) 1"}) {
+		t.Error("TestStream3 failed")
+	}
+	handle(engine, "XREADGROUP GROUP g bob STREAMS s >")
+	if res := handle(engine, "XREADGROUP GROUP g bob STREAMS s >"); res[0] != "(nil)" {
+		t.Error("TestStream3 failed")
+	}
+	// history of alice
+	res = handle(engine, "XREADGROUP GROUP g alice STREAMS s 0")
+	if len(res) != 4 || res[1] != "   2) 1) 1) 1-0" {
+		t.Error("TestStream3 failed")
+	}
+
+	res = handle(engine, "XPENDING s g")
+	if !reflect.DeepEqual(res, []string{"1) (integer) 2", "2) 1-0", "3) 2-0", "4) 1) 1) alice", "      2) 1", "   2) 1) bob", "      2) 1"}) {
+		t.Error("TestStream3 failed")
+	}
+
+	// bob takes the entry of alice
+	res = handle(engine, "XCLAIM s g bob 0 1-0 JUSTID")
+	if !reflect.DeepEqual(res, []string{"1) 1-0"}) {
+		t.Error("TestStream3 failed")
+	}
+	res = handle(engine, "XPENDING s g - + 10 bob")
+	if len(res) != 8 || res[0] != "1) 1) 1-0" || res[1] != "   2) bob" {
+		t.Error("TestStream3 failed")
+	}
+
+	if res := handle(engine, "XACK s g 1-0 2-0 3-0"); res[0] != "(integer) 2" {
+		t.Error("TestStream3 failed")
+	}
+	if res := handle(engine, "XPENDING s g"); res[0] != "1) (integer) 0" {
+		t.Error("TestStream3 failed")
+	}
+
+	// the pending entries of a deleted entry are reported by XAUTOCLAIM
+	handle(engine, "XADD s 3-0 c 3")
+	handle(engine, "XREADGROUP GROUP g alice STREAMS s >")
+	handle(engine, "XDEL s 3-0")
+	res = handle(engine, "XAUTOCLAIM s g bob 0 0")
+	if !reflect.DeepEqual(res, []string{"1) 0-0", "2) (empty array)", "3) 1) 3-0"}) {
+		t.Error("TestStream3 failed")
+	}
+
+	res = handle(engine, "XREADGROUP GROUP nogroup c STREAMS s >")
+	if !strings.HasPrefix(res[0], "(error) NOGROUP") {
+		t.Error("TestStream3 failed")
+	}
+	if res := handle(engine, "XGROUP DESTROY s g"); res[0] != "(integer) 1" {
+		t.Error("TestStream3 failed")
+	}
+}
+
+// the propagated cmds rebuild the same stream, which is what the aof and replicas see
+func TestStream4(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+	replica := newStreamEngine()
+	defer replica.Stop()
+
+	cmds := []string{
+		"XADD s * a 1",
+		"XADD s * b 2",
+		"XADD s MAXLEN 2 * c 3",
+		"XGROUP CREATE s g 0",
+		"XREADGROUP GROUP g alice COUNT 1 STREAMS s >",
+		"XREADGROUP GROUP g bob STREAMS s >",
+		"XCLAIM s g carol 0 " + "0-1",
+	}
+	props := make([][]string, 0)
+	for _, cmdline := range cmds {
+		_, cmd_props := engine.HandleProp(strings.Fields(cmdline))
+		props = append(props, cmd_props...)
+	}
+	// replayed later, the seen-times of the consumers come from the cmds instead of the replay
+	time.Sleep(10 * time.Millisecond)
+	for _, prop := range props {
+		replica.Handle(prop)
+	}
+	for _, cmdline := range []string{"XRANGE s - +", "XINFO STREAM s FULL", "XINFO GROUPS s"} {
+		if !reflect.DeepEqual(handle(engine, cmdline), handle(replica, cmdline)) {
+			t.Error("TestStream4 failed")
+		}
+	}
+}
+
+// stream is rebuilt from the snapshot of db
+func TestStream5(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "database"), 0755)
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	db := server.NewDb("test_stream")
+	db.Open()
+	defer db.Close()
+
+	db.Exec([][]byte{[]byte("FLUSHDB")})
+	for _, cmdline := range []string{
+		"XGROUP CREATE s g $ MKSTREAM",
+		"XADD s 1-0 a 1",
+		"XADD s 2-0 b 2",
+		"XREADGROUP GROUP g alice COUNT 1 STREAMS s >",
+		"XGROUP CREATECONSUMER s g bob",
+		"XGROUP CREATE empty g $ MKSTREAM",
+	} {
+		cmd := make([][]byte, 0)
+		for _, arg := range strings.Fields(cmdline) {
+			cmd = append(cmd, []byte(arg))
+		}
+		db.Exec(cmd)
+	}
+
+	engine := newStreamEngine()
+	defer engine.Stop()
+	for _, cmd := range db.Snapshot() {
+		engine.Handle(cmd)
+	}
+	for _, cmdline := range []string{"XRANGE s - +", "XPENDING s g", "XINFO CONSUMERS s g", "XINFO STREAM empty"} {
+		cmd := make([][]byte, 0)
+		for _, arg := range strings.Fields(cmdline) {
+			cmd = append(cmd, []byte(arg))
+		}
+		res := db.Exec(cmd)
+		expected := make([]string, 0)
+		for _, v := range res {
+			expected = append(expected, string(v))
+		}
+		got := handle(engine, cmdline)
+		// idle time of consumers may differ
+		if cmdline == "XINFO CONSUMERS s g" {
+			expected, got = expected[:2], got[:2]
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Error("TestStream5 failed")
+		}
+	}
+}
+
+// blocking XREAD is woken up by XADD
+func TestStream6(t *testing.T) {
+	engine := newStreamEngine()
+	defer engine.Stop()
+	handle(engine, "XADD s 1-0 a 1")
+
+	res_chan := make(chan []string)
+	go func() {
+		res_chan <- handle(engine, "XREAD BLOCK 0 STREAMS s $")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	handle(engine, "XADD s 2-0 b 2")
+	select {
+	case res := <-res_chan:
+		if !reflect.DeepEqual(res, []string{"1) 1) s", "   2) 1) 1) 2-0", "         2) 1) b", "            2) 2"}) {
+			t.Error("TestStream6 failed")
+		}
+	case <-time.After(time.Second):
+		t.Error("TestStream6 failed")
+	}
+
+	// times out
+	start := time.Now()
+	if res := handle(engine, "XREAD BLOCK 100 STREAMS s $"); res[0] != "(nil)" || time.Since(start) < 100*time.Millisecond {
+		t.Error("TestStream6 failed")
+	}
+
+	// unblocked when the engine stops blocking
+	go func() {
+		res_chan <- handle(engine, "XREAD BLOCK 0 STREAMS s $")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	engine.Unblock()
+	select {
+	case res := <-res_chan:
+		if res[0] != "(nil)" {
+			t.Error("TestStream6 failed")
+		}
+	case <-time.After(time.Second):
+		t.Error("TestStream6 failed")
+	}
+}
+
+func TestStreamCmdKeys(t *testing.T) {
+	keys := server.GetCmdKeys([]string{"XREADGROUP", "GROUP", "g", "c", "COUNT", "1", "STREAMS", "a", "b", "0", ">"})
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Error("TestStreamCmdKeys failed")
+	}
+	if !server.IsBlockingCmd([]string{"XREAD", "BLOCK", "0", "STREAMS", "s", "$"}) || server.IsBlockingCmd([]string{"XREAD", "STREAMS", "BLOCK", "$"}) {
+		t.Error("TestStreamCmdKeys failed")
+	}
+}
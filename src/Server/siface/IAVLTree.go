@@ -13,5 +13,7 @@ type IAVLTree interface {
 	GetScore(key string) (score float64, err error)
 	GetRank(key string) (rank uint32, err error)
 	GetRangeByRank(start, end uint32) (entries []SetEntry)
+	// entries with score in [start, end]
 	GetRangeByScore(start, end float64) (entries []SetEntry)
+	GetCountByScore(start, end float64) uint32
 }
@@ -3,4 +3,5 @@ package siface
 type ICmdPack interface {
 	PackCmd([][]byte) []byte
 	UnpackCmd([]byte) [][]byte
+	UnpackCmds([]byte) [][][]byte
 }
@@ -1,7 +1,36 @@
 package siface
 
+// the stats of a db shown by INFO
+type DbStats struct {
+	Keys           int
+	Expires        int
+	KeyspaceHits   uint64
+	KeyspaceMisses uint64
+
+	AofSize              int64
+	AofRewrites          uint64
+	AofRewriteInProgress bool
+	AofLastRewriteOk     bool
+	AofLastRewriteAt     int64 // unix time the last rewrite finished, 0 if never
+	AofLastRewriteTime   int64 // ms the last rewrite took, -1 if never
+}
+
 type IDb interface {
 	Open() error
 	Close() error
 	Exec([][]byte) [][]byte
+	// like Exec, the cmds called by scripts are run only if check returns no error reply
+	ExecCheck(bcmd [][]byte, check func(cmd []string) string) [][]byte
+	Save() error
+
+	SetOnWrite(func(name string, cmd []string))
+	SetOnNotify(func(name string, class int, event string, key string))
+	// run fun while no cmd is running and the cmds executed are all passed to OnWrite
+	Freeze(fun func())
+	// run fun while no other cmd is running, the cmds run by exec are persisted like the ones of Exec
+	Atomic(fun func(exec func(cmd []string) []string)) error
+	Snapshot() [][]string
+	DumpKey(key string) [][]string
+	Foreach(func(key string, val interface{}, TTL int64))
+	GetStats() DbStats
 }
@@ -4,6 +4,26 @@ type IEngine interface {
 	Start()
 	Stop()
 
+	// like HandleProp, but the props aren't passed to OnProps, for replaying the aof
 	Handle([]string) []string
+	// also returns the cmds to persist and replicate, which replay to the same state as cmd.
+	// usually cmd itself, but e.g. XADD * is persisted with the generated id
+	HandleProp(cmd []string) (res []string, props [][]string)
+	// like HandleProp, the cmds called by the script of cmd must pass check, which returns the error reply
+	HandleCheck(cmd []string, check func(cmd []string) string) (res []string, props [][]string)
+	// fun is called with the props of each cmd run by HandleProp, before the cmd releases the engine
+	SetOnProps(fun func(props [][]string))
+	// run fun while no cmd is running
+	Exclusive(fun func(handle func(cmd []string) []string))
+	// fun is called with the class, event and key of every keyspace notification
+	SetOnNotify(fun func(class int, event string, key string))
+	// wake up the blocked cmds and stop blocking
+	Unblock()
 	Foreach(func(key string, val interface{}, TTL int64))
+	// the number of the keys and of the keys with ttl
+	Count() (keys int, expires int)
+	// the lookups of the read cmds which found the key or not
+	GetKeyspaceStats() (hits uint64, misses uint64)
+	ResetKeyspaceStats()
+	Dump(key string) (val interface{}, TTLat int64, err error)
 }
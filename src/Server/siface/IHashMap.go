@@ -12,11 +12,17 @@ type IHashMap interface {
 	GetString(key string) (val string, err error)
 	GetList(key string, create bool) (val []string, err error)
 	GetZset(key string, create bool) (val IAVLTree, err error)
+	GetStream(key string, create bool) (val IStream, err error)
 	Foreach(func(key string, val interface{}, TTLat int64))
+	Clear()
+	Count() (keys int, expires int)
+	GetKeyspaceStats() (hits uint64, misses uint64)
+	ResetKeyspaceStats()
 
 	SetTTL(key string, time int64) error
 	GetTTL(key string) (int64, error)
 	Persist(key string) error
+	SetOnExpire(func(key string))
 	StartTtlMonitor()
 	StopTtlMonitor()
 }
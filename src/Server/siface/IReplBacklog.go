@@ -0,0 +1,7 @@
+package siface
+
+type IReplBacklog interface {
+	Write(data []byte)
+	ReadFrom(offset int64) ([]byte, error)
+	GetOffset() int64
+}
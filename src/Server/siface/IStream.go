@@ -0,0 +1,77 @@
+package siface
+
+// id of a stream entry, ms-seq
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string // field value pairs, nil if the entry is deleted
+}
+
+// an entry delivered to a consumer but not acked yet
+type StreamPending struct {
+	ID            StreamID
+	Consumer      string
+	DeliveryTime  int64 // unix ms of the last delivery
+	DeliveryCount uint64
+}
+
+type StreamConsumer struct {
+	Name     string
+	SeenTime int64 // unix ms of the last read or claim
+	Pending  int
+}
+
+type IStream interface {
+	// id is *, ms-* or ms-seq, returns the id added
+	Add(id string, fields []string) (StreamID, error)
+	Len() uint64
+	LastID() StreamID
+	// the last id can't be smaller than the last entry
+	SetLastID(id StreamID) error
+	EntriesAdded() uint64
+	SetEntriesAdded(n uint64)
+	// entries in [start, end], at most count if count > 0
+	Range(start, end StreamID, count int, rev bool) []StreamEntry
+	Delete(ids []StreamID) int
+	// remove the oldest entries so that at most maxlen are left
+	TrimMaxLen(maxlen uint64) int
+	// remove the entries with id smaller than minid
+	TrimMinID(minid StreamID) int
+
+	CreateGroup(name string, id StreamID) error
+	DestroyGroup(name string) bool
+	GetGroup(name string) (IStreamGroup, error)
+	// sorted by name
+	Groups() []IStreamGroup
+}
+
+type IStreamGroup interface {
+	Name() string
+	LastID() StreamID
+	SetLastID(id StreamID)
+
+	// returns false if the consumer exists
+	CreateConsumer(name string, now int64) bool
+	// returns the number of pending entries of the deleted consumer
+	DelConsumer(name string) int
+	// sorted by name
+	Consumers() []StreamConsumer
+
+	// entries never delivered to the group, they are added to the pending list unless noack
+	ReadNew(consumer string, count int, noack bool, now int64) []StreamEntry
+	// pending entries of the consumer with id > start
+	ReadHistory(consumer string, start StreamID, count int, now int64) []StreamEntry
+	Ack(ids []StreamID) int
+	// sorted by id
+	Pending() []StreamPending
+	GetPending(id StreamID) (StreamPending, bool)
+
+	// give a pending entry to consumer with the delivery time and count,
+	// force adds the entry to the pending list if it's not there but in the stream.
+	// returns the entry if claimed, and whether it's removed from the pending list since it's deleted from the stream
+	Claim(consumer string, id StreamID, delivery_time int64, delivery_count uint64, force bool, now int64) (entry *StreamEntry, deleted bool)
+}
@@ -2,49 +2,222 @@ package utils
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 )
 
 type GlobalObj struct {
 	Name string
 
-	Ip   string
-	Port uint32
+	IpVersion string // tcp, tcp4 or tcp6
+	Ip        string
+	Port      uint32 // tcp listener is disabled if 0
+
+	UnixSocket     string // path of the unix socket, disabled if empty
+	UnixSocketPerm string // permission of the socket file in octal
 
 	MaxConnSize     uint32
 	MaxDataLen      uint32
-	MaxMsgRWChanLen uint32
+	MaxMsgRWChanLen uint32 // msgs of a connection waiting to be written, a client not reading them is disconnected when reached
+
+	PoolSize       uint32
+	TaskQueueSize  uint32
+	MaxConnPending uint32 // requests of a connection read but not handled yet, reading pauses when reached
+
+	ShutdownTimeout uint32 // seconds to wait for the queued requests when shutdown
+
+	// tls is enabled when cert and key are set
+	TLSCertFile    string
+	TLSKeyFile     string
+	TLSCAFile      string // CA to verify the peers, system CAs if empty
+	TLSAuthClients bool   // clients must have a cert signed by the CA
+	TLSReplication bool   // replicas, MIGRATE and the cluster bus connect to other nodes with tls
+
+	ReplBacklogSize uint32
+	MasterUser      string
+	MasterAuth      string
+
+	ClusterEnabled bool
+
+	RequirePass string
+	AclFile     string
 
-	PoolSize      uint32
-	TaskQueueSize uint32
+	NotifyKeyspaceEvents string // classes of keyspace notifications like "KEA", disabled if empty. e is never notified
+
+	MetricsAddr string // address of the http listener serving /metrics for prometheus, like ":9121", disabled if empty
+
+	SlowlogLogSlowerThan int64  // microseconds a cmd takes to be logged by SLOWLOG, disabled if negative
+	SlowlogMaxLen        uint32 // entries kept by SLOWLOG
+
+	MaxMemory      uint64 // bytes of the heap over which write cmds are denied, unlimited if 0
+	AofRewriteCmds uint32 // the aof is rewritten once more than this many cmds are appended, never if 0
+
+	LuaTimeLimit uint32 // milliseconds a script or function can run before it's stopped, unlimited if 0
 }
 
 var Global_obj *GlobalObj
 
-func init() {
-	Global_obj = &GlobalObj{
-		Name: "zinx",
-		Ip:   "127.0.0.1",
-		Port: 8999,
+// guards the fields CONFIG SET changes at runtime, the goroutines serving the cmds read them by the
+// accessors below
+var global_lock sync.RWMutex
+
+// the file Global_obj is loaded from, CONFIG REWRITE writes it back
+var ConfigFile = "config/config.json"
+
+func defaultGlobalObj() *GlobalObj {
+	return &GlobalObj{
+		Name:      "zinx",
+		IpVersion: "tcp4",
+		Ip:        "127.0.0.1",
+		Port:      8999,
+
+		UnixSocket:     "",
+		UnixSocketPerm: "700",
 
 		MaxConnSize:     10000,
 		MaxDataLen:      4096,
-		MaxMsgRWChanLen: 1,
+		MaxMsgRWChanLen: 1024,
+
+		PoolSize:       10,
+		TaskQueueSize:  20,
+		MaxConnPending: 16,
+
+		ShutdownTimeout: 10,
+
+		TLSCertFile:    "",
+		TLSKeyFile:     "",
+		TLSCAFile:      "",
+		TLSAuthClients: false,
+		TLSReplication: false,
+
+		ReplBacklogSize: 1024 * 1024,
+		MasterUser:      "default",
+		MasterAuth:      "",
+
+		ClusterEnabled: false,
+
+		RequirePass: "",
+		AclFile:     "database/users.acl",
+
+		NotifyKeyspaceEvents: "",
+
+		MetricsAddr: "",
+
+		SlowlogLogSlowerThan: 10000,
+		SlowlogMaxLen:        128,
+
+		MaxMemory:      0,
+		AofRewriteCmds: 5,
+
+		LuaTimeLimit: 5000,
+	}
+}
 
-		PoolSize:      10,
-		TaskQueueSize: 20,
+func init() {
+	Global_obj = defaultGlobalObj()
+	err := LoadConfig(ConfigFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, "config/config.json doesn't exist, use default config:")
+	} else if err != nil {
+		// the server checks the error again when it starts, the others go on with the defaults
+		fmt.Fprintf(os.Stderr, "%s, use default config\n", err.Error())
 	}
+}
 
-	buf, err := ioutil.ReadFile("config/config.json")
-	// invalid json file or not exist...
+// load the fields in the json file at path over the defaults, Global_obj isn't changed if it fails
+func LoadConfig(path string) error {
+	buf, err := ioutil.ReadFile(path)
 	if err != nil {
-		fmt.Println("config/config.json doesn't exist, use default config:")
-		return
+		return err
 	}
+	obj := defaultGlobalObj()
+	if err := json.Unmarshal(buf, obj); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	global_lock.Lock()
+	*Global_obj = *obj
+	global_lock.Unlock()
+	ConfigFile = path
+	return nil
+}
 
-	err = json.Unmarshal(buf, Global_obj)
+// write Global_obj into ConfigFile, through a temp file so a failed write keeps the old one
+func SaveConfig() error {
+	global_lock.RLock()
+	buf, err := json.MarshalIndent(Global_obj, "", "    ")
+	global_lock.RUnlock()
 	if err != nil {
-		panic(err.Error())
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ConfigFile), 0755); err != nil {
+		return err
 	}
+	tmp := ConfigFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(buf, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ConfigFile)
+}
+
+// run fun while the accessors wait, fun sets the fields of Global_obj changed at runtime
+func SetGlobalObj(fun func()) {
+	global_lock.Lock()
+	defer global_lock.Unlock()
+	fun()
+}
+
+// run fun while the fields of Global_obj aren't set by SetGlobalObj
+func ReadGlobalObj(fun func()) {
+	global_lock.RLock()
+	defer global_lock.RUnlock()
+	fun()
+}
+
+func GetMaxConnSize() uint32 {
+	global_lock.RLock()
+	defer global_lock.RUnlock()
+	return Global_obj.MaxConnSize
+}
+
+func GetShutdownTimeout() uint32 {
+	global_lock.RLock()
+	defer global_lock.RUnlock()
+	return Global_obj.ShutdownTimeout
+}
+
+// MasterUser and MasterAuth
+func GetMasterAuth() (user string, pass string) {
+	global_lock.RLock()
+	defer global_lock.RUnlock()
+	return Global_obj.MasterUser, Global_obj.MasterAuth
+}
+
+// SlowlogLogSlowerThan and SlowlogMaxLen
+func GetSlowlogConfig() (slower_than int64, max_len uint32) {
+	global_lock.RLock()
+	defer global_lock.RUnlock()
+	return Global_obj.SlowlogLogSlowerThan, Global_obj.SlowlogMaxLen
+}
+
+func GetMaxMemory() uint64 {
+	global_lock.RLock()
+	defer global_lock.RUnlock()
+	return Global_obj.MaxMemory
+}
+
+func GetAofRewriteCmds() uint32 {
+	global_lock.RLock()
+	defer global_lock.RUnlock()
+	return Global_obj.AofRewriteCmds
+}
+
+func GetLuaTimeLimit() uint32 {
+	global_lock.RLock()
+	defer global_lock.RUnlock()
+	return Global_obj.LuaTimeLimit
 }
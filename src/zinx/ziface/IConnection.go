@@ -2,6 +2,7 @@ package ziface
 
 import (
 	"net"
+	"time"
 )
 
 type IConnection interface {
@@ -11,7 +12,16 @@ type IConnection interface {
 
 	GetConnID() uint32
 	RemoteAddr() net.Addr
+	// fails and stops the connection if the msgs to write are full
 	SendMsg(id uint32, data []byte) error
+	// fails if the msgs to write are full, the msg is dropped
+	TrySendMsg(id uint32, data []byte) error
+	// waits for room if the msgs to write are full
+	SendMsgWait(id uint32, data []byte) error
+
+	GetStartTime() time.Time
+	GetLastActive() time.Time
+	GetPending() int
 
 	GetRouterManager() IRouterManager
 
@@ -6,4 +6,5 @@ type IConnectionManager interface {
 	Remove(IConnection)
 	ClearAll()
 	Size() uint32
+	GetConns() []IConnection
 }
@@ -1,8 +1,14 @@
 package ziface
 
+import "io"
+
 type IDataPack interface {
 	Pack(IMessage) ([]byte, error)
+	// like Pack, but a msg longer than MaxDataLen is split into frames instead of failing
+	PackFrames(IMessage) ([]byte, error)
 	UnpackHead([]byte) (IMessage, error)
+	// read a whole msg, joining the frames of PackFrames
+	ReadMsg(io.Reader) (IMessage, error)
 
 	GetHeadLen() uint32
 }
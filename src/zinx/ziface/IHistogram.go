@@ -0,0 +1,10 @@
+package ziface
+
+import "time"
+
+type IHistogram interface {
+	Observe(time.Duration)
+	// upper bounds of buckets and cumulative count of each bucket, the last bound is +Inf
+	// sum and count of all the observed values
+	Snapshot() (bounds []time.Duration, counts []uint64, sum time.Duration, count uint64)
+}
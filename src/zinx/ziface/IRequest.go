@@ -5,4 +5,10 @@ type IRequest interface {
 	GetDataLen() uint32
 	GetMsgId() uint32
 	GetData() []byte
+	// called once the request is handled or dropped
+	Done()
+	// finish the request later, e.g. a blocking cmd which waits for data, without holding the worker.
+	// later requests of the connection are held until resume is called, so the order is kept.
+	// must be called by the handler before it returns
+	Park() (resume func())
 }
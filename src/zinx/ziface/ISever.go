@@ -1,5 +1,7 @@
 package ziface
 
+import "time"
+
 type IServer interface {
 	// start Server
 	Start()
@@ -7,6 +9,8 @@ type IServer interface {
 	Stop()
 	// run Server
 	Serve()
+	// make Serve return
+	Shutdown()
 
 	// add a rounter
 	AddRounter(uint32, IRouter)
@@ -17,6 +21,13 @@ type IServer interface {
 	// get connection manager
 	GetConnectionManager() IConnectionManager
 
+	// metrics
+	GetStartTime() time.Time
+	// connections accepted, including the rejected ones
+	GetTotalConns() uint64
+	// connections rejected as MaxConnSize is reached
+	GetRejectedConns() uint64
+
 	// set onConnStartCallback
 	SetOnConnStart(func(IConnection))
 	// set onConnStopCallback
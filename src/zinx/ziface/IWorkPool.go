@@ -1,8 +1,25 @@
 package ziface
 
+import "context"
+
 type IWorkPool interface {
 	GetPoolSize() uint32
 	GetTaskQueueSize() uint32
+	// add a request, blocks when the task queue of its worker is full
 	AddRequest(IRequest)
 	StartWorkPool()
+	// refuse new requests and wait for the queued ones, the left ones are dropped when ctx is done
+	Stop(ctx context.Context) error
+
+	// metrics
+	GetQueueDepth() uint32
+	GetBusyWorkers() uint32
+	// requests handled since started
+	GetProcessed() uint64
+	// requests handled per second recently
+	GetOpsPerSec() uint64
+	// time requests wait in task queues
+	GetWaitLatency() IHistogram
+	// time requests are handled by routers
+	GetExecLatency() IHistogram
 }
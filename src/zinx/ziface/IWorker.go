@@ -3,6 +3,11 @@ package ziface
 type IWroker interface {
 	GetWorkerID() uint32
 	GetTaskQueueSize() uint32
+	// requests waiting in the task queue
+	GetQueueDepth() uint32
+	// a request is being handled
+	IsBusy() bool
 	AddRequest(IRequest)
 	StartWork()
+	StopWork()
 }
@@ -1,15 +1,28 @@
 package znet
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"gedis/src/zinx/utils"
 	"gedis/src/zinx/ziface"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// TrySendMsg fails with it if the msgs to write back up
+var ErrMsgChanFull = errors.New("msg_chan of the connection is full")
+
+// msgs sent to a stopped connection fail with it
+var ErrConnClosed = errors.New("connection is closed")
+
 type Connection struct {
+	// unix nano of the last msg read, accessed atomically, first for the alignment
+	last_active int64
+
 	id         uint32
 	conn       net.Conn
 	is_closed  bool
@@ -20,19 +33,35 @@ type Connection struct {
 	work_pool    ziface.IWorkPool
 	conn_manager ziface.IConnectionManager
 
-	data_pack ziface.IDataPack
-	msg_chan  chan []byte
-	exit_chan chan bool
+	data_pack   ziface.IDataPack
+	msg_chan    chan []byte
+	exit_chan   chan bool
+	writer_exit chan bool
+	writer_on   bool
+
+	// a slot is taken for each request until it's handled, which bounds the pending requests of this connection
+	pending   chan struct{}
+	stop_chan chan struct{}
 
 	onConnStart func(ziface.IConnection)
 	onConnStop  func(ziface.IConnection)
 
 	properties map[string]interface{}
 	prop_lock  sync.RWMutex
+
+	start_time time.Time
 }
 
 func NewConnection(id uint32, conn net.Conn, server ziface.IServer) (connection *Connection) {
 	data_pack := NewDataPack()
+	max_pending := utils.Global_obj.MaxConnPending
+	if max_pending == 0 {
+		max_pending = 1
+	}
+	max_msgs := utils.Global_obj.MaxMsgRWChanLen
+	if max_msgs == 0 {
+		max_msgs = 1
+	}
 
 	connection = &Connection{
 		id:        id,
@@ -44,16 +73,23 @@ func NewConnection(id uint32, conn net.Conn, server ziface.IServer) (connection
 		work_pool:    server.GetWorkPool(),
 		conn_manager: server.GetConnectionManager(),
 
-		data_pack: data_pack,
-		msg_chan:  make(chan []byte, 3),
-		exit_chan: make(chan bool, 2),
+		data_pack:   data_pack,
+		msg_chan:    make(chan []byte, max_msgs),
+		exit_chan:   make(chan bool, 2),
+		writer_exit: make(chan bool),
+
+		pending:   make(chan struct{}, max_pending),
+		stop_chan: make(chan struct{}),
 
 		onConnStart: server.GetOnConnStart(),
 		onConnStop:  server.GetOnConnStop(),
 
 		properties: make(map[string]interface{}),
 		prop_lock:  sync.RWMutex{},
+
+		start_time: time.Now(),
 	}
+	connection.last_active = connection.start_time.UnixNano()
 
 	return
 }
@@ -84,15 +120,34 @@ func (this *Connection) unpackMsg() (msg ziface.IMessage, err error) {
 }
 
 func (this *Connection) Writer() {
-end:
+	defer close(this.writer_exit)
+
+	// after a write fails, msgs are still taken from msg_chan and dropped, so SendMsg never blocks forever
+	failed := false
+	write := func(buf []byte) {
+		if failed {
+			return
+		}
+		if _, err := this.conn.Write(buf); err != nil {
+			failed = true
+		}
+	}
+
 	for {
 		select {
 		case <-this.exit_chan:
-			break end
-		case buf := <-this.msg_chan:
-			if _, err := this.conn.Write(buf); err != nil {
-				break end
+			// flush the replies already sent to msg_chan, a stuck client can't hold the stopping connection
+			this.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			for {
+				select {
+				case buf := <-this.msg_chan:
+					write(buf)
+				default:
+					return
+				}
 			}
+		case buf := <-this.msg_chan:
+			write(buf)
 		}
 	}
 
@@ -103,7 +158,26 @@ func (this *Connection) Start() {
 	defer this.Stop()
 
 	// start goes out a Writer，then serves as Reader itself
+	this.close_lock.Lock()
+	if this.is_closed {
+		// stopped by server before started
+		this.close_lock.Unlock()
+		return
+	}
+	this.writer_on = true
 	go this.Writer()
+	this.close_lock.Unlock()
+
+	// handshake of tls happens on the first read, a failed handshake makes every read fails
+	// so handshake here and give up the connection if fails
+	if tls_conn, ok := this.conn.(*tls.Conn); ok {
+		tls_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tls_conn.Handshake(); err != nil {
+			fmt.Printf("Connection %d tls handshake failed, %s\n", this.id, err.Error())
+			return
+		}
+		tls_conn.SetDeadline(time.Time{})
+	}
 
 	// on start callback, before reading from client...
 	this.onConnStart(this)
@@ -121,11 +195,20 @@ func (this *Connection) Start() {
 			fmt.Println(err.Error())
 			continue
 		}
+		atomic.StoreInt64(&this.last_active, time.Now().UnixNano())
 
-		request := NewRequest(this, msg)
-
-		// 读写分离后，读不需要handler的数据了，因此无需等待handler，把handler给go出去
-		go this.work_pool.AddRequest(request)
+		// backpressure: stop reading when too many requests of this connection are pending
+		// or the task queue of the worker is full, instead of piling up goroutines
+		select {
+		case this.pending <- struct{}{}:
+		case <-this.stop_chan:
+			return
+		}
+		// ordering: requests are added in the order they are read, all of them go to the same worker
+		// and are handled one by one, and replies are written in the order they are sent to msg_chan.
+		// so a client can pipeline cmds and get replies in order
+		request := NewRequest(this, msg, func() { <-this.pending })
+		this.work_pool.AddRequest(request)
 	}
 
 }
@@ -138,17 +221,24 @@ func (this *Connection) Stop() {
 		return
 	}
 	fmt.Printf("Connection %d is stopped[Reader]\n", this.id)
+	// the senders waiting for room in msg_chan give up
+	this.is_closed = true
+	close(this.stop_chan)
 
 	// on stop callback, before end this connection...
 	this.onConnStop(this)
 
-	// tell writer that reader is ready to exit...
+	// a writer blocked by a client not reading, like a slow monitor, gives up its write in time
+	this.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	// tell writer that reader is ready to exit and wait it flushes the left replies...
 	// otherwise writer may still use the closed tcp connection and cause error
 	this.exit_chan <- true
+	if this.writer_on {
+		<-this.writer_exit
+	}
 
 	this.conn.Close()
-	this.is_closed = true
-	close(this.msg_chan)
+	// msg_chan isn't closed, a sender may still be selecting on it
 	close(this.exit_chan)
 
 	this.conn_manager.Remove(this)
@@ -171,14 +261,85 @@ func (this *Connection) RemoteAddr() (addr net.Addr) {
 
 func (this *Connection) SendMsg(id uint32, data []byte) (err error) {
 	msg := NewMessage(id, data)
-	buf, err := this.data_pack.Pack(msg)
+	buf, err := this.data_pack.PackFrames(msg)
 	if err != nil {
 		return
 	}
-	this.msg_chan <- buf
+
+	select {
+	case <-this.stop_chan:
+		return ErrConnClosed
+	default:
+	}
+	select {
+	case this.msg_chan <- buf:
+	default:
+		// the client doesn't read its replies, it's disconnected instead of blocking the worker
+		fmt.Printf("Connection %d is stopped, %d msgs are not read\n", this.id, cap(this.msg_chan))
+		go this.Stop()
+		err = ErrMsgChanFull
+	}
+	return
+}
+
+// like SendMsg but waits for room in msg_chan until the connection is stopped,
+// for the goroutines serving only this connection, like the replication stream
+func (this *Connection) SendMsgWait(id uint32, data []byte) (err error) {
+	msg := NewMessage(id, data)
+	buf, err := this.data_pack.PackFrames(msg)
+	if err != nil {
+		return
+	}
+
+	// no lock is held while waiting for room, so Stop is never blocked by a client not reading
+	select {
+	case <-this.stop_chan:
+		return ErrConnClosed
+	default:
+	}
+	select {
+	case this.msg_chan <- buf:
+	case <-this.stop_chan:
+		err = ErrConnClosed
+	}
+	return
+}
+
+// like SendMsg but never blocks, for the msgs which can be dropped if the client is too slow
+func (this *Connection) TrySendMsg(id uint32, data []byte) (err error) {
+	msg := NewMessage(id, data)
+	buf, err := this.data_pack.PackFrames(msg)
+	if err != nil {
+		return
+	}
+
+	select {
+	case <-this.stop_chan:
+		return ErrConnClosed
+	default:
+	}
+	select {
+	case this.msg_chan <- buf:
+	default:
+		err = ErrMsgChanFull
+	}
 	return
 }
 
+func (this *Connection) GetStartTime() time.Time {
+	return this.start_time
+}
+
+// the time the last msg is read from the client
+func (this *Connection) GetLastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&this.last_active))
+}
+
+// the requests read but not handled yet
+func (this *Connection) GetPending() int {
+	return len(this.pending)
+}
+
 func (this *Connection) GetRouterManager() ziface.IRouterManager {
 	return this.rt_manager
 }
@@ -3,6 +3,7 @@ package znet
 import (
 	"errors"
 	"gedis/src/zinx/ziface"
+	"sort"
 	"sync"
 )
 
@@ -50,11 +51,17 @@ func (this *ConnectionManager) Remove(conn ziface.IConnection) {
 // not only clear the map, but also Stop all the connections to free sockets and other resources
 func (this *ConnectionManager) ClearAll() {
 	this.lock.Lock()
-	defer this.lock.Unlock()
-
+	conns := make([]ziface.IConnection, 0, len(this.conns))
 	for id, conn := range this.conns {
 		delete(this.conns, id)
-		go conn.Stop()
+		conns = append(conns, conn)
+	}
+	this.lock.Unlock()
+
+	// stop outside the lock, Stop removes the connection from the manager itself
+	// and stop them one by one, so ClearAll returns after all the connections are closed
+	for _, conn := range conns {
+		conn.Stop()
 	}
 }
 
@@ -64,3 +71,16 @@ func (this *ConnectionManager) Size() uint32 {
 
 	return uint32(len(this.conns))
 }
+
+// the connections in the order of their ids
+func (this *ConnectionManager) GetConns() []ziface.IConnection {
+	this.lock.RLock()
+	conns := make([]ziface.IConnection, 0, len(this.conns))
+	for _, conn := range this.conns {
+		conns = append(conns, conn)
+	}
+	this.lock.RUnlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].GetConnID() < conns[j].GetConnID() })
+	return conns
+}
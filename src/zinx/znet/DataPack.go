@@ -6,8 +6,13 @@ import (
 	"errors"
 	"gedis/src/zinx/utils"
 	"gedis/src/zinx/ziface"
+	"io"
 )
 
+// set in the id of a frame followed by more frames of the same msg. a msg longer than MaxDataLen
+// is sent as several frames, the requests read by the server still have to fit in one
+const MSG_MORE uint32 = 1 << 31
+
 type DataPack struct {
 }
 
@@ -51,6 +56,54 @@ func (this *DataPack) Pack(msg ziface.IMessage) (data []byte, err error) {
 	return
 }
 
+// pack msg into frames of MaxDataLen at most, a msg fitting in a frame is packed like Pack
+func (this *DataPack) PackFrames(msg ziface.IMessage) (data []byte, err error) {
+	max_len := utils.Global_obj.MaxDataLen
+	if msg.GetDataLen() <= max_len || max_len == 0 {
+		return this.Pack(msg)
+	}
+
+	rest := msg.GetMsgData()
+	data = make([]byte, 0, len(rest)+int(this.GetHeadLen())*(len(rest)/int(max_len)+1))
+	for len(rest) > 0 {
+		n, id := len(rest), msg.GetMsgID()
+		if n > int(max_len) {
+			n, id = int(max_len), id|MSG_MORE
+		}
+		frame, err := this.Pack(NewMessage(id, rest[:n]))
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, frame...)
+		rest = rest[n:]
+	}
+	return
+}
+
+// read a msg from r, the frames of a msg sent by PackFrames are joined
+func (this *DataPack) ReadMsg(r io.Reader) (msg ziface.IMessage, err error) {
+	var data []byte
+	for {
+		head := make([]byte, this.GetHeadLen())
+		if _, err = io.ReadFull(r, head); err != nil {
+			return nil, err
+		}
+		if msg, err = this.UnpackHead(head); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(r, msg.GetMsgData()); err != nil {
+			return nil, err
+		}
+		if msg.GetMsgID()&MSG_MORE == 0 {
+			if data == nil {
+				return msg, nil
+			}
+			return NewMessage(msg.GetMsgID(), append(data, msg.GetMsgData()...)), nil
+		}
+		data = append(data, msg.GetMsgData()...)
+	}
+}
+
 func (this *DataPack) UnpackHead(head []byte) (msg ziface.IMessage, err error) {
 	buf := bytes.NewBuffer(head)
 	var len uint32 = 0
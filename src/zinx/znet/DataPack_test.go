@@ -1,7 +1,10 @@
 package znet
 
 import (
+	"bytes"
 	"encoding/binary"
+	"gedis/src/zinx/utils"
+	"strings"
 	"testing"
 )
 
@@ -163,3 +166,25 @@ func TestDataPack_MultiPack(t *testing.T) {
 		return
 	}
 }
+
+// test: a msg longer than MaxDataLen is packed into frames and joined by ReadMsg
+func TestDataPack_Frames(t *testing.T) {
+	dp := NewDataPack()
+	str := strings.Repeat("x", 2*int(utils.Global_obj.MaxDataLen)+10)
+	data, err := dp.PackFrames(NewMessage(6, []byte(str)))
+	if err != nil {
+		t.Error("PackFrames error: ", err)
+		return
+	}
+	// 3 frames, all but the last one have MSG_MORE
+	if len(data) != 3*8+len(str) || binary.LittleEndian.Uint32(data[4:8]) != 6|MSG_MORE {
+		t.Error("PackFrames error: frames are not correct")
+		return
+	}
+	small, _ := dp.PackFrames(NewMessage(6, []byte("small")))
+	msg, err := dp.ReadMsg(bytes.NewReader(append(data, small...)))
+	if err != nil || msg.GetMsgID() != 6 || string(msg.GetMsgData()) != str {
+		t.Error("ReadMsg error: msg is not correct")
+		return
+	}
+}
@@ -0,0 +1,61 @@
+package znet
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// default buckets of latency, from 100us to 1s
+var DefaultLatencyBounds = []time.Duration{
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second,
+}
+
+// histogram with fixed buckets, an extra +Inf bucket is appended to bounds
+type Histogram struct {
+	bounds []time.Duration
+	counts []uint64 // count of each bucket, not cumulative
+	sum    time.Duration
+	count  uint64
+	lock   sync.Mutex
+}
+
+func NewHistogram(bounds []time.Duration) *Histogram {
+	bounds = append(append([]time.Duration{}, bounds...), time.Duration(math.MaxInt64))
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (this *Histogram) Observe(d time.Duration) {
+	// bounds are few, linear search is fast enough
+	i := 0
+	for d > this.bounds[i] {
+		i++
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.counts[i]++
+	this.sum += d
+	this.count++
+}
+
+func (this *Histogram) Snapshot() (bounds []time.Duration, counts []uint64, sum time.Duration, count uint64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	bounds = append([]time.Duration{}, this.bounds...)
+	counts = make([]uint64, len(this.counts))
+	var acc uint64 = 0
+	for i, c := range this.counts {
+		acc += c
+		counts[i] = acc
+	}
+	return bounds, counts, this.sum, this.count
+}
@@ -0,0 +1,64 @@
+package znet
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// tcp listener, wrapped with tls if tls is enabled
+func NewTCPListener(ip_version string, ip string, port uint32) (net.Listener, error) {
+	switch ip_version {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("invalid ip version %s, should be tcp, tcp4 or tcp6", ip_version)
+	}
+
+	listener, err := net.Listen(ip_version, net.JoinHostPort(ip, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	if IsTLSEnabled() {
+		config, err := NewTLSServerConfig()
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, config)
+	}
+	return listener, nil
+}
+
+// unix socket listener, perm is in octal like "700"
+// the socket file left by a crashed server is removed before listening
+func NewUnixListener(path string, perm string) (net.Listener, error) {
+	mode, err := strconv.ParseUint(perm, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unix socket perm %s, should be octal like 700", perm)
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a unix socket", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
@@ -0,0 +1,76 @@
+package znet
+
+import (
+	"gedis/src/zinx/utils"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serve only on a unix socket
+func TestUnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gedis.sock")
+
+	old_port, old_socket, old_perm := utils.Global_obj.Port, utils.Global_obj.UnixSocket, utils.Global_obj.UnixSocketPerm
+	defer func() {
+		utils.Global_obj.Port, utils.Global_obj.UnixSocket, utils.Global_obj.UnixSocketPerm = old_port, old_socket, old_perm
+	}()
+	utils.Global_obj.Port = 0
+	utils.Global_obj.UnixSocket = path
+	utils.Global_obj.UnixSocketPerm = "770"
+
+	server := NewServer()
+	server.AddRounter(0, &echoRouter{})
+	go server.Start()
+	defer server.Stop()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if res, err := echo(conn, "hello unix"); err != nil || res != "hello unix" {
+		t.Error("TestUnixListener failed", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0770 {
+		t.Error("TestUnixListener failed, wrong perm of the socket file")
+	}
+}
+
+func TestNewTCPListener(t *testing.T) {
+	if _, err := NewTCPListener("udp", "127.0.0.1", 0); err == nil {
+		t.Error("TestNewTCPListener failed, invalid ip version is accepted")
+	}
+	if _, err := NewTCPListener("tcp4", "::1", 0); err == nil {
+		t.Error("TestNewTCPListener failed, ipv6 address is accepted by tcp4")
+	}
+	listener, err := NewTCPListener("tcp", "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+}
+
+func TestNewUnixListener(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewUnixListener(filepath.Join(dir, "a.sock"), "999"); err == nil {
+		t.Error("TestNewUnixListener failed, invalid perm is accepted")
+	}
+	// regular files are never removed
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, []byte("data"), 0600)
+	if _, err := NewUnixListener(file, "700"); err == nil {
+		t.Error("TestNewUnixListener failed, regular file is replaced")
+	}
+}
@@ -5,12 +5,22 @@ import "gedis/src/zinx/ziface"
 type Request struct {
 	conn ziface.IConnection
 	msg  ziface.IMessage
+
+	on_done func()
+	// set by the worker handling this request
+	on_park func() (resume func())
 }
 
-func NewRequest(conn ziface.IConnection, msg ziface.IMessage) (request *Request) {
+// on_done is called once the request is handled or dropped, nil if not needed
+func NewRequest(conn ziface.IConnection, msg ziface.IMessage, on_done func()) (request *Request) {
+	if on_done == nil {
+		on_done = func() {}
+	}
 	request = &Request{
 		conn: conn,
 		msg:  msg,
+
+		on_done: on_done,
 	}
 	return
 }
@@ -32,3 +42,15 @@ func (this *Request) GetDataLen() uint32 {
 func (this *Request) GetMsgId() uint32 {
 	return this.msg.GetMsgID()
 }
+
+func (this *Request) Done() {
+	this.on_done()
+}
+
+func (this *Request) Park() (resume func()) {
+	if this.on_park == nil {
+		// not handled by a worker, nothing to hold
+		return func() {}
+	}
+	return this.on_park()
+}
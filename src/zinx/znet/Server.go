@@ -1,22 +1,45 @@
 package znet
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"gedis/src/zinx/utils"
 	"gedis/src/zinx/ziface"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+var errServerStopped = errors.New("server is stopped")
+
 // implement of IServer interface, the Server mode
 type Server struct {
+	// accessed atomically, first for the alignment
+	total_conns    uint64
+	rejected_conns uint64
+
 	name string
 
 	ip_version string
 	ip         string
 	port       uint32
 
+	unix_socket      string
+	unix_socket_perm string
+
+	listeners   []net.Listener
+	listen_lock sync.Mutex
+	stopped     bool
+	conn_id     uint32
+	start_time  time.Time
+
+	exit_chan chan bool
+
 	rt_manager   ziface.IRouterManager
 	work_pool    ziface.IWorkPool
 	conn_manager ziface.IConnectionManager
@@ -27,14 +50,21 @@ type Server struct {
 
 func NewServer() (server *Server) {
 	server = &Server{
-		name:         utils.Global_obj.Name,
-		ip_version:   "tcp4",
-		ip:           utils.Global_obj.Ip,
-		port:         utils.Global_obj.Port,
+		name:       utils.Global_obj.Name,
+		ip_version: utils.Global_obj.IpVersion,
+		ip:         utils.Global_obj.Ip,
+		port:       utils.Global_obj.Port,
+
+		unix_socket:      utils.Global_obj.UnixSocket,
+		unix_socket_perm: utils.Global_obj.UnixSocketPerm,
+
 		rt_manager:   NewRouterManager(),
 		work_pool:    NewWorkPool(),
 		conn_manager: NewConnectionManager(),
 
+		start_time: time.Now(),
+		exit_chan:  make(chan bool, 1),
+
 		onConnStart: func(i ziface.IConnection) {},
 		onConnStop:  func(i ziface.IConnection) {},
 	}
@@ -45,35 +75,99 @@ func NewServer() (server *Server) {
 func (this *Server) Start() {
 	this.work_pool.StartWorkPool()
 
-	fmt.Printf("start server %s at (%s: %d)\n", this.name, this.ip, this.port)
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", this.ip, this.port))
-	if err != nil {
+	listeners, err := this.listen()
+	if errors.Is(err, errServerStopped) {
+		return
+	} else if err != nil {
 		panic(err.Error())
 	}
 
-	var conn_id uint32 = 0
+	wg := sync.WaitGroup{}
+	for _, listener := range listeners {
+		fmt.Printf("start server %s at (%s: %s)\n", this.name, listener.Addr().Network(), listener.Addr().String())
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			this.accept(listener)
+		}(listener)
+	}
+	wg.Wait()
+}
+
+// open the tcp listener on ip:port (disabled if port is 0) and the unix listener on unix_socket (disabled if empty)
+func (this *Server) listen() ([]net.Listener, error) {
+	this.listen_lock.Lock()
+	defer this.listen_lock.Unlock()
+
+	if this.stopped {
+		return nil, errServerStopped
+	}
+	listeners := []net.Listener{}
+	if this.port != 0 {
+		listener, err := NewTCPListener(this.ip_version, this.ip, this.port)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	if this.unix_socket != "" {
+		listener, err := NewUnixListener(this.unix_socket, this.unix_socket_perm)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("no listener is configured, set Port or UnixSocket")
+	}
+
+	this.listeners = listeners
+	return listeners, nil
+}
+
+func (this *Server) accept(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			fmt.Println(err.Error())
 			continue
 		}
 
+		atomic.AddUint64(&this.total_conns, 1)
 		// fmt.Printf("size of connections is %d\n", this.conn_manager.Size())
-		if this.conn_manager.Size() >= utils.Global_obj.MaxConnSize {
+		if max_conns := utils.GetMaxConnSize(); this.conn_manager.Size() >= max_conns {
+			atomic.AddUint64(&this.rejected_conns, 1)
+			fmt.Printf("reject connection from %s, MaxConnSize %d is reached\n", conn.RemoteAddr().String(), max_conns)
 			conn.Close()
 			continue
 		}
 
-		connection := NewConnection(conn_id, conn, this)
+		// conn id is shared by all listeners
+		connection := NewConnection(atomic.AddUint32(&this.conn_id, 1)-1, conn, this)
 		this.conn_manager.Add(connection)
 		go connection.Start()
-
-		conn_id++
 	}
 }
 
+// graceful stop: new connections are refused, queued and in-flight requests finish
+// (or are dropped after ShutdownTimeout) and then all the connections are closed
 func (this *Server) Stop() {
+	this.listen_lock.Lock()
+	closeListeners(this.listeners)
+	this.listeners = nil
+	this.stopped = true
+	this.listen_lock.Unlock()
+
+	timeout := utils.GetShutdownTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	if err := this.work_pool.Stop(ctx); err != nil {
+		fmt.Printf("requests are not finished in %ds, drop them\n", timeout)
+	}
+
 	this.conn_manager.ClearAll()
 }
 
@@ -84,6 +178,14 @@ func (this *Server) Serve() {
 	this.waitExitSig()
 }
 
+// make Serve stop the server and return, as if an exit signal is received
+func (this *Server) Shutdown() {
+	select {
+	case this.exit_chan <- true:
+	default:
+	}
+}
+
 func (this *Server) AddRounter(msg_id uint32, router ziface.IRouter) {
 	this.rt_manager.AddRouter(msg_id, router)
 }
@@ -100,6 +202,18 @@ func (this *Server) GetConnectionManager() ziface.IConnectionManager {
 	return this.conn_manager
 }
 
+func (this *Server) GetStartTime() time.Time {
+	return this.start_time
+}
+
+func (this *Server) GetTotalConns() uint64 {
+	return atomic.LoadUint64(&this.total_conns)
+}
+
+func (this *Server) GetRejectedConns() uint64 {
+	return atomic.LoadUint64(&this.rejected_conns)
+}
+
 func (this *Server) SetOnConnStart(fun func(ziface.IConnection)) {
 	this.onConnStart = fun
 }
@@ -115,25 +229,15 @@ func (this *Server) GetOnConnStop() func(ziface.IConnection) {
 }
 
 func (this *Server) waitExitSig() {
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Kill, os.Interrupt)
-
-	for {
-		select {
-		case sig := <-c:
-			{
-				fmt.Printf("Got sig %s\n", sig.String())
-				switch sig {
-				case os.Kill, os.Interrupt:
-					{
-						return
-					}
-				default:
-					{
-						fmt.Printf("Got sig %s, use sigterm, sigkill or sigquit to quit the server\n", sig.String())
-					}
-				}
-			}
-		}
+	// SIGKILL can't be caught, SIGTERM is what service managers send
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(c)
+
+	select {
+	case sig := <-c:
+		fmt.Printf("Got sig %s, shutdown...\n", sig.String())
+	case <-this.exit_chan:
+		fmt.Println("Shutdown...")
 	}
 }
@@ -0,0 +1,269 @@
+package znet
+
+import (
+	"context"
+	"fmt"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/ziface"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type slowRouter struct {
+	BaseRounter
+	delay   time.Duration
+	handled chan bool // a value for each request handled if not nil
+}
+
+func (this *slowRouter) Handle(req ziface.IRequest) {
+	time.Sleep(this.delay)
+	req.GetConn().SendMsg(req.GetMsgId(), req.GetData())
+	if this.handled != nil {
+		this.handled <- true
+	}
+}
+
+func startTestServer(t *testing.T, router ziface.IRouter) (*Server, net.Conn) {
+	utils.Global_obj.Port = freePort(t)
+	server := NewServer()
+	server.AddRounter(0, router)
+	go server.Start()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", utils.Global_obj.Port)); err == nil {
+			return server, conn
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return nil, nil
+}
+
+// requests queued before Stop are handled and replied before the connection is closed
+func TestServerStop1(t *testing.T) {
+	old_port := utils.Global_obj.Port
+	defer func() { utils.Global_obj.Port = old_port }()
+
+	server, conn := startTestServer(t, &slowRouter{delay: 20 * time.Millisecond})
+	defer conn.Close()
+
+	dp := NewDataPack()
+	for i := 0; i < 10; i++ {
+		buf, _ := dp.Pack(NewMessage(0, []byte(fmt.Sprint(i))))
+		conn.Write(buf)
+	}
+	// wait the requests are read by the server
+	time.Sleep(50 * time.Millisecond)
+	server.Stop()
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for i := 0; i < 10; i++ {
+		head := make([]byte, dp.GetHeadLen())
+		if _, err := io.ReadFull(conn, head); err != nil {
+			t.Fatal("TestServerStop1 failed", i, err)
+		}
+		msg, _ := dp.UnpackHead(head)
+		io.ReadFull(conn, msg.GetMsgData())
+	}
+	// connection is closed after the replies
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("TestServerStop1 failed, connection is not closed", err)
+	}
+	// new connections are refused
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", utils.Global_obj.Port)); err == nil {
+		t.Error("TestServerStop1 failed, listener is not closed")
+	}
+}
+
+// requests not finished before the deadline are dropped
+func TestServerStop2(t *testing.T) {
+	old_port, old_timeout := utils.Global_obj.Port, utils.Global_obj.ShutdownTimeout
+	utils.Global_obj.ShutdownTimeout = 1
+
+	router := &slowRouter{delay: 300 * time.Millisecond, handled: make(chan bool, 10)}
+	server, conn := startTestServer(t, router)
+	defer conn.Close()
+
+	dp := NewDataPack()
+	for i := 0; i < 10; i++ {
+		buf, _ := dp.Pack(NewMessage(0, []byte(fmt.Sprint(i))))
+		conn.Write(buf)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	server.Stop()
+	if cost := time.Since(start); cost > 2*time.Second {
+		t.Error("TestServerStop2 failed, stop is not cancelled after the deadline", cost)
+	}
+	// the running handler reads Global_obj, it's restored after the handler returns
+	select {
+	case <-router.handled:
+	case <-time.After(time.Second):
+		t.Error("TestServerStop2 failed, handler doesn't return")
+	}
+	utils.Global_obj.Port, utils.Global_obj.ShutdownTimeout = old_port, old_timeout
+}
+
+// a connection whose client doesn't read is stopped in time, and TrySendMsg doesn't block meanwhile
+func TestConnectionStop(t *testing.T) {
+	old_port := utils.Global_obj.Port
+	defer func() { utils.Global_obj.Port = old_port }()
+
+	server, conn := startTestServer(t, &slowRouter{})
+	defer conn.Close()
+	defer server.Stop()
+
+	var conns []ziface.IConnection
+	for i := 0; i < 50 && len(conns) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		conns = server.GetConnectionManager().GetConns()
+	}
+	if len(conns) != 1 {
+		t.Fatal("TestConnectionStop failed")
+	}
+	// push until the socket and msg_chan are full, a small buffer fills soon
+	conns[0].(*Connection).conn.(*net.TCPConn).SetWriteBuffer(4096)
+	data := make([]byte, 4000)
+	full_since := time.Now()
+	for time.Since(full_since) < 200*time.Millisecond {
+		if err := conns[0].TrySendMsg(0, data); err == nil {
+			full_since = time.Now()
+		} else if err != ErrMsgChanFull {
+			t.Fatal("TestConnectionStop failed", err)
+		}
+	}
+
+	start := time.Now()
+	conns[0].Stop()
+	if cost := time.Since(start); cost > 3*time.Second {
+		t.Error("TestConnectionStop failed, stop is blocked by the client", cost)
+	}
+}
+
+// a SendMsgWait blocked by a client not reading doesn't block Stop, and it fails once stopped
+func TestConnectionStop2(t *testing.T) {
+	old_port := utils.Global_obj.Port
+	defer func() { utils.Global_obj.Port = old_port }()
+
+	server, conn := startTestServer(t, &slowRouter{})
+	defer conn.Close()
+	defer server.Stop()
+
+	var conns []ziface.IConnection
+	for i := 0; i < 50 && len(conns) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		conns = server.GetConnectionManager().GetConns()
+	}
+	if len(conns) != 1 {
+		t.Fatal("TestConnectionStop2 failed")
+	}
+	conns[0].(*Connection).conn.(*net.TCPConn).SetWriteBuffer(4096)
+	data := make([]byte, 4000)
+	res := make(chan error)
+	go func() {
+		for {
+			if err := conns[0].SendMsgWait(0, data); err != nil {
+				res <- err
+				return
+			}
+		}
+	}()
+	// the sender is blocked by now
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	conns[0].Stop()
+	if cost := time.Since(start); cost > 3*time.Second {
+		t.Error("TestConnectionStop2 failed, stop is blocked by the sender", cost)
+	}
+	select {
+	case err := <-res:
+		if err != ErrConnClosed {
+			t.Error("TestConnectionStop2 failed", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("TestConnectionStop2 failed, sender is still blocked")
+	}
+}
+
+// SendMsg to a client not reading fails instead of blocking, and the client is disconnected
+func TestConnectionStop3(t *testing.T) {
+	old_port := utils.Global_obj.Port
+	defer func() { utils.Global_obj.Port = old_port }()
+
+	server, conn := startTestServer(t, &slowRouter{})
+	defer conn.Close()
+	defer server.Stop()
+
+	var conns []ziface.IConnection
+	for i := 0; i < 50 && len(conns) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		conns = server.GetConnectionManager().GetConns()
+	}
+	if len(conns) != 1 {
+		t.Fatal("TestConnectionStop3 failed")
+	}
+	conns[0].(*Connection).conn.(*net.TCPConn).SetWriteBuffer(4096)
+	data := make([]byte, 4000)
+	res := make(chan error)
+	go func() {
+		for {
+			if err := conns[0].SendMsg(0, data); err != nil {
+				res <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-res:
+		if err != ErrMsgChanFull {
+			t.Error("TestConnectionStop3 failed", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("TestConnectionStop3 failed, SendMsg is blocked")
+	}
+	for i := 0; i < 300 && server.GetConnectionManager().Size() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.GetConnectionManager().Size() != 0 {
+		t.Error("TestConnectionStop3 failed, connection is not stopped")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	old_port := utils.Global_obj.Port
+	defer func() { utils.Global_obj.Port = old_port }()
+	utils.Global_obj.Port = freePort(t)
+
+	server := NewServer()
+	done := make(chan bool)
+	go func() {
+		server.Serve()
+		done <- true
+	}()
+	server.Shutdown()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Error("TestServerShutdown failed, Serve doesn't return")
+	}
+}
+
+func TestWorkPoolStop(t *testing.T) {
+	pool := NewWorkPool()
+	pool.StartWorkPool()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pool.Stop(ctx); err != nil {
+		t.Error("TestWorkPoolStop failed", err)
+	}
+	// stop twice is fine
+	if err := pool.Stop(ctx); err != nil {
+		t.Error("TestWorkPoolStop failed", err)
+	}
+}
@@ -0,0 +1,99 @@
+package znet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"gedis/src/zinx/utils"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+func IsTLSEnabled() bool {
+	return utils.Global_obj.TLSCertFile != "" && utils.Global_obj.TLSKeyFile != ""
+}
+
+// tls config of the listener, built from the TLS* fields of Global_obj
+func NewTLSServerConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(utils.Global_obj.TLSCertFile, utils.Global_obj.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("fail to load tls cert and key, %s", err.Error())
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if utils.Global_obj.TLSAuthClients {
+		if utils.Global_obj.TLSCAFile == "" {
+			return nil, errors.New("TLSCAFile is required to verify client certs")
+		}
+		pool, err := loadCAPool(utils.Global_obj.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// tls config to connect to other servers, the cert of this server is presented as the client cert if set
+func NewTLSClientConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if utils.Global_obj.TLSCAFile != "" {
+		pool, err := loadCAPool(utils.Global_obj.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if IsTLSEnabled() {
+		cert, err := tls.LoadX509KeyPair(utils.Global_obj.TLSCertFile, utils.Global_obj.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail to load tls cert and key, %s", err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// connect to another server, with tls if TLSReplication is set
+func DialPeer(addr string, timeout time.Duration) (net.Conn, error) {
+	if !utils.Global_obj.TLSReplication {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	config, err := NewTLSClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, config)
+}
+
+// listen for other servers, with tls if TLSReplication is set
+func ListenPeer(addr string) (net.Listener, error) {
+	if !utils.Global_obj.TLSReplication {
+		return net.Listen("tcp", addr)
+	}
+	config, err := NewTLSServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", addr, config)
+}
+
+func loadCAPool(file string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read tls CA file, %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no cert found in tls CA file %s", file)
+	}
+	return pool, nil
+}
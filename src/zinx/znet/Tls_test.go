@@ -0,0 +1,182 @@
+package znet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/ziface"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type echoRouter struct {
+	BaseRounter
+}
+
+func (this *echoRouter) Handle(req ziface.IRequest) {
+	req.GetConn().SendMsg(req.GetMsgId(), req.GetData())
+}
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// generate a cert signed by parent, self-signed if parent is nil
+func genCert(t *testing.T, dir string, name string, parent *testCert, is_ca bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+
+		BasicConstraintsValid: true,
+		IsCA:                  is_ca,
+	}
+	signer, signer_key := template, key
+	if parent != nil {
+		signer, signer_key = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signer_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	key_der, _ := x509.MarshalECPrivateKey(key)
+
+	tc := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key")}
+	os.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600)
+	return tc
+}
+
+func freePort(t *testing.T) uint32 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return uint32(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// send a msg and wait for the echo
+func echo(conn net.Conn, data string) (string, error) {
+	dp := NewDataPack()
+	buf, _ := dp.Pack(NewMessage(0, []byte(data)))
+	if _, err := conn.Write(buf); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	head := make([]byte, dp.GetHeadLen())
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", err
+	}
+	msg, err := dp.UnpackHead(head)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.ReadFull(conn, msg.GetMsgData()); err != nil {
+		return "", err
+	}
+	return string(msg.GetMsgData()), nil
+}
+
+// start a tls server verifying client certs, only clients with certs signed by the CA can talk to it
+func TestTLSServer(t *testing.T) {
+	dir := t.TempDir()
+	ca := genCert(t, dir, "ca", nil, true)
+	server_cert := genCert(t, dir, "server", ca, false)
+	client_cert := genCert(t, dir, "client", ca, false)
+	other_ca := genCert(t, dir, "other_ca", nil, true)
+	other_client := genCert(t, dir, "other_client", other_ca, false)
+
+	old_port, old_auth := utils.Global_obj.Port, utils.Global_obj.TLSAuthClients
+	old_cert, old_key, old_ca := utils.Global_obj.TLSCertFile, utils.Global_obj.TLSKeyFile, utils.Global_obj.TLSCAFile
+	defer func() {
+		utils.Global_obj.Port, utils.Global_obj.TLSAuthClients = old_port, old_auth
+		utils.Global_obj.TLSCertFile, utils.Global_obj.TLSKeyFile, utils.Global_obj.TLSCAFile = old_cert, old_key, old_ca
+	}()
+	utils.Global_obj.Port = freePort(t)
+	utils.Global_obj.TLSCertFile = server_cert.certFile
+	utils.Global_obj.TLSKeyFile = server_cert.keyFile
+	utils.Global_obj.TLSCAFile = ca.certFile
+	utils.Global_obj.TLSAuthClients = true
+
+	server := NewServer()
+	server.AddRounter(0, &echoRouter{})
+	go server.Start()
+	addr := fmt.Sprintf("127.0.0.1:%d", utils.Global_obj.Port)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	dial := func(client *testCert) (conn net.Conn, err error) {
+		config := &tls.Config{RootCAs: pool}
+		if client != nil {
+			cert, err := tls.LoadX509KeyPair(client.certFile, client.keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		// wait for the server to listen
+		for i := 0; i < 50; i++ {
+			if conn, err = tls.Dial("tcp", addr, config); err == nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return
+	}
+
+	conn, err := dial(client_cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if res, err := echo(conn, "hello tls"); err != nil || res != "hello tls" {
+		t.Error("TestTLSServer failed", err)
+	}
+
+	// clients without a cert or with a cert of another CA are rejected
+	for _, client := range []*testCert{nil, other_client} {
+		conn, err := dial(client)
+		if err != nil {
+			continue
+		}
+		if _, err = echo(conn, "hello"); err == nil {
+			t.Error("TestTLSServer failed, client is not verified")
+		}
+		conn.Close()
+	}
+
+	// plain tcp can't talk to a tls server
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if _, err = echo(plain, "hello"); err == nil {
+		t.Error("TestTLSServer failed, plain tcp is accepted")
+	}
+}
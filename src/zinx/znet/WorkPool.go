@@ -1,16 +1,44 @@
 package znet
 
 import (
+	"context"
 	"gedis/src/zinx/utils"
 	"gedis/src/zinx/ziface"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the instantaneous ops/sec is the average of the samples of the last 1.6s, like redis
+const (
+	ops_sample_interval = 100 * time.Millisecond
+	ops_sample_num      = 16
 )
 
 type WorkPool struct {
+	// requests handled, first for the alignment of atomic access
+	processed uint64
+
 	pool_size       uint32
 	task_queue_size uint32
 	works           []ziface.IWroker
 
-	started bool
+	// requests added but not handled yet, both queued and in-flight
+	pending  int64
+	stopping int32
+
+	wait_latency *Histogram
+	exec_latency *Histogram
+
+	ops_lock    sync.Mutex
+	ops_samples [ops_sample_num]uint64
+	ops_idx     int
+	sample_exit chan struct{}
+
+	// lock serializes start and stop, works_lock guards works and started which are read by metrics
+	lock       sync.Mutex
+	works_lock sync.RWMutex
+	started    bool
 }
 
 func NewWorkPool() (work_pool *WorkPool) {
@@ -19,6 +47,9 @@ func NewWorkPool() (work_pool *WorkPool) {
 		task_queue_size: utils.Global_obj.TaskQueueSize,
 		works:           make([]ziface.IWroker, utils.Global_obj.PoolSize),
 
+		wait_latency: NewHistogram(DefaultLatencyBounds),
+		exec_latency: NewHistogram(DefaultLatencyBounds),
+
 		started: false,
 	}
 
@@ -33,21 +64,150 @@ func (this *WorkPool) GetTaskQueueSize() uint32 {
 }
 
 func (this *WorkPool) StartWorkPool() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	if this.started {
 		return
 	}
 
+	on_done := func(wait time.Duration, exec time.Duration) {
+		this.wait_latency.Observe(wait)
+		this.exec_latency.Observe(exec)
+		atomic.AddUint64(&this.processed, 1)
+		atomic.AddInt64(&this.pending, -1)
+	}
+	on_drop := func() { atomic.AddInt64(&this.pending, -1) }
+	this.works_lock.Lock()
 	for id := 0; id < int(this.pool_size); id++ {
-		this.works[id] = NewWorker(uint32(id))
+		this.works[id] = NewWorker(uint32(id), on_done, on_drop)
 		go this.works[id].StartWork()
 	}
+	this.sample_exit = make(chan struct{})
+	go this.sampleOps(this.sample_exit)
 	this.started = true
+	this.works_lock.Unlock()
 }
 
 func (this *WorkPool) AddRequest(request ziface.IRequest) {
 	if !this.started {
 		panic("Work pool is not started, while try to add request...")
 	}
+	// count the request before checking stopping, so Stop either sees it pending or it sees stopping
+	atomic.AddInt64(&this.pending, 1)
+	if atomic.LoadInt32(&this.stopping) == 1 {
+		atomic.AddInt64(&this.pending, -1)
+		request.Done()
+		return
+	}
+	// requests of a connection always go to the same worker, so they are handled in order
 	id := request.GetConn().GetConnID() % this.pool_size
 	this.works[id].AddRequest(request)
 }
+
+func (this *WorkPool) Stop(ctx context.Context) (err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if !this.started {
+		return nil
+	}
+	atomic.StoreInt32(&this.stopping, 1)
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for atomic.LoadInt64(&this.pending) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break wait
+		}
+	}
+
+	this.works_lock.Lock()
+	for _, worker := range this.works {
+		worker.StopWork()
+	}
+	close(this.sample_exit)
+	this.started = false
+	this.works_lock.Unlock()
+	return
+}
+
+func (this *WorkPool) GetQueueDepth() (depth uint32) {
+	this.works_lock.RLock()
+	defer this.works_lock.RUnlock()
+	if !this.started {
+		return 0
+	}
+	for _, worker := range this.works {
+		depth += worker.GetQueueDepth()
+	}
+	return
+}
+
+func (this *WorkPool) GetBusyWorkers() (busy uint32) {
+	this.works_lock.RLock()
+	defer this.works_lock.RUnlock()
+	if !this.started {
+		return 0
+	}
+	for _, worker := range this.works {
+		if worker.IsBusy() {
+			busy++
+		}
+	}
+	return
+}
+
+func (this *WorkPool) GetWaitLatency() ziface.IHistogram {
+	return this.wait_latency
+}
+
+func (this *WorkPool) GetExecLatency() ziface.IHistogram {
+	return this.exec_latency
+}
+
+func (this *WorkPool) GetProcessed() uint64 {
+	return atomic.LoadUint64(&this.processed)
+}
+
+func (this *WorkPool) GetOpsPerSec() uint64 {
+	this.ops_lock.Lock()
+	defer this.ops_lock.Unlock()
+	n := this.ops_idx
+	if n > ops_sample_num {
+		n = ops_sample_num
+	}
+	if n == 0 {
+		return 0
+	}
+	var sum uint64
+	for i := 0; i < n; i++ {
+		sum += this.ops_samples[i]
+	}
+	return sum / uint64(n)
+}
+
+// sample the requests handled per second until exit is closed
+func (this *WorkPool) sampleOps(exit chan struct{}) {
+	ticker := time.NewTicker(ops_sample_interval)
+	defer ticker.Stop()
+	last, last_time := this.GetProcessed(), time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			processed := this.GetProcessed()
+			ops := float64(processed-last) / now.Sub(last_time).Seconds()
+			this.ops_lock.Lock()
+			this.ops_samples[this.ops_idx%ops_sample_num] = uint64(ops)
+			this.ops_idx++
+			this.ops_lock.Unlock()
+			last, last_time = processed, now
+		case <-exit:
+			return
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package znet
+
+import (
+	"context"
+	"fmt"
+	"gedis/src/zinx/utils"
+	"gedis/src/zinx/ziface"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type blockRouter struct {
+	BaseRounter
+	unblock chan bool
+}
+
+func (this *blockRouter) Handle(req ziface.IRequest) {
+	<-this.unblock
+	req.GetConn().SendMsg(req.GetMsgId(), req.GetData())
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]time.Duration{time.Millisecond, 10 * time.Millisecond})
+	h.Observe(500 * time.Microsecond)
+	h.Observe(time.Millisecond)
+	h.Observe(5 * time.Millisecond)
+	h.Observe(time.Second)
+
+	bounds, counts, sum, count := h.Snapshot()
+	if len(bounds) != 3 || len(counts) != 3 {
+		t.Fatal("TestHistogram failed, +Inf bucket is missing")
+	}
+	if counts[0] != 2 || counts[1] != 3 || counts[2] != 4 {
+		t.Error("TestHistogram failed, wrong counts", counts)
+	}
+	if count != 4 || sum != time.Second+6500*time.Microsecond {
+		t.Error("TestHistogram failed, wrong sum or count", sum, count)
+	}
+}
+
+// a connection can't have more than MaxConnPending requests in the pool, the reader waits instead
+func TestWorkPoolBackpressure(t *testing.T) {
+	old_pending := utils.Global_obj.MaxConnPending
+	defer func() { utils.Global_obj.MaxConnPending = old_pending }()
+	utils.Global_obj.MaxConnPending = 3
+
+	router := &blockRouter{unblock: make(chan bool)}
+	server, conn := startTestServer(t, router)
+	defer server.Stop()
+	defer conn.Close()
+	pool := server.GetWorkPool()
+
+	dp := NewDataPack()
+	for i := 0; i < 10; i++ {
+		buf, _ := dp.Pack(NewMessage(0, []byte(fmt.Sprint(i))))
+		conn.Write(buf)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if busy := pool.GetBusyWorkers(); busy != 1 {
+		t.Error("TestWorkPoolBackpressure failed, wrong busy workers", busy)
+	}
+	if depth := pool.GetQueueDepth(); depth != 2 {
+		t.Error("TestWorkPoolBackpressure failed, wrong queue depth", depth)
+	}
+
+	// all the requests are handled after unblocking, in order
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for i := 0; i < 10; i++ {
+		router.unblock <- true
+		head := make([]byte, dp.GetHeadLen())
+		if _, err := io.ReadFull(conn, head); err != nil {
+			t.Fatal("TestWorkPoolBackpressure failed", err)
+		}
+		msg, _ := dp.UnpackHead(head)
+		io.ReadFull(conn, msg.GetMsgData())
+		if string(msg.GetMsgData()) != fmt.Sprint(i) {
+			t.Error("TestWorkPoolBackpressure failed, out of order", i, string(msg.GetMsgData()))
+		}
+	}
+
+	// metrics are updated right after the reply is sent
+	time.Sleep(50 * time.Millisecond)
+	_, _, _, count := pool.GetExecLatency().Snapshot()
+	if count != 10 {
+		t.Error("TestWorkPoolBackpressure failed, wrong count of exec latency", count)
+	}
+	if busy := pool.GetBusyWorkers(); busy != 0 {
+		t.Error("TestWorkPoolBackpressure failed, wrong busy workers", busy)
+	}
+}
+
+// replies to "park" after a while, without holding the worker
+type parkRouter struct {
+	BaseRounter
+}
+
+func (this *parkRouter) Handle(req ziface.IRequest) {
+	if string(req.GetData()) != "park" {
+		req.GetConn().SendMsg(req.GetMsgId(), req.GetData())
+		return
+	}
+	resume := req.Park()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		req.GetConn().SendMsg(req.GetMsgId(), req.GetData())
+		resume()
+	}()
+}
+
+// requests after a parked one wait for it, while other connections of the same worker don't
+func TestWorkPoolPark(t *testing.T) {
+	old_pool_size := utils.Global_obj.PoolSize
+	defer func() { utils.Global_obj.PoolSize = old_pool_size }()
+	utils.Global_obj.PoolSize = 1
+
+	server, conn := startTestServer(t, &parkRouter{})
+	defer server.Stop()
+	defer conn.Close()
+	other, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", utils.Global_obj.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	dp := NewDataPack()
+	for _, data := range []string{"park", "a", "park", "b"} {
+		buf, _ := dp.Pack(NewMessage(0, []byte(data)))
+		conn.Write(buf)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	if res, err := echo(other, "other"); err != nil || res != "other" {
+		t.Error("TestWorkPoolPark failed", err)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Error("TestWorkPoolPark failed, worker is held by the parked request")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for _, expect := range []string{"park", "a", "park", "b"} {
+		head := make([]byte, dp.GetHeadLen())
+		if _, err := io.ReadFull(conn, head); err != nil {
+			t.Fatal("TestWorkPoolPark failed", err)
+		}
+		msg, _ := dp.UnpackHead(head)
+		io.ReadFull(conn, msg.GetMsgData())
+		if string(msg.GetMsgData()) != expect {
+			t.Error("TestWorkPoolPark failed, out of order", expect, string(msg.GetMsgData()))
+		}
+	}
+}
+
+// the requests left when the pool is stopped are dropped and done, so the connection doesn't wait for them
+func TestWorkPoolStop2(t *testing.T) {
+	old_port := utils.Global_obj.Port
+	defer func() { utils.Global_obj.Port = old_port }()
+
+	router := &blockRouter{unblock: make(chan bool)}
+	server, conn := startTestServer(t, router)
+	defer server.Stop()
+	defer conn.Close()
+
+	dp := NewDataPack()
+	for i := 0; i < 5; i++ {
+		buf, _ := dp.Pack(NewMessage(0, []byte(fmt.Sprint(i))))
+		conn.Write(buf)
+	}
+	time.Sleep(50 * time.Millisecond)
+	conns := server.GetConnectionManager().GetConns()
+	if len(conns) != 1 || conns[0].GetPending() != 5 {
+		t.Fatal("TestWorkPoolStop2 failed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.GetWorkPool().Stop(ctx); err != context.DeadlineExceeded {
+		t.Error("TestWorkPoolStop2 failed", err)
+	}
+	// the request running is finished, the 4 queued are dropped
+	router.unblock <- true
+	for i := 0; i < 50 && conns[0].GetPending() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pending := conns[0].GetPending(); pending != 0 {
+		t.Error("TestWorkPoolStop2 failed, requests are not done", pending)
+	}
+}
@@ -3,19 +3,49 @@ package znet
 import (
 	"gedis/src/zinx/utils"
 	"gedis/src/zinx/ziface"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+type task struct {
+	request  ziface.IRequest
+	queue_at time.Time
+}
+
 type Worker struct {
 	id              uint32
 	task_queue_size uint32
-	task_queue      chan ziface.IRequest
+	task_queue      chan task
+	exit_chan       chan bool
+	busy            int32
+
+	// AddRequest holds it for read, so no request is queued after the worker drops the left ones
+	add_lock sync.RWMutex
+	stopped  bool
+
+	// connections with a parked request, and their requests held until it's resumed
+	parked      map[uint32][]task
+	resume_chan chan uint32
+
+	// called after each request is handled, with the time it waits in queue and is handled
+	on_done func(wait time.Duration, exec time.Duration)
+	// called for each request dropped
+	on_drop func()
 }
 
-func NewWorker(id uint32) (worker *Worker) {
+func NewWorker(id uint32, on_done func(wait time.Duration, exec time.Duration), on_drop func()) (worker *Worker) {
 	worker = &Worker{
 		id:              id,
 		task_queue_size: utils.Global_obj.TaskQueueSize,
-		task_queue:      make(chan ziface.IRequest, utils.Global_obj.TaskQueueSize),
+		task_queue:      make(chan task, utils.Global_obj.TaskQueueSize),
+		exit_chan:       make(chan bool),
+
+		parked:      make(map[uint32][]task),
+		resume_chan: make(chan uint32, 64),
+
+		on_done: on_done,
+		on_drop: on_drop,
 	}
 	return
 }
@@ -28,16 +58,127 @@ func (this *Worker) GetTaskQueueSize() uint32 {
 	return this.task_queue_size
 }
 
+func (this *Worker) GetQueueDepth() uint32 {
+	return uint32(len(this.task_queue))
+}
+
+func (this *Worker) IsBusy() bool {
+	return atomic.LoadInt32(&this.busy) == 1
+}
+
+// blocks when the task queue is full, which slows down the reader of the connection
 func (this *Worker) AddRequest(request ziface.IRequest) {
 	// fmt.Printf("Add request (msg id %d, con id %d) to work %d\n", request.GetMsgId(), request.GetConn().GetConnID(), this.id)
-	this.task_queue <- request
+	this.add_lock.RLock()
+	defer this.add_lock.RUnlock()
+	if this.stopped {
+		this.drop(request)
+		return
+	}
+	select {
+	case this.task_queue <- task{request: request, queue_at: time.Now()}:
+	case <-this.exit_chan:
+		// worker is stopped, the request is dropped
+		this.drop(request)
+	}
+}
+
+func (this *Worker) drop(request ziface.IRequest) {
+	request.Done()
+	this.on_drop()
 }
 
 func (this *Worker) StartWork() {
 	for {
+		// a stopped worker doesn't take more tasks
 		select {
-		case request := <-this.task_queue:
-			request.GetConn().GetRouterManager().ExecHandler(request)
+		case <-this.exit_chan:
+			this.dropAll()
+			return
+		default:
+		}
+
+		select {
+		case t := <-this.task_queue:
+			conn_id := t.request.GetConn().GetConnID()
+			if held, ok := this.parked[conn_id]; ok {
+				this.parked[conn_id] = append(held, t)
+				continue
+			}
+			this.exec(t)
+		case conn_id := <-this.resume_chan:
+			held := this.parked[conn_id]
+			delete(this.parked, conn_id)
+			for i, t := range held {
+				if this.exec(t) {
+					// parked again, hold the rest
+					this.parked[conn_id] = append(this.parked[conn_id], held[i+1:]...)
+					break
+				}
+			}
+		case <-this.exit_chan:
+			this.dropAll()
+			return
 		}
 	}
 }
+
+// drop the requests held and queued once stopped, so their connections and the work pool don't wait for them
+func (this *Worker) dropAll() {
+	// the AddRequests waiting for room are woken by exit_chan, no more requests are queued after it
+	this.add_lock.Lock()
+	this.stopped = true
+	this.add_lock.Unlock()
+
+	for conn_id, held := range this.parked {
+		for _, t := range held {
+			this.drop(t.request)
+		}
+		delete(this.parked, conn_id)
+	}
+	for {
+		select {
+		case t := <-this.task_queue:
+			this.drop(t.request)
+		default:
+			return
+		}
+	}
+}
+
+// handle a request, returns true if it's parked by the handler
+func (this *Worker) exec(t task) (parked bool) {
+	conn_id := t.request.GetConn().GetConnID()
+	if request, ok := t.request.(*Request); ok {
+		request.on_park = func() func() {
+			parked = true
+			return func() {
+				request.Done()
+				select {
+				case this.resume_chan <- conn_id:
+				case <-this.exit_chan:
+				}
+			}
+		}
+	}
+
+	atomic.StoreInt32(&this.busy, 1)
+	start := time.Now()
+	t.request.GetConn().GetRouterManager().ExecHandler(t.request)
+	end := time.Now()
+	atomic.StoreInt32(&this.busy, 0)
+
+	if parked {
+		// an empty list marks the connection parked
+		this.parked[conn_id] = []task{}
+	} else {
+		t.request.Done()
+	}
+	this.on_done(start.Sub(t.queue_at), end.Sub(start))
+	return
+}
+
+// the request being handled is finished, requests held and left in task queue are dropped
+func (this *Worker) StopWork() {
+	close(this.exit_chan)
+}